@@ -56,6 +56,65 @@ var DebugEnabled = os.Getenv("DEBUG") == "true"
 var MemoryCacheEnabled = os.Getenv("MEMORY_CACHE_ENABLED") == "true"
 
 var LogConsumeEnabled = true
+var AppTagHeader = ""
+
+// SupportContact is shown to banned users so they know whom to reach out to
+var SupportContact = ""
+
+// TokenHeaderName is an alternate header carrying the API key, for gateways that cannot send Authorization
+var TokenHeaderName = ""
+
+// FreeModels is a comma separated list of model names or prefix patterns (ending with "*") that are not billed
+var FreeModels = ""
+
+// DisabledModels is a comma separated list of model names or prefix patterns that are rejected at relay entry
+var DisabledModels = ""
+
+// DuplicateRequestLimit is how many identical requests a token may send within DuplicateRequestWindow seconds,
+// 0 disables duplicate detection
+var DuplicateRequestLimit = 0
+var DuplicateRequestWindow = 120
+
+// DuplicateRequestExemptModels is a comma separated list of model names or prefix patterns never throttled as duplicates,
+// e.g. the models used by health checks
+var DuplicateRequestExemptModels = ""
+
+// StreamModeMismatchAction is "reject" or "coalesce": stream requests to non-streaming models are then relayed
+// without streaming and answered with a single chunk, non-stream requests to streaming-only models are always rejected
+var StreamModeMismatchAction = "reject"
+
+// RequestSignatureTolerance is the clock skew in seconds accepted on requests signed with a token secret,
+// signatures are remembered for twice as long to reject replays
+var RequestSignatureTolerance = 300
+
+// AllowedImageMimeTypes is a comma separated list of image mime types accepted in vision requests, empty means all
+var AllowedImageMimeTypes = ""
+
+// MaxImagesPerRequest caps the images counted per request, every image url is downloaded, 0 means unlimited
+var MaxImagesPerRequest = 0
+
+// MaxImagesPerMessage caps the images of a single message, 0 means unlimited
+var MaxImagesPerMessage = 0
+
+// MaxImageBytesPerRequest caps the total decoded size of the images of a request, 0 means unlimited
+var MaxImageBytesPerRequest = 50 * 1024 * 1024
+
+// MaxImageBytes caps the decoded size of a single base64 image, larger images are rejected before decoding,
+// 0 means unlimited
+var MaxImageBytes = 0
+
+// ImageCountConcurrency is how many images of a request are fetched and measured at once
+var ImageCountConcurrency = 4
+
+// ImageCountTimeout is the wall-clock budget in milliseconds for counting all the images of a request,
+// the images not measured in time are charged at the flat price, 0 means unlimited
+var ImageCountTimeout = 0
+
+// CostExportDestination receives the daily cost report: file:///dir, s3://bucket/prefix or an http(s) webhook,
+// empty disables the export
+var CostExportDestination = ""
+var CostExportWebhookSecret = "" // signs the webhook body with HMAC-SHA256 when set
+var CostExportRetryTimes = 3
 
 var SMTPServer = ""
 var SMTPPort = 587
@@ -77,11 +136,47 @@ var QuotaForNewUser = 0
 var QuotaForInviter = 0
 var QuotaForInvitee = 0
 var ChannelDisableThreshold = 5.0
+var ChannelSLOTarget = 99.5               // availability objective in percent, used for the error budget
+var ChannelSLODeprioritizeThreshold = 0.0 // channels whose 7-day availability is below this percent are deprioritized, 0 disables it
 var AutomaticDisableChannelEnabled = false
+var ChannelAffinityEnabled = false
+var ChannelWeightDecayEnabled = false
+var ChannelWarmUpCount = 0           // connections to this many of the busiest channels are kept warm, 0 disables the warm-up
+var StreamCompressionEnabled = false // gzips event streams for clients accepting it, about 3µs per flushed event (BenchmarkStreamEvent)
+var CostFooterEnabled = false
+var QuotaTransferAutoApproveEnabled = false
+var PromptMaskEnabled = false
+var PromptMaskPrefixLength = 16 // characters of a masked prompt kept in logs
+var StreamQuotaCutoffEnabled = false
+var StreamQuotaOverdraft = 0 // streams are cut off once the estimated cost exceeds the user quota by more than this
+var StripSystemFingerprintEnabled = false
+var AzureEmptyChoiceChunkEnabled = false    // forward Azure's stream chunks without choices, strict clients break on them
+var ReasoningModelParamStripEnabled = false // remove the sampling parameters o-series models reject
+var StreamUsageChunkEnabled = false         // always end chat streams with a usage chunk, not only when the client asks for it
+var JSONModeStrictEnabled = false           // buffer JSON mode streams of conversion channels until the output is validated
+var ResponseDelayEnabled = false            // for load testing only, never enable in production
+var ResponseDelayMin = 0                    // in milliseconds
+var ResponseDelayMax = 0                    // in milliseconds, a random delay between min and max is applied
 var QuotaRemindThreshold = 1000
+var ProvisionedTokenMaxTTL = 86400 // in seconds
+var TokenExpiryRemindHours = 0     // remind the owner of a token expiring within this many hours, 0 disables it
+var ReminderWebhookURL = ""        // also receives the quota and token expiry reminders as JSON when set
+var ReminderWebhookSecret = ""     // signs the webhook body with HMAC-SHA256 when set
 var PreConsumedQuota = 500
+var FineTuningJobQuota = 0 // flat quota charged per fine-tuning job, trained tokens are billed on completion
+var AudioInputTokensPerSecond = 10
+var StreamTrailingDataMode = "passthrough" // "strict" discards upstream data after [DONE], "passthrough" forwards it
+var MessageSanitizeMode = ""               // "strip" or "reject" NUL bytes and invalid UTF-8 in messages, empty to forward as is
+var MaxMessageContentSize = 0              // in bytes, per message, 0 means unlimited
+
+// AudioCompletionRatio is the ratio of audio output tokens relative to text completion tokens
+var AudioCompletionRatio = 8.0
 var ApproximateTokenEnabled = false
+var ApproximateCountWarningEnabled = false
+var ImageTokenStrictEnabled = false // reject images that cannot be measured with a 422 instead of charging the flat price
 var RetryTimes = 0
+var UpstreamRetryTimes = 0     // same-channel retries of transient upstream failures, before RetryTimes fails over
+var UpstreamRetryBackoff = 200 // in milliseconds, doubled on every same-channel retry
 
 var RootUserEmail = ""
 
@@ -97,10 +192,19 @@ var BatchUpdateInterval = GetOrDefault("BATCH_UPDATE_INTERVAL", 5)
 
 var RelayTimeout = GetOrDefault("RELAY_TIMEOUT", 0) // unit is second
 
+var RequestBodySpillThreshold = GetOrDefault("REQUEST_BODY_SPILL_THRESHOLD", 0) // in bytes, larger bodies are kept in temp files, 0 keeps all in memory
+
 var LogPrompt = os.Getenv("LOG_PROMPT") == "true"
 
+// PromptMaskSalt salts the prompt hashes in logs, keep it stable to correlate requests across restarts
+var PromptMaskSalt = os.Getenv("PROMPT_MASK_SALT")
+
+// OtelExporterEndpoint is the OTLP/HTTP collector, e.g. http://localhost:4318, tracing is off when empty
+var OtelExporterEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+
 const (
 	RequestIdKey = "X-Oneapi-Request-Id"
+	AppTagKey    = "app_tag"
 )
 
 const (
@@ -163,6 +267,18 @@ const (
 	ChannelStatusAutoDisabled     = 3
 )
 
+const (
+	QuotaTransferStatusPending   = 1 // don't use 0, 0 is the default value!
+	QuotaTransferStatusCompleted = 2
+	QuotaTransferStatusCancelled = 3
+	QuotaTransferStatusRejected  = 4
+)
+
+const (
+	CanaryStatusEnabled  = 1 // don't use 0, 0 is the default value!
+	CanaryStatusDisabled = 2 // also don't use 0
+)
+
 const (
 	ChannelTypeUnknown        = 0
 	ChannelTypeOpenAI         = 1
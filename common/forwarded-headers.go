@@ -0,0 +1,41 @@
+package common
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// ForwardedRequestHeaders is a comma separated list of client request headers relayed to the upstream,
+// OpenAI-Organization is opt-in, it would let clients bill another organization of the channel key
+var ForwardedRequestHeaders = "OpenAI-Beta"
+
+// ChannelTypeForwardedRequestHeaders overrides ForwardedRequestHeaders for a channel type, keyed by the type id
+var ChannelTypeForwardedRequestHeaders = map[string]string{}
+
+func ChannelTypeForwardedRequestHeaders2JSONString() string {
+	jsonBytes, err := json.Marshal(ChannelTypeForwardedRequestHeaders)
+	if err != nil {
+		SysError("error marshalling channel type forwarded request headers: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateChannelTypeForwardedRequestHeadersByJSONString(jsonStr string) error {
+	ChannelTypeForwardedRequestHeaders = make(map[string]string)
+	return json.Unmarshal([]byte(jsonStr), &ChannelTypeForwardedRequestHeaders)
+}
+
+func GetForwardedRequestHeaders(channelType int) []string {
+	list, ok := ChannelTypeForwardedRequestHeaders[strconv.Itoa(channelType)]
+	if !ok {
+		list = ForwardedRequestHeaders
+	}
+	var headers []string
+	for _, header := range strings.Split(list, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
@@ -5,28 +5,113 @@ import (
 	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"io"
+	"os"
 )
 
-func GetBodyReusable(c *gin.Context) ([]byte, error) {
-	requestBody, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		return nil, err
+const reusableBodyKey = "reusable_body"
+const spilledBodyFileKey = "spilled_body_file"
+
+// GetBodyReadSeeker buffers the request body once and returns it rewound to the start.
+// Bodies above RequestBodySpillThreshold go to a temp file instead of memory, which is removed by
+// CleanupReusableBody. c.Request.Body keeps reading from the same buffer, so it can be relayed again.
+func GetBodyReadSeeker(c *gin.Context) (io.ReadSeeker, error) {
+	if body, ok := c.Get(reusableBodyKey); ok {
+		readSeeker := body.(io.ReadSeeker)
+		if _, err := readSeeker.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		c.Request.Body = io.NopCloser(readSeeker)
+		return readSeeker, nil
+	}
+	var readSeeker io.ReadSeeker
+	contentLength := c.Request.ContentLength
+	if RequestBodySpillThreshold > 0 && (contentLength < 0 || contentLength > int64(RequestBodySpillThreshold)) {
+		file, err := os.CreateTemp("", "one-api-body-*")
+		if err != nil {
+			return nil, err
+		}
+		c.Set(spilledBodyFileKey, file)
+		if _, err = io.Copy(file, c.Request.Body); err != nil {
+			return nil, err
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		readSeeker = file
+	} else {
+		requestBody, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return nil, err
+		}
+		readSeeker = bytes.NewReader(requestBody)
 	}
-	err = c.Request.Body.Close()
+	err := c.Request.Body.Close()
 	if err != nil {
 		return nil, err
 	}
+	c.Set(reusableBodyKey, readSeeker)
+	c.Request.Body = io.NopCloser(readSeeker)
+	return readSeeker, nil
+}
 
-	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
-	return requestBody, nil
+// CleanupReusableBody removes the temp file of a spilled body and the parts of a multipart form kept on disk,
+// it must run on every exit path
+func CleanupReusableBody(c *gin.Context) {
+	if c.Request != nil && c.Request.MultipartForm != nil {
+		_ = c.Request.MultipartForm.RemoveAll()
+	}
+	file, ok := c.Get(spilledBodyFileKey)
+	if !ok {
+		return
+	}
+	_ = file.(*os.File).Close()
+	if err := os.Remove(file.(*os.File).Name()); err != nil {
+		SysError("failed to remove spilled request body: " + err.Error())
+	}
 }
 
-func SetBodyReusable(c *gin.Context, f func([]byte) ([]byte, error)) error {
-	requestBody, err := io.ReadAll(c.Request.Body)
+func resetBodyReusable(c *gin.Context, requestBody []byte) {
+	readSeeker := bytes.NewReader(requestBody)
+	c.Set(reusableBodyKey, readSeeker)
+	c.Request.Body = io.NopCloser(readSeeker)
+}
+
+// IsBodySpilled tells whether the request body was kept in a temp file, callers should stream it then
+func IsBodySpilled(c *gin.Context) bool {
+	_, ok := c.Get(spilledBodyFileKey)
+	return ok
+}
+
+// CopyBodyReusable streams the request body to w, e.g. a hash, without holding it in memory
+func CopyBodyReusable(c *gin.Context, w io.Writer) error {
+	readSeeker, err := GetBodyReadSeeker(c)
 	if err != nil {
 		return err
 	}
-	err = c.Request.Body.Close()
+	if _, err = io.Copy(w, readSeeker); err != nil {
+		return err
+	}
+	_, err = readSeeker.Seek(0, io.SeekStart)
+	return err
+}
+
+// GetBodyReusable returns the whole request body, callers that only need to read it once should use
+// GetBodyReadSeeker or CopyBodyReusable, which do not load a spilled body into memory
+func GetBodyReusable(c *gin.Context) ([]byte, error) {
+	readSeeker, err := GetBodyReadSeeker(c)
+	if err != nil {
+		return nil, err
+	}
+	requestBody, err := io.ReadAll(readSeeker)
+	if err != nil {
+		return nil, err
+	}
+	_, err = readSeeker.Seek(0, io.SeekStart)
+	return requestBody, err
+}
+
+func SetBodyReusable(c *gin.Context, f func([]byte) ([]byte, error)) error {
+	requestBody, err := GetBodyReusable(c)
 	if err != nil {
 		return err
 	}
@@ -36,24 +121,44 @@ func SetBodyReusable(c *gin.Context, f func([]byte) ([]byte, error)) error {
 		return err
 	}
 
-	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+	resetBodyReusable(c, requestBody)
 	return nil
 }
 
 func UnmarshalBodyReusable(c *gin.Context, v any) error {
-	requestBody, err := io.ReadAll(c.Request.Body)
+	readSeeker, err := GetBodyReadSeeker(c)
 	if err != nil {
 		return err
 	}
-	err = c.Request.Body.Close()
+	// decode from the buffer directly, large bodies are not copied again
+	err = json.NewDecoder(readSeeker).Decode(&v)
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(requestBody, &v)
+	// Reset request body
+	_, err = readSeeker.Seek(0, io.SeekStart)
+	return err
+}
+
+// getMultipartMaxMemory is how much of a multipart form is kept in memory, the rest of the file parts goes to temp files,
+// with spilling enabled no more than RequestBodySpillThreshold is
+func getMultipartMaxMemory() int64 {
+	maxMemory := int64(32 << 20)
+	if RequestBodySpillThreshold > 0 && int64(RequestBodySpillThreshold) < maxMemory {
+		maxMemory = int64(RequestBodySpillThreshold)
+	}
+	return maxMemory
+}
+
+// ParseMultipartFormReusable parses the multipart form while keeping the request body readable for relaying.
+func ParseMultipartFormReusable(c *gin.Context) error {
+	readSeeker, err := GetBodyReadSeeker(c)
 	if err != nil {
 		return err
 	}
-	// Reset request body
-	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
-	return nil
+	err = c.Request.ParseMultipartForm(getMultipartMaxMemory())
+	if _, seekErr := readSeeker.Seek(0, io.SeekStart); seekErr != nil {
+		return seekErr
+	}
+	return err
 }
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newMultipartBody(t testing.TB, size int) ([]byte, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	_ = writer.WriteField("model", "whisper-1")
+	part, err := writer.CreateFormFile("file", "audio.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write(bytes.Repeat([]byte{0xff}, size))
+	_ = writer.Close()
+	return buf.Bytes(), writer.FormDataContentType()
+}
+
+func newBodyContext(body []byte, contentType string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/audio/transcriptions", bytes.NewReader(body))
+	c.Request.Header.Set("Content-Type", contentType)
+	return c
+}
+
+func TestSpilledMultipartBody(t *testing.T) {
+	defer func(threshold int) {
+		RequestBodySpillThreshold = threshold
+	}(RequestBodySpillThreshold)
+	RequestBodySpillThreshold = 1 << 20
+	body, contentType := newMultipartBody(t, 4<<20)
+	c := newBodyContext(body, contentType)
+
+	if err := ParseMultipartFormReusable(c); err != nil {
+		t.Fatal(err)
+	}
+	if !IsBodySpilled(c) || c.Request.FormValue("model") != "whisper-1" {
+		t.Fatal("body not spilled or form not parsed")
+	}
+	file, err := c.Request.MultipartForm.File["file"][0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	partFile, onDisk := file.(*os.File)
+	_ = file.Close()
+	if !onDisk {
+		t.Fatal("file part above the threshold kept in memory")
+	}
+	hash := sha256.New()
+	if err := CopyBodyReusable(c, hash); err != nil {
+		t.Fatal(err)
+	}
+	if expected := sha256.Sum256(body); !bytes.Equal(hash.Sum(nil), expected[:]) {
+		t.Error("streamed body differs")
+	}
+	relayed, _ := io.ReadAll(c.Request.Body)
+	if !bytes.Equal(relayed, body) {
+		t.Error("body not readable for relaying after streaming")
+	}
+	spilled, _ := c.Get(spilledBodyFileKey)
+	CleanupReusableBody(c)
+	for _, name := range []string{spilled.(*os.File).Name(), partFile.Name()} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("temp file %s not removed", name)
+		}
+	}
+}
+
+// BenchmarkReusableMultipartBody relays a 25 MB upload: parse the form, hash and re-read the body,
+// with spilling the bytes allocated per request stay flat instead of growing with the upload
+func BenchmarkReusableMultipartBody(b *testing.B) {
+	body, contentType := newMultipartBody(b, 25<<20)
+	for _, bc := range []struct {
+		name      string
+		threshold int
+	}{{"memory", 0}, {"spill", 1 << 20}} {
+		b.Run(bc.name, func(b *testing.B) {
+			defer func(threshold int) {
+				RequestBodySpillThreshold = threshold
+			}(RequestBodySpillThreshold)
+			RequestBodySpillThreshold = bc.threshold
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c := newBodyContext(body, contentType)
+				c.Request.ContentLength = -1
+				if err := ParseMultipartFormReusable(c); err != nil {
+					b.Fatal(err)
+				}
+				if err := CopyBodyReusable(c, sha256.New()); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, c.Request.Body); err != nil {
+					b.Fatal(err)
+				}
+				CleanupReusableBody(c)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package common
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 var GroupRatio = map[string]float64{
 	"default": 1,
@@ -29,3 +32,218 @@ func GetGroupRatio(name string) float64 {
 	}
 	return ratio
 }
+
+// GroupMaxMessages caps the number of messages in a chat request per group, missing or 0 means unlimited
+var GroupMaxMessages = map[string]int{}
+
+func GroupMaxMessages2JSONString() string {
+	jsonBytes, err := json.Marshal(GroupMaxMessages)
+	if err != nil {
+		SysError("error marshalling group max messages: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateGroupMaxMessagesByJSONString(jsonStr string) error {
+	GroupMaxMessages = make(map[string]int)
+	return json.Unmarshal([]byte(jsonStr), &GroupMaxMessages)
+}
+
+func GetGroupMaxMessages(name string) int {
+	return GroupMaxMessages[name]
+}
+
+// GroupMaxTokens caps the output tokens of chat and completion requests per group, missing or 0 means unlimited,
+// a channel limit applies on top of it and only lowers the value further
+var GroupMaxTokens = map[string]int{}
+
+func GroupMaxTokens2JSONString() string {
+	jsonBytes, err := json.Marshal(GroupMaxTokens)
+	if err != nil {
+		SysError("error marshalling group max tokens: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateGroupMaxTokensByJSONString(jsonStr string) error {
+	GroupMaxTokens = make(map[string]int)
+	return json.Unmarshal([]byte(jsonStr), &GroupMaxTokens)
+}
+
+func GetGroupMaxTokens(name string) int {
+	return GroupMaxTokens[name]
+}
+
+// ModelDowngradeRule maps expensive models to cheaper ones, applied once the user's
+// remaining quota drops below Threshold
+type ModelDowngradeRule struct {
+	Threshold int               `json:"threshold"`
+	Models    map[string]string `json:"models"`
+}
+
+var GroupModelDowngrade = map[string]ModelDowngradeRule{}
+
+func GroupModelDowngrade2JSONString() string {
+	jsonBytes, err := json.Marshal(GroupModelDowngrade)
+	if err != nil {
+		SysError("error marshalling group model downgrade: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateGroupModelDowngradeByJSONString(jsonStr string) error {
+	GroupModelDowngrade = make(map[string]ModelDowngradeRule)
+	return json.Unmarshal([]byte(jsonStr), &GroupModelDowngrade)
+}
+
+// GetModelDowngrade returns the fallback model and the quota threshold below which it applies,
+// an empty fallback means the model is never downgraded for this group
+func GetModelDowngrade(group string, model string) (string, int) {
+	rule, ok := GroupModelDowngrade[group]
+	if !ok {
+		return "", 0
+	}
+	return rule.Models[model], rule.Threshold
+}
+
+// GroupLatencyBudget is the wall-clock budget in milliseconds of a request per group, including retries,
+// missing or 0 means unlimited
+var GroupLatencyBudget = map[string]int{}
+
+func GroupLatencyBudget2JSONString() string {
+	jsonBytes, err := json.Marshal(GroupLatencyBudget)
+	if err != nil {
+		SysError("error marshalling group latency budget: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateGroupLatencyBudgetByJSONString(jsonStr string) error {
+	GroupLatencyBudget = make(map[string]int)
+	return json.Unmarshal([]byte(jsonStr), &GroupLatencyBudget)
+}
+
+func GetGroupLatencyBudget(name string) int {
+	return GroupLatencyBudget[name]
+}
+
+// GroupApproximateToken overrides ApproximateTokenEnabled per group, see IsApproximateTokenModel
+var GroupApproximateToken = map[string]bool{}
+
+func GroupApproximateToken2JSONString() string {
+	jsonBytes, err := json.Marshal(GroupApproximateToken)
+	if err != nil {
+		SysError("error marshalling group approximate token: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateGroupApproximateTokenByJSONString(jsonStr string) error {
+	GroupApproximateToken = make(map[string]bool)
+	return json.Unmarshal([]byte(jsonStr), &GroupApproximateToken)
+}
+
+const (
+	StorePolicyPassthrough = "passthrough"
+	StorePolicyForceTrue   = "force-true"
+	StorePolicyForceFalse  = "force-false"
+)
+
+// GroupStorePolicy decides per group what happens to the store field of chat requests,
+// missing groups pass the client's value through
+var GroupStorePolicy = map[string]string{}
+
+func GroupStorePolicy2JSONString() string {
+	jsonBytes, err := json.Marshal(GroupStorePolicy)
+	if err != nil {
+		SysError("error marshalling group store policy: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateGroupStorePolicyByJSONString(jsonStr string) error {
+	policies := make(map[string]string)
+	err := json.Unmarshal([]byte(jsonStr), &policies)
+	if err != nil {
+		return err
+	}
+	for group, policy := range policies {
+		switch policy {
+		case StorePolicyPassthrough, StorePolicyForceTrue, StorePolicyForceFalse:
+		default:
+			return fmt.Errorf("invalid store policy %s of group %s", policy, group)
+		}
+	}
+	GroupStorePolicy = policies
+	return nil
+}
+
+func GetGroupStorePolicy(name string) string {
+	policy, ok := GroupStorePolicy[name]
+	if !ok {
+		return StorePolicyPassthrough
+	}
+	return policy
+}
+
+// GroupFallbacks lists per group the groups consulted in order when the group has no available channel for a model,
+// the request is then served and billed in the first fallback group that has one
+var GroupFallbacks = map[string][]string{}
+
+func GroupFallbacks2JSONString() string {
+	jsonBytes, err := json.Marshal(GroupFallbacks)
+	if err != nil {
+		SysError("error marshalling group fallbacks: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateGroupFallbacksByJSONString(jsonStr string) error {
+	fallbacks := make(map[string][]string)
+	err := json.Unmarshal([]byte(jsonStr), &fallbacks)
+	if err != nil {
+		return err
+	}
+	if err := checkGroupFallbackCycles(fallbacks); err != nil {
+		return err
+	}
+	GroupFallbacks = fallbacks
+	return nil
+}
+
+// checkGroupFallbackCycles rejects groups that can fall back to themselves, directly or through other groups
+func checkGroupFallbackCycles(fallbacks map[string][]string) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(group string, path []string) error
+	visit = func(group string, path []string) error {
+		path = append(path, group)
+		switch state[group] {
+		case visiting:
+			return fmt.Errorf("group fallbacks form a cycle: %v", path)
+		case visited:
+			return nil
+		}
+		state[group] = visiting
+		for _, fallback := range fallbacks[group] {
+			if err := visit(fallback, path); err != nil {
+				return err
+			}
+		}
+		state[group] = visited
+		return nil
+	}
+	for group := range fallbacks {
+		if err := visit(group, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetGroupFallbacks(name string) []string {
+	return GroupFallbacks[name]
+}
@@ -0,0 +1,19 @@
+package common
+
+import "testing"
+
+func TestUpdateGroupFallbacksRejectsCycles(t *testing.T) {
+	defer func(fallbacks map[string][]string) { GroupFallbacks = fallbacks }(GroupFallbacks)
+	for _, jsonStr := range []string{
+		`{"default":["default"]}`,
+		`{"default":["overflow"],"overflow":["default"]}`,
+		`{"default":["vip","overflow"],"overflow":["shared"],"shared":["default"]}`,
+	} {
+		if err := UpdateGroupFallbacksByJSONString(jsonStr); err == nil {
+			t.Errorf("cycle accepted: %s", jsonStr)
+		}
+	}
+	if err := UpdateGroupFallbacksByJSONString(`{"default":["overflow","shared"],"overflow":["shared"]}`); err != nil {
+		t.Errorf("fallbacks without a cycle rejected: %v", err)
+	}
+}
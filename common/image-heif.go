@@ -0,0 +1,211 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+)
+
+// AVIF and HEIC are HEIF containers, only their dimensions are needed to count image tokens,
+// so the formats are registered with a header parser and cannot be fully decoded.
+func init() {
+	for _, brand := range []string{"avif", "avis"} {
+		image.RegisterFormat("avif", "????ftyp"+brand, decodeHEIF, decodeHEIFConfig)
+	}
+	for _, brand := range []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"} {
+		image.RegisterFormat("heic", "????ftyp"+brand, decodeHEIF, decodeHEIFConfig)
+	}
+}
+
+var errHEIFNotSupported = errors.New("heif: only the image header can be decoded")
+var errHEIFInvalid = errors.New("heif: invalid image header")
+
+type heifBox struct {
+	typ  string
+	body []byte
+}
+
+func decodeHEIF(r io.Reader) (image.Image, error) {
+	return nil, errHEIFNotSupported
+}
+
+// readHEIFBoxes splits data into ISO base media file format boxes
+func readHEIFBoxes(data []byte) ([]heifBox, error) {
+	var boxes []heifBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errHEIFInvalid
+		}
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		typ := string(data[4:8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			// the box extends to the end of the file
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errHEIFInvalid
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, errHEIFInvalid
+		}
+		boxes = append(boxes, heifBox{typ: typ, body: data[headerSize:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+func findHEIFBox(boxes []heifBox, typ string) *heifBox {
+	for i := range boxes {
+		if boxes[i].typ == typ {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+// readHEIFFullBoxChildren skips the version and flags of a full box and splits its children
+func readHEIFFullBoxChildren(box *heifBox) ([]heifBox, error) {
+	if len(box.body) < 4 {
+		return nil, errHEIFInvalid
+	}
+	return readHEIFBoxes(box.body[4:])
+}
+
+func getHEIFPrimaryItemId(pitm *heifBox) (uint32, bool) {
+	if pitm == nil || len(pitm.body) < 6 {
+		return 0, false
+	}
+	if pitm.body[0] == 0 {
+		return uint32(binary.BigEndian.Uint16(pitm.body[4:6])), true
+	}
+	if len(pitm.body) < 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(pitm.body[4:8]), true
+}
+
+// getHEIFItemProperties returns the 1-based ipco property indexes associated with the item
+func getHEIFItemProperties(ipma *heifBox, itemId uint32) []int {
+	if ipma == nil || len(ipma.body) < 8 {
+		return nil
+	}
+	version := ipma.body[0]
+	flags := ipma.body[3]
+	data := ipma.body[4:]
+	entryCount := binary.BigEndian.Uint32(data[0:4])
+	data = data[4:]
+	for i := uint32(0); i < entryCount; i++ {
+		var id uint32
+		if version < 1 {
+			if len(data) < 2 {
+				return nil
+			}
+			id = uint32(binary.BigEndian.Uint16(data[0:2]))
+			data = data[2:]
+		} else {
+			if len(data) < 4 {
+				return nil
+			}
+			id = binary.BigEndian.Uint32(data[0:4])
+			data = data[4:]
+		}
+		if len(data) < 1 {
+			return nil
+		}
+		count := int(data[0])
+		data = data[1:]
+		var indexes []int
+		for j := 0; j < count; j++ {
+			if flags&1 == 1 {
+				if len(data) < 2 {
+					return nil
+				}
+				indexes = append(indexes, int(binary.BigEndian.Uint16(data[0:2])&0x7fff))
+				data = data[2:]
+			} else {
+				if len(data) < 1 {
+					return nil
+				}
+				indexes = append(indexes, int(data[0]&0x7f))
+				data = data[1:]
+			}
+		}
+		if id == itemId {
+			return indexes
+		}
+	}
+	return nil
+}
+
+func parseHEIFSpatialExtent(ispe *heifBox) (int, int, bool) {
+	if len(ispe.body) < 12 {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint32(ispe.body[4:8])), int(binary.BigEndian.Uint32(ispe.body[8:12])), true
+}
+
+// decodeHEIFConfig reads the dimensions of the primary item from its "ispe" property,
+// falling back to the largest extent when the item properties cannot be resolved
+func decodeHEIFConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	boxes, err := readHEIFBoxes(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	meta := findHEIFBox(boxes, "meta")
+	if meta == nil {
+		return image.Config{}, errHEIFInvalid
+	}
+	metaBoxes, err := readHEIFFullBoxChildren(meta)
+	if err != nil {
+		return image.Config{}, err
+	}
+	iprp := findHEIFBox(metaBoxes, "iprp")
+	if iprp == nil {
+		return image.Config{}, errHEIFInvalid
+	}
+	iprpBoxes, err := readHEIFBoxes(iprp.body)
+	if err != nil {
+		return image.Config{}, err
+	}
+	ipco := findHEIFBox(iprpBoxes, "ipco")
+	if ipco == nil {
+		return image.Config{}, errHEIFInvalid
+	}
+	properties, err := readHEIFBoxes(ipco.body)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if itemId, ok := getHEIFPrimaryItemId(findHEIFBox(metaBoxes, "pitm")); ok {
+		for _, index := range getHEIFItemProperties(findHEIFBox(iprpBoxes, "ipma"), itemId) {
+			if index < 1 || index > len(properties) || properties[index-1].typ != "ispe" {
+				continue
+			}
+			if width, height, ok := parseHEIFSpatialExtent(&properties[index-1]); ok {
+				return image.Config{Width: width, Height: height}, nil
+			}
+		}
+	}
+	config := image.Config{}
+	for i := range properties {
+		if properties[i].typ != "ispe" {
+			continue
+		}
+		if width, height, ok := parseHEIFSpatialExtent(&properties[i]); ok && width*height > config.Width*config.Height {
+			config.Width, config.Height = width, height
+		}
+	}
+	if config.Width == 0 || config.Height == 0 {
+		return image.Config{}, errHEIFInvalid
+	}
+	return config, nil
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+func heifTestBox(typ string, body ...[]byte) []byte {
+	size := 8
+	for _, b := range body {
+		size += len(b)
+	}
+	box := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(box[0:4], uint32(size))
+	copy(box[4:8], typ)
+	for _, b := range body {
+		box = append(box, b...)
+	}
+	return box
+}
+
+func heifTestSpatialExtent(width, height uint32) []byte {
+	body := make([]byte, 12)
+	binary.BigEndian.PutUint32(body[4:8], width)
+	binary.BigEndian.PutUint32(body[8:12], height)
+	return heifTestBox("ispe", body)
+}
+
+// newTestHEIF builds the header of a HEIF file whose primary item 1 is 4032x3024, the thumbnail item 2
+// has a larger extent so that picking the wrong one is noticed
+func newTestHEIF(brand string, withPrimaryItem bool, ipmaVersion byte, ipmaFlags byte) []byte {
+	ftyp := heifTestBox("ftyp", []byte(brand), []byte{0, 0, 0, 0}, []byte("mif1"), []byte(brand))
+	ipco := heifTestBox("ipco", heifTestSpatialExtent(8000, 6000), heifTestSpatialExtent(4032, 3024))
+	// item 1 has property 2, item 2 has property 1
+	ipmaBody := []byte{ipmaVersion, 0, 0, ipmaFlags, 0, 0, 0, 2}
+	for _, entry := range [][2]int{{2, 1}, {1, 2}} {
+		if ipmaVersion < 1 {
+			ipmaBody = append(ipmaBody, 0, byte(entry[0]))
+		} else {
+			ipmaBody = append(ipmaBody, 0, 0, 0, byte(entry[0]))
+		}
+		ipmaBody = append(ipmaBody, 1)
+		if ipmaFlags&1 == 1 {
+			ipmaBody = append(ipmaBody, 0x80, byte(entry[1]))
+		} else {
+			ipmaBody = append(ipmaBody, 0x80|byte(entry[1]))
+		}
+	}
+	iprp := heifTestBox("iprp", ipco, heifTestBox("ipma", ipmaBody))
+	metaChildren := [][]byte{{0, 0, 0, 0}}
+	if withPrimaryItem {
+		metaChildren = append(metaChildren, heifTestBox("pitm", []byte{0, 0, 0, 0, 0, 1}))
+	}
+	metaChildren = append(metaChildren, iprp)
+	// the coded image data follows, it is never read
+	return append(append(ftyp, heifTestBox("meta", metaChildren...)...), heifTestBox("mdat", make([]byte, 64))...)
+}
+
+func TestDecodeHEIFConfig(t *testing.T) {
+	for _, tc := range []struct {
+		brand       string
+		format      string
+		ipmaVersion byte
+		ipmaFlags   byte
+	}{
+		{"avif", "avif", 0, 0},
+		{"heic", "heic", 0, 0},
+		{"heic", "heic", 1, 1},
+		{"mif1", "heic", 0, 1},
+	} {
+		config, format, err := image.DecodeConfig(bytes.NewReader(newTestHEIF(tc.brand, true, tc.ipmaVersion, tc.ipmaFlags)))
+		if err != nil || format != tc.format || config.Width != 4032 || config.Height != 3024 {
+			t.Errorf("%s ipma v%d flags %d: %s %dx%d, err %v", tc.brand, tc.ipmaVersion, tc.ipmaFlags, format, config.Width, config.Height, err)
+		}
+	}
+	// without a primary item the largest extent is taken
+	config, _, err := image.DecodeConfig(bytes.NewReader(newTestHEIF("avif", false, 0, 0)))
+	if err != nil || config.Width != 8000 || config.Height != 6000 {
+		t.Errorf("without primary item: %dx%d, err %v", config.Width, config.Height, err)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(newTestHEIF("avif", true, 0, 0))); err != errHEIFNotSupported {
+		t.Errorf("full decode: %v", err)
+	}
+	truncated := newTestHEIF("heic", true, 0, 0)[:40]
+	if _, _, err := image.DecodeConfig(bytes.NewReader(truncated)); err == nil {
+		t.Error("truncated header accepted")
+	}
+}
@@ -0,0 +1,16 @@
+package common
+
+import "strings"
+
+func IsImageMimeTypeAllowed(mimeType string) bool {
+	if AllowedImageMimeTypes == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(AllowedImageMimeTypes, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == mimeType || (allowed == "image/jpeg" && mimeType == "image/jpg") {
+			return true
+		}
+	}
+	return false
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var (
@@ -20,9 +21,14 @@ func printHelp() {
 	fmt.Println("Copyright (C) 2023 JustSong. All rights reserved.")
 	fmt.Println("GitHub: https://github.com/songquanpeng/one-api")
 	fmt.Println("Usage: one-api [--port <port>] [--log-dir <log directory>] [--version] [--help]")
+	fmt.Println("       one-api admin <command> [options], run \"one-api admin\" for the commands")
 }
 
 func init() {
+	if strings.HasSuffix(os.Args[0], ".test") {
+		// test binaries parse their own flags and must not create the log directory
+		return
+	}
 	flag.Parse()
 
 	if *PrintVersion {
@@ -52,7 +52,7 @@ func SysLog(s string) {
 
 func SysError(s string) {
 	t := time.Now()
-	_, _ = fmt.Fprintf(gin.DefaultErrorWriter, "[SYS] %v | %s \n", t.Format("2006/01/02 - 15:04:05"), s)
+	_, _ = fmt.Fprintf(gin.DefaultErrorWriter, "[SYS] %v | %s \n", t.Format("2006/01/02 - 15:04:05"), RedactURLSecrets(s))
 }
 
 func LogInfo(ctx context.Context, msg string) {
@@ -74,7 +74,7 @@ func logHelper(ctx context.Context, level string, msg string) {
 	}
 	id := ctx.Value(RequestIdKey)
 	now := time.Now()
-	_, _ = fmt.Fprintf(writer, "[%s] %v | %s | %s \n", level, now.Format("2006/01/02 - 15:04:05"), id, msg)
+	_, _ = fmt.Fprintf(writer, "[%s] %v | %s | %s \n", level, now.Format("2006/01/02 - 15:04:05"), id, RedactURLSecrets(msg))
 	logCount++ // we don't need accurate count, so no lock here
 	if logCount > maxLogCount && !setupLogWorking {
 		logCount = 0
@@ -2,7 +2,10 @@ package common
 
 import (
 	"encoding/json"
+	"fmt"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,11 +27,275 @@ var DalleGenerationImageAmounts = map[string][2]int{
 	"dall-e-3": {1, 1}, // OpenAI allows n=1 currently.
 }
 
+// DalleImagePromptLengthLimitations are measured in characters, not bytes
 var DalleImagePromptLengthLimitations = map[string]int{
 	"dall-e-2": 1000,
 	"dall-e-3": 4000,
 }
 
+func DalleImagePromptLengthLimitations2JSONString() string {
+	jsonBytes, err := json.Marshal(DalleImagePromptLengthLimitations)
+	if err != nil {
+		SysError("error marshalling image prompt length limitations: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateDalleImagePromptLengthLimitationsByJSONString(jsonStr string) error {
+	DalleImagePromptLengthLimitations = make(map[string]int)
+	return json.Unmarshal([]byte(jsonStr), &DalleImagePromptLengthLimitations)
+}
+
+// ModelTimeouts override RelayTimeout for slow models, in seconds
+var ModelTimeouts = map[string]int{}
+
+func ModelTimeouts2JSONString() string {
+	jsonBytes, err := json.Marshal(ModelTimeouts)
+	if err != nil {
+		SysError("error marshalling model timeouts: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateModelTimeoutsByJSONString(jsonStr string) error {
+	ModelTimeouts = make(map[string]int)
+	return json.Unmarshal([]byte(jsonStr), &ModelTimeouts)
+}
+
+// ApproximateTokenModels override ApproximateTokenEnabled per model, e.g. exact counting
+// for billing sensitive models and approximate counting for cheap bulk ones
+var ApproximateTokenModels = map[string]bool{}
+
+func ApproximateTokenModels2JSONString() string {
+	jsonBytes, err := json.Marshal(ApproximateTokenModels)
+	if err != nil {
+		SysError("error marshalling approximate token models: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateApproximateTokenModelsByJSONString(jsonStr string) error {
+	ApproximateTokenModels = make(map[string]bool)
+	return json.Unmarshal([]byte(jsonStr), &ApproximateTokenModels)
+}
+
+// IsApproximateTokenModel decides the counting mode of a model for a group,
+// the model override wins over the group override, which wins over ApproximateTokenEnabled
+func IsApproximateTokenModel(model string, group string) bool {
+	if approximate, ok := ApproximateTokenModels[model]; ok {
+		return approximate
+	}
+	if approximate, ok := GroupApproximateToken[group]; ok {
+		return approximate
+	}
+	return ApproximateTokenEnabled
+}
+
+const (
+	ServiceTierAuto    = "auto"
+	ServiceTierDefault = "default"
+	ServiceTierFlex    = "flex" // economy, served by the channels of the flex tier
+)
+
+// ServiceTierRatios multiply the group ratio of requests served in a tier
+var ServiceTierRatios = map[string]float64{
+	ServiceTierFlex: 0.5,
+}
+
+func ServiceTierRatios2JSONString() string {
+	jsonBytes, err := json.Marshal(ServiceTierRatios)
+	if err != nil {
+		SysError("error marshalling service tier ratios: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateServiceTierRatiosByJSONString(jsonStr string) error {
+	ServiceTierRatios = make(map[string]float64)
+	return json.Unmarshal([]byte(jsonStr), &ServiceTierRatios)
+}
+
+func GetServiceTierRatio(tier string) float64 {
+	ratio, ok := ServiceTierRatios[tier]
+	if !ok {
+		return 1
+	}
+	return ratio
+}
+
+// ModelFallbacks map a model to a comparable one, used only when no channel can serve the model
+var ModelFallbacks = map[string]string{}
+
+func ModelFallbacks2JSONString() string {
+	jsonBytes, err := json.Marshal(ModelFallbacks)
+	if err != nil {
+		SysError("error marshalling model fallbacks: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateModelFallbacksByJSONString(jsonStr string) error {
+	ModelFallbacks = make(map[string]string)
+	return json.Unmarshal([]byte(jsonStr), &ModelFallbacks)
+}
+
+// ContextLengthFallbacks map a model to one with a larger context window, the request is retried once
+// on it when the upstream rejects the prompt with context_length_exceeded
+var ContextLengthFallbacks = map[string]string{}
+
+func ContextLengthFallbacks2JSONString() string {
+	jsonBytes, err := json.Marshal(ContextLengthFallbacks)
+	if err != nil {
+		SysError("error marshalling context length fallbacks: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateContextLengthFallbacksByJSONString(jsonStr string) error {
+	ContextLengthFallbacks = make(map[string]string)
+	return json.Unmarshal([]byte(jsonStr), &ContextLengthFallbacks)
+}
+
+// ModelContextLimits caps the prompt tokens of a model, longer prompts are rejected with context_length_exceeded
+// before reaching the upstream, so ContextLengthFallbacks apply to them as well
+var ModelContextLimits = map[string]int{}
+
+func ModelContextLimits2JSONString() string {
+	jsonBytes, err := json.Marshal(ModelContextLimits)
+	if err != nil {
+		SysError("error marshalling model context limits: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateModelContextLimitsByJSONString(jsonStr string) error {
+	ModelContextLimits = make(map[string]int)
+	return json.Unmarshal([]byte(jsonStr), &ModelContextLimits)
+}
+
+// GetModelContextLimit returns the context limit of the model, 0 means unlimited
+func GetModelContextLimit(name string) int {
+	limit, _ := lookupSnapshot(ModelContextLimits, name)
+	return limit
+}
+
+const (
+	ModelStreamModeStreamOnly    = "stream_only"
+	ModelStreamModeNonStreamOnly = "non_stream_only"
+)
+
+// ModelStreamModes restrict models to streaming or non-streaming requests, missing models support both,
+// see StreamModeMismatchAction for what happens to the other requests
+var ModelStreamModes = map[string]string{}
+
+func ModelStreamModes2JSONString() string {
+	jsonBytes, err := json.Marshal(ModelStreamModes)
+	if err != nil {
+		SysError("error marshalling model stream modes: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateModelStreamModesByJSONString(jsonStr string) error {
+	ModelStreamModes = make(map[string]string)
+	return json.Unmarshal([]byte(jsonStr), &ModelStreamModes)
+}
+
+// ImageTokenParams describes how an image in a prompt is converted to tokens:
+// the image is scaled to fit MaxLongSide x MaxShortSide, cut into TileSize tiles,
+// and charged BaseTokens plus TileTokens per tile. Low detail images cost BaseTokens only.
+type ImageTokenParams struct {
+	BaseTokens   int `json:"base_tokens"`
+	TileTokens   int `json:"tile_tokens"`
+	TileSize     int `json:"tile_size"`
+	MaxLongSide  int `json:"max_long_side"`
+	MaxShortSide int `json:"max_short_side"`
+}
+
+// ImageTokenParameters are keyed by model family, the longest prefix of the model name wins,
+// models matching no family use the "default" entry
+var ImageTokenParameters = map[string]ImageTokenParams{
+	"default": {
+		BaseTokens:   85,
+		TileTokens:   170,
+		TileSize:     512,
+		MaxLongSide:  2000,
+		MaxShortSide: 768,
+	},
+}
+
+func ImageTokenParameters2JSONString() string {
+	jsonBytes, err := json.Marshal(ImageTokenParameters)
+	if err != nil {
+		SysError("error marshalling image token parameters: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateImageTokenParametersByJSONString(jsonStr string) error {
+	parameters := make(map[string]ImageTokenParams)
+	err := json.Unmarshal([]byte(jsonStr), &parameters)
+	if err != nil {
+		return err
+	}
+	for family, params := range parameters {
+		if params.TileSize <= 0 || params.MaxLongSide <= 0 || params.MaxShortSide <= 0 {
+			return fmt.Errorf("invalid image token parameters for %s", family)
+		}
+	}
+	ImageTokenParameters = parameters
+	return nil
+}
+
+func GetImageTokenParams(model string) ImageTokenParams {
+	params, ok := ImageTokenParameters["default"]
+	if !ok {
+		params = ImageTokenParams{BaseTokens: 85, TileTokens: 170, TileSize: 512, MaxLongSide: 2000, MaxShortSide: 768}
+	}
+	matched := ""
+	for family, familyParams := range ImageTokenParameters {
+		if family != "default" && strings.HasPrefix(model, family) && len(family) > len(matched) {
+			matched = family
+			params = familyParams
+		}
+	}
+	return params
+}
+
+// DalleImagePromptRequirements tells whether an image endpoint requires a prompt for a model.
+// Endpoints missing here require a prompt, except for variations.
+var DalleImagePromptRequirements = map[string]map[string]bool{
+	"dall-e-2": {
+		"generations": true,
+		"edits":       true,
+		"variations":  false,
+	},
+	"dall-e-3": {
+		"generations": true,
+	},
+}
+
+func DalleImagePromptRequirements2JSONString() string {
+	jsonBytes, err := json.Marshal(DalleImagePromptRequirements)
+	if err != nil {
+		SysError("error marshalling image prompt requirements: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateDalleImagePromptRequirementsByJSONString(jsonStr string) error {
+	DalleImagePromptRequirements = make(map[string]map[string]bool)
+	return json.Unmarshal([]byte(jsonStr), &DalleImagePromptRequirements)
+}
+
+func IsImagePromptRequired(model string, endpoint string) bool {
+	required, ok := DalleImagePromptRequirements[model][endpoint]
+	if !ok {
+		return endpoint != "variations"
+	}
+	return required
+}
+
 // ModelRatio
 // https://platform.openai.com/docs/models/model-endpoint-compatibility
 // https://cloud.baidu.com/doc/WENXINWORKSHOP/s/Blfmc9dlf
@@ -109,8 +376,41 @@ func UpdateModelRatioByJSONString(jsonStr string) error {
 	return json.Unmarshal([]byte(jsonStr), &ModelRatio)
 }
 
+// snapshotSuffix matches the date of a dated snapshot like gpt-4o-2024-11-20 or claude-3-5-sonnet-20241022,
+// legacy four digit snapshots like gpt-4-0613 are priced differently and must be listed on their own
+var snapshotSuffix = regexp.MustCompile(`-(\d{4}-\d{2}-\d{2}|\d{8})$`)
+
+// snapshotBase returns the model a dated snapshot belongs to, other names are returned as is
+func snapshotBase(name string) string {
+	return snapshotSuffix.ReplaceAllString(name, "")
+}
+
+// loggedSnapshots remembers the snapshots already reported, so every new one is logged once
+var loggedSnapshots sync.Map
+
+// lookupSnapshot finds the entry of a dated snapshot through its base model, exact entries take precedence,
+// so gpt-4o-mini-2024-07-18 resolves to gpt-4o-mini and never to gpt-4o, while variants like
+// gpt-4o-audio-preview-2024-10-01 are only found when their base model is listed
+func lookupSnapshot[T any](table map[string]T, name string) (T, bool) {
+	value, ok := table[name]
+	if ok {
+		return value, true
+	}
+	base := snapshotBase(name)
+	if base == name {
+		return value, false
+	}
+	if value, ok = table[base]; !ok {
+		return value, false
+	}
+	if _, logged := loggedSnapshots.LoadOrStore(name, true); !logged {
+		SysLog(fmt.Sprintf("new model snapshot %s found, priced as %s", name, base))
+	}
+	return value, true
+}
+
 func GetModelRatio(name string) float64 {
-	ratio, ok := ModelRatio[name]
+	ratio, ok := lookupSnapshot(ModelRatio, name)
 	if !ok {
 		SysError("model ratio not found: " + name)
 		return 30
@@ -118,6 +418,31 @@ func GetModelRatio(name string) float64 {
 	return ratio
 }
 
+// ModelIORatio optionally overrides the model ratio with separate input and output ratios
+type IORatio struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+var ModelIORatio = map[string]IORatio{}
+
+func ModelIORatio2JSONString() string {
+	jsonBytes, err := json.Marshal(ModelIORatio)
+	if err != nil {
+		SysError("error marshalling model io ratio: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateModelIORatioByJSONString(jsonStr string) error {
+	ModelIORatio = make(map[string]IORatio)
+	return json.Unmarshal([]byte(jsonStr), &ModelIORatio)
+}
+
+func GetModelIORatio(name string) (IORatio, bool) {
+	return lookupSnapshot(ModelIORatio, name)
+}
+
 func GetCompletionRatio(name string) float64 {
 	// 必须用全称
 	if name == "gpt-3.5-turbo-0301" || name == "gpt-35-turbo-0301" {
@@ -163,6 +488,9 @@ func GetCompletionRatio(name string) float64 {
 		return 2
 	}
 
+	// the rules below are by family, match dated snapshots by their base model like the ratio tables
+	name = snapshotBase(name)
+
 	if strings.HasPrefix(name, "gpt-3.5") {
 		if strings.HasSuffix(name, "1106") {
 			return 2
@@ -192,3 +520,54 @@ func GetCompletionRatio(name string) float64 {
 	}
 	return 1
 }
+
+// IsFreeModel reports whether the model is listed in FreeModels
+func IsFreeModel(name string) bool {
+	return matchModelList(FreeModels, name)
+}
+
+// IsModelDisabled reports whether the model is listed in DisabledModels
+func IsModelDisabled(name string) bool {
+	return matchModelList(DisabledModels, name)
+}
+
+// IsDuplicateRequestExemptModel reports whether the model is listed in DuplicateRequestExemptModels
+func IsDuplicateRequestExemptModel(name string) bool {
+	return matchModelList(DuplicateRequestExemptModels, name)
+}
+
+// IsReasoningModel reports whether the model is an o-series reasoning model, which only accepts the default sampling
+func IsReasoningModel(name string) bool {
+	for _, prefix := range []string{"o1", "o3", "o4"} {
+		if name == prefix || strings.HasPrefix(name, prefix+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsModelInList reports whether the model is allowed by a comma separated list, an empty list allows all
+func IsModelInList(list string, name string) bool {
+	return list == "" || matchModelList(list, name)
+}
+
+// matchModelList matches a model against a comma separated list, entries ending with "*" match by prefix
+func matchModelList(list string, name string) bool {
+	if list == "" {
+		return false
+	}
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
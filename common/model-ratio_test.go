@@ -0,0 +1,68 @@
+package common
+
+import "testing"
+
+func TestModelRatioOfSnapshots(t *testing.T) {
+	defer func(ratios map[string]float64) { ModelRatio = ratios }(ModelRatio)
+	ModelRatio = map[string]float64{"gpt-4o": 2.5, "gpt-4o-mini": 0.075, "gpt-4o-mini-2024-07-18": 0.1, "gpt-4": 15, "gpt-4o-audio-preview": 10}
+	for name, ratio := range map[string]float64{
+		"gpt-4o-2024-11-20":                  2.5,
+		"gpt-4o-mini-2024-09-01":             0.075,
+		"gpt-4o-mini-2024-07-18":             0.1,
+		"gpt-4o-audio-preview-2024-10-01":    10,
+		"gpt-4o-realtime-preview-2024-10-01": 30,
+		"claude-3-5-sonnet-20241022":         30,
+		"gpt-4-20240101":                     15,
+		// legacy four digit snapshots are not dated and must be listed on their own
+		"gpt-4-0613":    30,
+		"gpt-4omni":     30,
+		"gpt-3.5-turbo": 30,
+	} {
+		if got := GetModelRatio(name); got != ratio {
+			t.Errorf("ratio of %s is %v, want %v", name, got, ratio)
+		}
+	}
+}
+
+func TestModelIORatioOfSnapshots(t *testing.T) {
+	defer func(ratios map[string]IORatio) { ModelIORatio = ratios }(ModelIORatio)
+	ModelIORatio = map[string]IORatio{"o1": {Input: 7.5, Output: 30}, "o1-mini": {Input: 1.5, Output: 6}}
+	if ratio, ok := GetModelIORatio("o1-mini-2024-09-12"); !ok || ratio.Input != 1.5 {
+		t.Errorf("o1-mini snapshot priced as %v", ratio)
+	}
+	if ratio, ok := GetModelIORatio("o1-2024-12-17"); !ok || ratio.Input != 7.5 {
+		t.Errorf("o1 snapshot priced as %v", ratio)
+	}
+	if _, ok := GetModelIORatio("o10"); ok {
+		t.Error("a model matched without a dash after the prefix")
+	}
+}
+
+func TestCompletionRatioResolvesLikeModelRatio(t *testing.T) {
+	for _, name := range []string{"gpt-4o-2024-11-20", "gpt-4-vision-preview-2024-01-01", "claude-2-20231122"} {
+		if got, want := GetCompletionRatio(name), GetCompletionRatio(snapshotBase(name)); got != want {
+			t.Errorf("completion ratio of %s is %v, its base model has %v", name, got, want)
+		}
+	}
+	if got := GetCompletionRatio("gpt-4o-audio-preview-2024-10-01"); got != GetCompletionRatio("gpt-4o-audio-preview") {
+		t.Errorf("completion ratio of an audio preview snapshot is %v", got)
+	}
+}
+
+func TestModelContextLimitOfSnapshots(t *testing.T) {
+	defer func(limits map[string]int) { ModelContextLimits = limits }(ModelContextLimits)
+	if err := UpdateModelContextLimitsByJSONString(`{"gpt-4o":128000,"gpt-4o-mini":64000}`); err != nil {
+		t.Fatal(err)
+	}
+	for name, limit := range map[string]int{
+		"gpt-4o":                 128000,
+		"gpt-4o-2024-11-20":      128000,
+		"gpt-4o-mini-2024-07-18": 64000,
+		"gpt-4o-audio-preview":   0,
+		"gpt-4":                  0,
+	} {
+		if got := GetModelContextLimit(name); got != limit {
+			t.Errorf("context limit of %s is %d, want %d", name, got, limit)
+		}
+	}
+}
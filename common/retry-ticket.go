@@ -0,0 +1,88 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RetryTicketKey is both the query parameter of relay retry redirects and the context key of the parsed ticket
+const RetryTicketKey = "retry_ticket"
+
+// RetryTicketTTL is how long in seconds a client may take to follow a retry redirect
+const RetryTicketTTL = 10 * 60
+
+// RetryTicket is handed out by the server in the redirect of a relay retry, it is signed with SessionSecret,
+// so clients cannot forge a retry, pick another caller's attempt chain or reset the chain's start time
+type RetryTicket struct {
+	ChainId         string `json:"c"`           // request id of the first attempt
+	StartTime       int64  `json:"s"`           // start of the first attempt in milliseconds
+	Attempt         int    `json:"a"`           // attempts already made
+	Retry           int    `json:"r"`           // retries left
+	ContextFallback string `json:"f,omitempty"` // see ContextLengthFallbacks
+	TokenId         int    `json:"t"`
+	ExpiresAt       int64  `json:"e"`
+}
+
+var errInvalidRetryTicket = errors.New("invalid retry ticket")
+
+func signRetryTicket(payload string) string {
+	mac := hmac.New(sha256.New, []byte(SessionSecret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IssueRetryTicket encodes and signs the ticket, it expires after RetryTicketTTL
+func IssueRetryTicket(ticket RetryTicket) string {
+	ticket.ExpiresAt = GetTimestamp() + RetryTicketTTL
+	jsonBytes, err := json.Marshal(ticket)
+	if err != nil {
+		SysError("error marshalling retry ticket: " + err.Error())
+	}
+	payload := base64.RawURLEncoding.EncodeToString(jsonBytes)
+	return payload + "." + signRetryTicket(payload)
+}
+
+func ParseRetryTicket(value string) (*RetryTicket, error) {
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signRetryTicket(payload))) {
+		return nil, errInvalidRetryTicket
+	}
+	jsonBytes, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidRetryTicket
+	}
+	var ticket RetryTicket
+	if err := json.Unmarshal(jsonBytes, &ticket); err != nil || ticket.ChainId == "" {
+		return nil, errInvalidRetryTicket
+	}
+	if ticket.ExpiresAt < GetTimestamp() {
+		return nil, errors.New("retry ticket expired")
+	}
+	return &ticket, nil
+}
+
+// GetRetryTicket returns the verified ticket of a retried relay request, nil for a first attempt
+func GetRetryTicket(c *gin.Context) *RetryTicket {
+	if ticket, ok := c.Get(RetryTicketKey); ok {
+		return ticket.(*RetryTicket)
+	}
+	return nil
+}
+
+// StripRetryTicket removes the retry ticket from a raw query and keeps the client's parameters as sent
+func StripRetryTicket(rawQuery string) string {
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" || strings.HasPrefix(param, RetryTicketKey+"=") {
+			continue
+		}
+		params = append(params, param)
+	}
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRetryTicketRoundTrip(t *testing.T) {
+	issued := IssueRetryTicket(RetryTicket{ChainId: "chain", StartTime: 1000, Attempt: 1, Retry: 2, ContextFallback: "gpt-4o", TokenId: 7})
+	ticket, err := ParseRetryTicket(issued)
+	if err != nil {
+		t.Fatalf("ParseRetryTicket: %v", err)
+	}
+	if ticket.ChainId != "chain" || ticket.StartTime != 1000 || ticket.Attempt != 1 || ticket.Retry != 2 ||
+		ticket.ContextFallback != "gpt-4o" || ticket.TokenId != 7 {
+		t.Errorf("unexpected ticket %+v", ticket)
+	}
+}
+
+func TestRetryTicketRejectsForgery(t *testing.T) {
+	issued := IssueRetryTicket(RetryTicket{ChainId: "chain", TokenId: 7})
+	forged := IssueRetryTicket(RetryTicket{ChainId: "other", TokenId: 7})
+	payload, _, _ := strings.Cut(forged, ".")
+	_, signature, _ := strings.Cut(issued, ".")
+	for _, value := range []string{"", "chain", payload + "." + signature, payload + "."} {
+		if _, err := ParseRetryTicket(value); err == nil {
+			t.Errorf("ParseRetryTicket(%q) accepted a forged ticket", value)
+		}
+	}
+}
+
+func TestStripRetryTicket(t *testing.T) {
+	tests := map[string]string{
+		"":                             "",
+		"retry_ticket=abc":             "",
+		"a=1&retry_ticket=abc&b=2":     "a=1&b=2",
+		"api-version=2024-02-01":       "api-version=2024-02-01",
+		"retry_ticketx=1&retry_ticket": "retry_ticketx=1&retry_ticket",
+	}
+	for query, expected := range tests {
+		if stripped := StripRetryTicket(query); stripped != expected {
+			t.Errorf("StripRetryTicket(%q) = %q, want %q", query, stripped, expected)
+		}
+	}
+}
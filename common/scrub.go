@@ -0,0 +1,56 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// ErrorMessageScrubPatterns are newline separated regular expressions masked in upstream error messages,
+// e.g. Azure resource or organization names
+var ErrorMessageScrubPatterns = ""
+var errorMessageScrubRegexps []*regexp.Regexp
+
+func UpdateErrorMessageScrubPatterns(patterns string) error {
+	var regexps []*regexp.Regexp
+	for _, pattern := range strings.Split(patterns, "\n") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		regexps = append(regexps, re)
+	}
+	ErrorMessageScrubPatterns = patterns
+	errorMessageScrubRegexps = regexps
+	return nil
+}
+
+func ScrubErrorMessage(message string) string {
+	for _, re := range errorMessageScrubRegexps {
+		message = re.ReplaceAllString(message, "***")
+	}
+	return message
+}
+
+// MaskPrompt keeps the first PromptMaskPrefixLength characters of a prompt and a salted hash of the rest,
+// enough to correlate requests while the prompt cannot be reconstructed from logs
+func MaskPrompt(text string) string {
+	if !PromptMaskEnabled || text == "" {
+		return text
+	}
+	salt := PromptMaskSalt
+	if salt == "" {
+		salt = SessionSecret
+	}
+	hash := sha256.Sum256([]byte(salt + text))
+	prefix := []rune(text)
+	if len(prefix) > PromptMaskPrefixLength {
+		prefix = prefix[:PromptMaskPrefixLength]
+	}
+	return string(prefix) + "...[sha256:" + hex.EncodeToString(hash[:8]) + "]"
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// BuildTLSConfig builds the TLS config of a channel from its PEM encoded CA bundle and client certificate.
+func BuildTLSConfig(caCert string, clientCert string, clientKey string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caCert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(caCert)) {
+			return nil, errors.New("CA 证书解析失败，请检查 PEM 格式")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if clientCert != "" || clientKey != "" {
+		certificate, err := tls.X509KeyPair([]byte(clientCert), []byte(clientKey))
+		if err != nil {
+			return nil, errors.New("客户端证书或私钥解析失败：" + err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,243 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal W3C trace context and OTLP/HTTP JSON exporter. Every function is a no-op
+// returning nil spans when OtelExporterEndpoint is not set.
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+const traceExportBatchSize = 100
+const traceExportInterval = 5 * time.Second
+
+type spanContextKey struct{}
+
+type Span struct {
+	TraceId      string
+	SpanId       string
+	ParentSpanId string
+	Name         string
+	Kind         int
+	StartTime    time.Time
+	EndTime      time.Time
+	Failed       bool
+
+	attributesLock sync.Mutex
+	attributes     map[string]any
+}
+
+var traceExportChan chan *Span
+var traceExportOnce sync.Once
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ParseTraceparent extracts the trace id and parent span id of a W3C traceparent header
+func ParseTraceparent(header string) (string, string, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", "", false
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// StartServerSpan starts the root span of a request, continuing the caller's trace if traceparent is valid
+func StartServerSpan(ctx context.Context, name string, traceparent string) (context.Context, *Span) {
+	if OtelExporterEndpoint == "" {
+		return ctx, nil
+	}
+	span := &Span{Name: name, Kind: spanKindServer, SpanId: randomHex(8), StartTime: time.Now()}
+	if traceId, parentSpanId, ok := ParseTraceparent(traceparent); ok {
+		span.TraceId = traceId
+		span.ParentSpanId = parentSpanId
+	} else {
+		span.TraceId = randomHex(16)
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// StartSpan starts a child of the span in ctx, it returns nil when there is no parent
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		Name:         name,
+		Kind:         spanKindClient,
+		TraceId:      parent.TraceId,
+		SpanId:       randomHex(8),
+		ParentSpanId: parent.SpanId,
+		StartTime:    time.Now(),
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func (span *Span) SetAttribute(key string, value any) {
+	if span == nil {
+		return
+	}
+	span.attributesLock.Lock()
+	defer span.attributesLock.Unlock()
+	if span.attributes == nil {
+		span.attributes = make(map[string]any)
+	}
+	span.attributes[key] = value
+}
+
+// SetFailed marks the span as an error, a nil span is ignored like the other methods
+func (span *Span) SetFailed(failed bool) {
+	if span == nil {
+		return
+	}
+	span.Failed = failed
+}
+
+// Inject propagates the span to an outgoing request
+func (span *Span) Inject(header http.Header) {
+	if span == nil {
+		return
+	}
+	header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", span.TraceId, span.SpanId))
+}
+
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	span.EndTime = time.Now()
+	traceExportOnce.Do(func() {
+		traceExportChan = make(chan *Span, 10*traceExportBatchSize)
+		go exportSpans()
+	})
+	select {
+	case traceExportChan <- span:
+	default:
+		// never block the relay on a slow collector
+	}
+}
+
+func (span *Span) otlpAttributes() []map[string]any {
+	span.attributesLock.Lock()
+	defer span.attributesLock.Unlock()
+	attributes := make([]map[string]any, 0, len(span.attributes))
+	for key, value := range span.attributes {
+		var otlpValue map[string]any
+		switch v := value.(type) {
+		case int:
+			otlpValue = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			otlpValue = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			otlpValue = map[string]any{"boolValue": v}
+		case float64:
+			otlpValue = map[string]any{"doubleValue": v}
+		default:
+			otlpValue = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		attributes = append(attributes, map[string]any{"key": key, "value": otlpValue})
+	}
+	return attributes
+}
+
+func (span *Span) otlpSpan() map[string]any {
+	otlpSpan := map[string]any{
+		"traceId":           span.TraceId,
+		"spanId":            span.SpanId,
+		"name":              span.Name,
+		"kind":              span.Kind,
+		"startTimeUnixNano": strconv.FormatInt(span.StartTime.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+		"attributes":        span.otlpAttributes(),
+	}
+	if span.ParentSpanId != "" {
+		otlpSpan["parentSpanId"] = span.ParentSpanId
+	}
+	if span.Failed {
+		otlpSpan["status"] = map[string]any{"code": 2}
+	}
+	return otlpSpan
+}
+
+func exportSpans() {
+	ticker := time.NewTicker(traceExportInterval)
+	var batch []*Span
+	for {
+		select {
+		case span := <-traceExportChan:
+			batch = append(batch, span)
+			if len(batch) < traceExportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		err := postSpans(batch)
+		if err != nil {
+			SysError("failed to export traces: " + err.Error())
+		}
+		batch = nil
+	}
+}
+
+func postSpans(spans []*Span) error {
+	otlpSpans := make([]map[string]any, 0, len(spans))
+	for _, span := range spans {
+		otlpSpans = append(otlpSpans, span.otlpSpan())
+	}
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []any{map[string]any{"key": "service.name", "value": map[string]any{"stringValue": "one-api"}}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "one-api", "version": Version},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(strings.TrimSuffix(OtelExporterEndpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestSpanMethodsIgnoreDisabledTracing(t *testing.T) {
+	defer func(endpoint string) { OtelExporterEndpoint = endpoint }(OtelExporterEndpoint)
+	OtelExporterEndpoint = ""
+	ctx, server := StartServerSpan(context.Background(), "relay", "")
+	_, span := StartSpan(ctx, "upstream")
+	if server != nil || span != nil {
+		t.Fatalf("tracing is disabled but got spans %v %v", server, span)
+	}
+	header := http.Header{}
+	span.Inject(header)
+	span.SetAttribute("http.status_code", http.StatusOK)
+	span.SetFailed(true)
+	span.End()
+	if header.Get("traceparent") != "" {
+		t.Errorf("nil span injected %q", header.Get("traceparent"))
+	}
+}
+
+func TestPostSpans(t *testing.T) {
+	defer func(endpoint string) { OtelExporterEndpoint = endpoint }(OtelExporterEndpoint)
+	var payload []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			payload, _ = io.ReadAll(r.Body)
+		}
+	}))
+	defer collector.Close()
+	OtelExporterEndpoint = collector.URL + "/"
+
+	ctx, server := StartServerSpan(context.Background(), "relay", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, upstream := StartSpan(ctx, "upstream")
+	upstream.SetAttribute("quota", 42)
+	upstream.SetAttribute("stream", true)
+	upstream.SetFailed(true)
+	if err := postSpans([]*Span{server, upstream}); err != nil {
+		t.Fatal(err)
+	}
+	spans := gjson.GetBytes(payload, "resourceSpans.0.scopeSpans.0.spans")
+	if len(spans.Array()) != 2 || spans.Get("0.traceId").String() != "4bf92f3577b34da6a3ce929d0e0e4736" || spans.Get("0.parentSpanId").String() != "00f067aa0ba902b7" {
+		t.Fatalf("unexpected payload: %s", payload)
+	}
+	if spans.Get("1.parentSpanId").String() != server.SpanId || spans.Get("1.status.code").Int() != 2 ||
+		spans.Get(`1.attributes.#(key=="quota").value.intValue`).String() != "42" || !spans.Get(`1.attributes.#(key=="stream").value.boolValue`).Bool() {
+		t.Errorf("unexpected upstream span: %s", spans.Get("1").Raw)
+	}
+}
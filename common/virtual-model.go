@@ -0,0 +1,149 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// VirtualModelRule routes a virtual model to Model when the prompt matches, the bounds are in prompt tokens
+// and inclusive, 0 means unbounded, the pattern is matched against the prompt text
+type VirtualModelRule struct {
+	MinPromptTokens int    `json:"min_prompt_tokens,omitempty"`
+	MaxPromptTokens int    `json:"max_prompt_tokens,omitempty"`
+	Pattern         string `json:"pattern,omitempty"`
+	Model           string `json:"model"`
+	pattern         *regexp.Regexp
+}
+
+// VirtualModel is a model name defined by the operator, the first matching rule decides the model
+// the request is relayed to and billed as, Default serves the requests no rule matches
+type VirtualModel struct {
+	Rules   []VirtualModelRule `json:"rules"`
+	Default string             `json:"default"`
+}
+
+// virtual models resolving to virtual models are followed at most this many times, validation rejects cycles anyway
+const maxVirtualModelDepth = 8
+
+// VirtualModels map the virtual model names to their routing rules
+var VirtualModels = map[string]*VirtualModel{}
+
+func VirtualModels2JSONString() string {
+	jsonBytes, err := json.Marshal(VirtualModels)
+	if err != nil {
+		SysError("error marshalling virtual models: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateVirtualModelsByJSONString(jsonStr string) error {
+	virtualModels := make(map[string]*VirtualModel)
+	err := json.Unmarshal([]byte(jsonStr), &virtualModels)
+	if err != nil {
+		return err
+	}
+	for name, virtualModel := range virtualModels {
+		if virtualModel == nil || virtualModel.Default == "" {
+			return fmt.Errorf("virtual model %s has no default model", name)
+		}
+		for i := range virtualModel.Rules {
+			rule := &virtualModel.Rules[i]
+			if rule.Model == "" {
+				return fmt.Errorf("rule %d of virtual model %s has no model", i, name)
+			}
+			if rule.MaxPromptTokens != 0 && rule.MaxPromptTokens < rule.MinPromptTokens {
+				return fmt.Errorf("rule %d of virtual model %s has max_prompt_tokens below min_prompt_tokens", i, name)
+			}
+			if rule.Pattern != "" {
+				rule.pattern, err = regexp.Compile(rule.Pattern)
+				if err != nil {
+					return fmt.Errorf("invalid pattern of rule %d of virtual model %s: %s", i, name, err.Error())
+				}
+			}
+		}
+	}
+	if err := checkVirtualModelCycles(virtualModels); err != nil {
+		return err
+	}
+	VirtualModels = virtualModels
+	return nil
+}
+
+// checkVirtualModelCycles rejects virtual models that can resolve to themselves, directly or through other virtual models
+func checkVirtualModelCycles(virtualModels map[string]*VirtualModel) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		virtualModel, ok := virtualModels[name]
+		if !ok {
+			return nil
+		}
+		path = append(path, name)
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("virtual models form a cycle: %v", path)
+		case visited:
+			return nil
+		}
+		if len(path) > maxVirtualModelDepth {
+			return fmt.Errorf("virtual models nest deeper than %d: %v", maxVirtualModelDepth, path)
+		}
+		state[name] = visiting
+		targets := []string{virtualModel.Default}
+		for _, rule := range virtualModel.Rules {
+			targets = append(targets, rule.Model)
+		}
+		for _, target := range targets {
+			if err := visit(target, path); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for name := range virtualModels {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func IsVirtualModel(name string) bool {
+	_, ok := VirtualModels[name]
+	return ok
+}
+
+func (rule *VirtualModelRule) matches(promptTokens int, prompt string) bool {
+	if promptTokens < rule.MinPromptTokens {
+		return false
+	}
+	if rule.MaxPromptTokens != 0 && promptTokens > rule.MaxPromptTokens {
+		return false
+	}
+	return rule.pattern == nil || rule.pattern.MatchString(prompt)
+}
+
+// ResolveVirtualModel returns the concrete model a request to name is routed to, name itself if it is not virtual
+func ResolveVirtualModel(name string, promptTokens int, prompt string) string {
+	for depth := 0; depth < maxVirtualModelDepth; depth++ {
+		virtualModel, ok := VirtualModels[name]
+		if !ok {
+			return name
+		}
+		resolved := virtualModel.Default
+		for i := range virtualModel.Rules {
+			if virtualModel.Rules[i].matches(promptTokens, prompt) {
+				resolved = virtualModel.Rules[i].Model
+				break
+			}
+		}
+		name = resolved
+	}
+	return name
+}
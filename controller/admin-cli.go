@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"one-api/common"
+	"one-api/model"
+	"os"
+	"strings"
+)
+
+const adminUsage = `Usage: one-api admin <command> [options]
+
+Commands:
+  user create   --username <name> --password <password> [--display-name <name>] [--role common|admin|root] [--quota <quota>]
+  channel add   --name <name> --type <type> --key <key> [--base-url <url>] [--models <a,b>] [--group <a,b>]
+  token create  --username <name> --name <name> [--quota <quota>] [--unlimited] [--expired-time <timestamp>] [--models <a,b>]
+  option set    --key <key> --value <value>
+
+Every command accepts --json to print the result as JSON.`
+
+var adminRoles = map[string]int{
+	"common": common.RoleCommonUser,
+	"admin":  common.RoleAdminUser,
+	"root":   common.RoleRootUser,
+}
+
+type adminCommand func(flags *flag.FlagSet, args []string) (message string, data any, err error)
+
+var adminCommands = map[string]adminCommand{
+	"user create":  adminCreateUser,
+	"channel add":  adminAddChannel,
+	"token create": adminCreateToken,
+	"option set":   adminSetOption,
+}
+
+// RunAdminCommand runs "one-api admin ..." against the configured database, for deployments without the dashboard.
+// It goes through the same validation as the HTTP handlers and returns the process exit code.
+func RunAdminCommand(args []string, stdout io.Writer) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, adminUsage)
+		return 2
+	}
+	name := args[0] + " " + args[1]
+	command, ok := adminCommands[name]
+	if !ok {
+		fmt.Fprintln(os.Stderr, adminUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	jsonOutput := flags.Bool("json", false, "print the result as JSON")
+	message, data, err := command(flags, args[2:])
+	if *jsonOutput {
+		result := map[string]any{
+			"success": err == nil,
+			"message": message,
+			"data":    data,
+		}
+		if err != nil {
+			result["message"] = err.Error()
+		}
+		jsonBytes, _ := json.Marshal(result)
+		fmt.Fprintln(stdout, string(jsonBytes))
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+	} else {
+		fmt.Fprintln(stdout, message)
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func adminCreateUser(flags *flag.FlagSet, args []string) (string, any, error) {
+	username := flags.String("username", "", "username")
+	password := flags.String("password", "", "password")
+	displayName := flags.String("display-name", "", "display name, the username by default")
+	role := flags.String("role", "common", "common, admin or root")
+	quota := flags.Int("quota", -1, "initial quota, QuotaForNewUser by default")
+	if err := flags.Parse(args); err != nil {
+		return "", nil, err
+	}
+	roleValue, ok := adminRoles[*role]
+	if !ok {
+		return "", nil, errors.New("无效的角色 " + *role)
+	}
+	user := model.User{
+		Username:    *username,
+		Password:    *password,
+		DisplayName: *displayName,
+	}
+	if err := validateNewUser(&user); err != nil {
+		return "", nil, err
+	}
+	if *quota < 0 {
+		*quota = common.QuotaForNewUser
+	}
+	// a failure never leaves a common user behind
+	if err := user.InsertWithRole(roleValue, *quota); err != nil {
+		return "", nil, err
+	}
+	model.RecordLog(user.Id, model.LogTypeManage, fmt.Sprintf("通过命令行创建用户，角色 %s", *role))
+	data := map[string]any{
+		"id":           user.Id,
+		"username":     user.Username,
+		"role":         roleValue,
+		"access_token": user.AccessToken,
+	}
+	return fmt.Sprintf("created user #%d %s", user.Id, user.Username), data, nil
+}
+
+func adminAddChannel(flags *flag.FlagSet, args []string) (string, any, error) {
+	name := flags.String("name", "", "channel name")
+	channelType := flags.Int("type", common.ChannelTypeOpenAI, "channel type")
+	key := flags.String("key", "", "channel key, one channel is created per line")
+	baseURL := flags.String("base-url", "", "base url")
+	models := flags.String("models", "", "comma separated models")
+	group := flags.String("group", "default", "comma separated groups")
+	if err := flags.Parse(args); err != nil {
+		return "", nil, err
+	}
+	if *key == "" {
+		return "", nil, errors.New("密钥不能为空")
+	}
+	channel := model.Channel{
+		Name:        *name,
+		Type:        *channelType,
+		Key:         *key,
+		BaseURL:     baseURL,
+		Models:      *models,
+		Group:       *group,
+		CreatedTime: common.GetTimestamp(),
+	}
+	if err := validateChannel(&channel, &channel); err != nil {
+		return "", nil, err
+	}
+	var channels []model.Channel
+	for _, key := range strings.Split(channel.Key, "\n") {
+		if key == "" {
+			continue
+		}
+		localChannel := channel
+		localChannel.Key = key
+		channels = append(channels, localChannel)
+	}
+	if err := model.BatchInsertChannels(channels); err != nil {
+		return "", nil, err
+	}
+	var ids []int
+	for _, channel := range channels {
+		ids = append(ids, channel.Id)
+	}
+	return fmt.Sprintf("created %d channel(s) %s", len(channels), channel.Name), map[string]any{"ids": ids}, nil
+}
+
+func adminCreateToken(flags *flag.FlagSet, args []string) (string, any, error) {
+	username := flags.String("username", "", "owner of the token")
+	name := flags.String("name", "", "token name")
+	quota := flags.Int("quota", 0, "remain quota")
+	unlimited := flags.Bool("unlimited", false, "unlimited quota")
+	expiredTime := flags.Int64("expired-time", -1, "expiry unix timestamp, -1 never expires")
+	models := flags.String("models", "", "comma separated models the token may use, all by default")
+	if err := flags.Parse(args); err != nil {
+		return "", nil, err
+	}
+	user := model.User{Username: *username}
+	if *username == "" || user.FillUserByUsername() != nil || user.Id == 0 {
+		return "", nil, errors.New("用户不存在")
+	}
+	token, err := newUserToken(user.Id, &model.Token{
+		Name:           *name,
+		ExpiredTime:    *expiredTime,
+		RemainQuota:    *quota,
+		UnlimitedQuota: *unlimited,
+		Models:         *models,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if err := token.Insert(); err != nil {
+		return "", nil, err
+	}
+	data := map[string]any{
+		"id":  token.Id,
+		"key": "sk-" + token.Key,
+	}
+	return "sk-" + token.Key, data, nil
+}
+
+func adminSetOption(flags *flag.FlagSet, args []string) (string, any, error) {
+	key := flags.String("key", "", "option key")
+	value := flags.String("value", "", "option value")
+	if err := flags.Parse(args); err != nil {
+		return "", nil, err
+	}
+	common.OptionMapRWMutex.RLock()
+	_, ok := common.OptionMap[*key]
+	common.OptionMapRWMutex.RUnlock()
+	if !ok {
+		return "", nil, errors.New("未知的配置项 " + *key)
+	}
+	if err := validateOption(*key, *value); err != nil {
+		return "", nil, err
+	}
+	if err := model.UpdateOption(*key, *value); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("set option %s", *key), nil, nil
+}
@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"bytes"
+	"one-api/common"
+	"one-api/model"
+	"strings"
+	"testing"
+)
+
+func TestAdminCreateUser(t *testing.T) {
+	var stdout bytes.Buffer
+	code := RunAdminCommand([]string{"user", "create", "--json", "--username", "cliadmin", "--password", "12345678", "--role", "admin", "--quota", "500"}, &stdout)
+	if code != 0 || !strings.Contains(stdout.String(), `"success":true`) {
+		t.Fatalf("exit code %d: %s", code, stdout.String())
+	}
+	var user model.User
+	if err := model.DB.Where("username = ?", "cliadmin").First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != common.RoleAdminUser || user.Quota != 500 {
+		t.Errorf("created role %d with quota %d", user.Role, user.Quota)
+	}
+	// the failed creation leaves nothing behind
+	stdout.Reset()
+	if code = RunAdminCommand([]string{"user", "create", "--username", "cliadmin", "--password", "12345678", "--role", "root"}, &stdout); code == 0 {
+		t.Fatal("created a duplicate user")
+	}
+	var count int64
+	model.DB.Model(&model.User{}).Where("username = ?", "cliadmin").Count(&count)
+	if count != 1 {
+		t.Errorf("%d users named cliadmin", count)
+	}
+}
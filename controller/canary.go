@@ -0,0 +1,300 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type canaryRequest struct {
+	ChatRequest
+	Stream bool `json:"stream"`
+}
+
+// runCanary sends a tiny streaming completion to the canary's channel and records
+// success, latency and first token time. The outcome feeds the adaptive channel weight
+// like relayed requests do. Canary traffic is never billed to a user, but the consumed
+// quota is attributed to the channel.
+func runCanary(canary *model.Canary) {
+	result := &model.CanaryResult{
+		CanaryId:  canary.Id,
+		ChannelId: canary.ChannelId,
+		Model:     canary.Model,
+	}
+	defer model.RecordCanaryResult(result)
+	channel, err := model.GetChannelById(canary.ChannelId, true)
+	if err != nil {
+		result.Message = err.Error()
+		return
+	}
+	prompt := canary.Prompt
+	if prompt == "" {
+		prompt = "hi"
+	}
+	request := canaryRequest{
+		ChatRequest: ChatRequest{
+			Model:     canary.Model,
+			Messages:  []Message{{Role: "user", Content: prompt}},
+			MaxTokens: 1,
+		},
+		Stream: true,
+	}
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		result.Message = err.Error()
+		return
+	}
+	req, err := http.NewRequest("POST", getTestRequestURL(channel, canary.Model), bytes.NewBuffer(jsonData))
+	if err != nil {
+		result.Message = err.Error()
+		return
+	}
+	if channel.Type == common.ChannelTypeAzure {
+		req.Header.Set("api-key", channel.Key)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+channel.Key)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	applyChannelAuth(req, channel.GetAuthType(), channel.GetAuthParam(), channel.Key)
+	err = applyChannelHeaders(req, channel.GetHeaders(), channel.Key)
+	if err != nil {
+		result.Message = err.Error()
+		return
+	}
+	client, err := getChannelHTTPClient(channel)
+	if err != nil {
+		result.Message = err.Error()
+		return
+	}
+	tik := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Message = err.Error()
+		model.RecordChannelError(channel.Id, http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		openaiErr := relayErrorHandler(resp)
+		result.Message = fmt.Sprintf("status code %d, message %s", openaiErr.StatusCode, openaiErr.Message)
+		model.RecordChannelError(channel.Id, openaiErr.StatusCode)
+		if shouldDisableChannel(&openaiErr.OpenAIError, openaiErr.StatusCode) {
+			disableChannel(channel.Id, channel.Name, openaiErr.Message)
+		}
+		return
+	}
+	responseText := ""
+	received := false
+	repairer := &streamRepairer{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := repairer.feed(scanner.Text())
+		if !ok {
+			continue
+		}
+		if !received {
+			received = true
+			result.FirstTokenTime = int(time.Since(tik).Milliseconds())
+		}
+		if strings.HasPrefix(data, "[DONE]") {
+			break
+		}
+		var streamResponse ChatCompletionsStreamResponse
+		if err := json.Unmarshal([]byte(data), &streamResponse); err != nil {
+			continue
+		}
+		for _, choice := range streamResponse.Choices {
+			responseText += choice.Delta.Content
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		result.Message = err.Error()
+		model.RecordChannelError(channel.Id, http.StatusInternalServerError)
+		return
+	}
+	milliseconds := time.Since(tik).Milliseconds()
+	result.Latency = int(milliseconds)
+	result.Success = received
+	if result.Success {
+		model.RecordChannelSuccess(channel.Id)
+	} else {
+		result.Message = "no data received from upstream"
+		model.RecordChannelError(channel.Id, http.StatusInternalServerError)
+	}
+	channel.UpdateResponseTime(milliseconds)
+
+	approximate := !canary.AccurateCount && common.IsApproximateTokenModel(canary.Model, "")
+	promptTokens := countTokenMessages(request.Messages, canary.Model, approximate)
+	completionTokens := countTokenText(responseText, canary.Model, approximate)
+	quota := getTextQuota(canary.Model, promptTokens, completionTokens, common.GetModelRatio(canary.Model), 1)
+	if quota > 0 {
+		model.UpdateChannelUsedQuota(channel.Id, quota)
+	}
+}
+
+func AutomaticallyRunCanaries() {
+	for {
+		time.Sleep(time.Minute)
+		canaries, err := model.GetEnabledCanaries()
+		if err != nil {
+			common.SysError("failed to get canaries: " + err.Error())
+			continue
+		}
+		now := common.GetTimestamp()
+		for _, canary := range canaries {
+			if now-canary.LastRunTime < int64(canary.Interval)*60 {
+				continue
+			}
+			canary.UpdateLastRunTime(now)
+			go runCanary(canary)
+		}
+	}
+}
+
+func validateCanary(canary *model.Canary) error {
+	if canary.Model == "" {
+		return errors.New("模型不能为空")
+	}
+	if canary.Interval <= 0 {
+		return errors.New("间隔必须大于 0")
+	}
+	if _, err := model.GetChannelById(canary.ChannelId, false); err != nil {
+		return errors.New("无效的渠道 Id")
+	}
+	return nil
+}
+
+func GetAllCanaries(c *gin.Context) {
+	canaries, err := model.GetAllCanaries()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    canaries,
+	})
+	return
+}
+
+func AddCanary(c *gin.Context) {
+	canary := model.Canary{}
+	err := c.ShouldBindJSON(&canary)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if err := validateCanary(&canary); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	canary.Id = 0
+	canary.CreatedTime = common.GetTimestamp()
+	canary.LastRunTime = 0
+	err = canary.Insert()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    canary,
+	})
+	return
+}
+
+func UpdateCanary(c *gin.Context) {
+	canary := model.Canary{}
+	err := c.ShouldBindJSON(&canary)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if err := validateCanary(&canary); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	err = canary.Update()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    canary,
+	})
+	return
+}
+
+func DeleteCanary(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	canary := model.Canary{Id: id}
+	err := canary.Delete()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+	return
+}
+
+func GetCanarySummary(c *gin.Context) {
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	if startTimestamp == 0 {
+		startTimestamp = common.GetTimestamp() - 24*60*60
+	}
+	summaries, err := model.GetCanarySummaries(startTimestamp)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    summaries,
+	})
+	return
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/model"
+	"testing"
+)
+
+func TestRunCanary(t *testing.T) {
+	defer func(approximate bool) { common.ApproximateTokenEnabled = approximate }(common.ApproximateTokenEnabled)
+	defer func(enabled bool) { common.ChannelWeightDecayEnabled = enabled }(common.ChannelWeightDecayEnabled)
+	defer func(ratios map[string]common.IORatio) { common.ModelIORatio = ratios }(common.ModelIORatio)
+	common.ApproximateTokenEnabled = true
+	common.ChannelWeightDecayEnabled = true
+	// priced like relayed requests, the model ratio of gpt-4o-mini alone rounds to a few quota
+	common.ModelIORatio = map[string]common.IORatio{"gpt-4o-mini": {Input: 100, Output: 100}}
+	var failing bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, `{"error":{"message":"overloaded","type":"server_error"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"id\":\"1\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hello\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	channel := createTestChannel(t, "canary", upstream.URL)
+	canary := &model.Canary{ChannelId: channel.Id, Model: "gpt-4o-mini", Interval: 10, Status: common.CanaryStatusEnabled}
+	if err := canary.Insert(); err != nil {
+		t.Fatal(err)
+	}
+
+	runCanary(canary)
+	var result model.CanaryResult
+	model.DB.Where("canary_id = ?", canary.Id).Last(&result)
+	if !result.Success || result.ChannelId != channel.Id || result.Message != "" {
+		t.Errorf("successful canary recorded as %+v", result)
+	}
+	// the quota goes to the channel, no user is billed for it
+	updated, _ := model.GetChannelById(channel.Id, false)
+	if updated.UsedQuota < 100 {
+		t.Errorf("channel used quota %d", updated.UsedQuota)
+	}
+	var logs int64
+	model.DB.Model(&model.Log{}).Where("channel_id = ?", channel.Id).Count(&logs)
+	if logs != 0 {
+		t.Errorf("canary left %d logs", logs)
+	}
+
+	failing = true
+	runCanary(canary)
+	result = model.CanaryResult{}
+	model.DB.Where("canary_id = ?", canary.Id).Last(&result)
+	if result.Success || result.Message == "" {
+		t.Errorf("failed canary recorded as %+v", result)
+	}
+	// the failure moves relayed traffic away from the channel, the next success brings it back
+	failedScale := model.GetChannelWeightScale(channel.Id)
+	if failedScale >= 1 {
+		t.Errorf("weight scale %v after a failed canary", failedScale)
+	}
+	failing = false
+	runCanary(canary)
+	if scale := model.GetChannelWeightScale(channel.Id); scale <= failedScale {
+		t.Errorf("weight scale %v after a successful canary, %v before", scale, failedScale)
+	}
+
+	summaries, err := model.GetCanarySummaries(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, summary := range summaries {
+		if summary.ChannelId == channel.Id && summary.Model == "gpt-4o-mini" {
+			found = true
+			if summary.Total != 3 || summary.SuccessCount != 2 {
+				t.Errorf("summary %+v", summary)
+			}
+		}
+	}
+	if !found {
+		t.Error("no summary for the canary")
+	}
+}
@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+)
+
+const (
+	channelAuthTypeBearer = "bearer"
+	channelAuthTypeHeader = "header"
+	channelAuthTypeQuery  = "query"
+)
+
+func validateChannelAuth(authType string, authParam string) error {
+	switch authType {
+	case "", channelAuthTypeBearer:
+		return nil
+	case channelAuthTypeHeader, channelAuthTypeQuery:
+		if authParam == "" {
+			return errors.New("请填写鉴权请求头或查询参数名称")
+		}
+		if authType == channelAuthTypeHeader && reservedChannelHeaders[http.CanonicalHeaderKey(authParam)] {
+			return errors.New("不允许设置请求头 " + authParam)
+		}
+		return nil
+	default:
+		return errors.New("无效的鉴权方式")
+	}
+}
+
+// applyChannelAuth moves the channel key into a custom header or query parameter when the channel asks for it,
+// otherwise the headers already set by the request builder are kept
+func applyChannelAuth(req *http.Request, authType string, authParam string, key string) {
+	switch authType {
+	case channelAuthTypeHeader:
+		req.Header.Del("Authorization")
+		req.Header.Del("api-key")
+		req.Header.Set(authParam, key)
+	case channelAuthTypeQuery:
+		req.Header.Del("Authorization")
+		req.Header.Del("api-key")
+		query := req.URL.Query()
+		query.Set(authParam, key)
+		req.URL.RawQuery = query.Encode()
+	}
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"one-api/common"
+	"one-api/model"
+	"strings"
+	"time"
+)
+
+const baseURLProbeTimeout = 5 * time.Second
+
+// appendsV1Path tells whether the relay appends a path starting with /v1 to the base_url of the channel type,
+// the other types append their own paths or ignore the base_url
+func appendsV1Path(channelType int) bool {
+	switch channelType {
+	case common.ChannelTypeAzure, common.ChannelTypePaLM, common.ChannelTypeAIProxyLibrary, common.ChannelTypeBaidu,
+		common.ChannelTypeZhipu, common.ChannelTypeAli, common.ChannelTypeXunfei, common.ChannelTypeTencent:
+		return false
+	}
+	return true
+}
+
+// normalizeChannelBaseURL trims the trailing slashes of a base_url, and its /v1 when the request path
+// already starts with /v1 and keeping it produces https://host/v1/v1/chat/completions
+func normalizeChannelBaseURL(channel *model.Channel) error {
+	if channel.BaseURL == nil {
+		return nil
+	}
+	baseURL := strings.TrimRight(strings.TrimSpace(*channel.BaseURL), "/")
+	for appendsV1Path(channel.Type) && strings.HasSuffix(baseURL, "/v1") {
+		baseURL = strings.TrimRight(strings.TrimSuffix(baseURL, "/v1"), "/")
+	}
+	*channel.BaseURL = baseURL
+	if baseURL == "" {
+		return nil
+	}
+	parsedURL, err := url.Parse(baseURL)
+	if err != nil || parsedURL.Host == "" || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return errors.New("代理地址必须是以 http:// 或 https:// 开头的有效地址")
+	}
+	return nil
+}
+
+// probeChannelBaseURL checks that the base_url answers HTTP requests, any status code counts as reachable
+func probeChannelBaseURL(channel *model.Channel) error {
+	baseURL := channel.GetBaseURL()
+	if baseURL == "" {
+		return nil
+	}
+	client, err := getChannelHTTPClient(channel)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), baseURLProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("代理地址无法访问：%s", err.Error())
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// joinRequestURL collapses the /v1 repeated where the base url and the request path meet,
+// e.g. a base url saved before validation existed with a trailing /v1
+func joinRequestURL(baseURL string, requestURL string) string {
+	baseURL = strings.TrimRight(baseURL, "/")
+	if strings.HasSuffix(baseURL, "/v1") && (requestURL == "/v1" || strings.HasPrefix(requestURL, "/v1/") || strings.HasPrefix(requestURL, "/v1?")) {
+		return strings.TrimSuffix(baseURL, "/v1") + requestURL
+	}
+	return baseURL + requestURL
+}
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"one-api/common"
+	"one-api/model"
+	"testing"
+)
+
+func TestNormalizeChannelBaseURL(t *testing.T) {
+	for _, test := range []struct {
+		channelType int
+		baseURL     string
+		want        string
+	}{
+		{common.ChannelTypeOpenAI, "https://api.example.com/", "https://api.example.com"},
+		{common.ChannelTypeOpenAI, " https://api.example.com/v1/ ", "https://api.example.com"},
+		{common.ChannelTypeOpenAI, "https://api.example.com/v1/v1", "https://api.example.com"},
+		{common.ChannelTypeCustom, "https://proxy.example.com/openai/v1", "https://proxy.example.com/openai"},
+		{common.ChannelTypeAnthropic, "https://claude.example.com/v1", "https://claude.example.com"},
+		{common.ChannelTypeAzure, "https://azure.example.com/v1/", "https://azure.example.com/v1"},
+		{common.ChannelTypePaLM, "https://palm.example.com/v1", "https://palm.example.com/v1"},
+		{common.ChannelTypeOpenAI, "https://api.example.com/v10", "https://api.example.com/v10"},
+		{common.ChannelTypeOpenAI, "", ""},
+	} {
+		baseURL := test.baseURL
+		channel := &model.Channel{Type: test.channelType, BaseURL: &baseURL}
+		if err := normalizeChannelBaseURL(channel); err != nil || *channel.BaseURL != test.want {
+			t.Errorf("type %d base_url %q normalized to %q, %v, want %q", test.channelType, test.baseURL, *channel.BaseURL, err, test.want)
+		}
+	}
+	for _, baseURL := range []string{"api.example.com", "ftp://api.example.com", "https://"} {
+		channel := &model.Channel{Type: common.ChannelTypeOpenAI, BaseURL: &baseURL}
+		if err := normalizeChannelBaseURL(channel); err == nil {
+			t.Errorf("invalid base_url %q accepted", baseURL)
+		}
+	}
+}
+
+func TestJoinRequestURL(t *testing.T) {
+	for _, test := range []struct {
+		baseURL    string
+		requestURL string
+		want       string
+	}{
+		{"https://api.example.com", "/v1/chat/completions", "https://api.example.com/v1/chat/completions"},
+		{"https://api.example.com/", "/v1/chat/completions", "https://api.example.com/v1/chat/completions"},
+		{"https://api.example.com/v1", "/v1/chat/completions", "https://api.example.com/v1/chat/completions"},
+		{"https://api.example.com/v1/", "/v1/models?limit=1", "https://api.example.com/v1/models?limit=1"},
+		{"https://api.example.com/chat", "/chat/completions", "https://api.example.com/chat/chat/completions"},
+		{"https://api.example.com/openai", "/openai/files", "https://api.example.com/openai/openai/files"},
+		{"https://api.example.com/v1", "/v1beta/models", "https://api.example.com/v1/v1beta/models"},
+	} {
+		if got := joinRequestURL(test.baseURL, test.requestURL); got != test.want {
+			t.Errorf("%q + %q joined to %q, want %q", test.baseURL, test.requestURL, got, test.want)
+		}
+	}
+}
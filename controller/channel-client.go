@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"sync"
+	"time"
+)
+
+type channelHTTPClient struct {
+	fingerprint string
+	client      *http.Client
+}
+
+// channelHTTPClients caches the clients of channels with custom TLS settings, keyed by channel id
+var channelHTTPClients = map[int]*channelHTTPClient{}
+var channelHTTPClientsLock sync.Mutex
+
+func getChannelTLSFingerprint(channel *model.Channel) string {
+	return fmt.Sprintf("%s|%s|%s|%t", channel.GetTLSCACert(), channel.GetTLSClientCert(), channel.GetTLSClientKey(), channel.GetTLSInsecure())
+}
+
+func validateChannelTLS(channel *model.Channel) error {
+	_, err := common.BuildTLSConfig(channel.GetTLSCACert(), channel.GetTLSClientCert(), channel.GetTLSClientKey(), channel.GetTLSInsecure())
+	return err
+}
+
+func getChannelHTTPClient(channel *model.Channel) (*http.Client, error) {
+	if !channel.HasCustomTLS() {
+		return httpClient, nil
+	}
+	fingerprint := getChannelTLSFingerprint(channel)
+	channelHTTPClientsLock.Lock()
+	defer channelHTTPClientsLock.Unlock()
+	if cached, ok := channelHTTPClients[channel.Id]; ok && cached.fingerprint == fingerprint {
+		return cached.client, nil
+	}
+	tlsConfig, err := common.BuildTLSConfig(channel.GetTLSCACert(), channel.GetTLSClientCert(), channel.GetTLSClientKey(), channel.GetTLSInsecure())
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.InsecureSkipVerify {
+		common.SysError(fmt.Sprintf("WARNING: TLS certificate verification is disabled for channel #%d (%s)", channel.Id, channel.Name))
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   httpClient.Timeout,
+	}
+	channelHTTPClients[channel.Id] = &channelHTTPClient{
+		fingerprint: fingerprint,
+		client:      client,
+	}
+	return client, nil
+}
+
+// getRelayTimeout picks the upstream timeout, the channel timeout wins over the model timeout,
+// which wins over the global RelayTimeout. 0 means no timeout.
+func getRelayTimeout(channelTimeout int, modelName string) time.Duration {
+	if channelTimeout > 0 {
+		return time.Duration(channelTimeout) * time.Second
+	}
+	if modelTimeout := common.ModelTimeouts[modelName]; modelTimeout > 0 {
+		return time.Duration(modelTimeout) * time.Second
+	}
+	return time.Duration(common.RelayTimeout) * time.Second
+}
+
+// getRelayHTTPClient returns the client of the channel selected by the distributor.
+func getRelayHTTPClient(c *gin.Context) (*http.Client, error) {
+	client := httpClient
+	if channel, ok := c.Get("tls_channel"); ok {
+		var err error
+		client, err = getChannelHTTPClient(channel.(*model.Channel))
+		if err != nil {
+			return nil, err
+		}
+	}
+	timeout := getRelayTimeout(c.GetInt("channel_timeout"), c.GetString("request_model"))
+	if timeout != client.Timeout {
+		// the copy shares the transport, and with it the connection pool
+		clientWithTimeout := *client
+		clientWithTimeout.Timeout = timeout
+		client = &clientWithTimeout
+	}
+	return client, nil
+}
+
+func isTLSError(err error) bool {
+	var recordHeaderError tls.RecordHeaderError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var certificateInvalidError x509.CertificateInvalidError
+	var hostnameError x509.HostnameError
+	return errors.As(err, &recordHeaderError) ||
+		errors.As(err, &unknownAuthorityError) ||
+		errors.As(err, &certificateInvalidError) ||
+		errors.As(err, &hostnameError)
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/model"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTLSTestChannel is never saved, the id only keys the client cache
+func newTLSTestChannel(id int, server *httptest.Server) *model.Channel {
+	baseURL := server.URL
+	return &model.Channel{Id: id, Type: common.ChannelTypeOpenAI, Key: "sk-test", BaseURL: &baseURL}
+}
+
+func certificatePEM(certificate *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+}
+
+func TestChannelTLSSettings(t *testing.T) {
+	var clientCertificates int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCertificates = len(r.TLS.PeerCertificates)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+	caCert := certificatePEM(server.Certificate())
+
+	// the system roots do not know the test CA, the handshake error is reported as such
+	channel := newTLSTestChannel(1000001, server)
+	if err, _ := testChannel(channel, *buildTestRequest()); err == nil || !strings.Contains(err.Error(), "TLS 握手失败") {
+		t.Errorf("unknown CA reported as %v", err)
+	}
+
+	channel.TLSCACert = &caCert
+	if err := validateChannelTLS(channel); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := testChannel(channel, *buildTestRequest()); err != nil {
+		t.Errorf("custom CA not trusted: %v", err)
+	}
+	client, _ := getChannelHTTPClient(channel)
+	if cached, _ := getChannelHTTPClient(channel); cached != client {
+		t.Error("the client of the channel is not cached")
+	}
+
+	// the test server certificate doubles as client certificate
+	key, err := x509.MarshalPKCS8PrivateKey(server.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}))
+	channel.TLSClientCert, channel.TLSClientKey = &caCert, &clientKey
+	if updated, _ := getChannelHTTPClient(channel); updated == client {
+		t.Error("the cached client survived a change of the TLS settings")
+	}
+	if err, _ := testChannel(channel, *buildTestRequest()); err != nil || clientCertificates != 1 {
+		t.Errorf("client certificate not sent: %v, %d certificates", err, clientCertificates)
+	}
+
+	insecure := true
+	insecureChannel := newTLSTestChannel(1000002, server)
+	insecureChannel.TLSInsecure = &insecure
+	if err, _ := testChannel(insecureChannel, *buildTestRequest()); err != nil {
+		t.Errorf("insecure_skip_verify not applied: %v", err)
+	}
+
+	invalid := "-----BEGIN CERTIFICATE-----\nnot a certificate\n-----END CERTIFICATE-----\n"
+	if err := validateChannelTLS(&model.Channel{TLSCACert: &invalid}); err == nil {
+		t.Error("invalid CA bundle accepted")
+	}
+	if err := validateChannelTLS(&model.Channel{TLSClientCert: &caCert}); err == nil {
+		t.Error("client certificate without its key accepted")
+	}
+}
+
+func TestRelayTimeoutPrecedence(t *testing.T) {
+	defer func(global int, models map[string]int) { common.RelayTimeout, common.ModelTimeouts = global, models }(common.RelayTimeout, common.ModelTimeouts)
+	common.RelayTimeout = 30
+	common.ModelTimeouts = map[string]int{"slow-model": 120}
+	for _, tc := range []struct {
+		channelTimeout int
+		model          string
+		want           time.Duration
+	}{
+		{300, "slow-model", 300 * time.Second},
+		{0, "slow-model", 120 * time.Second},
+		{0, "fast-model", 30 * time.Second},
+		{300, "fast-model", 300 * time.Second},
+	} {
+		if got := getRelayTimeout(tc.channelTimeout, tc.model); got != tc.want {
+			t.Errorf("channel %ds, model %s: got %s, want %s", tc.channelTimeout, tc.model, got, tc.want)
+		}
+	}
+
+	// the relay client carries the timeout, the shared client is left untouched
+	c, _ := newTestContext(http.MethodPost, "/v1/chat/completions", "")
+	c.Set("channel_timeout", 300)
+	c.Set("request_model", "slow-model")
+	client, err := getRelayHTTPClient(c)
+	if err != nil || client.Timeout != 300*time.Second || client == httpClient {
+		t.Errorf("relay client timeout %s, err %v", client.Timeout, err)
+	}
+}
+
+func TestChannelTimeoutAppliedToRelay(t *testing.T) {
+	defer func(global int, models map[string]int) { common.RelayTimeout, common.ModelTimeouts = global, models }(common.RelayTimeout, common.ModelTimeouts)
+	common.RelayTimeout = 60
+	common.ModelTimeouts = map[string]int{"channel-timeout-model": 60}
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+	channel := createTestRelayChannel(t, upstream.URL, "channel-timeout-model")
+	model.DB.Model(channel).Update("timeout", 1)
+	token := createTestToken(t, createTestUser(t, "channel-timeout", 1000000).Id, "channel-timeout")
+	start := time.Now()
+	recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"channel-timeout-model","messages":[{"role":"user","content":"hi"}]}`)
+	if elapsed := time.Since(start); recorder.Code == http.StatusOK || elapsed < time.Second || elapsed > 5*time.Second {
+		t.Errorf("got %d after %s: %s", recorder.Code, elapsed, recorder.Body.String())
+	}
+}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"encoding/csv"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+	"time"
+)
+
+var channelDailyUsageCSVHeader = []string{"date", "channel_id", "requests", "quota"}
+
+// GetChannelDailyUsages returns the per-day quota consumed by channels between start_timestamp and end_timestamp
+// (the last 30 days by default), optionally for a single channel_id, as CSV when format=csv
+func GetChannelDailyUsages(c *gin.Context) {
+	channelId, _ := strconv.Atoi(c.Query("channel_id"))
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	if startTimestamp == 0 {
+		startTimestamp = common.GetTimestamp() - 30*24*3600
+	}
+	usages, err := model.GetChannelDailyUsages(channelId, startTimestamp, endTimestamp)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if c.Query("format") == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", "attachment; filename=channel-usage.csv")
+		writer := csv.NewWriter(c.Writer)
+		_ = writer.Write(channelDailyUsageCSVHeader)
+		for _, usage := range usages {
+			_ = writer.Write([]string{
+				time.Unix(usage.Day, 0).UTC().Format("2006-01-02"),
+				strconv.Itoa(usage.ChannelId),
+				strconv.Itoa(usage.Requests),
+				strconv.FormatInt(usage.Quota, 10),
+			})
+		}
+		writer.Flush()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    usages,
+	})
+	return
+}
+
+// BackfillChannelDailyUsages rebuilds the daily rollups from the consume logs, meant to be run once
+// for the history recorded before the rollup existed
+func BackfillChannelDailyUsages(c *gin.Context) {
+	var req struct {
+		StartTimestamp int64 `json:"start_timestamp"`
+		EndTimestamp   int64 `json:"end_timestamp"`
+	}
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	count, err := model.BackfillChannelDailyUsages(req.StartTimestamp, req.EndTimestamp)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    count,
+	})
+	return
+}
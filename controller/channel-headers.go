@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"one-api/common"
+	"strings"
+)
+
+// channelKeyPlaceholder in a custom header value is replaced with the channel key
+const channelKeyPlaceholder = "{key}"
+
+// reservedChannelHeaders are managed by the http client and must not be overridden
+var reservedChannelHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+}
+
+// blockedForwardedHeaders carry credentials, they are set by us and never taken from the client
+var blockedForwardedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Api-Key":             true,
+	"X-Api-Key":           true,
+	"Cookie":              true,
+}
+
+// applyForwardedHeaders copies the allowed client request headers, headers already set on the request win
+func applyForwardedHeaders(req *http.Request, clientHeader http.Header, channelType int) {
+	for _, name := range common.GetForwardedRequestHeaders(channelType) {
+		name = http.CanonicalHeaderKey(name)
+		if blockedForwardedHeaders[name] || reservedChannelHeaders[name] || name == http.CanonicalHeaderKey(common.TokenHeaderName) {
+			continue
+		}
+		if req.Header.Get(name) != "" {
+			continue
+		}
+		if values := clientHeader.Values(name); len(values) > 0 {
+			req.Header[name] = append([]string(nil), values...)
+		}
+	}
+}
+
+func parseChannelHeaders(headers string) (map[string]string, error) {
+	headerMap := make(map[string]string)
+	if headers == "" || headers == "{}" {
+		return headerMap, nil
+	}
+	err := json.Unmarshal([]byte(headers), &headerMap)
+	return headerMap, err
+}
+
+func validateChannelHeaders(headers string) error {
+	headerMap, err := parseChannelHeaders(headers)
+	if err != nil {
+		return fmt.Errorf("自定义请求头必须是 JSON 对象：%s", err.Error())
+	}
+	for key := range headerMap {
+		if reservedChannelHeaders[http.CanonicalHeaderKey(key)] {
+			return fmt.Errorf("不允许设置请求头 %s", key)
+		}
+	}
+	return nil
+}
+
+// applyChannelHeaders injects the channel's custom headers into an upstream request
+func applyChannelHeaders(req *http.Request, headers string, key string) error {
+	headerMap, err := parseChannelHeaders(headers)
+	if err != nil {
+		return err
+	}
+	for name, value := range headerMap {
+		if reservedChannelHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		req.Header.Set(name, strings.ReplaceAll(value, channelKeyPlaceholder, key))
+	}
+	return nil
+}
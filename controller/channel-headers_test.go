@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestApplyForwardedHeaders(t *testing.T) {
+	defer func(headers string, overrides map[string]string) {
+		common.ForwardedRequestHeaders, common.ChannelTypeForwardedRequestHeaders = headers, overrides
+	}(common.ForwardedRequestHeaders, common.ChannelTypeForwardedRequestHeaders)
+
+	clientHeader := http.Header{}
+	clientHeader.Set("OpenAI-Beta", "assistants=v2")
+	clientHeader.Set("OpenAI-Organization", "org-other")
+	clientHeader.Set("X-Custom", "custom")
+	clientHeader.Set("Authorization", "Bearer sk-client")
+
+	req, _ := http.NewRequest(http.MethodPost, "https://api.openai.com/v1/chat/completions", nil)
+	applyForwardedHeaders(req, clientHeader, common.ChannelTypeOpenAI)
+	if req.Header.Get("OpenAI-Beta") != "assistants=v2" {
+		t.Error("OpenAI-Beta did not reach the upstream")
+	}
+	if req.Header.Get("OpenAI-Organization") != "" || req.Header.Get("X-Custom") != "" {
+		t.Error("header outside the default allowlist forwarded")
+	}
+
+	common.ForwardedRequestHeaders = "OpenAI-Beta,OpenAI-Organization,Authorization"
+	common.ChannelTypeForwardedRequestHeaders = map[string]string{"14": "X-Custom"}
+	req, _ = http.NewRequest(http.MethodPost, "https://api.openai.com/v1/chat/completions", nil)
+	req.Header.Set("Authorization", "Bearer sk-channel")
+	applyForwardedHeaders(req, clientHeader, common.ChannelTypeOpenAI)
+	if req.Header.Get("OpenAI-Organization") != "org-other" {
+		t.Error("opted in OpenAI-Organization not forwarded")
+	}
+	if req.Header.Get("Authorization") != "Bearer sk-channel" {
+		t.Error("client Authorization overrode the channel key")
+	}
+	req, _ = http.NewRequest(http.MethodPost, "https://api.anthropic.com/v1/messages", nil)
+	applyForwardedHeaders(req, clientHeader, common.ChannelTypeAnthropic)
+	if req.Header.Get("X-Custom") != "custom" || req.Header.Get("OpenAI-Beta") != "" {
+		t.Error("channel type override not applied")
+	}
+}
+
+func TestApplyChannelHeaders(t *testing.T) {
+	if err := validateChannelHeaders(`{"host":"evil.example.com"}`); err == nil {
+		t.Error("reserved header accepted")
+	}
+	if err := validateChannelHeaders(`["X-Org-Id"]`); err == nil {
+		t.Error("headers that are not an object accepted")
+	}
+	req, _ := http.NewRequest(http.MethodPost, "https://gateway.example.com/v1/chat/completions", nil)
+	err := applyChannelHeaders(req, `{"X-Org-Id":"org-1","CF-Access-Client-Secret":"secret-{key}"}`, "sk-channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("X-Org-Id") != "org-1" || req.Header.Get("CF-Access-Client-Secret") != "secret-sk-channel" {
+		t.Errorf("headers not injected: %v", req.Header)
+	}
+}
+
+func TestChannelHeadersNotReturned(t *testing.T) {
+	channel := createTestChannel(t, "gateway", "http://127.0.0.1")
+	headers := `{"CF-Access-Client-Secret":"secret"}`
+	if err := model.DB.Model(channel).Update("headers", headers).Error; err != nil {
+		t.Fatal(err)
+	}
+	id := strconv.Itoa(channel.Id)
+	for name, handler := range map[string]func(*gin.Context){"get": GetChannel, "list": GetAllChannels, "search": SearchChannels} {
+		c, recorder := newTestContext(http.MethodGet, "/api/channel/"+id+"?keyword="+id, "")
+		c.Params = gin.Params{{Key: "id", Value: id}}
+		handler(c)
+		if strings.Contains(recorder.Body.String(), "secret") {
+			t.Errorf("%s endpoint returned the headers: %s", name, recorder.Body.String())
+		}
+	}
+	// the frontend never has the headers, saving the channel keeps them
+	c, _ := newTestContext(http.MethodPut, "/api/channel/", `{"id":`+id+`,"name":"gateway renamed","models":"gpt-4o-mini","group":"default"}`)
+	UpdateChannel(c)
+	saved, err := model.GetChannelById(channel.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Name != "gateway renamed" || saved.GetHeaders() != headers {
+		t.Errorf("update lost the headers: %+v", saved)
+	}
+}
+
+func TestForwardedHeadersReachUpstream(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "forwarded-headers-model")
+	token := createTestToken(t, createTestUser(t, "forwarded-headers", 1000000).Id, "forwarded-headers")
+	header := http.Header{}
+	header.Set("OpenAI-Beta", "assistants=v2")
+	header.Set("OpenAI-Organization", "org-other")
+	header.Set("X-Custom", "custom")
+	recorder := serveRelayWithHeader(t, token, "/v1/chat/completions", `{"model":"forwarded-headers-model","messages":[{"role":"user","content":"hi"}]}`, header)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if upstreamHeader.Get("OpenAI-Beta") != "assistants=v2" {
+		t.Error("OpenAI-Beta did not reach the upstream")
+	}
+	if upstreamHeader.Get("OpenAI-Organization") != "" || upstreamHeader.Get("X-Custom") != "" {
+		t.Errorf("disallowed headers reached the upstream: %v", upstreamHeader)
+	}
+	if upstreamHeader.Get("Authorization") != "Bearer sk-test" {
+		t.Errorf("upstream got Authorization %q", upstreamHeader.Get("Authorization"))
+	}
+}
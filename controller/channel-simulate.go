@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+)
+
+// channelSimulationRequest is either given as query parameters or as a sample relay request body,
+// the fields of the relay request other than model and service_tier are ignored
+type channelSimulationRequest struct {
+	Model       string `json:"model" form:"model"`
+	Group       string `json:"group" form:"group"`
+	TokenId     int    `json:"token_id" form:"token_id"`
+	ServiceTier string `json:"service_tier" form:"service_tier"`
+	AppTag      string `json:"app_tag" form:"app_tag"` // recorded in the trace like in the logs, the app tag header is used when empty
+}
+
+// SimulateChannelSelection explains which channel a request would be relayed to, without relaying it.
+// The group comes from token_id when given, so that the token's model list, the user affinity and the
+// quota based downgrade apply, the selection itself is model.SelectChannel, the one of Distribute.
+func SimulateChannelSelection(c *gin.Context) {
+	request := channelSimulationRequest{}
+	var err error
+	if c.Request.Method == http.MethodPost {
+		err = c.ShouldBindJSON(&request)
+	} else {
+		err = c.ShouldBindQuery(&request)
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "无效的参数",
+		})
+		return
+	}
+	modelName := request.Model
+	group := request.Group
+	serviceTier := request.ServiceTier
+	userId := 0
+	if modelName == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "模型不能为空",
+		})
+		return
+	}
+	switch serviceTier {
+	case "", common.ServiceTierAuto, common.ServiceTierDefault:
+		serviceTier = common.ServiceTierDefault
+	case common.ServiceTierFlex:
+	default:
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "无效的服务等级",
+		})
+		return
+	}
+	tokenModels := ""
+	if request.TokenId != 0 {
+		token, err := model.GetTenantTokenById(request.TokenId, getTenantId(c))
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		group, err = model.CacheGetUserGroup(token.UserId)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		userId = token.UserId
+		tokenModels = token.Models
+		if !common.IsModelInList(tokenModels, modelName) {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": fmt.Sprintf("该令牌无权使用模型 %s", modelName),
+			})
+			return
+		}
+	}
+	if group == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "令牌 Id 与分组不能同时为空",
+		})
+		return
+	}
+	appTag := request.AppTag
+	if appTag == "" {
+		appTag = c.Request.Header.Get(common.AppTagHeader)
+	}
+	trace, err := model.SimulateChannelSelection(&model.ChannelSelectionRequest{
+		Group:       group,
+		Model:       modelName,
+		UserId:      userId,
+		ServiceTier: serviceTier,
+		TokenModels: tokenModels,
+	}, appTag)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    trace,
+	})
+}
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestSimulateChannelSelectionSkipsCooledDownChannels(t *testing.T) {
+	defer func(enabled bool, decay bool) {
+		common.MemoryCacheEnabled, common.ChannelWeightDecayEnabled = enabled, decay
+		model.InitChannelCache()
+	}(common.MemoryCacheEnabled, common.ChannelWeightDecayEnabled)
+	common.ChannelWeightDecayEnabled = true
+	limited := createTestRelayChannel(t, "http://127.0.0.1", "sim-cooldown")
+	failing := createTestRelayChannel(t, "http://127.0.0.1", "sim-cooldown")
+	fresh := createTestRelayChannel(t, "http://127.0.0.1", "sim-cooldown")
+	// the upstream rate limit of one channel is nearly used up, the other recovers from a server error
+	remaining, resetAt := 0, time.Now().Add(time.Minute).UnixMilli()
+	model.SetChannelRateLimit(limited.Id, &model.ChannelRateLimit{RemainingRequests: &remaining, ResetRequestsAt: &resetAt})
+	defer model.SetChannelRateLimit(limited.Id, &model.ChannelRateLimit{})
+	model.RecordChannelError(failing.Id, http.StatusInternalServerError)
+	defer func() {
+		for i := 0; i < 10; i++ {
+			model.RecordChannelSuccess(failing.Id)
+		}
+	}()
+	common.MemoryCacheEnabled = true
+	model.InitChannelCache()
+
+	// a sample relay request, the fields besides model are ignored
+	c, recorder := newTestContext(http.MethodPost, "/api/channel/simulate", `{"model":"sim-cooldown","group":"default","messages":[{"role":"user","content":"hi"}],"stream":true}`)
+	SimulateChannelSelection(c)
+	response := gjson.Get(recorder.Body.String(), "data")
+	if !gjson.Get(recorder.Body.String(), "success").Bool() {
+		t.Fatalf("simulation failed: %s", recorder.Body.String())
+	}
+	if selected := response.Get("selected_channel_id").Int(); selected != int64(failing.Id) && selected != int64(fresh.Id) {
+		t.Errorf("selected channel %d, the nearly exhausted channel is %d", selected, limited.Id)
+	}
+	candidate := func(channelId int) gjson.Result {
+		return response.Get(fmt.Sprintf("attempts.0.candidates.#(channel_id==%d)", channelId))
+	}
+	if limitedCandidate := candidate(limited.Id); !limitedCandidate.Get("excluded").Bool() || limitedCandidate.Get("reason").String() != model.ChannelExcludedNearlyExhausted {
+		t.Errorf("nearly exhausted channel not skipped: %s", limitedCandidate.Raw)
+	}
+	if failingCandidate := candidate(failing.Id); failingCandidate.Get("excluded").Bool() || failingCandidate.Get("weight_scale").Float() != 0.5 {
+		t.Errorf("recovering channel not traced with its weight scale: %s", failingCandidate.Raw)
+	}
+	if freshCandidate := candidate(fresh.Id); freshCandidate.Get("excluded").Bool() || freshCandidate.Get("weight_scale").Float() != 1 {
+		t.Errorf("unexpected trace of the healthy channel: %s", freshCandidate.Raw)
+	}
+}
@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+)
+
+// GetChannelSLOs reports availability, error budget and latency percentiles per channel,
+// over the last "hours" hours (a week by default)
+func GetChannelSLOs(c *gin.Context) {
+	hours, _ := strconv.Atoi(c.Query("hours"))
+	if hours <= 0 {
+		hours = 7 * 24
+	}
+	target := common.ChannelSLOTarget
+	if c.Query("target") != "" {
+		target, _ = strconv.ParseFloat(c.Query("target"), 64)
+	}
+	slos, err := model.GetChannelSLOs(common.GetTimestamp()-int64(hours)*3600, target)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    slos,
+	})
+	return
+}
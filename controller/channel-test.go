@@ -41,15 +41,7 @@ func testChannel(channel *model.Channel, request ChatRequest) (err error, openai
 	default:
 		request.Model = "gpt-3.5-turbo"
 	}
-	requestURL := common.ChannelBaseURLs[channel.Type]
-	if channel.Type == common.ChannelTypeAzure {
-		requestURL = fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=2023-03-15-preview", channel.GetBaseURL(), request.Model)
-	} else {
-		if baseURL := channel.GetBaseURL(); len(baseURL) > 0 {
-			requestURL = baseURL
-		}
-		requestURL = getFullRequestURL(requestURL, "/v1/chat/completions", channel.Type)
-	}
+	requestURL := getTestRequestURL(channel, request.Model)
 
 	jsonData, err := json.Marshal(request)
 	if err != nil {
@@ -65,8 +57,20 @@ func testChannel(channel *model.Channel, request ChatRequest) (err error, openai
 		req.Header.Set("Authorization", "Bearer "+channel.Key)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := httpClient.Do(req)
+	applyChannelAuth(req, channel.GetAuthType(), channel.GetAuthParam(), channel.Key)
+	err = applyChannelHeaders(req, channel.GetHeaders(), channel.Key)
+	if err != nil {
+		return err, nil
+	}
+	client, err := getChannelHTTPClient(channel)
+	if err != nil {
+		return err, nil
+	}
+	resp, err := client.Do(req)
 	if err != nil {
+		if isTLSError(err) {
+			return fmt.Errorf("TLS 握手失败：%s", err.Error()), nil
+		}
 		return err, nil
 	}
 	defer resp.Body.Close()
@@ -85,6 +89,17 @@ func testChannel(channel *model.Channel, request ChatRequest) (err error, openai
 	return nil, nil
 }
 
+func getTestRequestURL(channel *model.Channel, modelName string) string {
+	if channel.Type == common.ChannelTypeAzure {
+		return fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=2023-03-15-preview", channel.GetBaseURL(), modelName)
+	}
+	requestURL := common.ChannelBaseURLs[channel.Type]
+	if baseURL := channel.GetBaseURL(); len(baseURL) > 0 {
+		requestURL = baseURL
+	}
+	return getFullRequestURL(requestURL, "/v1/chat/completions", channel.Type)
+}
+
 func buildTestRequest() *ChatRequest {
 	testRequest := &ChatRequest{
 		Model:     "", // this will be set later
@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// bodyTransform moves the value at From to To (gjson/sjson paths) in the request body,
+// responses are relayed untouched
+type bodyTransform struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func parseBodyTransforms(transforms string) ([]bodyTransform, error) {
+	var bodyTransforms []bodyTransform
+	if transforms == "" || transforms == "[]" {
+		return bodyTransforms, nil
+	}
+	err := json.Unmarshal([]byte(transforms), &bodyTransforms)
+	return bodyTransforms, err
+}
+
+func validateBodyTransforms(transforms string) error {
+	bodyTransforms, err := parseBodyTransforms(transforms)
+	if err != nil {
+		return errors.New("请求体转换规则必须是 JSON 数组：" + err.Error())
+	}
+	for _, transform := range bodyTransforms {
+		if transform.From == "" || transform.To == "" {
+			return errors.New("请求体转换规则的 from 和 to 不能为空")
+		}
+	}
+	return nil
+}
+
+func moveJSONField(body []byte, from string, to string) ([]byte, error) {
+	value := gjson.GetBytes(body, from)
+	if !value.Exists() {
+		return body, nil
+	}
+	body, err := sjson.DeleteBytes(body, from)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetRawBytes(body, to, []byte(value.Raw))
+}
+
+// transformBody applies the channel's body transforms to the request body in order
+func transformBody(body []byte, transforms string) ([]byte, error) {
+	bodyTransforms, err := parseBodyTransforms(transforms)
+	if err != nil {
+		return nil, err
+	}
+	for _, transform := range bodyTransforms {
+		body, err = moveJSONField(body, transform.From, transform.To)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
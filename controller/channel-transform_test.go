@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/model"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestBodyTransformsRenameRequestFieldsOnly(t *testing.T) {
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","prompt":"kept","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+	channel := createTestRelayChannel(t, upstream.URL, "body-transform")
+	model.DB.Model(channel).Update("body_transforms", `[{"from":"messages","to":"prompt"}]`)
+	token := createTestToken(t, createTestUser(t, "body-transform", 1000000).Id, "body-transform")
+	recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"body-transform","messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if gjson.GetBytes(upstreamBody, "messages").Exists() || gjson.GetBytes(upstreamBody, "prompt.0.content").String() != "hi" {
+		t.Errorf("the request was not renamed: %s", upstreamBody)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, `"prompt":"kept"`) || strings.Contains(body, `"messages"`) {
+		t.Errorf("the response was transformed: %s", body)
+	}
+}
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"one-api/common"
+	"one-api/model"
+	"sync"
+	"time"
+)
+
+// idle connections are reaped after 90 seconds by the default transport
+const channelWarmUpInterval = 60 * time.Second
+
+type channelWarmUpResult struct {
+	ChannelId int    `json:"channel_id"`
+	Success   bool   `json:"success"`
+	Reused    bool   `json:"reused"`  // the pooled connection was still alive
+	Latency   int64  `json:"latency"` // in milliseconds
+	Message   string `json:"message"`
+	WarmedAt  int64  `json:"warmed_at"`
+}
+
+var channelWarmUpResults = make(map[int]*channelWarmUpResult)
+var channelWarmUpResultsLock sync.Mutex
+
+// warmUpChannel sends a HEAD request to the channel's base URL through the same client
+// used for relaying, so DNS, TCP and TLS are done before real traffic lands
+func warmUpChannel(channel *model.Channel) *channelWarmUpResult {
+	result := &channelWarmUpResult{
+		ChannelId: channel.Id,
+		WarmedAt:  common.GetTimestamp(),
+	}
+	baseURL := common.ChannelBaseURLs[channel.Type]
+	if channel.GetBaseURL() != "" {
+		baseURL = channel.GetBaseURL()
+	}
+	if baseURL == "" {
+		result.Message = "no base url"
+		return result
+	}
+	client, err := getChannelHTTPClient(channel)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	req, err := http.NewRequest("HEAD", baseURL, nil)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			result.Reused = info.Reused
+		},
+	}))
+	tik := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	// drain the body so the connection goes back to the idle pool
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	result.Latency = time.Since(tik).Milliseconds()
+	result.Success = true
+	return result
+}
+
+func warmUpChannels(count int) {
+	// the rollups of today and yesterday, the top channels of the last day at least
+	channelIds, err := model.GetTopChannelIds(count, common.GetTimestamp()-24*60*60)
+	if err != nil {
+		common.SysError("failed to get top channels: " + err.Error())
+		return
+	}
+	for _, channelId := range channelIds {
+		channel, err := model.GetChannelById(channelId, true)
+		if err != nil || channel.Status != common.ChannelStatusEnabled {
+			continue
+		}
+		result := warmUpChannel(channel)
+		channelWarmUpResultsLock.Lock()
+		channelWarmUpResults[channelId] = result
+		channelWarmUpResultsLock.Unlock()
+		if !result.Success {
+			common.SysError(fmt.Sprintf("failed to warm up channel #%d (%s): %s", channel.Id, channel.Name, result.Message))
+		} else if !result.Reused {
+			common.SysLog(fmt.Sprintf("channel #%d (%s) warmed up in %d ms", channel.Id, channel.Name, result.Latency))
+		}
+	}
+}
+
+// AutomaticallyWarmUpChannels keeps connections to the ChannelWarmUpCount busiest channels open, it runs
+// once at startup and then again before the idle connections would be reaped, 0 skips it, e.g. for air-gapped tests
+func AutomaticallyWarmUpChannels() {
+	for {
+		if count := common.ChannelWarmUpCount; count > 0 {
+			warmUpChannels(count)
+		}
+		time.Sleep(channelWarmUpInterval)
+	}
+}
+
+func GetChannelWarmUpResults(c *gin.Context) {
+	channelWarmUpResultsLock.Lock()
+	results := make([]*channelWarmUpResult, 0, len(channelWarmUpResults))
+	for _, result := range channelWarmUpResults {
+		results = append(results, result)
+	}
+	channelWarmUpResultsLock.Unlock()
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    results,
+	})
+	return
+}
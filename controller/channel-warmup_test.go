@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/model"
+	"testing"
+)
+
+func TestWarmUpTopChannels(t *testing.T) {
+	var warmed int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			warmed++
+		}
+	}))
+	defer server.Close()
+	busy := createTestChannel(t, "warm-up-busy", server.URL)
+	quiet := createTestChannel(t, "warm-up-quiet", server.URL)
+	day := common.GetTimestamp() - common.GetTimestamp()%86400
+	model.DB.Create(&model.ChannelDailyUsage{ChannelId: busy.Id, Day: day, Requests: 100})
+	model.DB.Create(&model.ChannelDailyUsage{ChannelId: quiet.Id, Day: day, Requests: 1})
+
+	warmUpChannels(1)
+	channelWarmUpResultsLock.Lock()
+	busyResult, quietResult := channelWarmUpResults[busy.Id], channelWarmUpResults[quiet.Id]
+	channelWarmUpResultsLock.Unlock()
+	if busyResult == nil || !busyResult.Success || warmed != 1 {
+		t.Fatalf("busiest channel not warmed up: %+v, %d requests", busyResult, warmed)
+	}
+	if quietResult != nil {
+		t.Error("channel outside the top warmed up")
+	}
+
+	// the periodic warm-up finds the pooled connection still open
+	warmUpChannels(1)
+	channelWarmUpResultsLock.Lock()
+	busyResult = channelWarmUpResults[busy.Id]
+	channelWarmUpResultsLock.Unlock()
+	if !busyResult.Success || !busyResult.Reused || warmed != 2 {
+		t.Errorf("pooled connection not reused: %+v", busyResult)
+	}
+
+	// disabled channels are skipped even when busy
+	model.DB.Model(busy).Update("status", common.ChannelStatusManuallyDisabled)
+	warmUpChannels(1)
+	if warmed != 2 {
+		t.Error("disabled channel warmed up")
+	}
+}
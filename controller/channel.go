@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"one-api/common"
@@ -65,6 +66,7 @@ func GetChannel(c *gin.Context) {
 		})
 		return
 	}
+	channel.RateLimit = model.GetChannelRateLimit(id)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -73,6 +75,25 @@ func GetChannel(c *gin.Context) {
 	return
 }
 
+// validateChannel checks the settings of a channel before it is saved and normalizes its base_url,
+// tlsChannel carries the TLS settings to check, which may come from the saved channel
+func validateChannel(channel *model.Channel, tlsChannel *model.Channel) error {
+	err := validateChannelTLS(tlsChannel)
+	if err == nil {
+		err = validateChannelHeaders(channel.GetHeaders())
+	}
+	if err == nil {
+		err = validateBodyTransforms(channel.GetBodyTransforms())
+	}
+	if err == nil {
+		err = validateChannelAuth(channel.GetAuthType(), channel.GetAuthParam())
+	}
+	if err == nil {
+		err = normalizeChannelBaseURL(channel)
+	}
+	return err
+}
+
 func AddChannel(c *gin.Context) {
 	channel := model.Channel{}
 	err := c.ShouldBindJSON(&channel)
@@ -83,6 +104,20 @@ func AddChannel(c *gin.Context) {
 		})
 		return
 	}
+	err = validateChannel(&channel, &channel)
+	if err == nil && c.Query("probe") == "true" {
+		err = probeChannelBaseURL(&channel)
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if channel.GetTLSInsecure() {
+		common.SysError(fmt.Sprintf("WARNING: user #%d saved channel %s with TLS certificate verification disabled", c.GetInt("id"), channel.Name))
+	}
 	channel.CreatedTime = common.GetTimestamp()
 	keys := strings.Split(channel.Key, "\n")
 	channels := make([]model.Channel, 0, len(keys))
@@ -154,6 +189,28 @@ func UpdateChannel(c *gin.Context) {
 		})
 		return
 	}
+	tlsChannel := channel
+	// the client key and the headers are never sent back to the frontend, a channel saved without them keeps the saved ones
+	if channel.TLSClientKey == nil {
+		if origin, err := model.GetChannelById(channel.Id, true); err == nil {
+			tlsChannel.TLSClientKey = origin.TLSClientKey
+		}
+	}
+	err = validateChannel(&channel, &tlsChannel)
+	if err == nil && c.Query("probe") == "true" {
+		tlsChannel.BaseURL = channel.BaseURL
+		err = probeChannelBaseURL(&tlsChannel)
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if channel.GetTLSInsecure() {
+		common.SysError(fmt.Sprintf("WARNING: user #%d saved channel #%d with TLS certificate verification disabled", c.GetInt("id"), channel.Id))
+	}
 	err = channel.Update()
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
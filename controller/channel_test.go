@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+func TestRelayRecordsUpstreamRateLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("x-ratelimit-limit-requests", "500")
+		w.Header().Set("x-ratelimit-remaining-requests", "499")
+		w.Header().Set("x-ratelimit-remaining-tokens", "150000")
+		w.Header().Set("x-ratelimit-reset-requests", "120ms")
+		w.Header().Set("x-ratelimit-reset-tokens", "6m0s")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+	channel := createTestRelayChannel(t, upstream.URL, "ratelimit-model")
+	token := createTestToken(t, createTestUser(t, "ratelimit", 1000000000).Id, "ratelimit")
+	if recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"ratelimit-model","messages":[{"role":"user","content":"hi"}]}`); recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	c, recorder := newTestContext(http.MethodGet, "/api/channel/"+strconv.Itoa(channel.Id), "")
+	c.Params = gin.Params{{Key: "id", Value: strconv.Itoa(channel.Id)}}
+	GetChannel(c)
+	rateLimit := gjson.Get(recorder.Body.String(), "data.rate_limit")
+	if rateLimit.Get("limit_requests").Int() != 500 || rateLimit.Get("remaining_requests").Int() != 499 || rateLimit.Get("remaining_tokens").Int() != 150000 {
+		t.Errorf("channel detail reports %s", rateLimit.Raw)
+	}
+	// providers without the headers leave the fields null
+	if rateLimit.Get("limit_tokens").Type != gjson.Null {
+		t.Errorf("limit_tokens reported as %s", rateLimit.Get("limit_tokens").Raw)
+	}
+}
+
+func TestParseRateLimitHeaders(t *testing.T) {
+	if rateLimit := parseRateLimitHeaders(http.Header{"Content-Type": {"application/json"}}); rateLimit != nil {
+		t.Errorf("rate limit parsed without the headers: %+v", rateLimit)
+	}
+	header := http.Header{}
+	header.Set("x-ratelimit-remaining-tokens", "10")
+	header.Set("x-ratelimit-reset-tokens", "1m30s")
+	rateLimit := parseRateLimitHeaders(header)
+	if rateLimit == nil || rateLimit.RemainingRequests != nil || *rateLimit.RemainingTokens != 10 || rateLimit.ResetRequestsAt != nil {
+		t.Fatalf("parsed %+v", rateLimit)
+	}
+	if resetIn := *rateLimit.ResetTokensAt - rateLimit.UpdatedAt; resetIn != 90000 {
+		t.Errorf("tokens reset in %dms, want 90000", resetIn)
+	}
+}
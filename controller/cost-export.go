@@ -0,0 +1,237 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/url"
+	"one-api/common"
+	"one-api/model"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// costExportCatchUpDays is how far back the days without a successful export are exported again,
+// the same days GetCostExports lists
+const costExportCatchUpDays = 30
+
+// costExportRetryBackoff doubles after every failed send
+var costExportRetryBackoff = 30 * time.Second
+
+// costExportsRunning holds the days being exported, a day is never exported twice at the same time
+var costExportsRunning = make(map[int64]bool)
+var costExportsRunningLock sync.Mutex
+
+func lockCostExport(day int64) bool {
+	costExportsRunningLock.Lock()
+	defer costExportsRunningLock.Unlock()
+	if costExportsRunning[day] {
+		return false
+	}
+	costExportsRunning[day] = true
+	return true
+}
+
+func unlockCostExport(day int64) {
+	costExportsRunningLock.Lock()
+	defer costExportsRunningLock.Unlock()
+	delete(costExportsRunning, day)
+}
+
+// costReport is the normalized daily feed for FinOps tooling
+type costReport struct {
+	Date         string                 `json:"date"` // UTC day, YYYY-MM-DD
+	StartTime    int64                  `json:"start_time"`
+	EndTime      int64                  `json:"end_time"`
+	QuotaPerUnit float64                `json:"quota_per_unit"`
+	Rows         []*model.CostReportRow `json:"rows"`
+}
+
+func getCostReportName(day int64) string {
+	return "cost-" + time.Unix(day, 0).UTC().Format("2006-01-02") + ".json"
+}
+
+// sendCostReport pushes the report to CostExportDestination: file:///dir, s3://bucket/prefix or an http(s) webhook
+func sendCostReport(day int64, body []byte) error {
+	destination, err := url.Parse(common.CostExportDestination)
+	if err != nil {
+		return err
+	}
+	name := getCostReportName(day)
+	switch destination.Scheme {
+	case "file":
+		return os.WriteFile(filepath.Join(destination.Path, name), body, 0644)
+	case "s3":
+		return common.PutS3Object(httpClient, destination.Host, path.Join(strings.TrimPrefix(destination.Path, "/"), name), "application/json", body)
+	case "http", "https":
+		req, err := http.NewRequest(http.MethodPost, common.CostExportDestination, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if common.CostExportWebhookSecret != "" {
+			// the receiver recomputes the signature over "<timestamp>.<body>" and rejects stale timestamps
+			timestamp := strconv.FormatInt(common.GetTimestamp(), 10)
+			mac := hmac.New(sha256.New, []byte(common.CostExportWebhookSecret))
+			mac.Write([]byte(timestamp + "."))
+			mac.Write(body)
+			req.Header.Set("X-Oneapi-Timestamp", timestamp)
+			req.Header.Set("X-Oneapi-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			responseBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return fmt.Errorf("webhook returned status code %d: %s", resp.StatusCode, string(responseBody))
+		}
+		return nil
+	default:
+		return errors.New("unsupported cost export destination " + destination.Scheme)
+	}
+}
+
+// exportCostReport builds the report of the day starting at day and pushes it, retrying with backoff,
+// the caller holds lockCostExport
+func exportCostReport(day int64) error {
+	rows, err := model.GetCostReport(day, day+24*3600)
+	if err != nil {
+		model.RecordCostExport(day, false, 0, err.Error())
+		return err
+	}
+	report := costReport{
+		Date:         time.Unix(day, 0).UTC().Format("2006-01-02"),
+		StartTime:    day,
+		EndTime:      day + 24*3600,
+		QuotaPerUnit: common.QuotaPerUnit,
+		Rows:         rows,
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		model.RecordCostExport(day, false, 0, err.Error())
+		return err
+	}
+	attempts := 0
+	for {
+		err = sendCostReport(day, body)
+		attempts++
+		if err == nil || attempts > common.CostExportRetryTimes {
+			break
+		}
+		time.Sleep(time.Duration(1<<(attempts-1)) * costExportRetryBackoff)
+	}
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to export cost report of %s: %s", report.Date, err.Error()))
+		model.RecordCostExport(day, false, attempts, err.Error())
+		return err
+	}
+	model.RecordCostExport(day, true, attempts, "")
+	return nil
+}
+
+// exportMissingCostReports exports the finished days of the last costExportCatchUpDays without a successful export,
+// oldest first
+func exportMissingCostReports() {
+	now := common.GetTimestamp()
+	today := now - now%(24*3600)
+	exports, err := model.GetRecentCostExports(costExportCatchUpDays)
+	if err != nil {
+		common.SysError("failed to get cost exports: " + err.Error())
+		return
+	}
+	exported := make(map[int64]bool, len(exports))
+	for _, export := range exports {
+		if export.Success {
+			exported[export.Day] = true
+		}
+	}
+	for day := today - costExportCatchUpDays*24*3600; day < today; day += 24 * 3600 {
+		if exported[day] || !lockCostExport(day) {
+			continue
+		}
+		_ = exportCostReport(day)
+		unlockCostExport(day)
+	}
+}
+
+// AutomaticallyExportCostReports exports every day once it is over,
+// the days that failed or were missed are tried again every hour
+func AutomaticallyExportCostReports() {
+	for {
+		time.Sleep(time.Hour)
+		if common.CostExportDestination == "" {
+			continue
+		}
+		exportMissingCostReports()
+	}
+}
+
+// GetCostExports lists the export status of the last days, days without a record were never exported
+func GetCostExports(c *gin.Context) {
+	exports, err := model.GetRecentCostExports(30)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    exports,
+	})
+	return
+}
+
+// ExportCostReport starts the export of the day containing the "day" timestamp, e.g. to fill a missing day,
+// the outcome shows up in GetCostExports
+func ExportCostReport(c *gin.Context) {
+	day, _ := strconv.ParseInt(c.Query("day"), 10, 64)
+	if common.CostExportDestination == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "未配置成本报表导出地址",
+		})
+		return
+	}
+	day = day - day%(24*3600)
+	if day <= 0 || day+24*3600 > common.GetTimestamp() {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "只能导出已经结束的日期",
+		})
+		return
+	}
+	if !lockCostExport(day) {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "该日期正在导出",
+		})
+		return
+	}
+	// the retries back off for minutes, the admin does not wait for them
+	go func() {
+		defer unlockCostExport(day)
+		_ = exportCostReport(day)
+	}()
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "已开始导出，结果见导出记录",
+	})
+	return
+}
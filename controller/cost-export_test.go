@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCostExportCountsSendAttempts(t *testing.T) {
+	defer func(destination string, retryTimes int, backoff time.Duration) {
+		common.CostExportDestination, common.CostExportRetryTimes, costExportRetryBackoff = destination, retryTimes, backoff
+	}(common.CostExportDestination, common.CostExportRetryTimes, costExportRetryBackoff)
+	var sends int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&sends, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer webhook.Close()
+	common.CostExportDestination, common.CostExportRetryTimes, costExportRetryBackoff = webhook.URL, 3, 0
+	day := int64(100 * 24 * 3600)
+	if err := exportCostReport(day); err != nil {
+		t.Fatal(err)
+	}
+	export, err := model.GetCostExport(day)
+	if err != nil || !export.Success || export.Attempts != 2 {
+		t.Errorf("got %+v, %v, want a success after 2 sends", export, err)
+	}
+}
+
+func TestExportMissingCostReports(t *testing.T) {
+	defer func(destination string) { common.CostExportDestination = destination }(common.CostExportDestination)
+	dir := t.TempDir()
+	common.CostExportDestination = "file://" + dir
+	now := common.GetTimestamp()
+	today := now - now%(24*3600)
+	// the day before yesterday was already exported, every other missing day is
+	model.RecordCostExport(today-2*24*3600, true, 1, "")
+	exportMissingCostReports()
+	files, _ := filepath.Glob(filepath.Join(dir, "cost-*.json"))
+	if len(files) != costExportCatchUpDays-1 {
+		t.Errorf("exported %d days, want %d", len(files), costExportCatchUpDays-1)
+	}
+	if _, err := os.Stat(filepath.Join(dir, getCostReportName(today-2*24*3600))); err == nil {
+		t.Error("exported a day again")
+	}
+	if _, err := os.Stat(filepath.Join(dir, getCostReportName(today-24*3600))); err != nil {
+		t.Errorf("yesterday was not exported: %v", err)
+	}
+}
+
+func TestExportCostReportDoesNotWaitForTheUpstream(t *testing.T) {
+	defer func(destination string) { common.CostExportDestination = destination }(common.CostExportDestination)
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer webhook.Close()
+	defer close(release)
+	common.CostExportDestination = webhook.URL
+	day := int64(200 * 24 * 3600)
+	c, recorder := newTestContext(http.MethodPost, fmt.Sprintf("/api/log/cost_export?day=%d", day), "")
+	done := make(chan struct{})
+	go func() {
+		ExportCostReport(c)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the handler waited for the export")
+	}
+	if !strings.Contains(recorder.Body.String(), `"success":true`) {
+		t.Errorf("got %s", recorder.Body.String())
+	}
+	// the day is being exported, it is not started twice
+	c, recorder = newTestContext(http.MethodPost, fmt.Sprintf("/api/log/cost_export?day=%d", day), "")
+	ExportCostReport(c)
+	if !strings.Contains(recorder.Body.String(), `"success":false`) {
+		t.Errorf("started the same day twice: %s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+)
+
+const (
+	secondsPerDay       = 24 * 60 * 60
+	movingAverageWindow = 7
+)
+
+// fitLinearTrend fits y = a + b*x by least squares, x being the index of the day
+func fitLinearTrend(values []float64) (a float64, b float64) {
+	n := float64(len(values))
+	if n == 0 {
+		return 0, 0
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for i, y := range values {
+		x := float64(i)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return sumY / n, 0
+	}
+	b = (n*sumXY - sumX*sumY) / denominator
+	a = (sumY - b*sumX) / n
+	return a, b
+}
+
+func movingAverage(values []float64, window int) float64 {
+	if len(values) < window {
+		window = len(values)
+	}
+	if window == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, value := range values[len(values)-window:] {
+		sum += value
+	}
+	return sum / float64(window)
+}
+
+// getModelDailyCapacity sums the TPM limits configured on the channels serving the model,
+// returns nil if none of them has one
+func getModelDailyCapacity(modelName string) (*int64, error) {
+	channelIds, err := model.GetEnabledChannelIdsByModel(modelName)
+	if err != nil {
+		return nil, err
+	}
+	if len(channelIds) == 0 {
+		return nil, nil
+	}
+	channels, err := model.GetChannelsByIds(channelIds)
+	if err != nil {
+		return nil, err
+	}
+	var capacity *int64
+	for _, channel := range channels {
+		if channel.TPMLimit == nil || *channel.TPMLimit <= 0 {
+			continue
+		}
+		if capacity == nil {
+			capacity = new(int64)
+		}
+		*capacity += int64(*channel.TPMLimit) * 24 * 60
+	}
+	return capacity, nil
+}
+
+func GetUsageForecast(c *gin.Context) {
+	modelName := c.Query("model_name")
+	method := c.DefaultQuery("method", "linear")
+	days, _ := strconv.Atoi(c.Query("days"))
+	if days <= 0 {
+		days = 30
+	}
+	horizon, _ := strconv.Atoi(c.Query("horizon"))
+	if horizon <= 0 {
+		horizon = 14
+	}
+	today := common.GetTimestamp() / secondsPerDay * secondsPerDay
+	startDay := today - int64(days-1)*secondsPerDay
+	usages, err := model.GetDailyTokenUsage(modelName, startDay)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	// fill the days without consumption
+	series := make([]*model.DailyTokenUsage, days)
+	values := make([]float64, days)
+	for i := range series {
+		series[i] = &model.DailyTokenUsage{Day: startDay + int64(i)*secondsPerDay}
+	}
+	for _, usage := range usages {
+		idx := int((usage.Day - startDay) / secondsPerDay)
+		if idx >= 0 && idx < days {
+			series[idx].Tokens = usage.Tokens
+			values[idx] = float64(usage.Tokens)
+		}
+	}
+	a, b := fitLinearTrend(values)
+	average := movingAverage(values, movingAverageWindow)
+	forecast := make([]*model.DailyTokenUsage, horizon)
+	for i := range forecast {
+		projected := average
+		if method == "linear" {
+			projected = a + b*float64(days+i)
+		}
+		if projected < 0 {
+			projected = 0
+		}
+		forecast[i] = &model.DailyTokenUsage{Day: today + int64(i+1)*secondsPerDay, Tokens: int64(projected)}
+	}
+	var dailyCapacity *int64
+	var exhaustedAt *int64
+	if modelName != "" {
+		dailyCapacity, err = getModelDailyCapacity(modelName)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	if dailyCapacity != nil {
+		for _, day := range forecast {
+			if day.Tokens > *dailyCapacity {
+				exhaustedAt = &day.Day
+				break
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data": gin.H{
+			"model_name":     modelName,
+			"method":         method,
+			"series":         series,
+			"forecast":       forecast,
+			"daily_capacity": dailyCapacity,
+			"exhausted_at":   exhaustedAt,
+		},
+	})
+	return
+}
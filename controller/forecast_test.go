@@ -0,0 +1,26 @@
+package controller
+
+import (
+	"one-api/model"
+	"testing"
+)
+
+func TestForecastCapacityComesFromConfiguredLimits(t *testing.T) {
+	configured := createTestRelayChannel(t, "http://localhost", "forecast-capacity")
+	createTestRelayChannel(t, "http://localhost", "forecast-capacity")
+	model.DB.Model(configured).Update("tpm_limit", 1000)
+	// what the upstream reported must not count as capacity
+	limitTokens := 999999
+	model.SetChannelRateLimit(configured.Id, &model.ChannelRateLimit{LimitTokens: &limitTokens})
+	capacity, err := getModelDailyCapacity("forecast-capacity")
+	if err != nil {
+		t.Fatalf("getModelDailyCapacity: %v", err)
+	}
+	if capacity == nil || *capacity != 1000*24*60 {
+		t.Errorf("daily capacity %v, want %d from the configured TPM limit", capacity, 1000*24*60)
+	}
+	capacity, err = getModelDailyCapacity("forecast-unconfigured")
+	if err != nil || capacity != nil {
+		t.Errorf("a model without configured limits has capacity %v, %v", capacity, err)
+	}
+}
@@ -0,0 +1,291 @@
+package controller
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"regexp"
+	"strconv"
+)
+
+type recountItem struct {
+	LogId     int             `json:"log_id"`
+	Request   json.RawMessage `json:"request"`
+	Response  string          `json:"response"`
+	Responses []string        `json:"responses"` // the completions of all choices of a request with n > 1
+}
+
+type recountResult struct {
+	LogId                  int    `json:"log_id"`
+	UserId                 int    `json:"user_id"`
+	ModelName              string `json:"model_name"`
+	Source                 string `json:"source"` // "request" when recounted from the supplied request, "log" when repriced from the logged tokens
+	LoggedPromptTokens     int    `json:"logged_prompt_tokens"`
+	PromptTokens           int    `json:"prompt_tokens"`
+	LoggedCompletionTokens int    `json:"logged_completion_tokens"`
+	CompletionTokens       int    `json:"completion_tokens"`
+	LoggedQuota            int    `json:"logged_quota"`
+	Quota                  int    `json:"quota"`
+	Delta                  int    `json:"delta"`
+	Applied                bool   `json:"applied"`
+	Message                string `json:"message"`
+}
+
+var recountCSVHeader = []string{"log_id", "user_id", "model_name", "source", "logged_prompt_tokens", "prompt_tokens",
+	"logged_completion_tokens", "completion_tokens", "logged_quota", "quota", "delta", "applied", "message"}
+
+func (result *recountResult) csvRecord() []string {
+	return []string{
+		strconv.Itoa(result.LogId),
+		strconv.Itoa(result.UserId),
+		result.ModelName,
+		result.Source,
+		strconv.Itoa(result.LoggedPromptTokens),
+		strconv.Itoa(result.PromptTokens),
+		strconv.Itoa(result.LoggedCompletionTokens),
+		strconv.Itoa(result.CompletionTokens),
+		strconv.Itoa(result.LoggedQuota),
+		strconv.Itoa(result.Quota),
+		strconv.Itoa(result.Delta),
+		strconv.FormatBool(result.Applied),
+		result.Message,
+	}
+}
+
+var (
+	logServiceTierPattern = regexp.MustCompile(`服务等级 (\w+)`)
+	logChoicesPattern     = regexp.MustCompile(`，n=(\d+)`)
+	logAudioTokensPattern = regexp.MustCompile(`音频输出 tokens (\d+)`)
+)
+
+// loggedCharge is what a consume log content tells about the charge besides its tokens, see relayTextHelper
+type loggedCharge struct {
+	serviceTier string
+	n           int
+	audioTokens int
+}
+
+func parseLoggedCharge(log *model.Log) loggedCharge {
+	charge := loggedCharge{n: 1}
+	if match := logServiceTierPattern.FindStringSubmatch(log.Content); match != nil {
+		charge.serviceTier = match[1]
+	}
+	if match := logChoicesPattern.FindStringSubmatch(log.Content); match != nil {
+		charge.n, _ = strconv.Atoi(match[1])
+	}
+	if match := logAudioTokensPattern.FindStringSubmatch(log.Content); match != nil {
+		charge.audioTokens, _ = strconv.Atoi(match[1])
+	}
+	return charge
+}
+
+// recountTokens re-runs the current token counting code over a stored request and the completions of its choices,
+// in the counting mode that produced the logged charge
+func recountTokens(rawRequest []byte, responses []string, modelName string, approximate bool) (promptTokens int, completionTokens int, err error) {
+	textRequest, promptImages, promptAudios, err := parseTextRequest(rawRequest)
+	if err != nil {
+		return 0, 0, err
+	}
+	if textRequest.Model != "" {
+		modelName = textRequest.Model
+	}
+	if textRequest.Messages != nil {
+		promptTokens = countTokenMessages(textRequest.Messages, modelName, approximate)
+		if textRequest.Functions != nil {
+			promptTokens += countTokenFunctions(textRequest.Functions, textRequest.FunctionCall, modelName, approximate)
+		}
+		if textRequest.Tools != nil {
+			promptTokens += countTokenFunctions(textRequest.Tools, textRequest.ToolChoice, modelName, approximate)
+		}
+	} else if textRequest.Prompt != nil {
+		promptTokens = countTokenInput(textRequest.Prompt, modelName, approximate)
+	} else {
+		promptTokens = countTokenInput(textRequest.Input, modelName, approximate)
+	}
+	if len(promptAudios) > 0 {
+		audioTokens, err := countTokenAudios(promptAudios)
+		if err != nil {
+			return 0, 0, err
+		}
+		promptTokens += audioTokens
+	}
+	if len(promptImages) > 0 {
+		imageTokens, _, errs, err := countTokenImages(promptImages, modelName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(errs) > 0 {
+			return 0, 0, fmt.Errorf("failed to count image tokens: %s", errs[0].Error())
+		}
+		promptTokens += imageTokens
+	}
+	for _, responseText := range responses {
+		completionTokens += countTokenText(responseText, modelName, approximate)
+	}
+	return promptTokens, completionTokens, nil
+}
+
+// recountLog recomputes the quota of a consume log, and only adjusts the user's quota when apply is set
+func recountLog(item *recountItem, apply bool) *recountResult {
+	log, err := model.GetLogById(item.LogId)
+	if err != nil {
+		return &recountResult{LogId: item.LogId, Message: err.Error()}
+	}
+	return recountLoggedCharge(log, item, apply)
+}
+
+// recountLoggedCharge recomputes the quota of a log with the group, discount and service tier it was charged with,
+// the tokens are counted again from the request of the item, without one the logged tokens are repriced
+func recountLoggedCharge(log *model.Log, item *recountItem, apply bool) *recountResult {
+	result := &recountResult{
+		LogId:                  log.Id,
+		UserId:                 log.UserId,
+		ModelName:              log.ModelName,
+		LoggedPromptTokens:     log.PromptTokens,
+		LoggedCompletionTokens: log.CompletionTokens,
+		LoggedQuota:            log.Quota,
+	}
+	if log.Type != model.LogTypeConsume {
+		result.Message = "not a consume log"
+		return result
+	}
+	charge := parseLoggedCharge(log)
+	if item == nil || len(item.Request) == 0 {
+		result.Source = "log"
+		result.PromptTokens, result.CompletionTokens = log.PromptTokens, log.CompletionTokens
+	} else {
+		result.Source = "request"
+		responses := item.Responses
+		if len(responses) == 0 {
+			responses = []string{item.Response}
+		}
+		if len(responses) != charge.n {
+			result.Message = fmt.Sprintf("请求 n=%d，需要提供全部 %d 个候选的回复", charge.n, charge.n)
+			return result
+		}
+		var err error
+		result.PromptTokens, result.CompletionTokens, err = recountTokens(item.Request, responses, log.ModelName, isApproximateCountLog(log))
+		if err != nil {
+			result.Message = err.Error()
+			return result
+		}
+		// audio output is not part of the completion text
+		result.CompletionTokens += charge.audioTokens
+	}
+	group := log.Group
+	if group == "" {
+		// logs from before the group was recorded
+		var err error
+		if group, err = model.CacheGetUserGroup(log.UserId); err != nil {
+			result.Message = err.Error()
+			return result
+		}
+	}
+	modelRatio := common.GetModelRatio(log.ModelName)
+	if common.IsFreeModel(log.ModelName) {
+		modelRatio = 0
+	}
+	// the discount the user had when charged, not the current one
+	discount := log.Discount
+	if discount <= 0 {
+		discount = 1
+	}
+	groupRatio := common.GetGroupRatio(group) * discount * common.GetServiceTierRatio(charge.serviceTier)
+	result.Quota = getUsageQuota(log.ModelName, result.PromptTokens, result.CompletionTokens, charge.audioTokens, modelRatio, groupRatio)
+	if log.Recounted {
+		// compare with what the user was charged after the previous adjustment
+		result.LoggedQuota = log.RecountedQuota
+	}
+	result.Delta = result.Quota - result.LoggedQuota
+	if !apply || result.Delta == 0 {
+		return result
+	}
+	if log.Recounted {
+		result.Message = model.ErrLogAlreadyRecounted.Error()
+		return result
+	}
+	err := model.ApplyLogRecount(log.Id, log.UserId, result.Quota, result.Delta)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	result.Applied = true
+	model.RecordLog(log.UserId, model.LogTypeManage, fmt.Sprintf("重新计费日志 #%d，原额度 %s，新额度 %s，调整 %s",
+		log.Id, common.LogQuota(result.LoggedQuota), common.LogQuota(result.Quota), common.LogQuota(-result.Delta)))
+	return result
+}
+
+func RecountLog(c *gin.Context) {
+	var req struct {
+		recountItem
+		Apply bool `json:"apply"`
+	}
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	result := recountLog(&req.recountItem, req.Apply)
+	c.JSON(http.StatusOK, gin.H{
+		"success": result.Message == "",
+		"message": result.Message,
+		"data":    result,
+	})
+	return
+}
+
+// BatchRecountLogs recounts the consume logs in the given time range and streams the comparison as CSV,
+// logs with a supplied request are counted again, the others are repriced from their logged tokens
+func BatchRecountLogs(c *gin.Context) {
+	var req struct {
+		StartTimestamp int64         `json:"start_timestamp"`
+		EndTimestamp   int64         `json:"end_timestamp"`
+		Items          []recountItem `json:"items"`
+		Apply          bool          `json:"apply"`
+	}
+	err := c.ShouldBindJSON(&req)
+	if err == nil && req.StartTimestamp == 0 {
+		err = errors.New("请指定开始时间")
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	items := make(map[int]*recountItem, len(req.Items))
+	for i := range req.Items {
+		items[req.Items[i].LogId] = &req.Items[i]
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", "attachment; filename=recount.csv")
+	writer := csv.NewWriter(c.Writer)
+	_ = writer.Write(recountCSVHeader)
+	for afterId := 0; ; {
+		logs, err := model.GetConsumeLogsInRange(req.StartTimestamp, req.EndTimestamp, afterId, common.ItemsPerPage)
+		if err != nil {
+			common.SysError("failed to get logs to recount: " + err.Error())
+			break
+		}
+		for _, log := range logs {
+			result := recountLoggedCharge(log, items[log.Id], req.Apply)
+			_ = writer.Write(result.csvRecord())
+			afterId = log.Id
+		}
+		writer.Flush()
+		c.Writer.Flush()
+		if len(logs) < common.ItemsPerPage {
+			break
+		}
+	}
+	writer.Flush()
+}
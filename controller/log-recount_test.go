@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRecountUsesTheLoggedCountingMode(t *testing.T) {
+	// the charge was counted approximately for the token, the global default is exact counting
+	defer func(approximate bool) { common.ApproximateTokenEnabled = approximate }(common.ApproximateTokenEnabled)
+	common.ApproximateTokenEnabled = false
+	user := createTestUser(t, "recount-mode", 1000000)
+	log := &model.Log{UserId: user.Id, Type: model.LogTypeConsume, ModelName: "gpt-3.5-turbo",
+		Content: "模型倍率 0.75，分组倍率 1.00，" + approximateCountLogNote, PromptTokens: 1, CompletionTokens: 1, Quota: 1}
+	if err := model.DB.Create(log).Error; err != nil {
+		t.Fatalf("failed to create log: %v", err)
+	}
+	request := `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"hello there"}]}`
+	result := recountLog(&recountItem{LogId: log.Id, Request: []byte(request), Response: "general kenobi"}, false)
+	if result.Message != "" {
+		t.Fatalf("recount failed: %s", result.Message)
+	}
+	textRequest, _, _, _ := parseTextRequest([]byte(request))
+	if want := countTokenMessages(textRequest.Messages, "gpt-3.5-turbo", true); result.PromptTokens != want {
+		t.Errorf("recounted %d prompt tokens, want the approximate %d", result.PromptTokens, want)
+	}
+	if want := countTokenText("general kenobi", "gpt-3.5-turbo", true); result.CompletionTokens != want {
+		t.Errorf("recounted %d completion tokens, want the approximate %d", result.CompletionTokens, want)
+	}
+}
+
+func TestRecountUsesTheLoggedDiscount(t *testing.T) {
+	// the user had a discount of 0.5 when charged, it was lifted since
+	user := createTestUser(t, "recount-discount", 1000000)
+	request := `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"hello there"}]}`
+	recount := func(discount float64) int {
+		log := &model.Log{UserId: user.Id, Type: model.LogTypeConsume, ModelName: "gpt-3.5-turbo", Quota: 1, Discount: discount,
+			Content: approximateCountLogNote}
+		if err := model.DB.Create(log).Error; err != nil {
+			t.Fatalf("failed to create log: %v", err)
+		}
+		result := recountLog(&recountItem{LogId: log.Id, Request: []byte(request), Response: "general kenobi"}, false)
+		if result.Message != "" {
+			t.Fatalf("recount failed: %s", result.Message)
+		}
+		return result.Quota
+	}
+	full, discounted := recount(1), recount(0.5)
+	if discounted >= full {
+		t.Errorf("recounted %d with the logged discount, %d without", discounted, full)
+	}
+}
+
+func TestRecountUsesTheLoggedGroup(t *testing.T) {
+	// the user was in the vip group when charged and moved to default since
+	defer func(ratios map[string]float64) { common.GroupRatio = ratios }(common.GroupRatio)
+	common.GroupRatio = map[string]float64{"default": 1, "vip": 2}
+	user := createTestUser(t, "recount-group", 1000000)
+	log := &model.Log{UserId: user.Id, Type: model.LogTypeConsume, ModelName: "gpt-3.5-turbo", Group: "vip", Discount: 1,
+		PromptTokens: 100, CompletionTokens: 50, Quota: 1}
+	if err := model.DB.Create(log).Error; err != nil {
+		t.Fatalf("failed to create log: %v", err)
+	}
+	result := recountLog(&recountItem{LogId: log.Id}, false)
+	if result.Message != "" || result.Source != "log" {
+		t.Fatalf("recount failed: %+v", result)
+	}
+	if want := getTextQuota("gpt-3.5-turbo", 100, 50, common.GetModelRatio("gpt-3.5-turbo"), 2); result.Quota != want {
+		t.Errorf("recounted %d, want %d at the logged group ratio", result.Quota, want)
+	}
+}
+
+func TestRecountKeepsAudioChoicesAndServiceTier(t *testing.T) {
+	defer func(approximate bool) { common.ApproximateTokenEnabled = approximate }(common.ApproximateTokenEnabled)
+	common.ApproximateTokenEnabled = true
+	user := createTestUser(t, "recount-charge", 1000000)
+	log := &model.Log{UserId: user.Id, Type: model.LogTypeConsume, ModelName: "gpt-4o-audio-preview", Group: "default", Discount: 1, Quota: 1,
+		Content: "模型倍率 1.25，分组倍率 1.00，服务等级 flex，n=2，音频输出 tokens 50，音频倍率 8.00，" + approximateCountLogNote}
+	if err := model.DB.Create(log).Error; err != nil {
+		t.Fatalf("failed to create log: %v", err)
+	}
+	request := `{"model":"gpt-4o-audio-preview","n":2,"service_tier":"flex","messages":[{"role":"user","content":"hello there"}]}`
+	if result := recountLog(&recountItem{LogId: log.Id, Request: []byte(request), Response: "general kenobi"}, false); result.Message == "" {
+		t.Errorf("recounted n=2 from a single choice: %+v", result)
+	}
+	result := recountLog(&recountItem{LogId: log.Id, Request: []byte(request), Responses: []string{"general kenobi", "hello"}}, false)
+	if result.Message != "" {
+		t.Fatalf("recount failed: %s", result.Message)
+	}
+	textTokens := countTokenText("general kenobi", "gpt-4o-audio-preview", true) + countTokenText("hello", "gpt-4o-audio-preview", true)
+	if result.CompletionTokens != textTokens+50 {
+		t.Errorf("recounted %d completion tokens, want %d text and 50 audio", result.CompletionTokens, textTokens)
+	}
+	want := getUsageQuota("gpt-4o-audio-preview", result.PromptTokens, result.CompletionTokens, 50, common.GetModelRatio("gpt-4o-audio-preview"),
+		common.GetServiceTierRatio(common.ServiceTierFlex))
+	if result.Quota != want {
+		t.Errorf("recounted %d, want %d", result.Quota, want)
+	}
+}
+
+func TestBatchRecountReadsStoredLogs(t *testing.T) {
+	user := createTestUser(t, "recount-batch", 1000000)
+	var ids []int
+	for _, createdAt := range []int64{500, 1000, 1500, 2500} {
+		log := &model.Log{UserId: user.Id, Type: model.LogTypeConsume, ModelName: "gpt-3.5-turbo", Group: "default", Discount: 1,
+			CreatedAt: createdAt, PromptTokens: 10, CompletionTokens: 10, Quota: 1, Content: approximateCountLogNote}
+		if err := model.DB.Create(log).Error; err != nil {
+			t.Fatalf("failed to create log: %v", err)
+		}
+		ids = append(ids, log.Id)
+	}
+	body := fmt.Sprintf(`{"start_timestamp":1000,"end_timestamp":2000,"items":[{"log_id":%d,"request":{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"hi"}]},"response":"hello"}]}`, ids[2])
+	c, recorder := newTestContext(http.MethodPost, "/api/log/recount/batch", body)
+	BatchRecountLogs(c)
+	records, err := csv.NewReader(strings.NewReader(recorder.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make(map[int]string)
+	for _, record := range records[1:] {
+		id, _ := strconv.Atoi(record[0])
+		sources[id] = record[3]
+	}
+	if len(sources) != 2 || sources[ids[1]] != "log" || sources[ids[2]] != "request" {
+		t.Errorf("recounted %v, want logs %d and %d", sources, ids[1], ids[2])
+	}
+	var adjusted int64
+	model.DB.Model(&model.Log{}).Where("user_id = ? and recounted = ?", user.Id, true).Count(&adjusted)
+	if adjusted != 0 {
+		t.Errorf("%d logs adjusted without apply", adjusted)
+	}
+}
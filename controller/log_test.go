@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/middleware"
+	"one-api/model"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestConsumeLogIsTaggedWithTheAppTag(t *testing.T) {
+	defer func(header string) { common.AppTagHeader = header }(common.AppTagHeader)
+	common.AppTagHeader = "X-App-Tag"
+	defer func(approximate bool) { common.ApproximateTokenEnabled = approximate }(common.ApproximateTokenEnabled)
+	common.ApproximateTokenEnabled = true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "gpt-3.5-turbo-app-tag")
+	user := createTestUser(t, "apptag", 1000000)
+	token := createTestToken(t, user.Id, "apptag")
+
+	engine := gin.New()
+	relayRouter := engine.Group("/v1")
+	relayRouter.Use(middleware.AppTag(), middleware.TokenAuth(), middleware.Distribute())
+	relayRouter.POST("/*path", Relay)
+	request := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-3.5-turbo-app-tag","messages":[{"role":"user","content":"hi"}]}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer sk-"+token.Key)
+	request.Header.Set("X-App-Tag", " billing app ")
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var log model.Log
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if model.DB.Where("user_id = ? and type = ?", user.Id, model.LogTypeConsume).First(&log).Error == nil {
+			break
+		}
+	}
+	if log.AppTag != "billingapp" {
+		t.Errorf("consume log tagged %q", log.AppTag)
+	}
+	usage := model.GetAppTagUsages()["billingapp"]
+	if usage.Requests != 1 || usage.PromptTokens != 10 || usage.CompletionTokens != 5 || usage.Quota != log.Quota {
+		t.Errorf("app tag metrics %+v, logged quota %d", usage, log.Quota)
+	}
+}
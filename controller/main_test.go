@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/middleware"
+	"one-api/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	// the in-memory fallbacks are tested, InitRedisClient is never called
+	common.RedisEnabled = false
+	gin.SetMode(gin.TestMode)
+	dir, err := os.MkdirTemp("", "one-api-controller-test")
+	if err != nil {
+		panic(err)
+	}
+	common.SQLitePath = filepath.Join(dir, "one-api.db")
+	if err := model.InitDB(); err != nil {
+		panic(err)
+	}
+	model.InitOptionMap()
+	code := m.Run()
+	_ = model.CloseDB()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newTestContext(method string, target string, body string) (*gin.Context, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		c.Request.Header.Set("Content-Type", "application/json")
+	}
+	return c, recorder
+}
+
+func createTestUser(t *testing.T, username string, quota int) *model.User {
+	t.Helper()
+	user := &model.User{Username: username, Password: "password", Quota: quota, Status: common.UserStatusEnabled, Group: "default",
+		AccessToken: common.GetUUID(), AffCode: common.GetUUID()[:8]}
+	if err := model.DB.Create(user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return user
+}
+
+func createTestToken(t *testing.T, userId int, name string) *model.Token {
+	t.Helper()
+	token := &model.Token{UserId: userId, Name: name, Key: common.GetUUID(), Status: common.TokenStatusEnabled,
+		ExpiredTime: -1, RemainQuota: 1000000, CreatedTime: common.GetTimestamp()}
+	if err := model.DB.Create(token).Error; err != nil {
+		t.Fatalf("failed to create token: %v", err)
+	}
+	return token
+}
+
+func createTestChannel(t *testing.T, name string, baseURL string) *model.Channel {
+	t.Helper()
+	channel := &model.Channel{Name: name, Type: common.ChannelTypeOpenAI, Key: "sk-test", Status: common.ChannelStatusEnabled,
+		BaseURL: &baseURL, Models: "gpt-4o-mini", Group: "default"}
+	if err := model.DB.Create(channel).Error; err != nil {
+		t.Fatalf("failed to create channel: %v", err)
+	}
+	return channel
+}
+
+// streamRecorder lets handlers using c.Stream run against a recorder, which does not implement http.CloseNotifier
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r *streamRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func newTestStreamContext(method string, target string, body string) (*gin.Context, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(&streamRecorder{recorder})
+	c.Request = httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		c.Request.Header.Set("Content-Type", "application/json")
+	}
+	return c, recorder
+}
+
+// createTestRelayChannel creates a channel with its abilities, so that Distribute selects it for the models,
+// the models should be unique to the test
+func createTestRelayChannel(t *testing.T, baseURL string, models string) *model.Channel {
+	t.Helper()
+	channel := &model.Channel{Name: models, Type: common.ChannelTypeOpenAI, Key: "sk-test", Status: common.ChannelStatusEnabled,
+		BaseURL: &baseURL, Models: models, Group: "default"}
+	if err := channel.Insert(); err != nil {
+		t.Fatalf("failed to create channel: %v", err)
+	}
+	return channel
+}
+
+// serveRelay sends a relay request through the token and channel middlewares, like SetRelayRouter does
+func serveRelay(t *testing.T, token *model.Token, path string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serveRelayWithHeader(t, token, path, body, nil)
+}
+
+// serveRelayWithHeader is serveRelay with extra client request headers
+func serveRelayWithHeader(t *testing.T, token *model.Token, path string, body string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	// the tiktoken encoders are not loaded in tests
+	defer func(approximate bool) { common.ApproximateTokenEnabled = approximate }(common.ApproximateTokenEnabled)
+	common.ApproximateTokenEnabled = true
+	engine := gin.New()
+	relayRouter := engine.Group("/v1")
+	relayRouter.Use(middleware.TokenAuth(), middleware.Distribute())
+	relayRouter.POST("/*path", Relay)
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer sk-"+token.Key)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(&streamRecorder{recorder}, request)
+	return recorder
+}
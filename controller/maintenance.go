@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/model"
+	"strconv"
+)
+
+func GetModelMaintenances(c *gin.Context) {
+	maintenances, err := model.GetModelMaintenances()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    maintenances,
+	})
+	return
+}
+
+func AddModelMaintenance(c *gin.Context) {
+	maintenance := model.ModelMaintenance{}
+	err := c.ShouldBindJSON(&maintenance)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if maintenance.Model == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "模型不能为空",
+		})
+		return
+	}
+	if _, err := model.GetChannelById(maintenance.ChannelId, false); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "无效的渠道 Id",
+		})
+		return
+	}
+	maintenance.Id = 0
+	err = maintenance.Insert()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    maintenance,
+	})
+	return
+}
+
+func DeleteModelMaintenance(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	err := model.DeleteModelMaintenanceById(id)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+	return
+}
@@ -1,7 +1,12 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -31,6 +36,8 @@ type OpenAIModels struct {
 	Permission []OpenAIModelPermission `json:"permission"`
 	Root       string                  `json:"root"`
 	Parent     *string                 `json:"parent"`
+	FreeTier   bool                    `json:"free_tier,omitempty"`
+	Health     *model.ModelHealth      `json:"health,omitempty"` // admins only
 }
 
 var openAIModels []OpenAIModels
@@ -583,16 +590,36 @@ func init() {
 	}
 }
 
+// isAdminToken tells whether the request comes from an admin, who may see the channel health of models
+func isAdminToken(c *gin.Context) bool {
+	return model.CacheIsAdmin(c.GetInt("id"))
+}
+
 func ListModels(c *gin.Context) {
+	models := make([]OpenAIModels, len(openAIModels))
+	copy(models, openAIModels)
+	var healths map[string]*model.ModelHealth
+	if isAdminToken(c) {
+		var err error
+		healths, err = model.GetModelHealths()
+		if err != nil {
+			common.SysError("failed to get model healths: " + err.Error())
+		}
+	}
+	for i := range models {
+		models[i].FreeTier = common.IsFreeModel(models[i].Id)
+		models[i].Health = healths[models[i].Id]
+	}
 	c.JSON(200, gin.H{
 		"object": "list",
-		"data":   openAIModels,
+		"data":   models,
 	})
 }
 
 func RetrieveModel(c *gin.Context) {
 	modelId := c.Param("model")
 	if model, ok := openAIModelsMap[modelId]; ok {
+		model.FreeTier = common.IsFreeModel(model.Id)
 		c.JSON(200, model)
 	} else {
 		openAIError := OpenAIError{
@@ -606,3 +633,46 @@ func RetrieveModel(c *gin.Context) {
 		})
 	}
 }
+
+// UpdateDisabledModel adds a model to or removes it from the kill list, it takes effect without restart
+func UpdateDisabledModel(c *gin.Context) {
+	var req struct {
+		Model    string `json:"model"`
+		Disabled bool   `json:"disabled"`
+	}
+	err := c.ShouldBindJSON(&req)
+	if err == nil && req.Model == "" {
+		err = errors.New("模型不能为空")
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	var disabledModels []string
+	for _, name := range strings.Split(common.DisabledModels, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && name != req.Model {
+			disabledModels = append(disabledModels, name)
+		}
+	}
+	if req.Disabled {
+		disabledModels = append(disabledModels, req.Model)
+	}
+	err = model.UpdateOption("DisabledModels", strings.Join(disabledModels, ","))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    common.DisabledModels,
+	})
+	return
+}
@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"strings"
+	"testing"
+)
+
+func TestModelKillSwitch(t *testing.T) {
+	defer func(disabledModels string) { common.DisabledModels = disabledModels }(common.DisabledModels)
+	common.DisabledModels = ""
+	relayed := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		relayed++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "kill-switch-model,kill-switch-other")
+	token := createTestToken(t, createTestUser(t, "kill-switch", 1000000).Id, "kill-switch")
+	request := func(modelName string) *httptest.ResponseRecorder {
+		t.Helper()
+		return serveRelay(t, token, "/v1/chat/completions", `{"model":"`+modelName+`","messages":[{"role":"user","content":"hi"}]}`)
+	}
+	toggle := func(body string) {
+		t.Helper()
+		c, recorder := newTestContext(http.MethodPut, "/api/channel/disabled_models", body)
+		UpdateDisabledModel(c)
+		if !strings.Contains(recorder.Body.String(), `"success":true`) {
+			t.Fatalf("toggle failed: %s", recorder.Body.String())
+		}
+	}
+
+	toggle(`{"model":"kill-switch-model","disabled":true}`)
+	if recorder := request("kill-switch-model"); recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "model_temporarily_disabled") {
+		t.Errorf("disabled model got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := request("kill-switch-other"); recorder.Code != http.StatusOK {
+		t.Errorf("other model got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if relayed != 1 {
+		t.Errorf("relayed %d requests, the disabled model reached the upstream", relayed)
+	}
+
+	toggle(`{"model":"kill-switch-model","disabled":false}`)
+	if common.DisabledModels != "" {
+		t.Errorf("kill list not cleared: %q", common.DisabledModels)
+	}
+	if recorder := request("kill-switch-model"); recorder.Code != http.StatusOK {
+		t.Errorf("re-enabled model got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// prefix patterns disable a whole family
+	common.DisabledModels = "kill-switch-*"
+	if recorder := request("kill-switch-other"); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("model matching a prefix pattern got %d", recorder.Code)
+	}
+}
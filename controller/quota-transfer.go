@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+)
+
+type quotaTransferRequest struct {
+	UserId int `json:"user_id"`
+	Quota  int `json:"quota"`
+}
+
+// RequestQuotaTransfer lets a user move quota to a user of the same tenant,
+// the quota is held until an admin approves the transfer unless transfers are auto approved
+func RequestQuotaTransfer(c *gin.Context) {
+	var req quotaTransferRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil || req.UserId == 0 || req.Quota <= 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "无效的参数",
+		})
+		return
+	}
+	id := c.GetInt("id")
+	if req.UserId == id {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "不能向自己转账",
+		})
+		return
+	}
+	sender, err := model.GetUserById(id, false)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	recipient, err := model.GetUserById(req.UserId, false)
+	if err != nil || recipient.TenantId != sender.TenantId {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "用户不存在",
+		})
+		return
+	}
+	transfer, err := model.CreateQuotaTransfer(id, req.UserId, sender.TenantId, req.Quota)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if common.QuotaTransferAutoApproveEnabled {
+		transfer, err = model.ApproveQuotaTransfer(transfer.Id, 0)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		_ = model.CacheUpdateUserQuota(req.UserId)
+	}
+	_ = model.CacheUpdateUserQuota(id)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    transfer,
+	})
+	return
+}
+
+func GetSelfQuotaTransfers(c *gin.Context) {
+	p, _ := strconv.Atoi(c.Query("p"))
+	if p < 0 {
+		p = 0
+	}
+	transfers, err := model.GetUserQuotaTransfers(c.GetInt("id"), p*common.ItemsPerPage, common.ItemsPerPage)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    transfers,
+	})
+	return
+}
+
+func CancelQuotaTransfer(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	transfer, err := model.CancelQuotaTransfer(id, c.GetInt("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	_ = model.CacheUpdateUserQuota(transfer.FromUserId)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    transfer,
+	})
+	return
+}
+
+func GetPendingQuotaTransfers(c *gin.Context) {
+	transfers, err := model.GetPendingQuotaTransfers(getTenantId(c))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    transfers,
+	})
+	return
+}
+
+// ReviewQuotaTransfer approves or rejects a pending transfer, reviewing it again with the same action succeeds
+func ReviewQuotaTransfer(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var transfer *model.QuotaTransfer
+	var err error
+	switch c.Query("action") {
+	case "approve":
+		transfer, err = model.ApproveQuotaTransfer(id, getTenantId(c))
+	case "reject":
+		transfer, err = model.RejectQuotaTransfer(id, getTenantId(c))
+	default:
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "无效的参数",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	_ = model.CacheUpdateUserQuota(transfer.FromUserId)
+	_ = model.CacheUpdateUserQuota(transfer.ToUserId)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    transfer,
+	})
+	return
+}
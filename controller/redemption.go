@@ -73,6 +73,14 @@ func GetRedemption(c *gin.Context) {
 }
 
 func AddRedemption(c *gin.Context) {
+	if getTenantId(c) != 0 {
+		// codes would mint quota outside the reseller's pool
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "分销管理员无法管理兑换码，请从自己的额度中划转",
+		})
+		return
+	}
 	redemption := model.Redemption{}
 	err := c.ShouldBindJSON(&redemption)
 	if err != nil {
@@ -150,6 +158,14 @@ func DeleteRedemption(c *gin.Context) {
 }
 
 func UpdateRedemption(c *gin.Context) {
+	if getTenantId(c) != 0 {
+		// codes would mint quota outside the reseller's pool
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "分销管理员无法管理兑换码，请从自己的额度中划转",
+		})
+		return
+	}
 	statusOnly := c.Query("status_only")
 	redemption := model.Redemption{}
 	err := c.ShouldBindJSON(&redemption)
@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type relayAttempt struct {
+	ChannelId  int    `json:"channel_id"`
+	StatusCode int    `json:"status_code"`
+	Code       any    `json:"code"`
+	Latency    int64  `json:"latency"` // in milliseconds
+	Message    string `json:"message"`
+}
+
+type relayAttemptChain struct {
+	attempts  []relayAttempt
+	updatedAt int64
+}
+
+// relayAttemptChains keeps the failed attempts of requests being retried, keyed by the request id of the first attempt.
+// Retries are redirects, so the chain has to survive across requests, its id travels in the server signed retry ticket.
+// With Redis the chains are shared by all nodes, a retry may land on any of them.
+var relayAttemptChains = map[string]*relayAttemptChain{}
+var relayAttemptChainsLock sync.Mutex
+
+func getRelayAttemptsKey(chainId string) string {
+	return "relayAttempts:" + chainId
+}
+
+func addRelayAttempt(chainId string, attempt relayAttempt) {
+	if common.RedisEnabled {
+		attempts := append(getRelayAttempts(chainId), attempt)
+		attemptsJSON, err := json.Marshal(attempts)
+		if err == nil {
+			err = common.RedisSet(getRelayAttemptsKey(chainId), string(attemptsJSON), time.Duration(common.RetryTicketTTL)*time.Second)
+		}
+		if err != nil {
+			common.SysError("failed to record relay attempt: " + err.Error())
+		}
+		return
+	}
+	relayAttemptChainsLock.Lock()
+	defer relayAttemptChainsLock.Unlock()
+	now := common.GetTimestamp()
+	for id, chain := range relayAttemptChains {
+		// clients may not follow the retry redirect
+		if now-chain.updatedAt > common.RetryTicketTTL {
+			delete(relayAttemptChains, id)
+		}
+	}
+	chain, ok := relayAttemptChains[chainId]
+	if !ok {
+		chain = &relayAttemptChain{}
+		relayAttemptChains[chainId] = chain
+	}
+	chain.attempts = append(chain.attempts, attempt)
+	chain.updatedAt = now
+}
+
+func getRelayAttempts(chainId string) []relayAttempt {
+	if common.RedisEnabled {
+		attemptsJSON, err := common.RedisGet(getRelayAttemptsKey(chainId))
+		if err != nil {
+			return nil
+		}
+		var attempts []relayAttempt
+		if err := json.Unmarshal([]byte(attemptsJSON), &attempts); err != nil {
+			return nil
+		}
+		return attempts
+	}
+	relayAttemptChainsLock.Lock()
+	defer relayAttemptChainsLock.Unlock()
+	chain, ok := relayAttemptChains[chainId]
+	if !ok {
+		return nil
+	}
+	return chain.attempts
+}
+
+// setRelayDeadline binds the upstream requests to the latency budget, it bounds the wait for upstream only,
+// doUpstreamRequest stops the timer once a response arrived, so a response being relayed, e.g. a long stream, is never cut off
+func setRelayDeadline(c *gin.Context, deadline time.Time) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Set("relay_context", ctx)
+	c.Set("relay_deadline", deadline)
+	c.Set("relay_deadline_timer", time.AfterFunc(time.Until(deadline), cancel))
+	return cancel
+}
+
+// isRelayBudgetExceeded tells whether the latency budget of the attempt chain has run out, no retry is made then
+func isRelayBudgetExceeded(c *gin.Context) bool {
+	deadline, ok := c.Get("relay_deadline")
+	return ok && !time.Now().Before(deadline.(time.Time))
+}
+
+// stopRelayDeadline keeps the latency budget from cancelling the response of upstream once it arrived
+func stopRelayDeadline(c *gin.Context) {
+	if timer, ok := c.Get("relay_deadline_timer"); ok {
+		timer.(*time.Timer).Stop()
+	}
+}
+
+// getRelayContext is the context upstream requests are bound to, it carries the latency budget deadline if any
+func getRelayContext(c *gin.Context) context.Context {
+	if ctx, ok := c.Get("relay_context"); ok {
+		return ctx.(context.Context)
+	}
+	return context.Background()
+}
+
+func removeRelayAttempts(chainId string) []relayAttempt {
+	if common.RedisEnabled {
+		attempts := getRelayAttempts(chainId)
+		if len(attempts) > 0 {
+			_ = common.RedisDel(getRelayAttemptsKey(chainId))
+		}
+		return attempts
+	}
+	relayAttemptChainsLock.Lock()
+	defer relayAttemptChainsLock.Unlock()
+	chain, ok := relayAttemptChains[chainId]
+	if !ok {
+		return nil
+	}
+	delete(relayAttemptChains, chainId)
+	return chain.attempts
+}
+
+// newRelayAttempt records a failed attempt, message is the error message with the prompt echoes masked
+func newRelayAttempt(c *gin.Context, err *OpenAIErrorWithStatusCode, message string, startTime time.Time) relayAttempt {
+	return relayAttempt{
+		ChannelId:  c.GetInt("channel_id"),
+		StatusCode: err.StatusCode,
+		Code:       err.Code,
+		Latency:    time.Since(startTime).Milliseconds(),
+		Message:    message,
+	}
+}
+
+// formatRelayAttempts summarizes the failed attempts for the consume log
+func formatRelayAttempts(attempts []relayAttempt) string {
+	parts := make([]string, 0, len(attempts))
+	for _, attempt := range attempts {
+		parts = append(parts, fmt.Sprintf("#%d(%d)", attempt.ChannelId, attempt.StatusCode))
+	}
+	return fmt.Sprintf("重试 %d 次：%s", len(attempts), strings.Join(parts, " "))
+}
+
+func recordFailedRequest(c *gin.Context, attempts []relayAttempt, message string) {
+	attemptsJSON, err := json.Marshal(attempts)
+	if err != nil {
+		common.SysError("failed to marshal relay attempts: " + err.Error())
+		return
+	}
+	model.RecordFailedRequest(&model.FailedRequest{
+		UserId:    c.GetInt("id"),
+		ModelName: c.GetString("request_model"),
+		RequestId: c.GetString(common.RequestIdKey),
+		Attempts:  string(attemptsJSON),
+		Message:   message,
+	})
+}
+
+func GetFailedRequests(c *gin.Context) {
+	p, _ := strconv.Atoi(c.Query("p"))
+	if p < 0 {
+		p = 0
+	}
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	modelName := c.Query("model_name")
+	failedRequests, err := model.GetFailedRequests(startTimestamp, endTimestamp, modelName, p*common.ItemsPerPage, common.ItemsPerPage)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    failedRequests,
+	})
+	return
+}
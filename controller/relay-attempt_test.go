@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelayDeadlineTripsOnSlowUpstream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer server.Close()
+	c, _ := newTestContext(http.MethodPost, "/v1/chat/completions", "")
+	cancel := setRelayDeadline(c, time.Now().Add(50*time.Millisecond))
+	defer cancel()
+	req, _ := http.NewRequestWithContext(getRelayContext(c), http.MethodPost, server.URL, nil)
+	start := time.Now()
+	resp, err := doUpstreamRequest(c, server.Client(), req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("slow upstream did not trip the latency budget")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("budget tripped after %s", time.Since(start))
+	}
+	if !isRelayBudgetExceeded(c) {
+		t.Error("budget not reported as exceeded, the request would be retried")
+	}
+}
+
+func TestRelayDeadlineKeepsStreamInProgress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for i := 0; i < 3; i++ {
+			time.Sleep(50 * time.Millisecond)
+			_, _ = io.WriteString(w, "data: {}\n\n")
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+	c, _ := newTestContext(http.MethodPost, "/v1/chat/completions", "")
+	cancel := setRelayDeadline(c, time.Now().Add(75*time.Millisecond))
+	defer cancel()
+	req, _ := http.NewRequestWithContext(getRelayContext(c), http.MethodPost, server.URL, nil)
+	resp, err := doUpstreamRequest(c, server.Client(), req)
+	if err != nil {
+		t.Fatalf("doUpstreamRequest: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("stream cut off by the latency budget: %v", err)
+	}
+	if len(body) != 3*len("data: {}\n\n") {
+		t.Errorf("unexpected stream %q", body)
+	}
+}
+
+func TestLatencyBudgetFailsSlowRelay(t *testing.T) {
+	defer func(budgets map[string]int, retryTimes int) {
+		common.GroupLatencyBudget, common.RetryTimes = budgets, retryTimes
+	}(common.GroupLatencyBudget, common.RetryTimes)
+	if err := common.UpdateGroupLatencyBudgetByJSONString(`{"default":100}`); err != nil {
+		t.Fatal(err)
+	}
+	// a retry would be made if the budget had not run out
+	common.RetryTimes = 2
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+	createTestRelayChannel(t, upstream.URL, "latency-budget-model")
+	token := createTestToken(t, createTestUser(t, "latency-budget", 1000000).Id, "latency-budget")
+	start := time.Now()
+	recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"latency-budget-model","messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != http.StatusGatewayTimeout || !strings.Contains(recorder.Body.String(), "latency_budget_exceeded") {
+		t.Errorf("got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("budget tripped after %s", elapsed)
+	}
+}
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"one-api/common"
+)
+
+// mp3Bitrates are the Layer III bitrates in kbps indexed by the frame header bitrate index,
+// MPEG-2 and MPEG-2.5 share the lower table
+var mp3Bitrates = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+var mp3LowSampleRateBitrates = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+
+const (
+	mp3VersionReserved = 1
+	mp3VersionMPEG1    = 3
+	mp3LayerIII        = 1
+)
+
+// getWavDuration reads the byte rate from the fmt chunk and the size of the data chunk
+func getWavDuration(buf []byte) (float64, error) {
+	if len(buf) < 12 || string(buf[0:4]) != "RIFF" || string(buf[8:12]) != "WAVE" {
+		return 0, errors.New("invalid wav data")
+	}
+	byteRate := uint32(0)
+	for offset := 12; offset+8 <= len(buf); {
+		chunkId := string(buf[offset : offset+4])
+		chunkSize := binary.LittleEndian.Uint32(buf[offset+4 : offset+8])
+		offset += 8
+		switch chunkId {
+		case "fmt ":
+			if offset+12 > len(buf) {
+				return 0, errors.New("invalid wav fmt chunk")
+			}
+			byteRate = binary.LittleEndian.Uint32(buf[offset+8 : offset+12])
+		case "data":
+			if byteRate == 0 {
+				return 0, errors.New("invalid wav byte rate")
+			}
+			dataSize := int(chunkSize)
+			if dataSize > len(buf)-offset {
+				dataSize = len(buf) - offset
+			}
+			return float64(dataSize) / float64(byteRate), nil
+		}
+		offset += int(chunkSize) + int(chunkSize%2)
+	}
+	return 0, errors.New("wav data chunk not found")
+}
+
+// getMp3Duration estimates the duration from the bitrate of the first frame, exact for constant bitrate files
+func getMp3Duration(buf []byte) (float64, error) {
+	offset := 0
+	if len(buf) >= 10 && string(buf[0:3]) == "ID3" {
+		// the tag size is a 28 bit synchsafe integer
+		tagSize := int(buf[6])<<21 | int(buf[7])<<14 | int(buf[8])<<7 | int(buf[9])
+		offset = 10 + tagSize
+	}
+	for ; offset+4 <= len(buf); offset++ {
+		if buf[offset] != 0xFF || buf[offset+1]&0xE0 != 0xE0 {
+			continue
+		}
+		version := buf[offset+1] >> 3 & 0x03
+		if version == mp3VersionReserved || buf[offset+1]>>1&0x03 != mp3LayerIII {
+			continue
+		}
+		bitrate := mp3Bitrates[buf[offset+2]>>4]
+		if version != mp3VersionMPEG1 {
+			bitrate = mp3LowSampleRateBitrates[buf[offset+2]>>4]
+		}
+		if bitrate == 0 {
+			continue
+		}
+		return float64(len(buf)-offset) * 8 / float64(bitrate*1000), nil
+	}
+	return 0, errors.New("mp3 frame not found")
+}
+
+func countTokenAudio(audio *ContentPartInputAudio) (int, error) {
+	buf, err := base64.StdEncoding.DecodeString(audio.Data)
+	if err != nil {
+		return 0, err
+	}
+	var duration float64
+	switch audio.Format {
+	case "wav":
+		duration, err = getWavDuration(buf)
+	case "mp3":
+		duration, err = getMp3Duration(buf)
+	default:
+		return 0, fmt.Errorf("unsupported audio format %q", audio.Format)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Ceil(duration * float64(common.AudioInputTokensPerSecond))), nil
+}
+
+func countTokenAudios(audios []*ContentPartInputAudio) (int, error) {
+	tokens := 0
+	for _, audio := range audios {
+		token, err := countTokenAudio(audio)
+		if err != nil {
+			return 0, err
+		}
+		tokens += token
+	}
+	return tokens, nil
+}
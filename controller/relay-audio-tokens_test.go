@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"encoding/base64"
+	"one-api/common"
+	"testing"
+)
+
+// mp3Frames is a buffer of the given size starting with a frame header of bitrate index 9
+func mp3Frames(versionLayerByte byte, size int) []byte {
+	buf := make([]byte, size)
+	buf[0], buf[1], buf[2] = 0xFF, versionLayerByte, 0x90
+	return buf
+}
+
+func TestMp3DurationPerMPEGVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   byte
+		duration float64
+	}{
+		{"MPEG-1 128 kbps", 0xFB, 1},
+		{"MPEG-2 80 kbps", 0xF3, 1.6},
+		{"MPEG-2.5 80 kbps", 0xE3, 1.6},
+	}
+	for _, test := range tests {
+		duration, err := getMp3Duration(mp3Frames(test.header, 16000))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if duration != test.duration {
+			t.Errorf("%s: duration %v, want %v", test.name, duration, test.duration)
+		}
+	}
+	// the reserved version is not a frame header
+	if _, err := getMp3Duration(mp3Frames(0xEB, 16000)); err == nil {
+		t.Error("a reserved MPEG version was measured")
+	}
+}
+
+func TestCountTokenAudioBillsByDuration(t *testing.T) {
+	defer func(rate int) { common.AudioInputTokensPerSecond = rate }(common.AudioInputTokensPerSecond)
+	common.AudioInputTokensPerSecond = 10
+	audio := &ContentPartInputAudio{Data: base64.StdEncoding.EncodeToString(mp3Frames(0xF3, 16000)), Format: "mp3"}
+	tokens, err := countTokenAudio(audio)
+	if err != nil {
+		t.Fatalf("countTokenAudio: %v", err)
+	}
+	if tokens != 16 {
+		t.Errorf("counted %d tokens for 1.6s of MPEG-2 audio, want 16", tokens)
+	}
+}
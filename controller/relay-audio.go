@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"one-api/common"
 	"one-api/model"
+	"strings"
 )
 
 func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
@@ -39,10 +40,12 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 
 	preConsumedTokens := common.PreConsumedQuota
 	modelRatio := common.GetModelRatio(audioModel)
-	groupRatio := common.GetGroupRatio(group)
+	// the negotiated user discount applies on top of the group ratio
+	userDiscount := model.CacheGetUserDiscount(userId)
+	groupRatio := common.GetGroupRatio(group) * userDiscount
 	ratio := modelRatio * groupRatio
 	preConsumedQuota := int(float64(preConsumedTokens) * ratio)
-	userQuota, err := model.CacheGetUserQuota(userId)
+	userQuota, err := model.GetUserQuotaForCategory(userId, model.QuotaCategoryAudio)
 	if err != nil {
 		return errorWrapper(err, "get_user_quota_failed", http.StatusInternalServerError)
 	}
@@ -58,7 +61,7 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 		if userQuota-preConsumedQuota < 0 {
 			return errorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
 		}
-		err = model.CacheDecreaseUserQuota(userId, preConsumedQuota)
+		err = model.CacheDecreaseUserCategoryQuota(userId, model.QuotaCategoryAudio, preConsumedQuota)
 		if err != nil {
 			return errorWrapper(err, "decrease_user_quota_failed", http.StatusInternalServerError)
 		}
@@ -68,7 +71,7 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 			preConsumedQuota = 0
 		}
 		if preConsumedQuota > 0 {
-			err := model.PreConsumeTokenQuota(tokenId, preConsumedQuota)
+			err := model.PreConsumeTokenQuota(tokenId, preConsumedQuota, model.QuotaCategoryAudio)
 			if err != nil {
 				return errorWrapper(err, "pre_consume_token_quota_failed", http.StatusForbidden)
 			}
@@ -84,9 +87,14 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 			return errorWrapper(err, "unmarshal_model_mapping_failed", http.StatusInternalServerError)
 		}
 		if modelMap[audioModel] != "" {
+			// responses report the model the client asked for, not the mapped upstream one
+			c.Set("response_model", audioModel)
 			audioModel = modelMap[audioModel]
 		}
 	}
+	if virtualModel := c.GetString("virtual_model"); virtualModel != "" {
+		c.Set("response_model", virtualModel)
+	}
 
 	baseURL := common.ChannelBaseURLs[channelType]
 	requestURL := c.Request.URL.String()
@@ -97,15 +105,21 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 	fullRequestURL := getFullRequestURL(baseURL, requestURL, channelType)
 	requestBody := c.Request.Body
 
-	req, err := http.NewRequest(c.Request.Method, fullRequestURL, requestBody)
+	req, err := http.NewRequestWithContext(getRelayContext(c), c.Request.Method, fullRequestURL, requestBody)
 	if err != nil {
 		return errorWrapper(err, "new_request_failed", http.StatusInternalServerError)
 	}
 	req.Header.Set("Authorization", c.Request.Header.Get("Authorization"))
 	req.Header.Set("Content-Type", c.Request.Header.Get("Content-Type"))
 	req.Header.Set("Accept", c.Request.Header.Get("Accept"))
+	applyForwardedHeaders(req, c.Request.Header, channelType)
+	applyChannelAuth(req, c.GetString("auth_type"), c.GetString("auth_param"), strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer "))
 
-	resp, err := httpClient.Do(req)
+	client, err := getRelayHTTPClient(c)
+	if err != nil {
+		return errorWrapper(err, "get_http_client_failed", http.StatusInternalServerError)
+	}
+	resp, err := doUpstreamRequest(c, client, req)
 	if err != nil {
 		return errorWrapper(err, "do_request_failed", http.StatusInternalServerError)
 	}
@@ -121,7 +135,7 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 
 	if relayMode == RelayModeAudioSpeech {
 		defer func(ctx context.Context) {
-			go postConsumeQuota(ctx, tokenId, quota, userId, channelId, modelRatio, groupRatio, audioModel, tokenName)
+			go postConsumeQuota(ctx, tokenId, quota, model.QuotaCategoryAudio, userId, channelId, modelRatio, groupRatio, userDiscount, audioModel, tokenName, group)
 		}(c.Request.Context())
 	} else {
 		responseBody, err := io.ReadAll(resp.Body)
@@ -137,10 +151,14 @@ func relayAudioHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode
 		if err != nil {
 			return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError)
 		}
+		if responseModel, serviceTier, rewrite := getResponseRewrite(c); rewrite {
+			responseBody = rewriteResponse(responseBody, responseModel, serviceTier)
+			resp.Header.Del("Content-Length")
+		}
 		defer func(ctx context.Context) {
-			quota := countTokenText(whisperResponse.Text, audioModel)
+			quota := countTokenText(whisperResponse.Text, audioModel, isApproximateTokenCount(c))
 			quotaDelta := quota - preConsumedQuota
-			go postConsumeQuota(ctx, tokenId, quotaDelta, userId, channelId, modelRatio, groupRatio, audioModel, tokenName)
+			go postConsumeQuota(ctx, tokenId, quotaDelta, model.QuotaCategoryAudio, userId, channelId, modelRatio, groupRatio, userDiscount, audioModel, tokenName, group)
 		}(c.Request.Context())
 		resp.Body = io.NopCloser(bytes.NewBuffer(responseBody))
 	}
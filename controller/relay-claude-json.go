@@ -0,0 +1,344 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"io"
+	"net/http"
+	"one-api/common"
+	"strings"
+)
+
+// JSON mode requests to Anthropic go to the messages API with a single tool the model is forced to call,
+// the tool input is the JSON object, the text completions API has no way to enforce it
+
+const claudeJSONToolName = "json_response"
+
+type ClaudeMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ClaudeTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type ClaudeToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type ClaudeMessagesRequest struct {
+	Model       string            `json:"model"`
+	System      string            `json:"system,omitempty"`
+	Messages    []ClaudeMessage   `json:"messages"`
+	MaxTokens   int               `json:"max_tokens"`
+	Temperature float64           `json:"temperature,omitempty"`
+	TopP        float64           `json:"top_p,omitempty"`
+	Stream      bool              `json:"stream,omitempty"`
+	Tools       []ClaudeTool      `json:"tools"`
+	ToolChoice  *ClaudeToolChoice `json:"tool_choice"`
+}
+
+type ClaudeContentBlock struct {
+	Type  string          `json:"type"`
+	Text  string          `json:"text,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+type ClaudeUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type ClaudeMessagesResponse struct {
+	Id         string               `json:"id"`
+	Model      string               `json:"model"`
+	Content    []ClaudeContentBlock `json:"content"`
+	StopReason string               `json:"stop_reason"`
+	Usage      ClaudeUsage          `json:"usage"`
+	Error      ClaudeError          `json:"error"`
+}
+
+// ClaudeMessagesStreamEvent covers the events of a messages stream we read
+type ClaudeMessagesStreamEvent struct {
+	Type    string                  `json:"type"`
+	Message *ClaudeMessagesResponse `json:"message,omitempty"`
+	Delta   struct {
+		Type        string `json:"type"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *ClaudeUsage `json:"usage,omitempty"`
+	Error ClaudeError  `json:"error"`
+}
+
+// invalidJSONError reports an upstream that ignored JSON mode
+func invalidJSONError() *OpenAIErrorWithStatusCode {
+	return &OpenAIErrorWithStatusCode{
+		OpenAIError: OpenAIError{
+			Message: "upstream returned invalid JSON in JSON mode",
+			Type:    "upstream_error",
+			Code:    "invalid_json_from_upstream",
+		},
+		StatusCode: http.StatusBadGateway,
+	}
+}
+
+func stopReasonClaudeMessages2OpenAI(reason string) string {
+	switch reason {
+	case "end_turn", "stop_sequence", "tool_use":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	default:
+		return reason
+	}
+}
+
+// requestOpenAI2ClaudeJSON forces the output through the json_response tool, a json_schema format becomes its input schema
+func requestOpenAI2ClaudeJSON(textRequest GeneralOpenAIRequest) *ClaudeMessagesRequest {
+	claudeRequest := ClaudeMessagesRequest{
+		Model:       textRequest.Model,
+		MaxTokens:   textRequest.MaxTokens,
+		Temperature: textRequest.Temperature,
+		TopP:        textRequest.TopP,
+		Stream:      textRequest.Stream,
+	}
+	if claudeRequest.MaxTokens == 0 {
+		claudeRequest.MaxTokens = 4096
+	}
+	var system []string
+	for _, message := range textRequest.Messages {
+		switch message.Role {
+		case "system":
+			system = append(system, message.Content)
+		case "user", "assistant":
+			claudeRequest.Messages = append(claudeRequest.Messages, ClaudeMessage{Role: message.Role, Content: message.Content})
+		}
+	}
+	claudeRequest.System = strings.Join(system, "\n\n")
+	schema := json.RawMessage(`{"type":"object"}`)
+	description := "Respond with a JSON object."
+	if jsonSchema := gjson.GetBytes(textRequest.ResponseFormat, "json_schema"); jsonSchema.Exists() {
+		if s := jsonSchema.Get("schema"); s.IsObject() {
+			schema = json.RawMessage(s.Raw)
+		}
+		if d := jsonSchema.Get("description").String(); d != "" {
+			description = d
+		}
+	}
+	claudeRequest.Tools = []ClaudeTool{{Name: claudeJSONToolName, Description: description, InputSchema: schema}}
+	claudeRequest.ToolChoice = &ClaudeToolChoice{Type: "tool", Name: claudeJSONToolName}
+	return &claudeRequest
+}
+
+// getClaudeJSONOutput returns the input of the forced tool call, or the text if the model answered without it
+func getClaudeJSONOutput(claudeResponse *ClaudeMessagesResponse) string {
+	text := ""
+	for _, block := range claudeResponse.Content {
+		if block.Type == "tool_use" && block.Name == claudeJSONToolName {
+			return string(block.Input)
+		}
+		if block.Type == "text" {
+			text += block.Text
+		}
+	}
+	return text
+}
+
+func claudeJSONHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode, *Usage) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+	}
+	var claudeResponse ClaudeMessagesResponse
+	err = json.Unmarshal(responseBody, &claudeResponse)
+	if err != nil {
+		return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	if claudeResponse.Error.Type != "" {
+		return &OpenAIErrorWithStatusCode{
+			OpenAIError: OpenAIError{
+				Message: claudeResponse.Error.Message,
+				Type:    claudeResponse.Error.Type,
+				Param:   "",
+				Code:    claudeResponse.Error.Type,
+			},
+			StatusCode: resp.StatusCode,
+		}, nil
+	}
+	output := getClaudeJSONOutput(&claudeResponse)
+	if !json.Valid([]byte(strings.TrimSpace(output))) {
+		return invalidJSONError(), nil
+	}
+	usage := Usage{
+		PromptTokens:     claudeResponse.Usage.InputTokens,
+		CompletionTokens: claudeResponse.Usage.OutputTokens,
+		TotalTokens:      claudeResponse.Usage.InputTokens + claudeResponse.Usage.OutputTokens,
+	}
+	fullTextResponse := OpenAITextResponse{
+		Id:      fmt.Sprintf("chatcmpl-%s", common.GetUUID()),
+		Object:  "chat.completion",
+		Created: common.GetTimestamp(),
+		Choices: []OpenAITextResponseChoice{{
+			Index:        0,
+			Message:      Message{Role: "assistant", Content: output},
+			FinishReason: stopReasonClaudeMessages2OpenAI(claudeResponse.StopReason),
+		}},
+		Usage: usage,
+	}
+	jsonResponse, err := json.Marshal(fullTextResponse)
+	if err != nil {
+		return errorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, err = c.Writer.Write(jsonResponse)
+	return nil, &usage
+}
+
+// claudeJSONStreamHandler relays the partial JSON of the tool input as content deltas as it comes. In strict mode
+// (JSONModeStrictEnabled) nothing is sent before the whole output is validated, so invalid output is never delivered
+// and can still be asked for again, without it the deltas are already sent and the stream ends with an error event.
+func claudeJSONStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode, *Usage) {
+	strict := common.JSONModeStrictEnabled
+	responseId := fmt.Sprintf("chatcmpl-%s", common.GetUUID())
+	createdTime := common.GetTimestamp()
+	responseModel := ""
+	var usage Usage
+	var output strings.Builder
+	var buffered []string
+	send := func(data string) {
+		if strict {
+			buffered = append(buffered, data)
+			return
+		}
+		c.Render(-1, common.CustomEvent{Data: data})
+		c.Writer.Flush()
+	}
+	sendDelta := func(content string, finishReason *string) {
+		var choice ChatCompletionsStreamResponseChoice
+		choice.Delta.Content = content
+		choice.FinishReason = finishReason
+		response := ChatCompletionsStreamResponse{
+			Id:      responseId,
+			Object:  "chat.completion.chunk",
+			Created: createdTime,
+			Model:   responseModel,
+			Choices: []ChatCompletionsStreamResponseChoice{choice},
+		}
+		jsonStr, err := json.Marshal(response)
+		if err != nil {
+			common.SysError("error marshalling stream response: " + err.Error())
+			return
+		}
+		send("data: " + string(jsonStr))
+	}
+	if !strict {
+		setEventStreamHeaders(c)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var event ClaudeMessagesStreamEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event); err != nil {
+			common.SysError("error unmarshalling stream response: " + err.Error())
+			continue
+		}
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				responseModel = event.Message.Model
+				usage.PromptTokens = event.Message.Usage.InputTokens
+			}
+		case "content_block_delta":
+			if event.Delta.Type == "input_json_delta" && event.Delta.PartialJSON != "" {
+				output.WriteString(event.Delta.PartialJSON)
+				sendDelta(event.Delta.PartialJSON, nil)
+			}
+		case "message_delta":
+			if event.Usage != nil {
+				usage.CompletionTokens = event.Usage.OutputTokens
+			}
+			finishReason := stopReasonClaudeMessages2OpenAI(event.Delta.StopReason)
+			sendDelta("", &finishReason)
+		case "error":
+			if strict || !c.Writer.Written() {
+				_ = resp.Body.Close()
+				return &OpenAIErrorWithStatusCode{
+					OpenAIError: OpenAIError{Message: event.Error.Message, Type: event.Error.Type, Code: event.Error.Type},
+					StatusCode:  http.StatusBadGateway,
+				}, nil
+			}
+		}
+	}
+	err := resp.Body.Close()
+	if err != nil {
+		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	if !json.Valid([]byte(strings.TrimSpace(output.String()))) {
+		if strict {
+			return invalidJSONError(), nil
+		}
+		errorData, _ := json.Marshal(gin.H{"error": invalidJSONError().OpenAIError})
+		send("data: " + string(errorData))
+	}
+	if strict {
+		setEventStreamHeaders(c)
+		for _, data := range buffered {
+			c.Render(-1, common.CustomEvent{Data: data})
+		}
+	}
+	c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
+	c.Writer.Flush()
+	return nil, &usage
+}
+
+// relayClaudeJSON handles a JSON mode response and asks the upstream once more when the output is not JSON,
+// as long as nothing has been sent to the client yet. Output that is never delivered is not billed, the usage is nil then.
+func relayClaudeJSON(c *gin.Context, req *http.Request, body []byte, resp *http.Response, isStream bool) (*OpenAIErrorWithStatusCode, *Usage) {
+	for retried := false; ; retried = true {
+		var openaiErr *OpenAIErrorWithStatusCode
+		var usage *Usage
+		if isStream {
+			openaiErr, usage = claudeJSONStreamHandler(c, resp)
+		} else {
+			openaiErr, usage = claudeJSONHandler(c, resp)
+		}
+		if openaiErr == nil || openaiErr.OpenAIError.Code != "invalid_json_from_upstream" || retried || c.Writer.Written() {
+			return openaiErr, usage
+		}
+		common.LogWarn(c.Request.Context(), "upstream returned invalid JSON in JSON mode, retrying once")
+		retryReq := req.Clone(getRelayContext(c))
+		retryReq.Body = io.NopCloser(bytes.NewReader(body))
+		retryReq.ContentLength = int64(len(body))
+		client, err := getRelayHTTPClient(c)
+		if err != nil {
+			return errorWrapper(err, "get_http_client_failed", http.StatusInternalServerError), nil
+		}
+		resp, err = doUpstreamRequest(c, client, retryReq)
+		if err != nil {
+			return errorWrapper(err, "do_request_failed", http.StatusInternalServerError), nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return relayErrorHandler(resp), nil
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestRequestOpenAI2ClaudeJSON(t *testing.T) {
+	var textRequest GeneralOpenAIRequest
+	_ = json.Unmarshal([]byte(`{"model":"claude-3-5-sonnet","messages":[{"role":"system","content":"be terse"},{"role":"user","content":"hi"}],
+		"response_format":{"type":"json_schema","json_schema":{"name":"reply","schema":{"type":"object","properties":{"answer":{"type":"string"}}}}}}`), &textRequest)
+	claudeRequest := requestOpenAI2ClaudeJSON(textRequest)
+	body, _ := json.Marshal(claudeRequest)
+	if gjson.GetBytes(body, "tool_choice.name").String() != claudeJSONToolName || gjson.GetBytes(body, "tools.0.input_schema.properties.answer.type").String() != "string" {
+		t.Errorf("JSON mode not forced through the tool: %s", body)
+	}
+	if claudeRequest.System != "be terse" || len(claudeRequest.Messages) != 1 {
+		t.Errorf("messages not converted: %s", body)
+	}
+}
+
+// serveClaudeJSON answers with the given outputs in turn, as tool input when they parse and as text otherwise
+func serveClaudeJSON(outputs []string, stream bool) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		output := outputs[int(atomic.AddInt32(&calls, 1)-1)%len(outputs)]
+		if !stream {
+			block := fmt.Sprintf(`{"type":"tool_use","name":"json_response","input":%s}`, output)
+			if !json.Valid([]byte(output)) {
+				block = fmt.Sprintf(`{"type":"text","text":%q}`, output)
+			}
+			_, _ = fmt.Fprintf(w, `{"id":"msg","model":"claude","content":[%s],"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5}}`, block)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"model\":\"claude\",\"usage\":{\"input_tokens\":10}}}\n\n")
+		for _, part := range []string{output[:len(output)/2], output[len(output)/2:]} {
+			delta, _ := json.Marshal(map[string]any{"type": "content_block_delta", "delta": map[string]string{"type": "input_json_delta", "partial_json": part}})
+			_, _ = fmt.Fprintf(w, "event: content_block_delta\ndata: %s\n\n", delta)
+		}
+		_, _ = io.WriteString(w, "event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"tool_use\"},\"usage\":{\"output_tokens\":5}}\n\n")
+		_, _ = io.WriteString(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	}))
+	return server, &calls
+}
+
+func relayClaudeJSONOnce(t *testing.T, server *httptest.Server, stream bool) (*OpenAIErrorWithStatusCode, *Usage, *httptest.ResponseRecorder) {
+	t.Helper()
+	c, recorder := newTestContext(http.MethodPost, "/v1/chat/completions", "")
+	body := []byte(`{"model":"claude"}`)
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/messages", bytes.NewReader(body))
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openaiErr, usage := relayClaudeJSON(c, req, body, resp, stream)
+	return openaiErr, usage, recorder
+}
+
+func TestRelayClaudeJSONRetriesInvalidOutput(t *testing.T) {
+	server, calls := serveClaudeJSON([]string{"Sure! here it is", `{"answer":"42"}`}, false)
+	defer server.Close()
+	openaiErr, usage, recorder := relayClaudeJSONOnce(t, server, false)
+	if openaiErr != nil {
+		t.Fatalf("valid retry not relayed: %s", openaiErr.OpenAIError.Message)
+	}
+	if *calls != 2 || gjson.Get(recorder.Body.String(), "choices.0.message.content").String() != `{"answer":"42"}` {
+		t.Errorf("calls %d, response %s", *calls, recorder.Body.String())
+	}
+	if usage == nil || usage.PromptTokens != 10 || usage.CompletionTokens != 5 {
+		t.Errorf("usage %+v", usage)
+	}
+
+	server, calls = serveClaudeJSON([]string{"not json"}, false)
+	defer server.Close()
+	openaiErr, usage, recorder = relayClaudeJSONOnce(t, server, false)
+	if openaiErr == nil || openaiErr.OpenAIError.Code != "invalid_json_from_upstream" || *calls != 2 {
+		t.Fatalf("invalid output not reported after one retry, calls %d", *calls)
+	}
+	if usage != nil || recorder.Body.Len() != 0 {
+		t.Error("invalid output delivered or billed")
+	}
+}
+
+func TestClaudeJSONStream(t *testing.T) {
+	defer func(strict bool) {
+		common.JSONModeStrictEnabled = strict
+	}(common.JSONModeStrictEnabled)
+
+	// strict mode buffers, so invalid output is retried and never billed
+	common.JSONModeStrictEnabled = true
+	server, calls := serveClaudeJSON([]string{"no json", `{"a":1}`}, true)
+	defer server.Close()
+	openaiErr, usage, recorder := relayClaudeJSONOnce(t, server, true)
+	if openaiErr != nil || *calls != 2 {
+		t.Fatalf("strict stream not retried, calls %d", *calls)
+	}
+	if strings.Contains(recorder.Body.String(), "no json") || !strings.Contains(recorder.Body.String(), "[DONE]") {
+		t.Errorf("unexpected stream %s", recorder.Body.String())
+	}
+	if usage == nil || usage.CompletionTokens != 5 {
+		t.Errorf("usage %+v", usage)
+	}
+	server, _ = serveClaudeJSON([]string{"no json"}, true)
+	defer server.Close()
+	if openaiErr, usage, _ = relayClaudeJSONOnce(t, server, true); openaiErr == nil || usage != nil {
+		t.Error("invalid strict stream delivered or billed")
+	}
+
+	// without strict mode the deltas pass through and the stream ends with an error event
+	common.JSONModeStrictEnabled = false
+	server, calls = serveClaudeJSON([]string{"no json"}, true)
+	defer server.Close()
+	openaiErr, _, recorder = relayClaudeJSONOnce(t, server, true)
+	if openaiErr != nil || *calls != 1 {
+		t.Fatalf("relayed stream retried, calls %d", *calls)
+	}
+	content := ""
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		content += gjson.Get(strings.TrimPrefix(line, "data: "), "choices.0.delta.content").String()
+	}
+	if content != "no json" || !strings.Contains(recorder.Body.String(), "invalid_json_from_upstream") {
+		t.Errorf("unexpected stream %s", recorder.Body.String())
+	}
+}
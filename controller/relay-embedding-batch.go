@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// embeddingBatchResponse keeps the items raw so base64 encoded embeddings pass through untouched
+type embeddingBatchResponse struct {
+	Object string            `json:"object"`
+	Data   []json.RawMessage `json:"data"`
+	Model  string            `json:"model"`
+	Usage  Usage             `json:"usage"`
+}
+
+// splitEmbeddingInput splits an input array into batches of at most batchSize items,
+// nil means the request fits in a single upstream call
+func splitEmbeddingInput(input any, batchSize int) [][]any {
+	items, ok := input.([]any)
+	if !ok || batchSize <= 0 || len(items) <= batchSize {
+		return nil
+	}
+	var batches [][]any
+	for start := 0; start < len(items); start += batchSize {
+		end := start + batchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		batches = append(batches, items[start:end])
+	}
+	return batches
+}
+
+// doEmbeddingBatches sends every batch as its own upstream request and merges the results
+// into one response. Indexes are shifted so they refer to the original input, usage is summed.
+// The first failed batch is returned as is, so the whole request fails with its error.
+func doEmbeddingBatches(c *gin.Context, client *http.Client, req *http.Request, batches [][]any) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	var merged embeddingBatchResponse
+	var header http.Header
+	offset := 0
+	for _, batch := range batches {
+		batchBody, err := sjson.SetBytes(body, "input", batch)
+		if err != nil {
+			return nil, err
+		}
+		batchReq := req.Clone(req.Context())
+		batchReq.Body = io.NopCloser(bytes.NewReader(batchBody))
+		batchReq.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(batchBody)), nil
+		}
+		batchReq.ContentLength = int64(len(batchBody))
+		batchReq.Header.Set("Content-Length", strconv.Itoa(len(batchBody)))
+		resp, err := doUpstreamRequest(c, client, batchReq)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return resp, nil
+		}
+		var batchResponse embeddingBatchResponse
+		err = json.NewDecoder(resp.Body).Decode(&batchResponse)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(batchResponse.Data) != len(batch) {
+			return nil, fmt.Errorf("embedding batch returned %d items for %d inputs", len(batchResponse.Data), len(batch))
+		}
+		// place items by their index, upstream is not required to return them in order
+		items := make([]json.RawMessage, len(batch))
+		for _, item := range batchResponse.Data {
+			index := int(gjson.GetBytes(item, "index").Int())
+			if index < 0 || index >= len(items) || items[index] != nil {
+				return nil, fmt.Errorf("embedding batch returned invalid index %d", index)
+			}
+			items[index], err = sjson.SetBytes(item, "index", offset+index)
+			if err != nil {
+				return nil, err
+			}
+		}
+		merged.Data = append(merged.Data, items...)
+		merged.Object = batchResponse.Object
+		merged.Model = batchResponse.Model
+		merged.Usage.PromptTokens += batchResponse.Usage.PromptTokens
+		merged.Usage.TotalTokens += batchResponse.Usage.TotalTokens
+		header = resp.Header
+		offset += len(batch)
+	}
+	mergedBody, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	header = header.Clone()
+	header.Del("Content-Length")
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(mergedBody)),
+	}, nil
+}
@@ -0,0 +1,425 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"math"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strings"
+	"time"
+)
+
+// Files and fine-tuning jobs live on the upstream account they were created with, so each one is
+// pinned to its channel and later requests about it bypass channel selection.
+
+type fineTuningJobRequest struct {
+	Model          string `json:"model"`
+	TrainingFile   string `json:"training_file"`
+	ValidationFile string `json:"validation_file"`
+}
+
+type fineTuningJobResponse struct {
+	Id            string `json:"id"`
+	Model         string `json:"model"`
+	Status        string `json:"status"`
+	TrainedTokens int    `json:"trained_tokens"`
+}
+
+type fineTuningFileResponse struct {
+	Id      string `json:"id"`
+	Purpose string `json:"purpose"`
+}
+
+func respondFineTuningError(c *gin.Context, err *OpenAIErrorWithStatusCode) {
+	if err == nil {
+		return
+	}
+	err.OpenAIError.Message = common.MessageWithRequestId(err.OpenAIError.Message, c.GetString(common.RequestIdKey))
+	c.JSON(err.StatusCode, gin.H{
+		"error": err.OpenAIError,
+	})
+}
+
+// doFineTuningRequest sends a request to the channel and returns the raw upstream response body,
+// clientHeader is nil for the requests of the settlement poller
+func doFineTuningRequest(clientHeader http.Header, channel *model.Channel, method string, path string, body io.Reader, contentType string) (*http.Response, []byte, *OpenAIErrorWithStatusCode) {
+	baseURL := common.ChannelBaseURLs[channel.Type]
+	if channel.GetBaseURL() != "" {
+		baseURL = channel.GetBaseURL()
+	}
+	req, err := http.NewRequest(method, getFullRequestURL(baseURL, path, channel.Type), body)
+	if err != nil {
+		return nil, nil, errorWrapper(err, "new_request_failed", http.StatusInternalServerError)
+	}
+	req.Header.Set("Authorization", "Bearer "+channel.Key)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	applyForwardedHeaders(req, clientHeader, channel.Type)
+	applyChannelAuth(req, channel.GetAuthType(), channel.GetAuthParam(), channel.Key)
+	err = applyChannelHeaders(req, channel.GetHeaders(), channel.Key)
+	if err != nil {
+		return nil, nil, errorWrapper(err, "apply_channel_headers_failed", http.StatusInternalServerError)
+	}
+	client, err := getChannelHTTPClient(channel)
+	if err != nil {
+		return nil, nil, errorWrapper(err, "get_http_client_failed", http.StatusInternalServerError)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, errorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, relayErrorHandler(resp)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, errorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return nil, nil, errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
+	}
+	return resp, responseBody, nil
+}
+
+func writeFineTuningResponse(c *gin.Context, resp *http.Response, responseBody []byte) {
+	for k, v := range resp.Header {
+		c.Writer.Header().Set(k, v[0])
+	}
+	c.Writer.Header().Del("Content-Length")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, _ = c.Writer.Write(responseBody)
+}
+
+func writeFineTuningList(c *gin.Context, objectType string) {
+	objects, err := model.GetUserFineTuningObjects(c.GetInt("id"), objectType)
+	if err != nil {
+		respondFineTuningError(c, errorWrapper(err, "get_fine_tuning_objects_failed", http.StatusInternalServerError))
+		return
+	}
+	data := make([]gin.H, 0, len(objects))
+	for _, object := range objects {
+		if !common.IsModelInList(c.GetString("token_models"), object.Model) {
+			continue
+		}
+		item := gin.H{"id": object.Id, "created_at": object.CreatedAt}
+		if objectType == model.FineTuningObjectTypeJob {
+			item["object"] = "fine_tuning.job"
+			item["model"] = object.Model
+		} else {
+			item["object"] = "file"
+			item["purpose"] = "fine-tune"
+		}
+		data = append(data, item)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   data,
+	})
+}
+
+// getPinnedChannel returns the channel a file or job of the current user was created on,
+// the file or job must be of a model the token may use
+func getPinnedChannel(c *gin.Context, id string, objectType string) (*model.FineTuningObject, *model.Channel, *OpenAIErrorWithStatusCode) {
+	object, err := model.GetFineTuningObject(id, objectType, c.GetInt("id"))
+	if err != nil {
+		return nil, nil, errorWrapper(fmt.Errorf("no such %s: %s", objectType, id), "not_found", http.StatusNotFound)
+	}
+	// a token restricted to some models only reaches the files and jobs of those base models
+	if !common.IsModelInList(c.GetString("token_models"), object.Model) {
+		return nil, nil, errorWrapper(fmt.Errorf("该令牌无权使用模型 %s", object.Model), "model_not_allowed", http.StatusForbidden)
+	}
+	channel, err := model.GetChannelById(object.ChannelId, true)
+	if err != nil {
+		return nil, nil, errorWrapper(errors.New("the channel of this "+objectType+" no longer exists"), "channel_not_found", http.StatusServiceUnavailable)
+	}
+	return object, channel, nil
+}
+
+// checkFineTuningModel applies the model restrictions of relaying to the base model, these routes skip Distribute
+func checkFineTuningModel(c *gin.Context, modelName string) *OpenAIErrorWithStatusCode {
+	if !common.IsModelInList(c.GetString("token_models"), modelName) {
+		return errorWrapper(fmt.Errorf("该令牌无权使用模型 %s", modelName), "model_not_allowed", http.StatusForbidden)
+	}
+	if common.IsModelDisabled(modelName) {
+		return errorWrapper(fmt.Errorf("模型 %s 已被临时禁用", modelName), "model_temporarily_disabled", http.StatusServiceUnavailable)
+	}
+	return nil
+}
+
+func chargeFineTuning(ctx context.Context, object *model.FineTuningObject, tokenName string, group string, quota int, discount float64, logContent string) {
+	err := model.PostConsumeTokenQuota(object.TokenId, quota, model.QuotaCategoryChat)
+	if err != nil {
+		common.LogError(ctx, "error consuming token remain quota: "+err.Error())
+	}
+	err = model.CacheUpdateUserQuota(object.UserId)
+	if err != nil {
+		common.LogError(ctx, "error update user quota cache: "+err.Error())
+	}
+	model.RecordConsumeLog(ctx, object.UserId, object.ChannelId, 0, 0, object.Model, tokenName, group, quota, discount, logContent)
+	model.UpdateUserUsedQuotaAndRequestCount(object.UserId, quota)
+	model.UpdateChannelUsedQuota(object.ChannelId, quota)
+}
+
+// settleFineTuningJob asks the upstream for the state of an unsettled job and charges its trained tokens once it succeeded,
+// jobs that ended without success are settled with nothing to charge
+func settleFineTuningJob(ctx context.Context, object *model.FineTuningObject) {
+	channel, err := model.GetChannelById(object.ChannelId, true)
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to get channel %d of fine-tuning job %s: %s", object.ChannelId, object.Id, err.Error()))
+		return
+	}
+	_, responseBody, openaiErr := doFineTuningRequest(nil, channel, http.MethodGet, "/v1/fine_tuning/jobs/"+object.Id, nil, "")
+	if openaiErr != nil {
+		common.SysError(fmt.Sprintf("failed to get fine-tuning job %s: %s", object.Id, openaiErr.OpenAIError.Message))
+		return
+	}
+	var jobResponse fineTuningJobResponse
+	if err := json.Unmarshal(responseBody, &jobResponse); err != nil {
+		common.SysError(fmt.Sprintf("failed to unmarshal fine-tuning job %s: %s", object.Id, err.Error()))
+		return
+	}
+	switch jobResponse.Status {
+	case "succeeded", "failed", "cancelled":
+	default:
+		return
+	}
+	// only the caller that flipped the flag charges, even if several nodes settle concurrently
+	if !model.MarkFineTuningObjectBilled(object.Id) {
+		return
+	}
+	if jobResponse.Status != "succeeded" || jobResponse.TrainedTokens <= 0 {
+		return
+	}
+	group, _ := model.CacheGetUserGroup(object.UserId)
+	userDiscount := model.CacheGetUserDiscount(object.UserId)
+	groupRatio := common.GetGroupRatio(group) * userDiscount
+	quota := int(math.Ceil(float64(jobResponse.TrainedTokens) * common.GetModelRatio(object.Model) * groupRatio))
+	if quota <= 0 {
+		return
+	}
+	tokenName := ""
+	if token, err := model.GetTokenById(object.TokenId); err == nil {
+		tokenName = token.Name
+	}
+	chargeFineTuning(ctx, object, tokenName, group, quota, userDiscount, fmt.Sprintf("微调任务 %s 完成，训练 tokens %d", object.Id, jobResponse.TrainedTokens))
+}
+
+// AutomaticallySettleFineTuningJobs polls the unsettled jobs, so trained tokens are charged whether or not the client polls
+func AutomaticallySettleFineTuningJobs() {
+	for {
+		time.Sleep(time.Minute)
+		objects, err := model.GetUnsettledFineTuningJobs()
+		if err != nil {
+			common.SysError("failed to get unsettled fine-tuning jobs: " + err.Error())
+			continue
+		}
+		for _, object := range objects {
+			settleFineTuningJob(context.Background(), object)
+		}
+	}
+}
+
+func uploadFineTuningFile(c *gin.Context) *OpenAIErrorWithStatusCode {
+	// the upload is relayed from the buffer, a spilled one is streamed from its temp file
+	body, err := common.GetBodyReadSeeker(c)
+	if err != nil {
+		return errorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
+	}
+	err = common.ParseMultipartFormReusable(c)
+	if err != nil {
+		return errorWrapper(err, "parse_multipart_form_failed", http.StatusBadRequest)
+	}
+	if purpose := c.Request.FormValue("purpose"); purpose != "fine-tune" {
+		return errorWrapper(fmt.Errorf("unsupported purpose %q, only fine-tune is supported", purpose), "unsupported_purpose", http.StatusBadRequest)
+	}
+	// the base model decides which channel holds the file, the job must later use the same channel
+	modelName := c.Request.FormValue("model")
+	if modelName == "" {
+		return errorWrapper(errors.New("model is required to choose the upstream of the file, pass it as a query parameter"), "required_field_missing", http.StatusBadRequest)
+	}
+	if openaiErr := checkFineTuningModel(c, modelName); openaiErr != nil {
+		return openaiErr
+	}
+	group, err := model.CacheGetUserGroup(c.GetInt("id"))
+	if err != nil {
+		return errorWrapper(err, "get_user_group_failed", http.StatusInternalServerError)
+	}
+	channel, err := model.CacheGetRandomSatisfiedChannel(group, modelName, 0)
+	if err != nil {
+		return errorWrapper(fmt.Errorf("no available channel for model %s", modelName), "model_not_available", http.StatusServiceUnavailable)
+	}
+	resp, responseBody, openaiErr := doFineTuningRequest(c.Request.Header, channel, http.MethodPost, "/v1/files", body, c.Request.Header.Get("Content-Type"))
+	if openaiErr != nil {
+		return openaiErr
+	}
+	var fileResponse fineTuningFileResponse
+	if err := json.Unmarshal(responseBody, &fileResponse); err != nil || fileResponse.Id == "" {
+		return errorWrapper(errors.New("invalid upstream response"), "unmarshal_response_body_failed", http.StatusInternalServerError)
+	}
+	err = model.RecordFineTuningObject(&model.FineTuningObject{
+		Id:        fileResponse.Id,
+		Type:      model.FineTuningObjectTypeFile,
+		UserId:    c.GetInt("id"),
+		TokenId:   c.GetInt("token_id"),
+		ChannelId: channel.Id,
+		Model:     modelName,
+	})
+	if err != nil {
+		return errorWrapper(err, "record_fine_tuning_file_failed", http.StatusInternalServerError)
+	}
+	writeFineTuningResponse(c, resp, responseBody)
+	return nil
+}
+
+func relayFineTuningFile(c *gin.Context) *OpenAIErrorWithStatusCode {
+	id := c.Param("id")
+	_, channel, openaiErr := getPinnedChannel(c, id, model.FineTuningObjectTypeFile)
+	if openaiErr != nil {
+		return openaiErr
+	}
+	path := "/v1/files/" + id
+	if strings.HasSuffix(c.Request.URL.Path, "/content") {
+		path += "/content"
+	}
+	resp, responseBody, openaiErr := doFineTuningRequest(c.Request.Header, channel, c.Request.Method, path, nil, "")
+	if openaiErr != nil {
+		return openaiErr
+	}
+	if c.Request.Method == http.MethodDelete {
+		if err := model.DeleteFineTuningObject(id); err != nil {
+			common.LogError(c.Request.Context(), "failed to delete fine-tuning file record: "+err.Error())
+		}
+	}
+	writeFineTuningResponse(c, resp, responseBody)
+	return nil
+}
+
+func createFineTuningJob(c *gin.Context) *OpenAIErrorWithStatusCode {
+	rawBody, err := common.GetBodyReusable(c)
+	if err != nil {
+		return errorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
+	}
+	var jobRequest fineTuningJobRequest
+	if err := json.Unmarshal(rawBody, &jobRequest); err != nil {
+		return errorWrapper(err, "unmarshal_request_body_failed", http.StatusBadRequest)
+	}
+	if jobRequest.Model == "" || jobRequest.TrainingFile == "" {
+		return errorWrapper(errors.New("fields model and training_file are required"), "required_field_missing", http.StatusBadRequest)
+	}
+	if openaiErr := checkFineTuningModel(c, jobRequest.Model); openaiErr != nil {
+		return openaiErr
+	}
+	_, channel, openaiErr := getPinnedChannel(c, jobRequest.TrainingFile, model.FineTuningObjectTypeFile)
+	if openaiErr != nil {
+		return openaiErr
+	}
+	if jobRequest.ValidationFile != "" {
+		validationFile, _, openaiErr := getPinnedChannel(c, jobRequest.ValidationFile, model.FineTuningObjectTypeFile)
+		if openaiErr != nil {
+			return openaiErr
+		}
+		if validationFile.ChannelId != channel.Id {
+			return errorWrapper(errors.New("training_file and validation_file were uploaded to different upstreams"), "invalid_validation_file", http.StatusBadRequest)
+		}
+	}
+	// the same model restrictions as for relaying apply to the base model
+	userId := c.GetInt("id")
+	group, err := model.CacheGetUserGroup(userId)
+	if err != nil {
+		return errorWrapper(err, "get_user_group_failed", http.StatusInternalServerError)
+	}
+	if !model.IsChannelServingModel(group, jobRequest.Model, channel.Id) {
+		return errorWrapper(fmt.Errorf("model %s is not available for fine-tuning", jobRequest.Model), "model_not_available", http.StatusForbidden)
+	}
+	quota := common.FineTuningJobQuota
+	if quota > 0 {
+		userQuota, err := model.GetUserQuotaForCategory(userId, model.QuotaCategoryChat)
+		if err != nil {
+			return errorWrapper(err, "get_user_quota_failed", http.StatusInternalServerError)
+		}
+		if userQuota < quota {
+			return errorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
+		}
+	}
+	resp, responseBody, openaiErr := doFineTuningRequest(c.Request.Header, channel, http.MethodPost, "/v1/fine_tuning/jobs", bytes.NewReader(rawBody), "application/json")
+	if openaiErr != nil {
+		return openaiErr
+	}
+	var jobResponse fineTuningJobResponse
+	if err := json.Unmarshal(responseBody, &jobResponse); err != nil || jobResponse.Id == "" {
+		return errorWrapper(errors.New("invalid upstream response"), "unmarshal_response_body_failed", http.StatusInternalServerError)
+	}
+	job := &model.FineTuningObject{
+		Id:        jobResponse.Id,
+		Type:      model.FineTuningObjectTypeJob,
+		UserId:    userId,
+		TokenId:   c.GetInt("token_id"),
+		ChannelId: channel.Id,
+		Model:     jobRequest.Model,
+	}
+	err = model.RecordFineTuningObject(job)
+	if err != nil {
+		return errorWrapper(err, "record_fine_tuning_job_failed", http.StatusInternalServerError)
+	}
+	if quota > 0 {
+		chargeFineTuning(c.Request.Context(), job, c.GetString("token_name"), group, quota, 1, fmt.Sprintf("微调任务 %s", jobResponse.Id))
+	}
+	writeFineTuningResponse(c, resp, responseBody)
+	return nil
+}
+
+func relayFineTuningJob(c *gin.Context) *OpenAIErrorWithStatusCode {
+	id := c.Param("id")
+	_, channel, openaiErr := getPinnedChannel(c, id, model.FineTuningObjectTypeJob)
+	if openaiErr != nil {
+		return openaiErr
+	}
+	path := "/v1/fine_tuning/jobs/" + id
+	if strings.HasSuffix(c.Request.URL.Path, "/cancel") {
+		path += "/cancel"
+	} else if strings.HasSuffix(c.Request.URL.Path, "/events") {
+		path += "/events"
+		if c.Request.URL.RawQuery != "" {
+			path += "?" + c.Request.URL.RawQuery
+		}
+	}
+	resp, responseBody, openaiErr := doFineTuningRequest(c.Request.Header, channel, c.Request.Method, path, nil, "")
+	if openaiErr != nil {
+		return openaiErr
+	}
+	writeFineTuningResponse(c, resp, responseBody)
+	return nil
+}
+
+func RelayFineTuningFileUpload(c *gin.Context) {
+	respondFineTuningError(c, uploadFineTuningFile(c))
+}
+
+func RelayFineTuningFileList(c *gin.Context) {
+	writeFineTuningList(c, model.FineTuningObjectTypeFile)
+}
+
+func RelayFineTuningFile(c *gin.Context) {
+	respondFineTuningError(c, relayFineTuningFile(c))
+}
+
+func RelayFineTuningJobCreate(c *gin.Context) {
+	respondFineTuningError(c, createFineTuningJob(c))
+}
+
+func RelayFineTuningJobList(c *gin.Context) {
+	writeFineTuningList(c, model.FineTuningObjectTypeJob)
+}
+
+func RelayFineTuningJob(c *gin.Context) {
+	respondFineTuningError(c, relayFineTuningJob(c))
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/middleware"
+	"one-api/model"
+	"strings"
+	"testing"
+)
+
+func TestSettleFineTuningJob(t *testing.T) {
+	status := "running"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(fineTuningJobResponse{Id: "ftjob-settle", Model: "gpt-4o-mini", Status: status, TrainedTokens: 1000})
+	}))
+	defer server.Close()
+	user := createTestUser(t, "fine-tuning-settle", 1000000)
+	token := createTestToken(t, user.Id, "fine-tuning")
+	channel := createTestChannel(t, "fine-tuning", server.URL)
+	object := &model.FineTuningObject{Id: "ftjob-settle", Type: model.FineTuningObjectTypeJob, UserId: user.Id, TokenId: token.Id,
+		ChannelId: channel.Id, Model: "gpt-4o-mini"}
+	if err := model.RecordFineTuningObject(object); err != nil {
+		t.Fatal(err)
+	}
+
+	settleFineTuningJob(context.Background(), object)
+	if quota, _ := model.GetUserQuota(user.Id); quota != 1000000 {
+		t.Fatalf("running job was charged, quota %d", quota)
+	}
+	status = "succeeded"
+	settleFineTuningJob(context.Background(), object)
+	charged, _ := model.GetUserQuota(user.Id)
+	if charged >= 1000000 {
+		t.Fatalf("succeeded job was not charged, quota %d", charged)
+	}
+	settleFineTuningJob(context.Background(), object)
+	if quota, _ := model.GetUserQuota(user.Id); quota != charged {
+		t.Errorf("job charged twice, quota %d then %d", charged, quota)
+	}
+	jobs, err := model.GetUnsettledFineTuningJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		if job.Id == object.Id {
+			t.Error("settled job is still polled")
+		}
+	}
+}
+
+func TestCheckFineTuningModel(t *testing.T) {
+	defer func(disabledModels string) {
+		common.DisabledModels = disabledModels
+	}(common.DisabledModels)
+	common.DisabledModels = "gpt-3.5*"
+
+	c, _ := newTestContext(http.MethodPost, "/v1/fine_tuning/jobs", "")
+	c.Set("token_models", "gpt-4o-mini,gpt-3.5-turbo")
+	if err := checkFineTuningModel(c, "gpt-4o-mini"); err != nil {
+		t.Errorf("permitted model rejected: %s", err.OpenAIError.Message)
+	}
+	if err := checkFineTuningModel(c, "davinci-002"); err == nil || err.StatusCode != http.StatusForbidden {
+		t.Error("model outside the token models accepted")
+	}
+	if err := checkFineTuningModel(c, "gpt-3.5-turbo"); err == nil || err.StatusCode != http.StatusServiceUnavailable {
+		t.Error("disabled model accepted")
+	}
+}
+
+func TestFineTuningRoutesHonorTokenModels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(fineTuningJobResponse{Id: strings.TrimPrefix(r.URL.Path, "/v1/fine_tuning/jobs/"), Status: "running"})
+	}))
+	defer server.Close()
+	user := createTestUser(t, "fine-tuning-models", 1000000)
+	token := createTestToken(t, user.Id, "fine-tuning-models")
+	model.DB.Model(token).Update("models", "ft-allowed")
+	channel := createTestChannel(t, "fine-tuning-models", server.URL)
+	for id, modelName := range map[string]string{"ftjob-allowed": "ft-allowed", "ftjob-other": "ft-other", "file-other": "ft-other"} {
+		objectType := model.FineTuningObjectTypeJob
+		if strings.HasPrefix(id, "file-") {
+			objectType = model.FineTuningObjectTypeFile
+		}
+		if err := model.RecordFineTuningObject(&model.FineTuningObject{Id: id, Type: objectType, UserId: user.Id, TokenId: token.Id,
+			ChannelId: channel.Id, Model: modelName}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	engine := gin.New()
+	fineTuningRouter := engine.Group("/v1")
+	fineTuningRouter.Use(middleware.TokenAuth())
+	fineTuningRouter.GET("/files/:id", RelayFineTuningFile)
+	fineTuningRouter.GET("/fine_tuning/jobs", RelayFineTuningJobList)
+	fineTuningRouter.GET("/fine_tuning/jobs/:id", RelayFineTuningJob)
+	fineTuningRouter.POST("/fine_tuning/jobs/:id/cancel", RelayFineTuningJob)
+	serve := func(method string, path string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		request.Header.Set("Authorization", "Bearer sk-"+token.Key)
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if recorder := serve(http.MethodGet, "/v1/fine_tuning/jobs/ftjob-allowed"); recorder.Code != http.StatusOK {
+		t.Errorf("job of a permitted model: %d %s", recorder.Code, recorder.Body.String())
+	}
+	for _, request := range [][2]string{
+		{http.MethodGet, "/v1/fine_tuning/jobs/ftjob-other"},
+		{http.MethodPost, "/v1/fine_tuning/jobs/ftjob-other/cancel"},
+		{http.MethodGet, "/v1/files/file-other"},
+	} {
+		if recorder := serve(request[0], request[1]); recorder.Code != http.StatusForbidden {
+			t.Errorf("%s %s of a model outside the token models: %d", request[0], request[1], recorder.Code)
+		}
+	}
+	list := serve(http.MethodGet, "/v1/fine_tuning/jobs").Body.String()
+	if !strings.Contains(list, "ftjob-allowed") || strings.Contains(list, "ftjob-other") {
+		t.Errorf("job list %s", list)
+	}
+}
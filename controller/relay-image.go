@@ -11,7 +11,9 @@ import (
 	"net/http"
 	"one-api/common"
 	"one-api/model"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 )
@@ -27,36 +29,21 @@ func isWithinRange(element string, value int) bool {
 	return value >= _min && value <= _max
 }
 
-func relayImageHelper(c *gin.Context, _ int) *OpenAIErrorWithStatusCode {
-	imageModel := "dall-e-2"
-	imageSize := "1024x1024"
-
-	tokenId := c.GetInt("token_id")
-	channelType := c.GetInt("channel")
-	channelId := c.GetInt("channel_id")
-	userId := c.GetInt("id")
-	consumeQuota := c.GetBool("consume_quota")
-	group := c.GetString("group")
-
-	rawBody, err := common.GetBodyReusable(c)
-	if err != nil {
-		return errorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
-	}
-
-	var imageRequest ImageRequest
-	if err := json.Unmarshal(rawBody, &imageRequest); err != nil {
-		return errorWrapper(err, "bind_request_body_failed", http.StatusBadRequest)
-	}
-
-	// Size validation
-	if imageRequest.Size != "" {
-		imageSize = imageRequest.Size
+func getImageEndpoint(relayMode int) string {
+	switch relayMode {
+	case RelayModeImagesEdits:
+		return "edits"
+	case RelayModeImagesVariations:
+		return "variations"
+	default:
+		return "generations"
 	}
+}
 
-	// Model validation
-	if imageRequest.Model != "" {
-		imageModel = imageRequest.Model
-	}
+// validateImageRequest collects all validation failures, clients would rather fix them at once,
+// it returns the cost ratio of the model and size, and defaults n to 1
+func validateImageRequest(imageRequest *ImageRequest, imageModel string, imageSize string, relayMode int) (float64, []*FieldError) {
+	var fieldErrors []*FieldError
 
 	imageCostRatio, hasValidSize := common.DalleSizeRatios[imageModel][imageSize]
 
@@ -70,17 +57,20 @@ func relayImageHelper(c *gin.Context, _ int) *OpenAIErrorWithStatusCode {
 			}
 		}
 	} else {
-		return errorWrapper(errors.New("size not supported for this image model"), "size_not_supported", http.StatusBadRequest)
+		fieldErrors = append(fieldErrors, &FieldError{Param: "size", Code: "size_not_supported", Message: "size not supported for this image model"})
 	}
 
 	// Prompt validation
-	if imageRequest.Prompt == "" {
-		return errorWrapper(errors.New("prompt is required"), "prompt_missing", http.StatusBadRequest)
+	if imageRequest.Prompt == "" && common.IsImagePromptRequired(imageModel, getImageEndpoint(relayMode)) {
+		fieldErrors = append(fieldErrors, &FieldError{Param: "prompt", Code: "prompt_missing", Message: "prompt is required"})
 	}
 
 	// Check prompt length
-	if len(imageRequest.Prompt) > common.DalleImagePromptLengthLimitations[imageModel] {
-		return errorWrapper(errors.New("prompt is too long"), "prompt_too_long", http.StatusBadRequest)
+	// count characters, multi-byte prompts such as Chinese would be rejected far below the real limit in bytes
+	// models without a configured limit are not checked
+	promptLength := utf8.RuneCountInString(imageRequest.Prompt)
+	if limit, ok := common.DalleImagePromptLengthLimitations[imageModel]; ok && promptLength > limit {
+		fieldErrors = append(fieldErrors, &FieldError{Param: "prompt", Code: "prompt_too_long", Message: fmt.Sprintf("prompt is too long: %d characters, at most %d characters are allowed", promptLength, limit)})
 	}
 
 	if imageRequest.N == 0 {
@@ -89,11 +79,65 @@ func relayImageHelper(c *gin.Context, _ int) *OpenAIErrorWithStatusCode {
 
 	// Number of generated images validation
 	if isWithinRange(imageModel, imageRequest.N) == false {
-		return errorWrapper(errors.New("invalid value of n"), "n_not_within_range", http.StatusBadRequest)
+		fieldErrors = append(fieldErrors, &FieldError{Param: "n", Code: "n_not_within_range", Message: "invalid value of n"})
+	}
+
+	return imageCostRatio, fieldErrors
+}
+
+func relayImageHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
+	imageModel := "dall-e-2"
+	imageSize := "1024x1024"
+
+	tokenId := c.GetInt("token_id")
+	channelType := c.GetInt("channel")
+	channelId := c.GetInt("channel_id")
+	userId := c.GetInt("id")
+	consumeQuota := c.GetBool("consume_quota")
+	group := c.GetString("group")
+
+	// the body is only decoded, a spilled upload stays in its temp file
+	var imageRequest ImageRequest
+	isMultipart := strings.HasPrefix(c.Request.Header.Get("Content-Type"), "multipart/form-data")
+	if isMultipart {
+		// edits and variations upload images as multipart form
+		if err := common.ParseMultipartFormReusable(c); err != nil {
+			return errorWrapper(err, "parse_multipart_form_failed", http.StatusBadRequest)
+		}
+		imageRequest.Model = c.Request.FormValue("model")
+		imageRequest.Prompt = c.Request.FormValue("prompt")
+		imageRequest.Size = c.Request.FormValue("size")
+		imageRequest.ResponseFormat = c.Request.FormValue("response_format")
+		imageRequest.User = c.Request.FormValue("user")
+		if n := c.Request.FormValue("n"); n != "" {
+			var err error
+			imageRequest.N, err = strconv.Atoi(n)
+			if err != nil {
+				return errorWrapper(err, "invalid_n", http.StatusBadRequest)
+			}
+		}
+	} else if err := common.UnmarshalBodyReusable(c, &imageRequest); err != nil {
+		return errorWrapper(err, "bind_request_body_failed", http.StatusBadRequest)
+	}
+
+	// Size validation
+	if imageRequest.Size != "" {
+		imageSize = imageRequest.Size
+	}
+
+	// Model validation
+	if imageRequest.Model != "" {
+		imageModel = imageRequest.Model
+	}
+
+	imageCostRatio, fieldErrors := validateImageRequest(&imageRequest, imageModel, imageSize, relayMode)
+	if len(fieldErrors) > 0 {
+		return validationErrorWrapper(fieldErrors)
 	}
 
 	// map model name
 	modelMapping := c.GetString("model_mapping")
+	isFreeModel := common.IsFreeModel(imageModel)
 	isModelMapped := false
 	if modelMapping != "" {
 		modelMap := make(map[string]string)
@@ -102,10 +146,15 @@ func relayImageHelper(c *gin.Context, _ int) *OpenAIErrorWithStatusCode {
 			return errorWrapper(err, "unmarshal_model_mapping_failed", http.StatusInternalServerError)
 		}
 		if modelMap[imageModel] != "" {
+			// responses report the model the client asked for, not the mapped upstream one
+			c.Set("response_model", imageModel)
 			imageModel = modelMap[imageModel]
 			isModelMapped = true
 		}
 	}
+	if virtualModel := c.GetString("virtual_model"); virtualModel != "" {
+		c.Set("response_model", virtualModel)
+	}
 	baseURL := common.ChannelBaseURLs[channelType]
 	requestURL := c.Request.URL.String()
 	if c.GetString("base_url") != "" {
@@ -127,7 +176,12 @@ func relayImageHelper(c *gin.Context, _ int) *OpenAIErrorWithStatusCode {
 	}
 
 	var requestBody io.Reader = c.Request.Body
-	if isModelMapped {
+	// the multipart body is relayed as is, so model mapping only rewrites JSON bodies
+	if isModelMapped && !isMultipart {
+		rawBody, err := common.GetBodyReusable(c)
+		if err != nil {
+			return errorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
+		}
 		buf, err := sjson.SetBytes(rawBody, "model", imageRequest.Model)
 		if err != nil {
 			return errorWrapper(err, "set_request_body_failed", http.StatusInternalServerError)
@@ -136,17 +190,22 @@ func relayImageHelper(c *gin.Context, _ int) *OpenAIErrorWithStatusCode {
 	}
 
 	modelRatio := common.GetModelRatio(imageModel)
-	groupRatio := common.GetGroupRatio(group)
+	if isFreeModel {
+		modelRatio = 0
+	}
+	// the negotiated user discount applies on top of the group ratio
+	userDiscount := model.CacheGetUserDiscount(userId)
+	groupRatio := common.GetGroupRatio(group) * userDiscount
 	ratio := modelRatio * groupRatio
-	userQuota, err := model.CacheGetUserQuota(userId)
+	userQuota, err := model.GetUserQuotaForCategory(userId, model.QuotaCategoryImage)
 
 	quota := int(ratio*imageCostRatio*1000) * imageRequest.N
 
-	if consumeQuota && userQuota-quota < 0 {
+	if consumeQuota && !isFreeModel && userQuota-quota < 0 {
 		return errorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
 	}
 
-	req, err := http.NewRequest(c.Request.Method, fullRequestURL, requestBody)
+	req, err := http.NewRequestWithContext(getRelayContext(c), c.Request.Method, fullRequestURL, requestBody)
 	if err != nil {
 		return errorWrapper(err, "new_request_failed", http.StatusInternalServerError)
 	}
@@ -161,8 +220,19 @@ func relayImageHelper(c *gin.Context, _ int) *OpenAIErrorWithStatusCode {
 
 	req.Header.Set("Content-Type", c.Request.Header.Get("Content-Type"))
 	req.Header.Set("Accept", c.Request.Header.Get("Accept"))
+	channelKey := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+	applyForwardedHeaders(req, c.Request.Header, channelType)
+	applyChannelAuth(req, c.GetString("auth_type"), c.GetString("auth_param"), channelKey)
+	err = applyChannelHeaders(req, c.GetString("channel_headers"), channelKey)
+	if err != nil {
+		return errorWrapper(err, "apply_channel_headers_failed", http.StatusInternalServerError)
+	}
 
-	resp, err := httpClient.Do(req)
+	client, err := getRelayHTTPClient(c)
+	if err != nil {
+		return errorWrapper(err, "get_http_client_failed", http.StatusInternalServerError)
+	}
+	resp, err := doUpstreamRequest(c, client, req)
 	if err != nil {
 		return errorWrapper(err, "do_request_failed", http.StatusInternalServerError)
 	}
@@ -176,10 +246,11 @@ func relayImageHelper(c *gin.Context, _ int) *OpenAIErrorWithStatusCode {
 		return errorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
 	}
 	var textResponse ImageResponse
+	emptyResponse := false
 
 	defer func(ctx context.Context) {
-		if consumeQuota {
-			err := model.PostConsumeTokenQuota(tokenId, quota)
+		if consumeQuota && !emptyResponse {
+			err := model.PostConsumeTokenQuota(tokenId, quota, model.QuotaCategoryImage)
 			if err != nil {
 				common.SysError("error consuming token remain quota: " + err.Error())
 			}
@@ -187,11 +258,20 @@ func relayImageHelper(c *gin.Context, _ int) *OpenAIErrorWithStatusCode {
 			if err != nil {
 				common.SysError("error update user quota cache: " + err.Error())
 			}
-			if quota != 0 {
+			if quota != 0 || isFreeModel {
 				tokenName := c.GetString("token_name")
 				//logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 %.2f", modelRatio, groupRatio)
 				logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 1.00", modelRatio)
-				model.RecordConsumeLog(ctx, userId, channelId, 0, 0, imageModel, tokenName, quota, logContent)
+				if userDiscount != 1 {
+					logContent += fmt.Sprintf("，用户折扣 %.2f", userDiscount)
+				}
+				if isFreeModel {
+					logContent += "，免费模型"
+				}
+				if relayAttempts := c.GetString("relay_attempts"); relayAttempts != "" {
+					logContent += "，" + relayAttempts
+				}
+				model.RecordConsumeLog(ctx, userId, channelId, 0, 0, imageModel, tokenName, group, quota, userDiscount, logContent)
 				model.UpdateUserUsedQuotaAndRequestCount(userId, quota)
 				channelId := c.GetInt("channel_id")
 				model.UpdateChannelUsedQuota(channelId, quota)
@@ -209,9 +289,17 @@ func relayImageHelper(c *gin.Context, _ int) *OpenAIErrorWithStatusCode {
 		if err != nil {
 			return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError)
 		}
-		err = json.Unmarshal(responseBody, &textResponse)
-		if err != nil {
-			return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError)
+		// nothing was generated, forward the empty response and bill nothing
+		emptyResponse = isEmptyResponse(resp, responseBody)
+		if !emptyResponse {
+			err = json.Unmarshal(responseBody, &textResponse)
+			if err != nil {
+				return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError)
+			}
+			if responseModel, serviceTier, rewrite := getResponseRewrite(c); rewrite {
+				responseBody = rewriteResponse(responseBody, responseModel, serviceTier)
+				resp.Header.Del("Content-Length")
+			}
 		}
 
 		resp.Body = io.NopCloser(bytes.NewBuffer(responseBody))
@@ -220,6 +308,10 @@ func relayImageHelper(c *gin.Context, _ int) *OpenAIErrorWithStatusCode {
 	for k, v := range resp.Header {
 		c.Writer.Header().Set(k, v[0])
 	}
+	if resp.Header.Get("Content-Type") == "" && !emptyResponse {
+		// image endpoints always answer with JSON, do not let the client guess
+		c.Writer.Header().Set("Content-Type", "application/json")
+	}
 	c.Writer.WriteHeader(resp.StatusCode)
 
 	_, err = io.Copy(c.Writer, resp.Body)
@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/middleware"
+	"one-api/model"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func hasFieldError(fieldErrors []*FieldError, code string) bool {
+	for _, fieldError := range fieldErrors {
+		if fieldError.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateImagePromptLength(t *testing.T) {
+	cases := []struct {
+		model  string
+		prompt string
+		long   bool
+	}{
+		// counted in characters, a CJK character is three bytes and an emoji four
+		{"dall-e-2", strings.Repeat("猫", 1000), false},
+		{"dall-e-2", strings.Repeat("猫", 1001), true},
+		{"dall-e-2", strings.Repeat("🐱", 1000), false},
+		{"dall-e-3", strings.Repeat("画", 4000), false},
+		{"dall-e-3", strings.Repeat("🎨", 4001), true},
+	}
+	for _, tc := range cases {
+		_, fieldErrors := validateImageRequest(&ImageRequest{Prompt: tc.prompt}, tc.model, "1024x1024", RelayModeImagesGenerations)
+		if hasFieldError(fieldErrors, "prompt_too_long") != tc.long {
+			t.Errorf("%s with %d characters: prompt_too_long %v, want %v", tc.model, len([]rune(tc.prompt)), !tc.long, tc.long)
+		}
+	}
+	_, fieldErrors := validateImageRequest(&ImageRequest{Prompt: strings.Repeat("猫", 1001)}, "dall-e-2", "1024x1024", RelayModeImagesGenerations)
+	if len(fieldErrors) != 1 || !strings.Contains(fieldErrors[0].Message, "1001 characters, at most 1000") {
+		t.Errorf("error does not report the measured length and the limit: %+v", fieldErrors)
+	}
+}
+
+func TestValidateImagePromptUnlistedModel(t *testing.T) {
+	defer delete(common.DalleSizeRatios, "gpt-image-1")
+	common.DalleSizeRatios["gpt-image-1"] = map[string]float64{"1024x1024": 1}
+	_, fieldErrors := validateImageRequest(&ImageRequest{Prompt: "a cat"}, "gpt-image-1", "1024x1024", RelayModeImagesGenerations)
+	if hasFieldError(fieldErrors, "prompt_too_long") {
+		t.Error("model without a configured limit rejected as too long")
+	}
+}
+
+func TestValidateImageRequestReportsAllErrors(t *testing.T) {
+	_, fieldErrors := validateImageRequest(&ImageRequest{Prompt: "a cat", N: 5}, "dall-e-3", "640x480", RelayModeImagesGenerations)
+	if len(fieldErrors) != 2 || !hasFieldError(fieldErrors, "size_not_supported") || !hasFieldError(fieldErrors, "n_not_within_range") {
+		t.Errorf("size and n not reported together: %+v", fieldErrors)
+	}
+	openaiErr := validationErrorWrapper(fieldErrors)
+	if openaiErr.StatusCode != http.StatusBadRequest || openaiErr.OpenAIError.Code != "invalid_request_parameters" || len(openaiErr.OpenAIError.Errors) != 2 {
+		t.Errorf("unexpected error %+v", openaiErr)
+	}
+}
+
+func TestValidateImagePromptRequirement(t *testing.T) {
+	defer func(requirements map[string]map[string]bool) { common.DalleImagePromptRequirements = requirements }(common.DalleImagePromptRequirements)
+	common.DalleImagePromptRequirements = map[string]map[string]bool{"dall-e-2": {"edits": false}}
+	for _, tc := range []struct {
+		relayMode int
+		required  bool
+	}{
+		{RelayModeImagesGenerations, true},
+		{RelayModeImagesVariations, false},
+		// configured per model and endpoint
+		{RelayModeImagesEdits, false},
+	} {
+		_, fieldErrors := validateImageRequest(&ImageRequest{}, "dall-e-2", "1024x1024", tc.relayMode)
+		if hasFieldError(fieldErrors, "prompt_missing") != tc.required {
+			t.Errorf("%s without a prompt: prompt_missing %v, want %v", getImageEndpoint(tc.relayMode), !tc.required, tc.required)
+		}
+	}
+	_, fieldErrors := validateImageRequest(&ImageRequest{}, "dall-e-3", "1024x1024", RelayModeImagesEdits)
+	if !hasFieldError(fieldErrors, "prompt_missing") {
+		t.Error("edit of an unconfigured model accepted without a prompt")
+	}
+}
+
+func TestImageVariationWithoutPrompt(t *testing.T) {
+	defer delete(common.DalleSizeRatios, "dall-e-variation")
+	defer delete(common.DalleGenerationImageAmounts, "dall-e-variation")
+	common.DalleSizeRatios["dall-e-variation"] = map[string]float64{"1024x1024": 1}
+	common.DalleGenerationImageAmounts["dall-e-variation"] = [2]int{1, 10}
+	var upstreamImage string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if file, _, err := r.FormFile("image"); err == nil {
+			content, _ := io.ReadAll(file)
+			upstreamImage = string(content)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"created":1,"data":[{"url":"https://example.com/cat.png"}]}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "dall-e-variation")
+	token := createTestToken(t, createTestUser(t, "variation", 1000000000).Id, "variation")
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	_ = writer.WriteField("model", "dall-e-variation")
+	part, _ := writer.CreateFormFile("image", "cat.png")
+	_, _ = part.Write([]byte("fake png"))
+	_ = writer.Close()
+	engine := gin.New()
+	relayRouter := engine.Group("/v1")
+	relayRouter.Use(middleware.TokenAuth(), middleware.Distribute())
+	relayRouter.POST("/*path", Relay)
+	request := httptest.NewRequest(http.MethodPost, "/v1/images/variations", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.Header.Set("Authorization", "Bearer sk-"+token.Key)
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || upstreamImage != "fake png" {
+		t.Errorf("variation without a prompt answered %d: %s, upstream got image %q", recorder.Code, recorder.Body.String(), upstreamImage)
+	}
+}
+
+func TestImageResponseWithoutContentType(t *testing.T) {
+	defer delete(common.DalleSizeRatios, "dall-e-no-content-type")
+	defer delete(common.DalleGenerationImageAmounts, "dall-e-no-content-type")
+	common.DalleSizeRatios["dall-e-no-content-type"] = map[string]float64{"1024x1024": 1}
+	common.DalleGenerationImageAmounts["dall-e-no-content-type"] = [2]int{1, 10}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a nil value stops net/http from sniffing one
+		w.Header()["Content-Type"] = nil
+		_, _ = io.WriteString(w, `{"created":1,"data":[{"url":"https://example.com/cat.png"}]}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "dall-e-no-content-type")
+	token := createTestToken(t, createTestUser(t, "image-content-type", 1000000000).Id, "image-content-type")
+	recorder := serveRelay(t, token, "/v1/images/generations", `{"model":"dall-e-no-content-type","prompt":"a cat","size":"1024x1024"}`)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got %d with Content-Type %q: %s", recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body.String())
+	}
+}
+
+func TestConfiguredImagePromptLength(t *testing.T) {
+	defer func(limits string) { _ = model.UpdateOption("DalleImagePromptLengthLimitations", limits) }(common.DalleImagePromptLengthLimitations2JSONString())
+	if err := model.UpdateOption("DalleImagePromptLengthLimitations", `{"dall-e-2":10,"dall-e-3":20}`); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		model  string
+		prompt string
+		long   bool
+	}{
+		{"dall-e-2", strings.Repeat("猫", 10), false},
+		{"dall-e-2", strings.Repeat("🐱", 11), true},
+		{"dall-e-3", strings.Repeat("🎨", 20), false},
+		{"dall-e-3", strings.Repeat("画", 21), true},
+	}
+	for _, tc := range cases {
+		_, fieldErrors := validateImageRequest(&ImageRequest{Prompt: tc.prompt}, tc.model, "1024x1024", RelayModeImagesGenerations)
+		if hasFieldError(fieldErrors, "prompt_too_long") != tc.long {
+			t.Errorf("%s with %d characters: prompt_too_long %v, want %v", tc.model, len([]rune(tc.prompt)), !tc.long, tc.long)
+		}
+	}
+}
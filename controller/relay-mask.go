@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"one-api/common"
+	"strconv"
+	"strings"
+)
+
+// prompts shorter than this are not looked for in error messages, they would match too much
+const minMaskedEchoLength = 8
+
+// shouldMaskPrompt tells whether prompts must be masked in the logs of this request,
+// tokens with the audit flag keep the full content
+func shouldMaskPrompt(c *gin.Context) bool {
+	return common.PromptMaskEnabled && !c.GetBool("token_audit")
+}
+
+// getPromptPaths lists the paths of the user supplied text in a request body:
+// message contents, text parts of multimodal contents, prompt and input
+func getPromptPaths(body []byte) []string {
+	var paths []string
+	addTexts := func(path string, value gjson.Result) {
+		if value.Type == gjson.String {
+			paths = append(paths, path)
+			return
+		}
+		for i, item := range value.Array() {
+			itemPath := path + "." + strconv.Itoa(i)
+			if item.Type == gjson.String {
+				paths = append(paths, itemPath)
+			} else if item.Get("text").Type == gjson.String {
+				paths = append(paths, itemPath+".text")
+			}
+		}
+	}
+	for i, message := range gjson.GetBytes(body, "messages").Array() {
+		addTexts("messages."+strconv.Itoa(i)+".content", message.Get("content"))
+	}
+	addTexts("prompt", gjson.GetBytes(body, "prompt"))
+	addTexts("input", gjson.GetBytes(body, "input"))
+	return paths
+}
+
+// maskRequestBody replaces the prompts in a request body with their masked form
+func maskRequestBody(body []byte) []byte {
+	for _, path := range getPromptPaths(body) {
+		masked, err := sjson.SetBytes(body, path, common.MaskPrompt(gjson.GetBytes(body, path).String()))
+		if err != nil {
+			continue
+		}
+		body = masked
+	}
+	return body
+}
+
+// maskPromptEcho masks the prompts of the request wherever a message repeats them, e.g. upstream errors,
+// a truncated or partial echo is masked like a full one
+func maskPromptEcho(c *gin.Context, message string) string {
+	if !shouldMaskPrompt(c) || message == "" {
+		return message
+	}
+	body, err := common.GetBodyReusable(c)
+	if err != nil {
+		return message
+	}
+	// every run of minMaskedEchoLength characters of the message, an echo of any length is made of them,
+	// the prompts are scanned against these runs without copying, so a long prompt costs no memory
+	runes := []rune(message)
+	offsets := make([]int, 0, len(runes)+1)
+	for offset := range message {
+		offsets = append(offsets, offset)
+	}
+	offsets = append(offsets, len(message))
+	pieces := make(map[string][]int)
+	for i := 0; i+minMaskedEchoLength <= len(runes); i++ {
+		piece := message[offsets[i]:offsets[i+minMaskedEchoLength]]
+		pieces[piece] = append(pieces[piece], i)
+	}
+	if len(pieces) == 0 {
+		return message
+	}
+	echoed := make([]bool, len(runes))
+	found := false
+	markEcho := func(piece string) {
+		for _, i := range pieces[piece] {
+			for j := i; j < i+minMaskedEchoLength; j++ {
+				echoed[j] = true
+			}
+			found = true
+		}
+	}
+	for _, path := range getPromptPaths(body) {
+		text := gjson.GetBytes(body, path).String()
+		// the offsets of the last minMaskedEchoLength characters, the oldest starts the current run
+		var starts [minMaskedEchoLength]int
+		count := 0
+		for offset := range text {
+			if count >= minMaskedEchoLength {
+				markEcho(text[starts[count%minMaskedEchoLength]:offset])
+			}
+			starts[count%minMaskedEchoLength] = offset
+			count++
+		}
+		if count >= minMaskedEchoLength {
+			markEcho(text[starts[count%minMaskedEchoLength]:])
+		}
+	}
+	if !found {
+		return message
+	}
+	// the echoed runs are masked once, masking prompt by prompt would mask the kept prefixes again
+	var masked strings.Builder
+	for i := 0; i < len(runes); {
+		if !echoed[i] {
+			masked.WriteRune(runes[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && echoed[j] {
+			j++
+		}
+		masked.WriteString(common.MaskPrompt(string(runes[i:j])))
+		i = j
+	}
+	return masked.String()
+}
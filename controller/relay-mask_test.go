@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/model"
+	"strings"
+	"testing"
+)
+
+const testSecretPrompt = "Summarize the merger of Acme and Globex closing on March 3rd for 4.2 billion dollars"
+
+func TestMaskPromptEchoMasksPartialEchoes(t *testing.T) {
+	defer func(enabled bool) { common.PromptMaskEnabled = enabled }(common.PromptMaskEnabled)
+	common.PromptMaskEnabled = true
+	c, _ := newTestContext(http.MethodPost, "/v1/chat/completions",
+		`{"model":"gpt-4","messages":[{"role":"user","content":"`+testSecretPrompt+`"}]}`)
+	for _, message := range []string{
+		"invalid prompt: " + testSecretPrompt,
+		"invalid prompt: '" + testSecretPrompt[:40] + "...'",
+		"content policy violation near 'closing on March 3rd for 4.2 billion'",
+	} {
+		masked := maskPromptEcho(c, message)
+		for _, secret := range []string{"March 3rd", "4.2 billion", "Acme and Globex"} {
+			if strings.Contains(masked, secret) {
+				t.Errorf("%q leaks %q", masked, secret)
+			}
+		}
+		if !strings.Contains(masked, "[sha256:") {
+			t.Errorf("%q was not masked", masked)
+		}
+	}
+	if message := "model gpt-4 is overloaded"; maskPromptEcho(c, message) != message {
+		t.Errorf("message without echo was changed to %q", maskPromptEcho(c, message))
+	}
+	c.Set("token_audit", true)
+	if message := "invalid prompt: " + testSecretPrompt; maskPromptEcho(c, message) != message {
+		t.Errorf("audited token was masked: %q", maskPromptEcho(c, message))
+	}
+}
+
+func TestMaskPromptEchoOfLongPrompts(t *testing.T) {
+	defer func(enabled bool) { common.PromptMaskEnabled = enabled }(common.PromptMaskEnabled)
+	common.PromptMaskEnabled = true
+	prompt := strings.Repeat("lorem ipsum dolor sit amet ", 40000) + testSecretPrompt
+	c, _ := newTestContext(http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4","messages":[{"role":"user","content":"`+prompt+`"}]}`)
+	message := "invalid prompt near '" + testSecretPrompt[20:60] + "'"
+	if masked := maskPromptEcho(c, message); strings.Contains(masked, "March 3rd") {
+		t.Errorf("%q leaks the prompt", masked)
+	}
+	// the work on the prompt does not grow with its length
+	if allocs := testing.AllocsPerRun(5, func() { maskPromptEcho(c, message) }); allocs > 1000 {
+		t.Errorf("masking a %d byte prompt took %v allocations", len(prompt), allocs)
+	}
+}
+
+func TestRelayErrorPathsDoNotLogPrompts(t *testing.T) {
+	defer func(enabled bool, logPrompt bool) {
+		common.PromptMaskEnabled, common.LogPrompt = enabled, logPrompt
+	}(common.PromptMaskEnabled, common.LogPrompt)
+	defer func(out io.Writer, errOut io.Writer) {
+		gin.DefaultWriter, gin.DefaultErrorWriter = out, errOut
+	}(gin.DefaultWriter, gin.DefaultErrorWriter)
+	common.PromptMaskEnabled = true
+	common.LogPrompt = true
+	var logs bytes.Buffer
+	gin.DefaultWriter, gin.DefaultErrorWriter = &logs, &logs
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		// upstreams quote a truncated prompt in their errors
+		_, _ = fmt.Fprintf(w, `{"error":{"message":"could not process '%s...'","type":"invalid_request_error","code":"invalid_prompt"}}`, testSecretPrompt[20:60])
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "mask-error-path")
+	user := createTestUser(t, "masked", 1000000)
+	token := createTestToken(t, user.Id, "masked")
+	recorder := serveRelay(t, token, "/v1/chat/completions",
+		`{"model":"mask-error-path","messages":[{"role":"user","content":"`+testSecretPrompt+`"}]}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var failedRequests []model.FailedRequest
+	model.DB.Where("user_id = ?", user.Id).Find(&failedRequests)
+	if len(failedRequests) != 1 {
+		t.Fatalf("got %d failed requests", len(failedRequests))
+	}
+	stored := logs.String() + failedRequests[0].Message + failedRequests[0].Attempts
+	for _, secret := range []string{"March 3rd", "Globex closing", "billion"} {
+		if strings.Contains(stored, secret) {
+			t.Errorf("the logs leak %q:\n%s", secret, stored)
+		}
+	}
+}
+
+func TestOnlyAdminsSetTokenAudit(t *testing.T) {
+	for _, role := range []int{common.RoleCommonUser, common.RoleAdminUser} {
+		user := createTestUser(t, fmt.Sprintf("auditor%d", role), 0)
+		c, _ := newTestContext(http.MethodPost, "/api/token/", `{"name":"audited","audit":true,"expired_time":-1}`)
+		c.Set("id", user.Id)
+		c.Set("role", role)
+		AddToken(c)
+		var token model.Token
+		if err := model.DB.Where("user_id = ?", user.Id).First(&token).Error; err != nil {
+			t.Fatalf("token of role %d was not created: %v", role, err)
+		}
+		if token.Audit != (role >= common.RoleAdminUser) {
+			t.Errorf("role %d created a token with audit %v", role, token.Audit)
+		}
+		c, _ = newTestContext(http.MethodPut, "/api/token/", fmt.Sprintf(`{"id":%d,"name":"audited","audit":%v,"expired_time":-1}`, token.Id, !token.Audit))
+		c.Set("id", user.Id)
+		c.Set("role", role)
+		UpdateToken(c)
+		if err := model.DB.First(&token, token.Id).Error; err != nil {
+			t.Fatal(err)
+		}
+		if token.Audit {
+			t.Errorf("role %d: audit is %v after the update", role, token.Audit)
+		}
+	}
+}
@@ -6,18 +6,39 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/tidwall/sjson"
 	"io"
 	"net/http"
 	"one-api/common"
 	"strings"
 )
 
-func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*OpenAIErrorWithStatusCode, string) {
+const maxStreamLineSize = 16 * 1024 * 1024
+
+const (
+	StreamTrailingDataModeStrict      = "strict"
+	StreamTrailingDataModePassthrough = "passthrough"
+)
+
+// streamBudget is fed every streamed delta and reports whether the user can no longer pay for the stream, nil disables it
+type streamBudget func(delta string) bool
+
+// streamUsageCounter counts the usage of a streamed response text, for the usage chunk sent when upstream sent none,
+// nil disables the chunk
+type streamUsageCounter func(responseText string) Usage
+
+func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int, budget streamBudget, usageCounter streamUsageCounter) (*OpenAIErrorWithStatusCode, string, *Usage) {
 	responseText := ""
+	quotaExhausted := false
+	var usage *Usage
+	var lastChunk ChatCompletionsStreamResponse
+	usageChunkSent := false
 	toolCallNames := map[int]string{}
 	toolCalls := map[int]string{}
 
 	scanner := bufio.NewScanner(resp.Body)
+	// audio deltas carry base64 data and easily exceed the default 64KB line limit
+	scanner.Buffer(make([]byte, 64*1024), maxStreamLineSize)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		if atEOF && len(data) == 0 {
 			return 0, nil, nil
@@ -32,26 +53,66 @@ func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*O
 	})
 	dataChan := make(chan string)
 	stopChan := make(chan bool)
+	repairer := &streamRepairer{}
+	responseModel, serviceTier, rewrite := getResponseRewrite(c)
+	// strict clients choke on anything after the sentinel
+	strictDone := common.StreamTrailingDataMode == StreamTrailingDataModeStrict
+	// like OpenAI with stream_options.include_usage, the usage comes in a last chunk without choices before the sentinel
+	sendUsageChunk := func() {
+		if usageChunkSent || usageCounter == nil || usage != nil || relayMode != RelayModeChatCompletions {
+			return
+		}
+		usageChunkSent = true
+		text := responseText
+		for i := 0; i < len(toolCallNames); i++ {
+			text += toolCallNames[i] + toolCalls[i]
+		}
+		streamUsage := usageCounter(text)
+		chunk, err := json.Marshal(ChatCompletionsStreamResponse{
+			Id:      lastChunk.Id,
+			Object:  "chat.completion.chunk",
+			Created: lastChunk.Created,
+			Model:   lastChunk.Model,
+			Choices: []ChatCompletionsStreamResponseChoice{},
+			Usage:   &streamUsage,
+		})
+		if err != nil {
+			common.SysError("error marshalling usage chunk: " + err.Error())
+			return
+		}
+		dataChan <- "data: " + string(chunk)
+	}
 	go func() {
 		for scanner.Scan() {
-			data := scanner.Text()
-			if len(data) < 6 { // ignore blank line or wrong format
+			data, ok := repairer.feed(scanner.Text())
+			if !ok {
 				continue
 			}
-			if data[:6] != "data: " && data[:6] != "[DONE]" {
-				continue
+			if rewrite && !strings.HasPrefix(data, "[DONE]") {
+				data = string(rewriteResponse([]byte(data), responseModel, serviceTier))
 			}
 			// Ignore invalid results in the first line of azure api results.
-			if c.GetInt("channel") == common.ChannelTypeAzure && !strings.HasPrefix(data[6:], "[DONE]") {
+			if c.GetInt("channel") == common.ChannelTypeAzure && !strings.HasPrefix(data, "[DONE]") {
 				var streamResponse ChatCompletionsStreamResponse
-				err := json.Unmarshal([]byte(data[6:]), &streamResponse)
+				err := json.Unmarshal([]byte(data), &streamResponse)
 				if err == nil && streamResponse.Id == "" {
 					continue
 				}
+				// heartbeats and content filter results come without choices, the usage chunk is always forwarded
+				if err == nil && len(streamResponse.Choices) == 0 && streamResponse.Usage == nil && !common.AzureEmptyChoiceChunkEnabled {
+					continue
+				}
+			}
+			if strings.HasPrefix(data, "[DONE]") {
+				sendUsageChunk()
+			}
+			dataChan <- "data: " + data
+			if strings.HasPrefix(data, "[DONE]") && strictDone {
+				// discard the trailing upstream bytes, closing the body below drops the connection
+				break
 			}
-			dataChan <- data
-			data = data[6:]
 			if !strings.HasPrefix(data, "[DONE]") {
+				delta := ""
 				switch relayMode {
 				case RelayModeChatCompletions:
 					var streamResponse ChatCompletionsStreamResponse
@@ -60,16 +121,23 @@ func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*O
 						common.SysError("error unmarshalling stream response: " + err.Error())
 						continue // just ignore the error
 					}
+					if streamResponse.Usage != nil {
+						usage = streamResponse.Usage
+					}
+					lastChunk = streamResponse
 					for _, choice := range streamResponse.Choices {
 						responseText += choice.Delta.Content
+						delta += choice.Delta.Content
 						if choice.Delta.FunctionCall != nil {
 							toolCallNames[0] += choice.Delta.FunctionCall.Name
 							toolCalls[0] += choice.Delta.FunctionCall.Arguments
+							delta += choice.Delta.FunctionCall.Name + choice.Delta.FunctionCall.Arguments
 						}
 						for _, toolCall := range choice.Delta.ToolCalls {
 							if toolCall.Function != nil {
 								toolCallNames[toolCall.Index] += toolCall.Function.Name
 								toolCalls[toolCall.Index] += toolCall.Function.Arguments
+								delta += toolCall.Function.Name + toolCall.Function.Arguments
 							}
 						}
 					}
@@ -80,19 +148,50 @@ func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*O
 						common.SysError("error unmarshalling stream response: " + err.Error())
 						continue
 					}
+					if streamResponse.Usage != nil {
+						usage = streamResponse.Usage
+					}
 					for _, choice := range streamResponse.Choices {
 						responseText += choice.Text
+						delta += choice.Text
 					}
 				}
+				if budget != nil && delta != "" && budget(delta) {
+					// stop reading, closing the body below cancels the upstream
+					quotaExhausted = true
+					errorData, _ := json.Marshal(gin.H{
+						"error": gin.H{
+							"message": common.MessageWithRequestId("user quota exhausted mid stream", c.GetString(common.RequestIdKey)),
+							"type":    "one_api_error",
+							"code":    "quota_exhausted_mid_stream",
+						},
+					})
+					dataChan <- "data: " + string(errorData)
+					break
+				}
 			}
 		}
+		if !quotaExhausted {
+			// the sentinel is added below when upstream did not send it
+			sendUsageChunk()
+		}
+		if repairer.repairs > 0 {
+			channelId := c.GetInt("channel_id")
+			addStreamRepairCount(channelId, repairer.repairs)
+			common.LogWarn(c.Request.Context(), fmt.Sprintf("repaired %d stream events from channel #%d", repairer.repairs, channelId))
+		}
 		stopChan <- true
 	}()
 	setEventStreamHeaders(c)
+	doneSent := false
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case data := <-dataChan:
 			if strings.HasPrefix(data, "data: [DONE]") {
+				if doneSent {
+					return true
+				}
+				doneSent = true
 				data = data[:12]
 			}
 			// some implementations may add \r at the end of data
@@ -100,14 +199,20 @@ func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*O
 			c.Render(-1, common.CustomEvent{Data: data})
 			return true
 		case <-stopChan:
+			// some upstreams close the stream without the sentinel, clients expect it
+			if !doneSent && !quotaExhausted {
+				c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
+			}
 			return false
 		}
 	})
 	err := resp.Body.Close()
 	if err != nil {
-		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), ""
+		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), "", nil
 	}
 
+	c.Set("tool_call_count", len(toolCallNames))
+	c.Set("quota_exhausted_mid_stream", quotaExhausted)
 	for i := 0; i < len(toolCallNames); i++ {
 		if buf, err := json.MarshalIndent(map[string]string{"name": toolCallNames[i], "arguments": toolCalls[i]}, "", "  "); err != nil {
 			responseText += toolCallNames[i] + toolCalls[i]
@@ -117,12 +222,42 @@ func openaiStreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*O
 	}
 
 	fmt.Println(responseText)
-	return nil, responseText
+	return nil, responseText, usage
 }
 
-func openaiHandler(c *gin.Context, resp *http.Response, consumeQuota bool, promptTokens int, model string) (*OpenAIErrorWithStatusCode, *Usage) {
+// costFooter builds the "one_api" object injected into non-stream responses, nil disables it
+type costFooter func(usage Usage) any
+
+func openaiHandler(c *gin.Context, resp *http.Response, consumeQuota bool, promptTokens int, model string, footer costFooter) (*OpenAIErrorWithStatusCode, *Usage) {
 	var textResponse TextResponse
-	if consumeQuota {
+	usageCompleted := false
+	completeUsage := func() {
+		if usageCompleted || textResponse.Usage.TotalTokens != 0 {
+			return
+		}
+		usageCompleted = true
+		completionTokens := 0
+		for _, choice := range textResponse.Choices {
+			completionTokens += countTokenText(choice.Message.Content, model, isApproximateTokenCount(c))
+			// content is empty when the assistant only calls tools, the arguments are the actual output
+			for _, toolCall := range choice.Message.ToolCalls {
+				if toolCall != nil && toolCall.Function != nil {
+					completionTokens += countTokenText(toolCall.Function.Name+toolCall.Function.Arguments, model, isApproximateTokenCount(c))
+				}
+			}
+		}
+		textResponse.Usage = Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		}
+		if consumeQuota {
+			setApproximateCountWarning(c, model)
+		}
+	}
+	responseModel, serviceTier, rewrite := getResponseRewrite(c)
+	coalesced := c.GetBool("stream_coalesced")
+	if consumeQuota || rewrite || coalesced {
 		responseBody, err := io.ReadAll(resp.Body)
 		if err != nil {
 			return errorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
@@ -131,16 +266,49 @@ func openaiHandler(c *gin.Context, resp *http.Response, consumeQuota bool, promp
 		if err != nil {
 			return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
 		}
+		if isEmptyResponse(resp, responseBody) {
+			// nothing to parse or bill, forward the empty response as is
+			for k, v := range resp.Header {
+				c.Writer.Header().Set(k, v[0])
+			}
+			c.Writer.WriteHeader(resp.StatusCode)
+			return nil, &Usage{}
+		}
+		if rewrite {
+			responseBody = rewriteResponse(responseBody, responseModel, serviceTier)
+			resp.Header.Del("Content-Length")
+		}
 		err = json.Unmarshal(responseBody, &textResponse)
 		if err != nil {
 			return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
 		}
 		if textResponse.Error.Type != "" {
+			textResponse.Error.Message = common.ScrubErrorMessage(textResponse.Error.Message)
 			return &OpenAIErrorWithStatusCode{
 				OpenAIError: textResponse.Error,
 				StatusCode:  resp.StatusCode,
 			}, nil
 		}
+		// before the headers are sent, for the warning
+		completeUsage()
+		if footer != nil {
+			responseBody, err = sjson.SetBytes(responseBody, "one_api", footer(textResponse.Usage))
+			if err != nil {
+				return errorWrapper(err, "set_response_body_failed", http.StatusInternalServerError), nil
+			}
+			resp.Header.Del("Content-Length")
+		}
+		if coalesced {
+			var usage *Usage
+			if c.GetBool("stream_include_usage") {
+				usage = &textResponse.Usage
+			}
+			err = writeCoalescedStream(c, responseBody, usage)
+			if err != nil {
+				return errorWrapper(err, "write_coalesced_stream_failed", http.StatusInternalServerError), nil
+			}
+			return nil, &textResponse.Usage
+		}
 		// Reset response body
 		resp.Body = io.NopCloser(bytes.NewBuffer(responseBody))
 	}
@@ -161,16 +329,11 @@ func openaiHandler(c *gin.Context, resp *http.Response, consumeQuota bool, promp
 		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
 	}
 
-	if textResponse.Usage.TotalTokens == 0 {
-		completionTokens := 0
-		for _, choice := range textResponse.Choices {
-			completionTokens += countTokenText(choice.Message.Content, model)
-		}
-		textResponse.Usage = Usage{
-			PromptTokens:     promptTokens,
-			CompletionTokens: completionTokens,
-			TotalTokens:      promptTokens + completionTokens,
-		}
+	completeUsage()
+	toolCallCount := 0
+	for _, choice := range textResponse.Choices {
+		toolCallCount += len(choice.Message.ToolCalls)
 	}
+	c.Set("tool_call_count", toolCallCount)
 	return nil, &textResponse.Usage
 }
@@ -0,0 +1,314 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/model"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestOpenAIStreamTrailingData(t *testing.T) {
+	defer func(mode string) { common.StreamTrailingDataMode = mode }(common.StreamTrailingDataMode)
+	upstream := "data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\ndata: {\"junk\":true}\n\n"
+	relay := func(mode string) string {
+		common.StreamTrailingDataMode = mode
+		c, recorder := newTestStreamContext(http.MethodPost, "/v1/chat/completions", "")
+		resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(upstream))}
+		if err, _, _ := openaiStreamHandler(c, resp, RelayModeChatCompletions, nil, nil); err != nil {
+			t.Fatalf("openaiStreamHandler: %v", err.Message)
+		}
+		return recorder.Body.String()
+	}
+	if body := relay(StreamTrailingDataModeStrict); strings.Contains(body, "junk") || !strings.HasSuffix(strings.TrimSpace(body), "data: [DONE]") {
+		t.Errorf("strict mode forwarded trailing data: %q", body)
+	}
+	if body := relay(StreamTrailingDataModePassthrough); !strings.Contains(body, "junk") {
+		t.Errorf("passthrough mode dropped trailing data: %q", body)
+	}
+}
+
+func TestStreamCutoffHonorsTokenQuota(t *testing.T) {
+	defer func(enabled bool) { common.StreamQuotaCutoffEnabled = enabled }(common.StreamQuotaCutoffEnabled)
+	common.StreamQuotaCutoffEnabled = true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 200; i++ {
+			_, _ = io.WriteString(w, "data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"a long answer \"}}]}\n\n")
+		}
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "cutoff-token-quota")
+	// the user can pay for the whole stream, the token cannot
+	token := createTestToken(t, createTestUser(t, "cutoff", 1000000000).Id, "cutoff")
+	model.DB.Model(token).Update("remain_quota", 2000)
+	recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"cutoff-token-quota","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if body := recorder.Body.String(); !strings.Contains(body, "quota_exhausted_mid_stream") {
+		t.Errorf("the stream was not cut off at the token quota: %d", recorder.Code)
+	}
+}
+
+func TestCompletionsStreamBillsUpstreamUsage(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"id\":\"1\",\"choices\":[{\"text\":\"hi\",\"index\":0}]}\n\n")
+		_, _ = io.WriteString(w, "data: {\"id\":\"1\",\"choices\":[],\"usage\":{\"prompt_tokens\":123,\"completion_tokens\":45,\"total_tokens\":168}}\n\n")
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "completions-stream-usage")
+	user := createTestUser(t, "completions-usage", 1000000000)
+	token := createTestToken(t, user.Id, "completions-usage")
+	recorder := serveRelay(t, token, "/v1/completions", `{"model":"completions-stream-usage","stream":true,"prompt":"hi"}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	// the settlement runs in the background
+	var log model.Log
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if model.DB.Where("user_id = ? and type = ?", user.Id, model.LogTypeConsume).First(&log).Error == nil {
+			break
+		}
+	}
+	if log.PromptTokens != 123 || log.CompletionTokens != 45 {
+		t.Errorf("billed %d prompt and %d completion tokens, want the upstream 123 and 45", log.PromptTokens, log.CompletionTokens)
+	}
+}
+
+func TestOpenAIStreamEndsWithSingleDone(t *testing.T) {
+	chunk := "data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n"
+	for name, upstream := range map[string]string{
+		"with sentinel":    chunk + "data: [DONE]\n\n",
+		"without sentinel": chunk,
+		"empty":            "",
+	} {
+		c, recorder := newTestStreamContext(http.MethodPost, "/v1/chat/completions", "")
+		resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(upstream))}
+		if err, _, _ := openaiStreamHandler(c, resp, RelayModeChatCompletions, nil, nil); err != nil {
+			t.Fatalf("%s: %v", name, err.Message)
+		}
+		body := recorder.Body.String()
+		if strings.Count(body, "[DONE]") != 1 || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+			t.Errorf("%s: relayed %q", name, body)
+		}
+	}
+}
+
+func TestCostFooter(t *testing.T) {
+	defer func(enabled bool) { common.CostFooterEnabled = enabled }(common.CostFooterEnabled)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":20,"total_tokens":30}}`)
+	}))
+	defer upstream.Close()
+	channel := createTestRelayChannel(t, upstream.URL, "cost-footer-model")
+	user := createTestUser(t, "cost-footer", 1000000)
+	token := createTestToken(t, user.Id, "cost-footer")
+	body := `{"model":"cost-footer-model","messages":[{"role":"user","content":"hi"}]}`
+
+	common.CostFooterEnabled = false
+	if recorder := serveRelay(t, token, "/v1/chat/completions", body); gjson.Get(recorder.Body.String(), "one_api").Exists() {
+		t.Errorf("footer injected while disabled: %s", recorder.Body.String())
+	}
+
+	common.CostFooterEnabled = true
+	recorder := serveRelay(t, token, "/v1/chat/completions", body)
+	footer := gjson.Get(recorder.Body.String(), "one_api")
+	modelRatio := common.GetModelRatio("cost-footer-model")
+	if footer.Get("channel").Int() != int64(channel.Id) || footer.Get("cost").Int() != int64(getTextQuota("cost-footer-model", 10, 20, modelRatio, 1)) ||
+		footer.Get("input_ratio").Float() != modelRatio || footer.Get("output_ratio").Float() != modelRatio*common.GetCompletionRatio("cost-footer-model") ||
+		footer.Get("group_ratio").Float() != 1 {
+		t.Errorf("unexpected footer: %s", recorder.Body.String())
+	}
+	// the standard fields are untouched
+	if gjson.Get(recorder.Body.String(), "choices.0.message.content").String() != "hi" || gjson.Get(recorder.Body.String(), "usage.total_tokens").Int() != 30 {
+		t.Errorf("response changed: %s", recorder.Body.String())
+	}
+
+	// with the option off, only admins can ask for it
+	common.CostFooterEnabled = false
+	admin := createTestUser(t, "cost-footer-admin", 0)
+	model.DB.Model(admin).Update("role", common.RoleAdminUser)
+	for _, tc := range []struct {
+		id   int
+		want bool
+	}{{user.Id, false}, {admin.Id, true}} {
+		c, _ := newTestContext(http.MethodPost, "/v1/chat/completions", body)
+		c.Request.Header.Set("X-Oneapi-Cost-Footer", "true")
+		c.Set("id", tc.id)
+		if got := wantCostFooter(c); got != tc.want {
+			t.Errorf("user %d asking for the footer got %v", tc.id, got)
+		}
+	}
+}
+
+func TestCostFooterMatchesSettlement(t *testing.T) {
+	defer func(enabled bool) { common.CostFooterEnabled = enabled }(common.CostFooterEnabled)
+	defer func(ratios map[string]common.IORatio) { common.ModelIORatio = ratios }(common.ModelIORatio)
+	common.CostFooterEnabled = true
+	common.ModelIORatio = map[string]common.IORatio{"cost-footer-audio-model": {Input: 1, Output: 4}}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":120,"total_tokens":130,"completion_tokens_details":{"audio_tokens":100}}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "cost-footer-audio-model")
+	user := createTestUser(t, "cost-footer-audio", 1000000)
+	recorder := serveRelay(t, createTestToken(t, user.Id, "cost-footer-audio"), "/v1/chat/completions", `{"model":"cost-footer-audio-model","messages":[{"role":"user","content":"hi"}]}`)
+	footer := gjson.Get(recorder.Body.String(), "one_api")
+	if footer.Get("input_ratio").Float() != 1 || footer.Get("output_ratio").Float() != 4 {
+		t.Errorf("footer reports the estimation ratio: %s", footer.Raw)
+	}
+	var log model.Log
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if model.DB.Where("user_id = ? and type = ?", user.Id, model.LogTypeConsume).First(&log).Error == nil {
+			break
+		}
+	}
+	if log.Quota == 0 || footer.Get("cost").Int() != int64(log.Quota) {
+		t.Errorf("footer cost %d, settled %d", footer.Get("cost").Int(), log.Quota)
+	}
+}
+
+func TestToolCallArgumentsAreBilled(t *testing.T) {
+	arguments := `{"rows":[` + strings.Repeat(`{"city":"Paris","temperature":21,"unit":"celsius"},`, 200) + `{}]}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(readAll(r), `"stream":true`) {
+			w.Header().Set("Content-Type", "application/json")
+			message, _ := json.Marshal(map[string]any{"role": "assistant", "content": nil, "tool_calls": []any{
+				map[string]any{"id": "call_1", "type": "function", "function": map[string]any{"name": "report_weather", "arguments": arguments}},
+			}})
+			_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":`+string(message)+`,"finish_reason":"tool_calls"}]}`)
+			return
+		}
+		// the arguments arrive as many small deltas
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, `data: {"id":"1","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"report_weather","arguments":""}}]}}]}`+"\n\n")
+		for i := 0; i < len(arguments); i += 16 {
+			end := i + 16
+			if end > len(arguments) {
+				end = len(arguments)
+			}
+			delta, _ := json.Marshal(arguments[i:end])
+			_, _ = io.WriteString(w, `data: {"id":"1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":`+string(delta)+`}}]}}]}`+"\n\n")
+		}
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "tool-call-model")
+	minTokens := countTokenText(arguments, "tool-call-model", true)
+	for _, stream := range []bool{false, true} {
+		user := createTestUser(t, fmt.Sprintf("tool-call-%v", stream), 100000000)
+		token := createTestToken(t, user.Id, "tool-call")
+		recorder := serveRelay(t, token, "/v1/chat/completions", fmt.Sprintf(`{"model":"tool-call-model","stream":%v,"messages":[{"role":"user","content":"weather?"}]}`, stream))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("stream %v: got %d: %s", stream, recorder.Code, recorder.Body.String())
+		}
+		var log model.Log
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if model.DB.Where("user_id = ? and type = ?", user.Id, model.LogTypeConsume).First(&log).Error == nil {
+				break
+			}
+		}
+		if log.CompletionTokens < minTokens || !strings.Contains(log.Content, "tool_call 1 次") {
+			t.Errorf("stream %v: %d completion tokens billed for %d tokens of arguments: %s", stream, log.CompletionTokens, minTokens, log.Content)
+		}
+	}
+}
+
+func TestEmptyUpstreamResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(readAll(r), `"empty-ok"}`) {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "empty-response-model")
+	for _, tc := range []struct {
+		name string
+		code int
+	}{{"no-content", http.StatusNoContent}, {"empty-ok", http.StatusOK}} {
+		user := createTestUser(t, "empty-response-"+tc.name, 100000)
+		token := createTestToken(t, user.Id, tc.name)
+		recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"empty-response-model","messages":[{"role":"user","content":"hi"}],"user":"`+tc.name+`"}`)
+		if recorder.Code != tc.code || recorder.Body.Len() != 0 {
+			t.Errorf("%s: got %d: %s", tc.name, recorder.Code, recorder.Body.String())
+		}
+		// the reservation is refunded and nothing is billed
+		var storedToken *model.Token
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if storedToken, _ = model.GetTokenById(token.Id); storedToken.RemainQuota == 1000000 {
+				break
+			}
+		}
+		if storedToken.RemainQuota != 1000000 || storedToken.UsedQuota != 0 {
+			t.Errorf("%s: token billed, remain %d used %d", tc.name, storedToken.RemainQuota, storedToken.UsedQuota)
+		}
+	}
+}
+
+func TestStreamUsageChunk(t *testing.T) {
+	defer func(enabled bool) { common.StreamUsageChunkEnabled = enabled }(common.StreamUsageChunkEnabled)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"id\":\"chatcmpl-7\",\"object\":\"chat.completion.chunk\",\"created\":42,\"model\":\"usage-chunk-model\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hello there\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "usage-chunk-model")
+	token := createTestToken(t, createTestUser(t, "usage-chunk", 1000000).Id, "usage-chunk")
+	// chunks returns the data of the stream events before the sentinel
+	chunks := func(body string) []string {
+		t.Helper()
+		recorder := serveRelay(t, token, "/v1/chat/completions", body)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+		}
+		var data []string
+		for _, line := range strings.Split(recorder.Body.String(), "\n") {
+			if strings.HasPrefix(line, "data: ") {
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			}
+		}
+		if len(data) == 0 || data[len(data)-1] != "[DONE]" {
+			t.Fatalf("stream does not end with the sentinel: %q", recorder.Body.String())
+		}
+		return data[:len(data)-1]
+	}
+	plain := `{"model":"usage-chunk-model","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	withUsage := `{"model":"usage-chunk-model","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`
+
+	common.StreamUsageChunkEnabled = false
+	if data := chunks(plain); len(data) != 1 || gjson.Get(data[0], "usage").Exists() {
+		t.Errorf("usage chunk sent without include_usage: %q", data)
+	}
+	for _, tc := range []struct {
+		forced bool
+		body   string
+	}{{false, withUsage}, {true, plain}} {
+		common.StreamUsageChunkEnabled = tc.forced
+		data := chunks(tc.body)
+		if len(data) != 2 {
+			t.Fatalf("forced %v: got chunks %q", tc.forced, data)
+		}
+		last := gjson.Parse(data[1])
+		usage := last.Get("usage")
+		if last.Get("object").String() != "chat.completion.chunk" || last.Get("id").String() != "chatcmpl-7" || last.Get("created").Int() != 42 ||
+			last.Get("model").String() != "usage-chunk-model" || !last.Get("choices").IsArray() || len(last.Get("choices").Array()) != 0 {
+			t.Errorf("forced %v: unexpected usage chunk %s", tc.forced, data[1])
+		}
+		if usage.Get("prompt_tokens").Int() == 0 || usage.Get("completion_tokens").Int() == 0 ||
+			usage.Get("total_tokens").Int() != usage.Get("prompt_tokens").Int()+usage.Get("completion_tokens").Int() {
+			t.Errorf("forced %v: unexpected usage %s", tc.forced, usage.Raw)
+		}
+	}
+}
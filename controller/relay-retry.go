@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"one-api/common"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type relayRetryCount struct {
+	Retries   int `json:"retries"`   // same-channel retries of transient failures
+	Failovers int `json:"failovers"` // retries redirected to another channel
+}
+
+// relayRetryCounts counts retries per channel since startup
+var relayRetryCounts = map[int]*relayRetryCount{}
+var relayRetryCountsLock sync.Mutex
+
+func addRelayRetryCount(channelId int, failover bool) {
+	relayRetryCountsLock.Lock()
+	defer relayRetryCountsLock.Unlock()
+	count, ok := relayRetryCounts[channelId]
+	if !ok {
+		count = &relayRetryCount{}
+		relayRetryCounts[channelId] = count
+	}
+	if failover {
+		count.Failovers++
+	} else {
+		count.Retries++
+	}
+}
+
+// isTransientUpstreamFailure tells whether a retry on the same channel is likely to succeed:
+// timeouts, connection resets, refused connections and gateway errors, but not permanent errors
+// such as an invalid url, an unknown host or a TLS failure
+func isTransientUpstreamFailure(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		if req.Context().Err() != nil {
+			return false
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return true
+		}
+		// a reused connection closed by the upstream surfaces as EOF
+		return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// getUpstreamRetryDelay backs off exponentially from UpstreamRetryBackoff, with jitter
+func getUpstreamRetryDelay(attempt int) time.Duration {
+	delay := float64(common.UpstreamRetryBackoff) * float64(int(1)<<attempt)
+	delay *= 0.5 + rand.Float64()
+	return time.Duration(delay) * time.Millisecond
+}
+
+// doUpstreamRequest sends the request to the selected channel, retrying transient failures on the same channel
+// up to UpstreamRetryTimes times before the cross-channel failover of Relay kicks in
+func doUpstreamRequest(c *gin.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	if common.UpstreamRetryTimes <= 0 {
+		resp, err := client.Do(req)
+		if err == nil {
+			stopRelayDeadline(c)
+		}
+		return resp, err
+	}
+	getBody := req.GetBody
+	if getBody == nil && req.Body != nil && req.Body != http.NoBody {
+		// the request forwards the client body as is, rewind the reusable copy
+		getBody = func() (io.ReadCloser, error) {
+			readSeeker, err := common.GetBodyReadSeeker(c)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(readSeeker), nil
+		}
+	}
+	channelId := c.GetInt("channel_id")
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(attemptReq)
+		if attempt >= common.UpstreamRetryTimes || c.Writer.Written() || !isTransientUpstreamFailure(req, resp, err) {
+			if err == nil {
+				stopRelayDeadline(c)
+			}
+			return resp, err
+		}
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = fmt.Sprintf("status code %d", resp.StatusCode)
+			resp.Body.Close()
+		}
+		addRelayRetryCount(channelId, false)
+		common.LogWarn(c.Request.Context(), fmt.Sprintf("retrying channel #%d after transient failure: %s", channelId, common.RedactURLSecrets(reason)))
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(getUpstreamRetryDelay(attempt)):
+		}
+		attemptReq = req.Clone(req.Context())
+		if getBody != nil {
+			attemptReq.Body, err = getBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func GetRelayRetryCounts(c *gin.Context) {
+	relayRetryCountsLock.Lock()
+	counts := make(map[int]relayRetryCount, len(relayRetryCounts))
+	for channelId, count := range relayRetryCounts {
+		counts[channelId] = *count
+	}
+	relayRetryCountsLock.Unlock()
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    counts,
+	})
+	return
+}
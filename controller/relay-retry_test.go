@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"one-api/common"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsTransientUpstreamFailure(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusedURL := "http://" + closed.Addr().String()
+	closed.Close()
+	reset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer reset.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	for _, test := range []struct {
+		name      string
+		url       string
+		transient bool
+	}{
+		{"refused", refusedURL, true},
+		{"reset", reset.URL, true},
+		{"timeout", slow.URL, true},
+		{"invalid scheme", "ftp://example.com", false},
+	} {
+		req := httptest.NewRequest(http.MethodPost, test.url, nil)
+		req.RequestURI = ""
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("%s: the request succeeded", test.name)
+		}
+		if transient := isTransientUpstreamFailure(req, nil, err); transient != test.transient {
+			t.Errorf("%s: %v is transient %v", test.name, err, transient)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "http://example.invalid", nil)
+	nxdomain := &url.Error{Op: "Post", URL: req.URL.String(), Err: &net.OpError{Op: "dial", Net: "tcp",
+		Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}}
+	if isTransientUpstreamFailure(req, nil, nxdomain) {
+		t.Error("an unknown host is retried")
+	}
+	for status, transient := range map[int]bool{http.StatusBadGateway: true, http.StatusServiceUnavailable: true,
+		http.StatusGatewayTimeout: true, http.StatusInternalServerError: false, http.StatusBadRequest: false} {
+		if isTransientUpstreamFailure(req, &http.Response{StatusCode: status}, nil) != transient {
+			t.Errorf("status %d is not transient %v", status, transient)
+		}
+	}
+}
+
+func TestDoUpstreamRequestRetriesResets(t *testing.T) {
+	defer func(times int, backoff int) {
+		common.UpstreamRetryTimes, common.UpstreamRetryBackoff = times, backoff
+	}(common.UpstreamRetryTimes, common.UpstreamRetryBackoff)
+	common.UpstreamRetryTimes = 2
+	common.UpstreamRetryBackoff = 1
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	c, _ := newTestContext(http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4"}`)
+	c.Set("channel_id", 187)
+	req, _ := http.NewRequest(http.MethodPost, upstream.URL, c.Request.Body)
+	resp, err := doUpstreamRequest(c, http.DefaultClient, req)
+	if err != nil {
+		t.Fatalf("the reset was not retried: %v", err)
+	}
+	resp.Body.Close()
+	if requests != 2 || relayRetryCounts[187] == nil || relayRetryCounts[187].Retries != 1 {
+		t.Errorf("got %d requests and retry count %+v", requests, relayRetryCounts[187])
+	}
+}
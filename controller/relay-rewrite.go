@@ -0,0 +1,40 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"one-api/common"
+)
+
+// getResponseRewrite tells whether responses need rewriting, which model name the client should see
+// and which service tier to echo, the model is only rewritten when the channel mapped it to another one
+func getResponseRewrite(c *gin.Context) (string, string, bool) {
+	responseModel := c.GetString("response_model")
+	serviceTier := ""
+	if c.GetBool("service_tier_requested") {
+		serviceTier = c.GetString("service_tier")
+	}
+	return responseModel, serviceTier, responseModel != "" || serviceTier != "" || common.StripSystemFingerprintEnabled
+}
+
+// rewriteResponse hides upstream identifiers in a response or stream event, other fields and usage are untouched
+func rewriteResponse(data []byte, responseModel string, serviceTier string) []byte {
+	if responseModel != "" && gjson.GetBytes(data, "model").Exists() {
+		if rewritten, err := sjson.SetBytes(data, "model", responseModel); err == nil {
+			data = rewritten
+		}
+	}
+	// the tier we served the request in, which is not necessarily the upstream one
+	if serviceTier != "" && gjson.GetBytes(data, "choices").Exists() {
+		if rewritten, err := sjson.SetBytes(data, "service_tier", serviceTier); err == nil {
+			data = rewritten
+		}
+	}
+	if common.StripSystemFingerprintEnabled && gjson.GetBytes(data, "system_fingerprint").Exists() {
+		if rewritten, err := sjson.DeleteBytes(data, "system_fingerprint"); err == nil {
+			data = rewritten
+		}
+	}
+	return data
+}
@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"net/http"
+	"one-api/common"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	MessageSanitizeModeStrip  = "strip"
+	MessageSanitizeModeReject = "reject"
+)
+
+func isDirtyText(text string) bool {
+	return strings.IndexByte(text, 0) >= 0 || !utf8.ValidString(text)
+}
+
+func cleanText(text string) string {
+	return strings.ReplaceAll(strings.ToValidUTF8(text, ""), "\x00", "")
+}
+
+// sanitizeMessages enforces the per message size cap and strips or rejects NUL bytes and invalid UTF-8
+// in chat messages. The returned body is what gets forwarded and counted, changed tells if it was rewritten.
+func sanitizeMessages(rawBody []byte) ([]byte, bool, *OpenAIErrorWithStatusCode) {
+	if common.MessageSanitizeMode == "" && common.MaxMessageContentSize <= 0 {
+		return rawBody, false, nil
+	}
+	body := rawBody
+	changed := false
+	for i, message := range gjson.GetBytes(rawBody, "messages").Array() {
+		// the text of a message is either its content or the text of its content parts
+		texts := map[string]string{}
+		content := message.Get("content")
+		if content.IsArray() {
+			for j, part := range content.Array() {
+				if part.Get("type").String() == string(ContentPartTypeText) {
+					texts[fmt.Sprintf("messages.%d.content.%d.text", i, j)] = part.Get("text").String()
+				}
+			}
+		} else if content.Type == gjson.String {
+			texts[fmt.Sprintf("messages.%d.content", i)] = content.String()
+		}
+		size := 0
+		for path, text := range texts {
+			if isDirtyText(text) {
+				switch common.MessageSanitizeMode {
+				case MessageSanitizeModeReject:
+					return nil, false, errorWrapper(fmt.Errorf("messages[%d] contains NUL bytes or invalid UTF-8", i), "invalid_message_content", http.StatusBadRequest)
+				case MessageSanitizeModeStrip:
+					text = cleanText(text)
+					var err error
+					body, err = sjson.SetBytes(body, path, text)
+					if err != nil {
+						return nil, false, errorWrapper(err, "set_request_body_failed", http.StatusInternalServerError)
+					}
+					changed = true
+				}
+			}
+			size += len(text)
+		}
+		if common.MaxMessageContentSize > 0 && size > common.MaxMessageContentSize {
+			return nil, false, errorWrapper(fmt.Errorf("messages[%d] is too large: %d bytes, at most %d bytes are allowed", i, size, common.MaxMessageContentSize), "message_too_large", http.StatusBadRequest)
+		}
+	}
+	return body, changed, nil
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"one-api/common"
+)
+
+// disableRequestStream turns a stream request into a plain one for models that cannot stream
+func disableRequestStream(body []byte) ([]byte, error) {
+	body, err := sjson.SetBytes(body, "stream", false)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.DeleteBytes(body, "stream_options")
+}
+
+// getCoalescedStreamChunk turns a chat completion into the single chunk of an equivalent stream,
+// each message becomes the delta of its choice, the usage is left to the usage chunk
+func getCoalescedStreamChunk(body []byte) ([]byte, error) {
+	chunk, err := sjson.SetBytes(body, "object", "chat.completion.chunk")
+	if err != nil {
+		return nil, err
+	}
+	chunk, err = sjson.DeleteBytes(chunk, "usage")
+	if err != nil {
+		return nil, err
+	}
+	for i, choice := range gjson.GetBytes(body, "choices").Array() {
+		path := fmt.Sprintf("choices.%d", i)
+		delta := choice.Get("message").Raw
+		if delta == "" {
+			delta = "{}"
+		}
+		chunk, err = sjson.SetRawBytes(chunk, path+".delta", []byte(delta))
+		if err != nil {
+			return nil, err
+		}
+		// stream deltas of tool calls carry their position
+		for j := range choice.Get("message.tool_calls").Array() {
+			chunk, err = sjson.SetBytes(chunk, fmt.Sprintf("%s.delta.tool_calls.%d.index", path, j), j)
+			if err != nil {
+				return nil, err
+			}
+		}
+		chunk, err = sjson.DeleteBytes(chunk, path+".message")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chunk, nil
+}
+
+// writeCoalescedStream answers a stream request relayed without streaming, see StreamModeMismatchAction,
+// the usage is sent like stream_options.include_usage does when it is not nil
+func writeCoalescedStream(c *gin.Context, body []byte, usage *Usage) error {
+	chunk, err := getCoalescedStreamChunk(body)
+	if err != nil {
+		return err
+	}
+	setEventStreamHeaders(c)
+	c.Render(-1, common.CustomEvent{Data: "data: " + string(chunk)})
+	if usage != nil {
+		usageChunk, err := json.Marshal(ChatCompletionsStreamResponse{
+			Id:      gjson.GetBytes(body, "id").String(),
+			Object:  "chat.completion.chunk",
+			Created: gjson.GetBytes(body, "created").Int(),
+			Model:   gjson.GetBytes(body, "model").String(),
+			Choices: []ChatCompletionsStreamResponseChoice{},
+			Usage:   usage,
+		})
+		if err != nil {
+			return err
+		}
+		c.Render(-1, common.CustomEvent{Data: "data: " + string(usageChunk)})
+	}
+	c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
+	c.Writer.Flush()
+	return nil
+}
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestNonStreamOnlyModels(t *testing.T) {
+	defer func(modes map[string]string, action string) {
+		common.ModelStreamModes, common.StreamModeMismatchAction = modes, action
+	}(common.ModelStreamModes, common.StreamModeMismatchAction)
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","created":1,"model":"no-stream","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "no-stream")
+	token := createTestToken(t, createTestUser(t, "nostream", 1000000).Id, "no-stream")
+	common.ModelStreamModes = map[string]string{"no-stream": common.ModelStreamModeNonStreamOnly}
+
+	common.StreamModeMismatchAction = "reject"
+	recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"no-stream","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "stream_not_supported") {
+		t.Errorf("reject mode answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	common.StreamModeMismatchAction = "coalesce"
+	chunks := func(body string) []string {
+		t.Helper()
+		recorder := serveRelay(t, token, "/v1/chat/completions", body)
+		if recorder.Code != http.StatusOK || gjson.GetBytes(upstreamBody, "stream").Bool() {
+			t.Fatalf("coalesce mode answered %d: %s, upstream got %s", recorder.Code, recorder.Body.String(), upstreamBody)
+		}
+		var data []string
+		for _, line := range strings.Split(recorder.Body.String(), "\n") {
+			if strings.HasPrefix(line, "data: ") && line != "data: [DONE]" {
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			}
+		}
+		return data
+	}
+	data := chunks(`{"model":"no-stream","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if len(data) != 1 || gjson.Get(data[0], "choices.0.delta.content").String() != "ok" || gjson.Get(data[0], "usage").Exists() {
+		t.Errorf("coalesced stream without include_usage: %v", data)
+	}
+	data = chunks(`{"model":"no-stream","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	if len(data) != 2 || gjson.Get(data[1], "choices.#").Int() != 0 || gjson.Get(data[1], "usage.total_tokens").Int() != 4 {
+		t.Errorf("coalesced stream with include_usage: %v", data)
+	}
+}
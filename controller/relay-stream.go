@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxPendingStreamData bounds how much of a split JSON object we keep waiting for its remainder
+const maxPendingStreamData = 64 * 1024
+
+// streamRepairCounts counts repaired stream events per channel since startup
+var streamRepairCounts = map[int]int{}
+var streamRepairCountsLock sync.Mutex
+
+func addStreamRepairCount(channelId int, count int) {
+	if count == 0 {
+		return
+	}
+	streamRepairCountsLock.Lock()
+	defer streamRepairCountsLock.Unlock()
+	streamRepairCounts[channelId] += count
+}
+
+// ignoredStreamEvents are event types some upstreams use for heartbeats, their data is neither forwarded nor counted
+var ignoredStreamEvents = map[string]bool{
+	"ping":       true,
+	"heartbeat":  true,
+	"keepalive":  true,
+	"keep-alive": true,
+}
+
+// streamRepairer normalizes the SSE lines of upstreams that do not follow the format strictly:
+// it follows the event framing of the spec (event:, id:, retry:, data: with or without the space,
+// multi-line data), skips comments and heartbeat events,
+// joins JSON objects split across events and resynchronizes after malformed ones.
+type streamRepairer struct {
+	pending string
+	repairs int
+	event   string // type of the event being read, reset by the blank line ending it
+}
+
+// feed takes a raw line and returns the payload without the "data: " prefix once a complete event is available
+func (r *streamRepairer) feed(line string) (string, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	var payload string
+	switch {
+	case line == "":
+		// end of the event
+		r.event = ""
+		return "", false
+	case strings.HasPrefix(line, ":"):
+		// comment, which is usually used as heartbeat
+		return "", false
+	case strings.HasPrefix(line, "data:"):
+		// the space after the colon is optional
+		payload = strings.TrimPrefix(line[5:], " ")
+	case strings.HasPrefix(line, "[DONE]"):
+		payload = line
+	case strings.HasPrefix(line, "event:"):
+		r.event = strings.TrimSpace(line[6:])
+		return "", false
+	case strings.HasPrefix(line, "id:") || strings.HasPrefix(line, "retry:"):
+		return "", false
+	default:
+		if r.pending == "" && !strings.HasPrefix(strings.TrimSpace(line), "{") {
+			return "", false
+		}
+		// data without prefix
+		payload = line
+		r.repairs++
+	}
+	if ignoredStreamEvents[r.event] {
+		return "", false
+	}
+	if strings.HasPrefix(payload, "[DONE]") {
+		if r.pending != "" {
+			r.pending = ""
+			r.repairs++
+		}
+		return "[DONE]", true
+	}
+	if r.pending != "" {
+		combined := r.pending + payload
+		if json.Valid([]byte(combined)) {
+			r.pending = ""
+			r.repairs++
+			return combined, true
+		}
+		if json.Valid([]byte(payload)) {
+			// the pending part can never be completed, drop it and resynchronize
+			r.pending = ""
+			r.repairs++
+			return payload, true
+		}
+		if len(combined) > maxPendingStreamData {
+			r.pending = ""
+			r.repairs++
+			return "", false
+		}
+		r.pending = combined
+		return "", false
+	}
+	if json.Valid([]byte(payload)) {
+		return payload, true
+	}
+	r.pending = payload
+	return "", false
+}
+
+func GetStreamRepairCounts(c *gin.Context) {
+	streamRepairCountsLock.Lock()
+	counts := make(map[int]int, len(streamRepairCounts))
+	for channelId, count := range streamRepairCounts {
+		counts[channelId] = count
+	}
+	streamRepairCountsLock.Unlock()
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    counts,
+	})
+	return
+}
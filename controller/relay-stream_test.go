@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamRepairFixtures(t *testing.T) {
+	// the fixtures reproduce the framing of misbehaving OpenAI-compatible upstreams,
+	// every one of them streams "Hello world" in three chunks
+	for i, test := range []struct {
+		fixture string
+		repairs int
+	}{
+		{"missing-space.sse", 0},
+		{"missing-prefix.sse", 1},
+		{"split-json.sse", 1},
+		{"heartbeat.sse", 0},
+		{"malformed.sse", 1},
+		{"event-framed.sse", 0},
+	} {
+		file, err := os.Open(filepath.Join("testdata", "stream", test.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		channelId := 1000 + i
+		c, recorder := newTestStreamContext(http.MethodPost, "/v1/chat/completions", "")
+		c.Set("channel_id", channelId)
+		resp := &http.Response{StatusCode: http.StatusOK, Body: file}
+		openaiErr, responseText, _ := openaiStreamHandler(c, resp, RelayModeChatCompletions, nil, nil)
+		if openaiErr != nil {
+			t.Fatalf("%s: %v", test.fixture, openaiErr.Message)
+		}
+		if responseText != "Hello world" {
+			t.Errorf("%s: counted %q", test.fixture, responseText)
+		}
+		body := recorder.Body.String()
+		if chunks := strings.Count(body, "data: {"); chunks != 3 || !strings.Contains(body, "data: [DONE]") {
+			t.Errorf("%s: forwarded %d chunks: %q", test.fixture, chunks, body)
+		}
+		streamRepairCountsLock.Lock()
+		repairs := streamRepairCounts[channelId]
+		streamRepairCountsLock.Unlock()
+		if repairs != test.repairs {
+			t.Errorf("%s: counted %d repairs, want %d", test.fixture, repairs, test.repairs)
+		}
+	}
+}
+
+func TestStreamRepairerEventFraming(t *testing.T) {
+	lines := []string{
+		"retry: 3000",
+		"id: 1",
+		"event: message",
+		`data:{"choices":[{"delta":{"content":"Hel"}}]}`,
+		"",
+		// heartbeat events carry data that must not be counted
+		"event: ping",
+		`data: {"type":"ping"}`,
+		"",
+		"event: message",
+		"id: 2",
+		// the data of one event spread over several lines
+		`data: {"choices":[{"delta":`,
+		`data: {"content":"lo"}}]}`,
+		"",
+		"event: keep-alive",
+		"data: {}",
+		"",
+		`data: {"choices":[{"delta":{"content":"!"}}]}`,
+		"",
+		"event: message",
+		"data: [DONE]",
+		"",
+	}
+	repairer := &streamRepairer{}
+	var payloads []string
+	for _, line := range lines {
+		if payload, ok := repairer.feed(line); ok {
+			payloads = append(payloads, payload)
+		}
+	}
+	want := []string{
+		`{"choices":[{"delta":{"content":"Hel"}}]}`,
+		`{"choices":[{"delta":{"content":"lo"}}]}`,
+		`{"choices":[{"delta":{"content":"!"}}]}`,
+		"[DONE]",
+	}
+	if strings.Join(payloads, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got payloads %q", payloads)
+	}
+}
@@ -55,64 +55,33 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 	userId := c.GetInt("id")
 	consumeQuota := c.GetBool("consume_quota")
 	group := c.GetString("group")
-	var textRequest GeneralOpenAIRequest
-	var promptImages []*ContentPartImageUrl
-
 	rawBody, err := common.GetBodyReusable(c)
 	if err != nil {
 		return errorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
 	}
-	err = json.Unmarshal(rawBody, &textRequest)
-	switch err := err.(type) {
-	case nil:
-	case *json.UnmarshalTypeError:
-		if err.Field == "messages.content" && err.Value == "array" {
-			type AliasMessage struct {
-				Message
-				Content json.RawMessage `json:"content"`
-			}
-			var request struct {
-				GeneralOpenAIRequest
-				Messages []AliasMessage `json:"messages"`
-			}
-			if err := json.Unmarshal(rawBody, &request); err != nil {
-				return errorWrapper(err, "unmarshal_request_body_failed", http.StatusBadRequest)
-			}
-			textRequest = request.GeneralOpenAIRequest
-			for _, msg := range request.Messages {
-				var strContent string
-				if gjson.ParseBytes(msg.Content).Type == gjson.String {
-					strContent = string(msg.Content)
-				} else {
-					var content []ContentParts
-					if err := json.Unmarshal(msg.Content, &content); err != nil {
-						return errorWrapper(err, "unmarshal_request_body_failed", http.StatusBadRequest)
-					}
-					sb := new(strings.Builder)
-					for _, part := range content {
-						if part.Type == ContentPartTypeText {
-							sb.WriteString(part.Text)
-						} else if part.Type == ContentPartTypeImageUrl {
-							promptImages = append(promptImages, part.ImageUrl)
-						}
-					}
-					strContent = sb.String()
-				}
-
-				textRequest.Messages = append(textRequest.Messages, Message{
-					Role:    msg.Role,
-					Name:    msg.Name,
-					Content: strContent,
-				})
+	if relayMode == RelayModeChatCompletions {
+		sanitizedBody, changed, sanitizeErr := sanitizeMessages(rawBody)
+		if sanitizeErr != nil {
+			return sanitizeErr
+		}
+		if changed {
+			// forward and count exactly the sanitized messages
+			rawBody = sanitizedBody
+			err = common.SetBodyReusable(c, func([]byte) ([]byte, error) {
+				return rawBody, nil
+			})
+			if err != nil {
+				return errorWrapper(err, "set_request_body_failed", http.StatusInternalServerError)
 			}
-		} else {
-			return errorWrapper(err, "unmarshal_request_body_failed", http.StatusBadRequest)
 		}
-	default:
+	}
+	textRequest, promptImages, promptAudios, err := parseTextRequest(rawBody)
+	if err != nil {
 		return errorWrapper(err, "unmarshal_request_body_failed", http.StatusBadRequest)
 	}
 
 	isStream := textRequest.Stream
+	approximate := isApproximateTokenCount(c)
 
 	if relayMode == RelayModeModerations && textRequest.Model == "" {
 		textRequest.Model = "text-moderation-latest"
@@ -133,6 +102,9 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 		if textRequest.Messages == nil || len(textRequest.Messages) == 0 {
 			return errorWrapper(errors.New("field messages is required"), "required_field_missing", http.StatusBadRequest)
 		}
+		if maxMessages := common.GetGroupMaxMessages(group); maxMessages > 0 && len(textRequest.Messages) > maxMessages {
+			return errorWrapper(fmt.Errorf("too many messages: %d, at most %d messages are allowed", len(textRequest.Messages), maxMessages), "too_many_messages", http.StatusBadRequest)
+		}
 	case RelayModeEmbeddings:
 	case RelayModeModerations:
 		if textRequest.Input == "" {
@@ -143,6 +115,11 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 			return errorWrapper(errors.New("field instruction is required"), "required_field_missing", http.StatusBadRequest)
 		}
 	}
+	if err := textRequest.validateLogprobs(relayMode); err != nil {
+		return errorWrapper(err, "invalid_logprobs", http.StatusBadRequest)
+	}
+	isRawBodyEdited := false
+	isFreeModel := common.IsFreeModel(textRequest.Model)
 	// map model name
 	modelMapping := c.GetString("model_mapping")
 	isModelMapped := false
@@ -153,10 +130,32 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 			return errorWrapper(err, "unmarshal_model_mapping_failed", http.StatusInternalServerError)
 		}
 		if modelMap[textRequest.Model] != "" {
+			// responses report the model the client asked for, not the mapped upstream one
+			c.Set("response_model", textRequest.Model)
 			textRequest.Model = modelMap[textRequest.Model]
 			isModelMapped = true
 		}
 	}
+	// the group limit and then the channel limit only ever lower the output limit of the client, see clampMaxTokens,
+	// the stored body is left untouched for retries on other channels
+	if relayMode == RelayModeChatCompletions || relayMode == RelayModeCompletions {
+		groupMaxTokens := common.GetGroupMaxTokens(group)
+		channelMaxTokens := c.GetInt("channel_max_tokens")
+		clampedBody, isClamped, err := clampMaxTokens(&textRequest, rawBody, groupMaxTokens, channelMaxTokens)
+		if err != nil {
+			return errorWrapper(err, "set_request_body_failed", http.StatusInternalServerError)
+		}
+		if isClamped {
+			common.LogInfo(c.Request.Context(), fmt.Sprintf("output tokens clamped to %d by group %s (%d) and channel #%d (%d)", textRequest.getMaxTokens(), group, groupMaxTokens, c.GetInt("channel_id"), channelMaxTokens))
+			rawBody = clampedBody
+			isRawBodyEdited = true
+		}
+	}
+	virtualModel := c.GetString("virtual_model")
+	if virtualModel != "" {
+		// clients only know the virtual model, the logs keep the concrete one
+		c.Set("response_model", virtualModel)
+	}
 	apiType := APITypeOpenAI
 	switch channelType {
 	case common.ChannelTypeAnthropic:
@@ -176,6 +175,60 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 	case common.ChannelTypeTencent:
 		apiType = APITypeTencent
 	}
+	switch common.ModelStreamModes[textRequest.Model] {
+	case common.ModelStreamModeStreamOnly:
+		if !isStream && (relayMode == RelayModeChatCompletions || relayMode == RelayModeCompletions) {
+			return errorWrapper(fmt.Errorf("model %s only supports streaming, set stream to true", textRequest.Model), "stream_required", http.StatusBadRequest)
+		}
+	case common.ModelStreamModeNonStreamOnly:
+		if isStream {
+			if common.StreamModeMismatchAction != "coalesce" || relayMode != RelayModeChatCompletions || apiType != APITypeOpenAI {
+				return errorWrapper(fmt.Errorf("model %s does not support streaming, set stream to false", textRequest.Model), "stream_not_supported", http.StatusBadRequest)
+			}
+			// stream_options goes away with the stream, the usage chunk it asks for is sent by writeCoalescedStream
+			c.Set("stream_include_usage", common.StreamUsageChunkEnabled || gjson.GetBytes(rawBody, "stream_options.include_usage").Bool())
+			rawBody, err = disableRequestStream(rawBody)
+			if err != nil {
+				return errorWrapper(err, "set_request_body_failed", http.StatusInternalServerError)
+			}
+			isRawBodyEdited = true
+			isStream = false
+			textRequest.Stream = false
+			// the response is turned back into a stream by openaiHandler
+			c.Set("stream_coalesced", true)
+		}
+	}
+	if common.ReasoningModelParamStripEnabled && apiType == APITypeOpenAI && common.IsReasoningModel(textRequest.Model) {
+		var strippedParams []string
+		rawBody, strippedParams, err = stripReasoningModelParams(rawBody)
+		if err != nil {
+			return errorWrapper(err, "set_request_body_failed", http.StatusInternalServerError)
+		}
+		if len(strippedParams) > 0 {
+			isRawBodyEdited = true
+			common.LogInfo(c.Request.Context(), fmt.Sprintf("removed parameters %s unsupported by model %s", strings.Join(strippedParams, ", "), textRequest.Model))
+		}
+	}
+	if apiType != APITypeOpenAI && apiType != APITypeClaude && textRequest.WantsJSON() {
+		return errorWrapper(errors.New("response_format json_object is not supported by this channel"), "unsupported_response_format", http.StatusBadRequest)
+	}
+	if apiType != APITypeOpenAI && textRequest.HasAudioOutput() {
+		return errorWrapper(errors.New("audio output is not supported by this channel"), "unsupported_modalities", http.StatusBadRequest)
+	}
+	if apiType != APITypeOpenAI {
+		// conversion based channels rebuild the body and cannot express these fields,
+		// OpenAI compatible channels get the raw body with only the model edited in place
+		var droppedFields []string
+		if textRequest.LogitBias != nil {
+			droppedFields = append(droppedFields, "logit_bias")
+		}
+		if textRequest.Seed != nil {
+			droppedFields = append(droppedFields, "seed")
+		}
+		if len(droppedFields) > 0 {
+			c.Writer.Header().Add("Warning", fmt.Sprintf("199 one-api \"unsupported by upstream, dropped: %s\"", strings.Join(droppedFields, ", ")))
+		}
+	}
 	baseURL := common.ChannelBaseURLs[channelType]
 	requestURL := c.Request.URL.String()
 	if c.GetString("base_url") != "" {
@@ -198,9 +251,14 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 			fullRequestURL = fmt.Sprintf("%s/openai/deployments/%s/%s", baseURL, textRequest.Model, task)
 		}
 	case APITypeClaude:
-		fullRequestURL = "https://api.anthropic.com/v1/complete"
+		// JSON mode needs tool use, which only the messages API has
+		claudePath := "/v1/complete"
+		if textRequest.WantsJSON() {
+			claudePath = "/v1/messages"
+		}
+		fullRequestURL = "https://api.anthropic.com" + claudePath
 		if baseURL != "" {
-			fullRequestURL = fmt.Sprintf("%s/v1/complete", baseURL)
+			fullRequestURL = baseURL + claudePath
 		}
 	case APITypeBaidu:
 		switch textRequest.Model {
@@ -250,34 +308,105 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 	var completionTokens int
 	switch relayMode {
 	case RelayModeChatCompletions:
-		promptTokens = countTokenMessages(textRequest.Messages, textRequest.Model)
+		promptTokens = countTokenMessages(textRequest.Messages, textRequest.Model, approximate)
 		if textRequest.Functions != nil {
-			promptTokens += countTokenFunctions(textRequest.Functions, textRequest.FunctionCall, textRequest.Model)
+			promptTokens += countTokenFunctions(textRequest.Functions, textRequest.FunctionCall, textRequest.Model, approximate)
 		}
 		if textRequest.Tools != nil {
-			promptTokens += countTokenFunctions(textRequest.Tools, textRequest.ToolChoice, textRequest.Model)
+			promptTokens += countTokenFunctions(textRequest.Tools, textRequest.ToolChoice, textRequest.Model, approximate)
+		}
+		if len(promptAudios) > 0 {
+			audioTokens, err := countTokenAudios(promptAudios)
+			if err != nil {
+				return errorWrapper(err, "invalid_input_audio", http.StatusBadRequest)
+			}
+			promptTokens += audioTokens
 		}
 	case RelayModeCompletions:
-		promptTokens = countTokenInput(textRequest.Prompt, textRequest.Model)
+		promptTokens = countTokenInput(textRequest.Prompt, textRequest.Model, approximate)
 	case RelayModeModerations:
-		promptTokens = countTokenInput(textRequest.Input, textRequest.Model)
+		promptTokens = countTokenInput(textRequest.Input, textRequest.Model, approximate)
 	}
-	preConsumedTokens := common.PreConsumedQuota
-	if textRequest.MaxTokens != 0 {
-		preConsumedTokens = promptTokens + textRequest.MaxTokens
+	var imageTokens int
+	var imageBytes int
+	var imageTokenErrs []*imageTokenError
+	if len(promptImages) > 0 {
+		err := checkImagesPerMessage(rawBody)
+		if err == nil {
+			err = checkImagesPerRequest(len(promptImages))
+		}
+		if err == nil {
+			imageTokens, imageBytes, imageTokenErrs, err = countTokenImages(imagesToMeasure(promptImages, isStream), textRequest.Model)
+		}
+		var limitErr *imageLimitError
+		if errors.As(err, &limitErr) {
+			return errorWrapper(limitErr, limitErr.Code, http.StatusBadRequest)
+		}
+		for _, imageTokenErr := range imageTokenErrs {
+			var mimeTypeErr *imageMimeTypeError
+			if errors.As(imageTokenErr.Err, &mimeTypeErr) {
+				return errorWrapper(fmt.Errorf("unsupported image %s", imageTokenErr.Error()), "image_mime_type_not_allowed", http.StatusBadRequest)
+			}
+			var tooLargeErr *imageTooLargeError
+			if errors.As(imageTokenErr.Err, &tooLargeErr) {
+				return errorWrapper(fmt.Errorf("unsupported image %s", imageTokenErr.Error()), "image_too_large", http.StatusBadRequest)
+			}
+		}
+		if len(imageTokenErrs) > 0 {
+			if common.ImageTokenStrictEnabled {
+				// strict billing never guesses, every image that could not be measured is reported
+				details := make([]string, 0, len(imageTokenErrs))
+				for _, imageTokenErr := range imageTokenErrs {
+					details = append(details, imageTokenErr.Error())
+				}
+				return errorWrapper(fmt.Errorf("failed to measure %d of %d images: %s", len(imageTokenErrs), len(promptImages), strings.Join(details, "; ")), "image_token_count_failed", http.StatusUnprocessableEntity)
+			}
+			if isStream {
+				// only streamed requests are billed by our own image token counting
+				urls := make([]string, 0, len(imageTokenErrs))
+				for _, imageTokenErr := range imageTokenErrs {
+					urls = append(urls, imageTokenErr.Url)
+				}
+				c.Writer.Header().Add("Warning", fmt.Sprintf("199 one-api \"images charged at flat price: %s\"", strings.Join(urls, ", ")))
+			}
+		}
+	}
+	if contextLimit := common.GetModelContextLimit(textRequest.Model); contextLimit > 0 && promptTokens > contextLimit {
+		err := fmt.Errorf("this model's maximum context length is %d tokens, however the prompt has %d tokens", contextLimit, promptTokens)
+		return errorWrapper(err, "context_length_exceeded", http.StatusBadRequest)
+	}
+	// the prompt is billed once, but each of the n choices may use up to max_tokens,
+	// completion tokens at settlement already cover all choices
+	n := 1
+	if textRequest.N > 1 {
+		n = textRequest.N
+	}
+	preConsumedTokens := common.PreConsumedQuota * n
+	if maxTokens := textRequest.getMaxTokens(); maxTokens != 0 {
+		preConsumedTokens = promptTokens + maxTokens*n
 	}
 	modelRatio := common.GetModelRatio(textRequest.Model)
-	groupRatio := common.GetGroupRatio(group)
+	if ioRatio, ok := common.GetModelIORatio(textRequest.Model); ok {
+		// only used to estimate the pre-consumed quota
+		modelRatio = math.Max(ioRatio.Input, ioRatio.Output)
+	}
+	if isFreeModel {
+		modelRatio = 0
+	}
+	// the negotiated user discount applies on top of the group ratio
+	userDiscount := model.CacheGetUserDiscount(userId)
+	serviceTier := c.GetString("service_tier")
+	groupRatio := common.GetGroupRatio(group) * userDiscount * common.GetServiceTierRatio(serviceTier)
 	ratio := modelRatio * groupRatio
 	preConsumedQuota := int(float64(preConsumedTokens) * ratio)
-	userQuota, err := model.CacheGetUserQuota(userId)
+	userQuota, err := model.GetUserQuotaForCategory(userId, model.QuotaCategoryChat)
 	if err != nil {
 		return errorWrapper(err, "get_user_quota_failed", http.StatusInternalServerError)
 	}
-	if userQuota-preConsumedQuota < 0 {
+	if !isFreeModel && userQuota-preConsumedQuota < 0 {
 		return errorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
 	}
-	err = model.CacheDecreaseUserQuota(userId, preConsumedQuota)
+	err = model.CacheDecreaseUserCategoryQuota(userId, model.QuotaCategoryChat, preConsumedQuota)
 	if err != nil {
 		return errorWrapper(err, "decrease_user_quota_failed", http.StatusInternalServerError)
 	}
@@ -288,12 +417,15 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 		common.LogInfo(c.Request.Context(), fmt.Sprintf("user %d has enough quota %d, trusted and no need to pre-consume", userId, userQuota))
 	}
 	if consumeQuota && preConsumedQuota > 0 {
-		err := model.PreConsumeTokenQuota(tokenId, preConsumedQuota)
+		err := model.PreConsumeTokenQuota(tokenId, preConsumedQuota, model.QuotaCategoryChat)
 		if err != nil {
 			return errorWrapper(err, "pre_consume_token_quota_failed", http.StatusForbidden)
 		}
 	}
 	var requestBody io.Reader = c.Request.Body
+	if isRawBodyEdited {
+		requestBody = bytes.NewBuffer(rawBody)
+	}
 	if isModelMapped {
 		buf, err := sjson.SetBytes(rawBody, "model", textRequest.Model)
 		if err != nil {
@@ -301,10 +433,55 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 		}
 		requestBody = bytes.NewBuffer(buf)
 	}
+	// only OpenAI itself understands service_tier, other upstreams may reject the unknown field,
+	// and a flex request that fell back to a default channel is not relayed as flex
+	requestedTier := gjson.GetBytes(rawBody, "service_tier")
+	if requestedTier.Exists() && (channelType != common.ChannelTypeOpenAI || requestedTier.String() == common.ServiceTierFlex && serviceTier != common.ServiceTierFlex) {
+		body, err := io.ReadAll(requestBody)
+		if err != nil {
+			return errorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
+		}
+		body, err = sjson.DeleteBytes(body, "service_tier")
+		if err != nil {
+			return errorWrapper(err, "set_request_body_failed", http.StatusInternalServerError)
+		}
+		requestBody = bytes.NewBuffer(body)
+	}
+	if storePolicy := common.GetGroupStorePolicy(group); storePolicy != common.StorePolicyPassthrough &&
+		relayMode == RelayModeChatCompletions && channelType == common.ChannelTypeOpenAI {
+		body, err := io.ReadAll(requestBody)
+		if err != nil {
+			return errorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
+		}
+		body, err = sjson.SetBytes(body, "store", storePolicy == common.StorePolicyForceTrue)
+		if err != nil {
+			return errorWrapper(err, "set_request_body_failed", http.StatusInternalServerError)
+		}
+		requestBody = bytes.NewBuffer(body)
+	}
+	if bodyTransforms := c.GetString("body_transforms"); bodyTransforms != "" && apiType == APITypeOpenAI {
+		body, err := io.ReadAll(requestBody)
+		if err != nil {
+			return errorWrapper(err, "read_request_body_failed", http.StatusInternalServerError)
+		}
+		body, err = transformBody(body, bodyTransforms)
+		if err != nil {
+			return errorWrapper(err, "transform_request_body_failed", http.StatusInternalServerError)
+		}
+		requestBody = bytes.NewBuffer(body)
+	}
+	var claudeJSONBody []byte
 	switch apiType {
 	case APITypeClaude:
-		claudeRequest := requestOpenAI2Claude(textRequest)
-		jsonStr, err := json.Marshal(claudeRequest)
+		var jsonStr []byte
+		var err error
+		if textRequest.WantsJSON() {
+			jsonStr, err = json.Marshal(requestOpenAI2ClaudeJSON(textRequest))
+			// kept to ask again when the output is not JSON
+			claudeJSONBody = jsonStr
+		} else {
+			jsonStr, err = json.Marshal(requestOpenAI2Claude(textRequest))
+		}
 		if err != nil {
 			return errorWrapper(err, "marshal_text_request_failed", http.StatusInternalServerError)
 		}
@@ -390,11 +567,14 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 			if err != nil {
 				logContent = fmt.Sprintf("failed to read request body, err: %s", err)
 			} else {
+				if shouldMaskPrompt(c) {
+					requestRaw = maskRequestBody(requestRaw)
+				}
 				logContent = "request content: " + string(reformatJson(requestRaw, false))
 			}
 			common.LogInfo(c, logContent)
 		}
-		req, err = http.NewRequest(c.Request.Method, fullRequestURL, requestBody)
+		req, err = http.NewRequestWithContext(getRelayContext(c), c.Request.Method, fullRequestURL, requestBody)
 		if err != nil {
 			return errorWrapper(err, "new_request_failed", http.StatusInternalServerError)
 		}
@@ -439,10 +619,34 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 			req.Header.Set("Accept", "text/event-stream")
 		}
 		//req.Header.Set("Connection", c.Request.Header.Get("Connection"))
-		resp, err = httpClient.Do(req)
+		applyForwardedHeaders(req, c.Request.Header, channelType)
+		applyChannelAuth(req, c.GetString("auth_type"), c.GetString("auth_param"), apiKey)
+		err = applyChannelHeaders(req, c.GetString("channel_headers"), apiKey)
+		if err != nil {
+			return errorWrapper(err, "apply_channel_headers_failed", http.StatusInternalServerError)
+		}
+		client, err := getRelayHTTPClient(c)
+		if err != nil {
+			return errorWrapper(err, "get_http_client_failed", http.StatusInternalServerError)
+		}
+		_, upstreamSpan := common.StartSpan(c.Request.Context(), "upstream "+textRequest.Model)
+		upstreamSpan.Inject(req.Header)
+		if batches := splitEmbeddingInput(textRequest.Input, c.GetInt("embedding_batch_size")); relayMode == RelayModeEmbeddings && apiType == APITypeOpenAI && batches != nil {
+			resp, err = doEmbeddingBatches(c, client, req, batches)
+		} else {
+			resp, err = doUpstreamRequest(c, client, req)
+		}
 		if err != nil {
+			upstreamSpan.SetFailed(true)
+			upstreamSpan.End()
 			return errorWrapper(err, "do_request_failed", http.StatusInternalServerError)
 		}
+		upstreamSpan.SetAttribute("http.status_code", resp.StatusCode)
+		upstreamSpan.SetFailed(resp.StatusCode != http.StatusOK)
+		upstreamSpan.End()
+		if rateLimit := parseRateLimitHeaders(resp.Header); rateLimit != nil {
+			model.SetChannelRateLimit(channelId, rateLimit)
+		}
 		err = req.Body.Close()
 		if err != nil {
 			return errorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
@@ -452,12 +656,13 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 			return errorWrapper(err, "close_request_body_failed", http.StatusInternalServerError)
 		}
 		isStream = isStream || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+		common.SpanFromContext(c.Request.Context()).SetAttribute("stream", isStream)
 
-		if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
 			if preConsumedQuota != 0 {
 				go func(ctx context.Context) {
 					// return pre-consumed quota
-					err := model.PostConsumeTokenQuota(tokenId, -preConsumedQuota)
+					err := model.PostConsumeTokenQuota(tokenId, -preConsumedQuota, model.QuotaCategoryChat)
 					if err != nil {
 						common.LogError(ctx, "error return pre-consumed quota: "+err.Error())
 					}
@@ -468,21 +673,31 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 	}
 
 	var textResponse TextResponse
+	// the stream carried the upstream usage, which already counts the prompt images
+	streamUsageReported := false
 	tokenName := c.GetString("token_name")
+	relayAttempts := c.GetString("relay_attempts")
+	downgradedFrom := c.GetString("downgraded_from")
+	fallbackFrom := c.GetString("fallback_from")
+	contextFallbackFrom := c.GetString("context_fallback_from")
+	groupFallbackFrom := c.GetString("group_fallback_from")
 
 	defer func(ctx context.Context) {
 		// c.Writer.Flush()
+		toolCallCount := c.GetInt("tool_call_count")
+		countedLocally := c.GetBool("usage_counted_locally")
+		quotaExhausted := c.GetBool("quota_exhausted_mid_stream")
 		go func() {
 			if consumeQuota {
+				_, settlementSpan := common.StartSpan(ctx, "settlement")
+				defer settlementSpan.End()
 				quota := 0
-				completionRatio := common.GetCompletionRatio(textRequest.Model)
 				promptTokens = textResponse.Usage.PromptTokens
 
-				if isStream && len(promptImages) > 0 {
-					imageTokens, errs := countTokenImages(promptImages)
-					if len(errs) > 0 {
+				if isStream && len(promptImages) > 0 && !streamUsageReported {
+					if len(imageTokenErrs) > 0 {
 						logContent := "error counting image tokens: "
-						for idx, err := range errs {
+						for idx, err := range imageTokenErrs {
 							if idx != 0 {
 								logContent += "; "
 							}
@@ -495,18 +710,14 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 				}
 
 				completionTokens = textResponse.Usage.CompletionTokens
-				quota = int(math.Ceil((float64(promptTokens) + float64(completionTokens)*completionRatio) * ratio))
-				if ratio != 0 && quota <= 0 {
-					quota = 1
-				}
-				totalTokens := promptTokens + completionTokens
-				if totalTokens == 0 {
-					// in this case, must be some error happened
-					// we cannot just return, because we may have to return the pre-consumed quota
-					quota = 0
-				}
+				audioTokens := textResponse.Usage.GetAudioTokens()
+				// a zero quota for a failed request still returns the pre-consumed quota below
+				quota = getUsageQuota(textRequest.Model, promptTokens, completionTokens, audioTokens, modelRatio, groupRatio)
+				settlementSpan.SetAttribute("prompt_tokens", promptTokens)
+				settlementSpan.SetAttribute("completion_tokens", completionTokens)
+				settlementSpan.SetAttribute("quota", quota)
 				quotaDelta := quota - preConsumedQuota
-				err := model.PostConsumeTokenQuota(tokenId, quotaDelta)
+				err := model.PostConsumeTokenQuota(tokenId, quotaDelta, model.QuotaCategoryChat)
 				if err != nil {
 					common.LogError(ctx, "error consuming token remain quota: "+err.Error())
 				}
@@ -514,10 +725,64 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 				if err != nil {
 					common.LogError(ctx, "error update user quota cache: "+err.Error())
 				}
-				if quota != 0 {
+				if quota != 0 || isFreeModel {
 					//logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 %.2f", modelRatio, groupRatio)
 					logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 1.00", modelRatio)
-					model.RecordConsumeLog(ctx, userId, channelId, promptTokens, completionTokens, textRequest.Model, tokenName, quota, logContent)
+					if ioRatio, ok := common.GetModelIORatio(textRequest.Model); ok && !isFreeModel {
+						logContent = fmt.Sprintf("输入倍率 %.2f，输出倍率 %.2f，分组倍率 1.00", ioRatio.Input, ioRatio.Output)
+					}
+					if userDiscount != 1 {
+						logContent += fmt.Sprintf("，用户折扣 %.2f", userDiscount)
+					}
+					if serviceTier == common.ServiceTierFlex {
+						logContent += fmt.Sprintf("，服务等级 %s", serviceTier)
+					}
+					if n > 1 {
+						logContent += fmt.Sprintf("，n=%d", n)
+					}
+					if isFreeModel {
+						logContent += "，免费模型"
+					}
+					if rejectedPredictionTokens := textResponse.Usage.GetRejectedPredictionTokens(); rejectedPredictionTokens > 0 {
+						logContent += fmt.Sprintf("，未采纳预测 tokens %d", rejectedPredictionTokens)
+					}
+					if imageBytes > 0 {
+						logContent += fmt.Sprintf("，图片 %d 张共 %d 字节", len(promptImages), imageBytes)
+					}
+					if isStream && len(imageTokenErrs) > 0 && !streamUsageReported {
+						logContent += fmt.Sprintf("，%d 张图片无法获取，按 765 tokens 计费", len(imageTokenErrs))
+					}
+					if audioTokens > 0 {
+						logContent += fmt.Sprintf("，音频输出 tokens %d，音频倍率 %.2f", audioTokens, common.AudioCompletionRatio)
+					}
+					if approximate && countedLocally {
+						logContent += "，" + approximateCountLogNote
+					}
+					if toolCallCount > 0 {
+						logContent += fmt.Sprintf("，tool_call %d 次", toolCallCount)
+					}
+					if downgradedFrom != "" {
+						logContent += "，额度不足由 " + downgradedFrom + " 降级"
+					}
+					if fallbackFrom != "" {
+						logContent += "，" + fallbackFrom + " 无可用渠道，回退至 " + textRequest.Model
+					}
+					if contextFallbackFrom != "" {
+						logContent += "，" + contextFallbackFrom + " 超出上下文长度，回退至 " + textRequest.Model
+					}
+					if virtualModel != "" {
+						logContent += "，虚拟模型 " + virtualModel
+					}
+					if groupFallbackFrom != "" {
+						logContent += "，分组 " + groupFallbackFrom + " 无可用渠道，回退至分组 " + group
+					}
+					if quotaExhausted {
+						logContent += "，额度耗尽中断"
+					}
+					if relayAttempts != "" {
+						logContent += "，" + relayAttempts
+					}
+					model.RecordConsumeLog(ctx, userId, channelId, promptTokens, completionTokens, textRequest.Model, tokenName, group, quota, userDiscount, logContent)
 					model.UpdateUserUsedQuotaAndRequestCount(userId, quota)
 					model.UpdateChannelUsedQuota(channelId, quota)
 				}
@@ -527,15 +792,69 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 	switch apiType {
 	case APITypeOpenAI:
 		if isStream {
-			err, responseText := openaiStreamHandler(c, resp, relayMode)
+			var budget streamBudget
+			if consumeQuota && !isFreeModel && common.StreamQuotaCutoffEnabled {
+				// the stream is paid from both the user and the token quota, whichever runs out first
+				remainQuota := userQuota
+				if tokenQuota := c.GetInt("token_remain_quota"); !c.GetBool("token_unlimited_quota") && tokenQuota < remainQuota {
+					remainQuota = tokenQuota
+				}
+				completionTokens := 0
+				budget = func(delta string) bool {
+					completionTokens += countTokenText(delta, textRequest.Model, true)
+					cost := getTextQuota(textRequest.Model, promptTokens, completionTokens, modelRatio, groupRatio)
+					return cost > remainQuota+common.StreamQuotaOverdraft
+				}
+			}
+			var usageCounter streamUsageCounter
+			if common.StreamUsageChunkEnabled || gjson.GetBytes(rawBody, "stream_options.include_usage").Bool() {
+				usageCounter = func(responseText string) Usage {
+					completionTokens := countTokenText(responseText, textRequest.Model, approximate)
+					return Usage{
+						PromptTokens:     promptTokens,
+						CompletionTokens: completionTokens,
+						TotalTokens:      promptTokens + completionTokens,
+					}
+				}
+			}
+			err, responseText, usage := openaiStreamHandler(c, resp, relayMode, budget, usageCounter)
 			if err != nil {
 				return err
 			}
+			if usage != nil && usage.TotalTokens != 0 {
+				// the upstream counted the stream itself, bill its usage like a non-stream response
+				textResponse.Usage = *usage
+				streamUsageReported = true
+				return nil
+			}
 			textResponse.Usage.PromptTokens = promptTokens
-			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model)
+			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model, approximate)
+			setApproximateCountWarning(c, textRequest.Model)
+			if usage != nil {
+				// rejected prediction tokens never show up in the streamed text
+				textResponse.Usage.CompletionTokensDetails = usage.CompletionTokensDetails
+				textResponse.Usage.CompletionTokens += usage.GetRejectedPredictionTokens()
+				// streamed audio is base64 data, not text, so take its tokens from the upstream usage
+				textResponse.Usage.CompletionTokens += usage.GetAudioTokens()
+			}
 			return nil
 		} else {
-			err, usage := openaiHandler(c, resp, consumeQuota, promptTokens, textRequest.Model)
+			var footer costFooter
+			if consumeQuota && wantCostFooter(c) {
+				inputRatio, outputRatio := getTextRatios(textRequest.Model, modelRatio)
+				footer = func(usage Usage) any {
+					return gin.H{
+						"channel":       channelId,
+						"cost":          getUsageQuota(textRequest.Model, usage.PromptTokens, usage.CompletionTokens, usage.GetAudioTokens(), modelRatio, groupRatio),
+						"input_ratio":   inputRatio,
+						"output_ratio":  outputRatio,
+						"group_ratio":   groupRatio,
+						"user_discount": userDiscount,
+						"service_tier":  serviceTier,
+					}
+				}
+			}
+			err, usage := openaiHandler(c, resp, consumeQuota, promptTokens, textRequest.Model, footer)
 			if err != nil {
 				return err
 			}
@@ -545,13 +864,24 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 			return nil
 		}
 	case APITypeClaude:
+		if textRequest.WantsJSON() {
+			err, usage := relayClaudeJSON(c, req, claudeJSONBody, resp, isStream)
+			if err != nil {
+				return err
+			}
+			if usage != nil {
+				textResponse.Usage = *usage
+			}
+			return nil
+		}
 		if isStream {
 			err, responseText := claudeStreamHandler(c, resp)
 			if err != nil {
 				return err
 			}
 			textResponse.Usage.PromptTokens = promptTokens
-			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model)
+			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model, approximate)
+			setApproximateCountWarning(c, textRequest.Model)
 			return nil
 		} else {
 			err, usage := claudeHandler(c, resp, promptTokens, textRequest.Model)
@@ -597,7 +927,8 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 				return err
 			}
 			textResponse.Usage.PromptTokens = promptTokens
-			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model)
+			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model, approximate)
+			setApproximateCountWarning(c, textRequest.Model)
 			return nil
 		} else {
 			err, usage := palmHandler(c, resp, promptTokens, textRequest.Model)
@@ -708,7 +1039,8 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 				return err
 			}
 			textResponse.Usage.PromptTokens = promptTokens
-			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model)
+			textResponse.Usage.CompletionTokens = countTokenText(responseText, textRequest.Model, approximate)
+			setApproximateCountWarning(c, textRequest.Model)
 			return nil
 		} else {
 			err, usage := tencentHandler(c, resp)
@@ -724,3 +1056,113 @@ func relayTextHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 		return errorWrapper(errors.New("unknown api type"), "unknown_api_type", http.StatusInternalServerError)
 	}
 }
+
+// parseTextRequest unmarshals a text request, flattening array message content
+// into plain text and collecting the image and audio parts.
+func parseTextRequest(rawBody []byte) (GeneralOpenAIRequest, []*ContentPartImageUrl, []*ContentPartInputAudio, error) {
+	var textRequest GeneralOpenAIRequest
+	var promptImages []*ContentPartImageUrl
+	var promptAudios []*ContentPartInputAudio
+	err := json.Unmarshal(rawBody, &textRequest)
+	switch err := err.(type) {
+	case nil:
+	case *json.UnmarshalTypeError:
+		// newer Go versions name the element, "messages.0.content"
+		if strings.HasPrefix(err.Field, "messages.") && strings.HasSuffix(err.Field, ".content") && err.Value == "array" {
+			type AliasMessage struct {
+				Message
+				Content json.RawMessage `json:"content"`
+			}
+			var request struct {
+				GeneralOpenAIRequest
+				Messages []AliasMessage `json:"messages"`
+			}
+			if err := json.Unmarshal(rawBody, &request); err != nil {
+				return textRequest, nil, nil, err
+			}
+			textRequest = request.GeneralOpenAIRequest
+			for _, msg := range request.Messages {
+				var strContent string
+				switch gjson.ParseBytes(msg.Content).Type {
+				case gjson.Null:
+					// assistant messages carrying only tool_calls have null content
+				case gjson.String:
+					strContent = gjson.ParseBytes(msg.Content).String()
+				default:
+					var content []ContentParts
+					if err := json.Unmarshal(msg.Content, &content); err != nil {
+						return textRequest, nil, nil, err
+					}
+					sb := new(strings.Builder)
+					for _, part := range content {
+						if part.Type == ContentPartTypeText {
+							sb.WriteString(part.Text)
+						} else if part.Type == ContentPartTypeImageUrl {
+							promptImages = append(promptImages, part.ImageUrl)
+						} else if part.Type == ContentPartTypeInputAudio && part.InputAudio != nil {
+							promptAudios = append(promptAudios, part.InputAudio)
+						}
+					}
+					strContent = sb.String()
+				}
+
+				textRequest.Messages = append(textRequest.Messages, Message{
+					Role:      msg.Role,
+					Name:      msg.Name,
+					Content:   strContent,
+					ToolCalls: msg.ToolCalls,
+				})
+			}
+		} else {
+			return textRequest, nil, nil, err
+		}
+	default:
+		return textRequest, nil, nil, err
+	}
+	return textRequest, promptImages, promptAudios, nil
+}
+
+// clampMaxTokens lowers the output limit of the request to the smallest of the given limits, 0 means unlimited.
+// Precedence: the client value is kept when it is lower than both the group limit (GroupMaxTokens) and the channel limit,
+// otherwise the lower of the two wins, so a channel can only further reduce a group clamped value.
+// The field the request uses is clamped, a request without a limit gets max_completion_tokens for o-series models,
+// which reject max_tokens, and max_tokens for the others.
+func clampMaxTokens(textRequest *GeneralOpenAIRequest, rawBody []byte, limits ...int) ([]byte, bool, error) {
+	limit := 0
+	for _, l := range limits {
+		if l > 0 && (limit == 0 || l < limit) {
+			limit = l
+		}
+	}
+	if limit == 0 {
+		return rawBody, false, nil
+	}
+	fields := map[string]*int{}
+	if textRequest.MaxTokens != 0 {
+		fields["max_tokens"] = &textRequest.MaxTokens
+	}
+	if textRequest.MaxCompletionTokens != 0 {
+		fields["max_completion_tokens"] = &textRequest.MaxCompletionTokens
+	}
+	if len(fields) == 0 {
+		if common.IsReasoningModel(textRequest.Model) {
+			fields["max_completion_tokens"] = &textRequest.MaxCompletionTokens
+		} else {
+			fields["max_tokens"] = &textRequest.MaxTokens
+		}
+	}
+	isClamped := false
+	for field, value := range fields {
+		if *value != 0 && *value <= limit {
+			continue
+		}
+		*value = limit
+		var err error
+		rawBody, err = sjson.SetBytes(rawBody, field, limit)
+		if err != nil {
+			return rawBody, false, err
+		}
+		isClamped = true
+	}
+	return rawBody, isClamped, nil
+}
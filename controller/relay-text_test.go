@@ -0,0 +1,630 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/middleware"
+	"one-api/model"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+func TestClampMaxTokens(t *testing.T) {
+	clamp := func(body string, limits ...int) (GeneralOpenAIRequest, string, bool) {
+		t.Helper()
+		var textRequest GeneralOpenAIRequest
+		if err := json.Unmarshal([]byte(body), &textRequest); err != nil {
+			t.Fatal(err)
+		}
+		clamped, isClamped, err := clampMaxTokens(&textRequest, []byte(body), limits...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return textRequest, string(clamped), isClamped
+	}
+
+	// the channel clamp further reduces an already group clamped value
+	request, body, isClamped := clamp(`{"model":"gpt-4o","max_tokens":8000}`, 4000, 1000)
+	if !isClamped || request.MaxTokens != 1000 || gjson.Get(body, "max_tokens").Int() != 1000 {
+		t.Errorf("channel clamp not applied: %s", body)
+	}
+	// a channel limit above the group limit does not raise it
+	_, body, _ = clamp(`{"model":"gpt-4o","max_tokens":8000}`, 4000, 6000)
+	if gjson.Get(body, "max_tokens").Int() != 4000 {
+		t.Errorf("group clamp not kept: %s", body)
+	}
+	_, body, isClamped = clamp(`{"model":"gpt-4o","max_tokens":500}`, 4000, 1000)
+	if isClamped || gjson.Get(body, "max_tokens").Int() != 500 {
+		t.Errorf("lower client value changed: %s", body)
+	}
+	// the field the request uses is clamped
+	request, body, _ = clamp(`{"model":"o3-mini","max_completion_tokens":9000}`, 0, 2000)
+	if request.getMaxTokens() != 2000 || gjson.Get(body, "max_completion_tokens").Int() != 2000 || gjson.Get(body, "max_tokens").Exists() {
+		t.Errorf("max_completion_tokens not clamped: %s", body)
+	}
+	_, body, _ = clamp(`{"model":"o1"}`, 3000)
+	if gjson.Get(body, "max_completion_tokens").Int() != 3000 || gjson.Get(body, "max_tokens").Exists() {
+		t.Errorf("o-series request got the wrong field: %s", body)
+	}
+	_, body, _ = clamp(`{"model":"gpt-4o-mini"}`, 3000)
+	if gjson.Get(body, "max_tokens").Int() != 3000 {
+		t.Errorf("unset limit not clamped: %s", body)
+	}
+	if _, _, isClamped = clamp(`{"model":"gpt-4o-mini"}`, 0, 0); isClamped {
+		t.Error("clamped without limits")
+	}
+}
+
+func TestDiscountedUserIsBilledLess(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1000,"completion_tokens":1000,"total_tokens":2000}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "gpt-3.5-turbo-discount")
+	billed := func(name string, discount float64) model.Log {
+		user := createTestUser(t, name, 1000000000)
+		model.DB.Model(user).Update("discount", discount)
+		recorder := serveRelay(t, createTestToken(t, user.Id, name), "/v1/chat/completions", `{"model":"gpt-3.5-turbo-discount","messages":[{"role":"user","content":"hi"}]}`)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+		}
+		var log model.Log
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if model.DB.Where("user_id = ? and type = ?", user.Id, model.LogTypeConsume).First(&log).Error == nil {
+				break
+			}
+		}
+		return log
+	}
+	full, discounted := billed("full price", 1), billed("discounted", 0.5)
+	if full.Quota == 0 || discounted.Quota*2 != full.Quota || discounted.Discount != 0.5 {
+		t.Errorf("billed %d at full price and %d with the discount %v", full.Quota, discounted.Quota, discounted.Discount)
+	}
+}
+
+func TestApproximateCountWarningOnlyWhenBilled(t *testing.T) {
+	defer func(enabled bool) { common.ApproximateCountWarningEnabled = enabled }(common.ApproximateCountWarningEnabled)
+	common.ApproximateCountWarningEnabled = true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if gjson.GetBytes(body, "stream").Bool() {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, "data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "warning-model")
+	token := createTestToken(t, createTestUser(t, "warning", 1000000000).Id, "warning")
+
+	recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"warning-model","messages":[{"role":"user","content":"hi"}]}`)
+	if warning := recorder.Result().Header.Get("Warning"); warning != "" {
+		t.Errorf("warned %q although the upstream usage was billed", warning)
+	}
+	// the stream has no usage, our counts are billed once the headers are long sent
+	recorder = serveRelay(t, token, "/v1/chat/completions", `{"model":"warning-model","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if warning := recorder.Result().Trailer.Get("Warning"); !strings.Contains(warning, "approximate") {
+		t.Errorf("a stream billed with approximate counts has the trailer %q", warning)
+	}
+}
+
+func TestFlexFallbackToDefaultChannelDropsServiceTier(t *testing.T) {
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+	// no economy channel serves the model
+	createTestRelayChannel(t, upstream.URL, "flex-fallback")
+	token := createTestToken(t, createTestUser(t, "flexfallback", 1000000).Id, "flex-fallback")
+	recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"flex-fallback","service_tier":"flex","messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if gjson.GetBytes(upstreamBody, "service_tier").Exists() {
+		t.Errorf("relayed the flex tier to a default channel: %s", upstreamBody)
+	}
+}
+
+func TestGroupStorePolicies(t *testing.T) {
+	defer func(policies map[string]string) { common.GroupStorePolicy = policies }(common.GroupStorePolicy)
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "store-openai")
+	azure := createTestRelayChannel(t, upstream.URL, "store-azure")
+	model.DB.Model(azure).Update("type", common.ChannelTypeAzure)
+	token := createTestToken(t, createTestUser(t, "store", 1000000).Id, "store")
+	relayedStore := func(policy string, modelName string) gjson.Result {
+		t.Helper()
+		common.GroupStorePolicy = map[string]string{"default": policy}
+		recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"`+modelName+`","store":true,"messages":[{"role":"user","content":"hi"}]}`)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+		}
+		return gjson.GetBytes(upstreamBody, "store")
+	}
+	if store := relayedStore(common.StorePolicyForceFalse, "store-openai"); store.Type != gjson.False {
+		t.Errorf("force-false relayed store %s", store.Raw)
+	}
+	if store := relayedStore(common.StorePolicyForceTrue, "store-openai"); store.Type != gjson.True {
+		t.Errorf("force-true relayed store %s", store.Raw)
+	}
+	if store := relayedStore(common.StorePolicyPassthrough, "store-openai"); store.Type != gjson.True {
+		t.Errorf("passthrough relayed store %s", store.Raw)
+	}
+	// only OpenAI itself gets the policy
+	if store := relayedStore(common.StorePolicyForceFalse, "store-azure"); store.Type != gjson.True {
+		t.Errorf("the policy was applied to an Azure channel: store %s", store.Raw)
+	}
+}
+
+func TestSeedAndLogitBiasSurviveModelMapping(t *testing.T) {
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/v1/complete") {
+			_, _ = io.WriteString(w, `{"completion":"ok","stop_reason":"stop_sequence","model":"claude-2"}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+	openAIChannel := createTestRelayChannel(t, upstream.URL, "seed-openai")
+	model.DB.Model(openAIChannel).Update("model_mapping", `{"seed-openai":"gpt-4o-mini-mapped"}`)
+	claudeChannel := createTestRelayChannel(t, upstream.URL, "seed-claude")
+	model.DB.Model(claudeChannel).Update("type", common.ChannelTypeAnthropic)
+	token := createTestToken(t, createTestUser(t, "seed", 1000000000).Id, "seed")
+
+	// a seed beyond the float64 precision only survives if the body is never decoded into numbers
+	const seed = `9007199254740993`
+	const logitBias = `{"50256": -100, "1734":5}`
+	recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"seed-openai","seed":`+seed+`,"logit_bias":`+logitBias+`,"messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if body := gjson.ParseBytes(upstreamBody); body.Get("model").String() != "gpt-4o-mini-mapped" || body.Get("seed").Raw != seed || body.Get("logit_bias").Raw != logitBias {
+		t.Errorf("OpenAI channel got %s", upstreamBody)
+	}
+	if warning := recorder.Header().Get("Warning"); warning != "" {
+		t.Errorf("OpenAI channel warned: %s", warning)
+	}
+
+	recorder = serveRelay(t, token, "/v1/chat/completions", `{"model":"seed-claude","seed":`+seed+`,"logit_bias":`+logitBias+`,"messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("conversion channel failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if body := gjson.ParseBytes(upstreamBody); body.Get("seed").Exists() || body.Get("logit_bias").Exists() {
+		t.Errorf("conversion channel got %s", upstreamBody)
+	}
+	if warning := recorder.Header().Get("Warning"); !strings.Contains(warning, "logit_bias, seed") {
+		t.Errorf("conversion channel warned %q", warning)
+	}
+}
+
+func TestRejectedPredictionTokensAreBilled(t *testing.T) {
+	const usage = `{"prompt_tokens":100,"completion_tokens":50,"total_tokens":150,"completion_tokens_details":{"accepted_prediction_tokens":20,"rejected_prediction_tokens":7}}`
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody, _ = io.ReadAll(r.Body)
+		if gjson.GetBytes(upstreamBody, "stream").Bool() {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, "data: {\"id\":\"1\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"ok\"}}]}\n\n")
+			_, _ = io.WriteString(w, "data: {\"id\":\"1\",\"choices\":[],\"usage\":"+usage+"}\n\n")
+			_, _ = io.WriteString(w, "data: [DONE]\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":`+usage+`}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "prediction-model")
+	const prediction = `{"type":"content","content":"the predicted answer"}`
+	for _, stream := range []bool{false, true} {
+		user := createTestUser(t, fmt.Sprintf("predict-%v", stream), 1000000000)
+		token := createTestToken(t, user.Id, "prediction")
+		recorder := serveRelay(t, token, "/v1/chat/completions", fmt.Sprintf(`{"model":"prediction-model","stream":%v,"prediction":%s,"messages":[{"role":"user","content":"hi"}]}`, stream, prediction))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+		}
+		if forwarded := gjson.GetBytes(upstreamBody, "prediction").Raw; forwarded != prediction {
+			t.Errorf("prediction forwarded as %s", forwarded)
+		}
+		var log model.Log
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if model.DB.Where("user_id = ? and type = ?", user.Id, model.LogTypeConsume).First(&log).Error == nil {
+				break
+			}
+		}
+		// the upstream completion tokens already include the rejected predictions
+		want := getTextQuota("prediction-model", 100, 50, common.GetModelRatio("prediction-model"), 1)
+		if log.CompletionTokens != 50 || log.Quota != want || !strings.Contains(log.Content, "未采纳预测 tokens 7") {
+			t.Errorf("stream %v billed %d completion tokens and quota %d, want 50 and %d: %s", stream, log.CompletionTokens, log.Quota, want, log.Content)
+		}
+	}
+}
+
+func TestAsymmetricIORatios(t *testing.T) {
+	defer func(ratios map[string]common.IORatio) { common.ModelIORatio = ratios }(common.ModelIORatio)
+	common.ModelIORatio = map[string]common.IORatio{"io-ratio-model": {Input: 0.5, Output: 4}}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":1000,"completion_tokens":100,"total_tokens":1100}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "io-ratio-model")
+	user := createTestUser(t, "io-ratio", 1000000000)
+	recorder := serveRelay(t, createTestToken(t, user.Id, "io-ratio"), "/v1/chat/completions", `{"model":"io-ratio-model","messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var log model.Log
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if model.DB.Where("user_id = ? and type = ?", user.Id, model.LogTypeConsume).First(&log).Error == nil {
+			break
+		}
+	}
+	// 1000 * 0.5 + 100 * 4, the single model ratio is ignored
+	if log.Quota != 900 || !strings.Contains(log.Content, "输入倍率 0.50，输出倍率 4.00") {
+		t.Errorf("billed %d: %s", log.Quota, log.Content)
+	}
+	// models without them keep the single ratio
+	if quota := getTextQuota("single-ratio-model", 1000, 100, 2, 1); quota != 2200 {
+		t.Errorf("single ratio billed %d, want 2200", quota)
+	}
+}
+
+func TestQuotaScalesWithN(t *testing.T) {
+	var tokenId int
+	var reserved int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the reservation is taken from the token before the request is relayed
+		token, _ := model.GetTokenById(tokenId)
+		reserved = 1000000 - token.RemainQuota
+		body, _ := io.ReadAll(r.Body)
+		n := gjson.GetBytes(body, "n").Int()
+		if n == 0 {
+			n = 1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, fmt.Sprintf(`{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":%d,"total_tokens":%d}}`, 20*n, 10+20*n))
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "n-choices-model")
+	settle := func(n int) (int, model.Log) {
+		t.Helper()
+		// a small balance is not trusted, so the reservation is actually taken
+		user := createTestUser(t, fmt.Sprintf("choices-%d", n), 300000)
+		token := createTestToken(t, user.Id, "choices")
+		tokenId = token.Id
+		recorder := serveRelay(t, token, "/v1/chat/completions", fmt.Sprintf(`{"model":"n-choices-model","n":%d,"max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`, n))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+		}
+		var log model.Log
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if model.DB.Where("user_id = ? and type = ?", user.Id, model.LogTypeConsume).First(&log).Error == nil {
+				break
+			}
+		}
+		return reserved, log
+	}
+	reservedOne, logOne := settle(1)
+	reservedThree, logThree := settle(3)
+	// the prompt is reserved once, max_tokens once per choice
+	ratio := common.GetModelRatio("n-choices-model")
+	if reservedOne == 0 || float64(reservedThree-reservedOne) != 200*ratio {
+		t.Errorf("reserved %d for n=1 and %d for n=3", reservedOne, reservedThree)
+	}
+	if logThree.CompletionTokens != 3*logOne.CompletionTokens || logThree.Quota != getTextQuota("n-choices-model", 10, 60, ratio, 1) || !strings.Contains(logThree.Content, "n=3") {
+		t.Errorf("settled %d and %d: %s", logOne.Quota, logThree.Quota, logThree.Content)
+	}
+}
+
+func TestGroupMaxMessages(t *testing.T) {
+	defer func(maxMessages map[string]int) { common.GroupMaxMessages = maxMessages }(common.GroupMaxMessages)
+	if err := common.UpdateGroupMaxMessagesByJSONString(`{"default":3}`); err != nil {
+		t.Fatal(err)
+	}
+	var relayed int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		relayed++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "max-messages-model")
+	token := createTestToken(t, createTestUser(t, "max-messages", 1000000).Id, "max-messages")
+	request := func(count int) *httptest.ResponseRecorder {
+		t.Helper()
+		messages := make([]string, count)
+		for i := range messages {
+			messages[i] = `{"role":"user","content":"hi"}`
+		}
+		return serveRelay(t, token, "/v1/chat/completions", `{"model":"max-messages-model","messages":[`+strings.Join(messages, ",")+`]}`)
+	}
+	if recorder := request(3); recorder.Code != http.StatusOK || relayed != 1 {
+		t.Errorf("request at the limit got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := request(4); recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "too_many_messages") || relayed != 1 {
+		t.Errorf("request over the limit got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	// groups without a cap are not limited
+	common.GroupMaxMessages = map[string]int{"vip": 3}
+	if recorder := request(4); recorder.Code != http.StatusOK || relayed != 2 {
+		t.Errorf("request of an uncapped group got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestModelDowngradeUnderQuotaThreshold(t *testing.T) {
+	defer func(rules map[string]common.ModelDowngradeRule) { common.GroupModelDowngrade = rules }(common.GroupModelDowngrade)
+	if err := common.UpdateGroupModelDowngradeByJSONString(`{"default":{"threshold":50000,"models":{"downgrade-expensive":"downgrade-cheap"}}}`); err != nil {
+		t.Fatal(err)
+	}
+	var upstreamModel string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstreamModel = gjson.GetBytes(body, "model").String()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "downgrade-expensive,downgrade-cheap")
+	request := func(quota int) model.Log {
+		t.Helper()
+		user := createTestUser(t, fmt.Sprintf("downgrade-%d", quota), quota)
+		token := createTestToken(t, user.Id, "downgrade")
+		recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"downgrade-expensive","messages":[{"role":"user","content":"hi"}]}`)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+		}
+		var log model.Log
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if model.DB.Where("user_id = ? and type = ?", user.Id, model.LogTypeConsume).First(&log).Error == nil {
+				break
+			}
+		}
+		return log
+	}
+	if log := request(50000); upstreamModel != "downgrade-expensive" || strings.Contains(log.Content, "降级") {
+		t.Errorf("user at the threshold downgraded to %s: %s", upstreamModel, log.Content)
+	}
+	if log := request(49999); upstreamModel != "downgrade-cheap" || log.ModelName != "downgrade-cheap" || !strings.Contains(log.Content, "由 downgrade-expensive 降级") {
+		t.Errorf("user under the threshold sent %s, logged %s: %s", upstreamModel, log.ModelName, log.Content)
+	}
+}
+
+func TestTraceContextPropagatesUpstream(t *testing.T) {
+	defer func(endpoint string) { common.OtelExporterEndpoint = endpoint }(common.OtelExporterEndpoint)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+	common.OtelExporterEndpoint = collector.URL
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "trace-model")
+	token := createTestToken(t, createTestUser(t, "trace", 1000000).Id, "trace")
+
+	defer func(approximate bool) { common.ApproximateTokenEnabled = approximate }(common.ApproximateTokenEnabled)
+	common.ApproximateTokenEnabled = true
+	engine := gin.New()
+	relayRouter := engine.Group("/v1")
+	relayRouter.Use(middleware.Trace(), middleware.TokenAuth(), middleware.Distribute())
+	relayRouter.POST("/*path", Relay)
+	relay := func(traceparent string) {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"trace-model","messages":[{"role":"user","content":"hi"}]}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer sk-"+token.Key)
+		if traceparent != "" {
+			request.Header.Set("traceparent", traceparent)
+		}
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+		}
+	}
+
+	// the caller's trace is continued, the upstream call is a child span of the relay
+	relay("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	traceId, parentSpanId, ok := common.ParseTraceparent(upstreamTraceparent)
+	if !ok || traceId != "4bf92f3577b34da6a3ce929d0e0e4736" || parentSpanId == "00f067aa0ba902b7" {
+		t.Errorf("upstream got traceparent %q", upstreamTraceparent)
+	}
+	// without one a new trace is started
+	relay("")
+	if traceId, _, ok := common.ParseTraceparent(upstreamTraceparent); !ok || traceId == "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("upstream got traceparent %q", upstreamTraceparent)
+	}
+	// no endpoint, no tracing
+	common.OtelExporterEndpoint = ""
+	relay("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if upstreamTraceparent != "" {
+		t.Errorf("tracing disabled but upstream got traceparent %q", upstreamTraceparent)
+	}
+}
+
+func TestChannelMaxTokensClampThroughRelay(t *testing.T) {
+	defer func(limits map[string]int) { common.GroupMaxTokens = limits }(common.GroupMaxTokens)
+	if err := common.UpdateGroupMaxTokensByJSONString(`{"default":1000}`); err != nil {
+		t.Fatal(err)
+	}
+	var upstreamMaxTokens int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstreamMaxTokens = gjson.GetBytes(body, "max_tokens").Int()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+	channel := createTestRelayChannel(t, upstream.URL, "channel-clamp-model")
+	token := createTestToken(t, createTestUser(t, "channel-clamp", 1000000).Id, "channel-clamp")
+	request := func(maxTokens int) int64 {
+		t.Helper()
+		recorder := serveRelay(t, token, "/v1/chat/completions", fmt.Sprintf(`{"model":"channel-clamp-model","max_tokens":%d,"messages":[{"role":"user","content":"hi"}]}`, maxTokens))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+		}
+		return upstreamMaxTokens
+	}
+	if got := request(2000); got != 1000 {
+		t.Errorf("group clamp sent %d", got)
+	}
+	model.DB.Model(channel).Update("max_tokens", 300)
+	if got := request(2000); got != 300 {
+		t.Errorf("channel clamp sent %d after the group clamp", got)
+	}
+	if got := request(100); got != 100 {
+		t.Errorf("lower client value raised to %d", got)
+	}
+}
+
+func TestReasoningModelParamsStrippedThroughRelay(t *testing.T) {
+	defer func(enabled bool) { common.ReasoningModelParamStripEnabled = enabled }(common.ReasoningModelParamStripEnabled)
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "o1-strip-test,gpt-strip-test")
+	token := createTestToken(t, createTestUser(t, "reasoning-strip", 1000000).Id, "reasoning-strip")
+	request := func(modelName string) {
+		t.Helper()
+		recorder := serveRelay(t, token, "/v1/chat/completions", `{"model":"`+modelName+`","temperature":0.2,"presence_penalty":0.5,"messages":[{"role":"user","content":"hi"}]}`)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+		}
+	}
+	common.ReasoningModelParamStripEnabled = false
+	request("o1-strip-test")
+	if !gjson.GetBytes(upstreamBody, "temperature").Exists() {
+		t.Error("temperature stripped while the option is off")
+	}
+	common.ReasoningModelParamStripEnabled = true
+	request("o1-strip-test")
+	if gjson.GetBytes(upstreamBody, "temperature").Exists() || gjson.GetBytes(upstreamBody, "presence_penalty").Exists() || gjson.GetBytes(upstreamBody, "messages.0.content").String() != "hi" {
+		t.Errorf("o1 request relayed as %s", upstreamBody)
+	}
+	request("gpt-strip-test")
+	if gjson.GetBytes(upstreamBody, "temperature").Float() != 0.2 {
+		t.Errorf("other model relayed as %s", upstreamBody)
+	}
+}
+
+func TestGroupFallbackBillsServingGroup(t *testing.T) {
+	defer func(fallbacks map[string][]string) { common.GroupFallbacks = fallbacks }(common.GroupFallbacks)
+	defer func(ratios map[string]float64) { common.GroupRatio = ratios }(common.GroupRatio)
+	if err := common.UpdateGroupFallbacksByJSONString(`{"default":["overflow"]}`); err != nil {
+		t.Fatal(err)
+	}
+	common.GroupRatio = map[string]float64{"default": 1, "overflow": 2}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":20,"total_tokens":30}}`)
+	}))
+	defer upstream.Close()
+	baseURL := upstream.URL
+	channel := &model.Channel{Name: "overflow-model", Type: common.ChannelTypeOpenAI, Key: "sk-test", Status: common.ChannelStatusEnabled,
+		BaseURL: &baseURL, Models: "overflow-model", Group: "overflow"}
+	if err := channel.Insert(); err != nil {
+		t.Fatal(err)
+	}
+	user := createTestUser(t, "group-fallback", 1000000)
+	recorder := serveRelay(t, createTestToken(t, user.Id, "group-fallback"), "/v1/chat/completions", `{"model":"overflow-model","messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var log model.Log
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if model.DB.Where("user_id = ? and type = ?", user.Id, model.LogTypeConsume).First(&log).Error == nil {
+			break
+		}
+	}
+	// the overflow group serves the request, so its ratio applies
+	if log.Quota != getTextQuota("overflow-model", 10, 20, common.GetModelRatio("overflow-model"), 2) || !strings.Contains(log.Content, "回退至分组 overflow") {
+		t.Errorf("settled %d: %s", log.Quota, log.Content)
+	}
+}
+
+func TestAudioTokensBilledAtOutputRatio(t *testing.T) {
+	defer func(ratios map[string]common.IORatio) { common.ModelIORatio = ratios }(common.ModelIORatio)
+	common.ModelIORatio = map[string]common.IORatio{"audio-io-model": {Input: 1, Output: 4}}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":120,"total_tokens":130,"completion_tokens_details":{"audio_tokens":100}}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "audio-io-model")
+	user := createTestUser(t, "audio-io", 1000000)
+	recorder := serveRelay(t, createTestToken(t, user.Id, "audio-io"), "/v1/chat/completions", `{"model":"audio-io-model","modalities":["text","audio"],"audio":{"voice":"alloy","format":"wav"},"messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var log model.Log
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if model.DB.Where("user_id = ? and type = ?", user.Id, model.LogTypeConsume).First(&log).Error == nil {
+			break
+		}
+	}
+	// 10 prompt tokens at the input ratio, 20 text and 100 audio completion tokens at the output ratio
+	want := 10*1 + 20*4 + int(math.Ceil(100*common.AudioCompletionRatio*4))
+	if log.Quota != want || !strings.Contains(log.Content, "音频输出 tokens 100") {
+		t.Errorf("settled %d, want %d: %s", log.Quota, want, log.Content)
+	}
+}
+
+func TestModelContextLimitRejectsLongPrompts(t *testing.T) {
+	defer func(limits map[string]int) { common.ModelContextLimits = limits }(common.ModelContextLimits)
+	common.ModelContextLimits = map[string]int{"context-limit-model": 20}
+	upstreamCalls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "context-limit-model,context-limit-model-20240101")
+	token := createTestToken(t, createTestUser(t, "context-limit", 1000000).Id, "context-limit")
+	request := func(modelName string, content string) *httptest.ResponseRecorder {
+		return serveRelay(t, token, "/v1/chat/completions", `{"model":"`+modelName+`","messages":[{"role":"user","content":"`+content+`"}]}`)
+	}
+	if recorder := request("context-limit-model", "hi"); recorder.Code != http.StatusOK {
+		t.Fatalf("short prompt got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	long := strings.Repeat("hello world ", 50)
+	for _, modelName := range []string{"context-limit-model", "context-limit-model-20240101"} {
+		recorder := request(modelName, long)
+		if recorder.Code != http.StatusBadRequest || gjson.Get(recorder.Body.String(), "error.code").String() != "context_length_exceeded" {
+			t.Errorf("%s: long prompt got %d: %s", modelName, recorder.Code, recorder.Body.String())
+		}
+	}
+	if upstreamCalls != 1 {
+		t.Errorf("upstream called %d times", upstreamCalls)
+	}
+}
@@ -0,0 +1,375 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestPNG(t testing.TB) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 512, 512))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// serveSlowImages serves the PNG after the delay
+func serveSlowImages(t testing.TB, delay time.Duration) *httptest.Server {
+	png := newTestPNG(t)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(png)
+	}))
+}
+
+func newTestImages(url string, count int) []*ContentPartImageUrl {
+	images := make([]*ContentPartImageUrl, count)
+	for i := range images {
+		images[i] = &ContentPartImageUrl{Url: url, Detail: "high"}
+	}
+	return images
+}
+
+func TestCountTokenImagesTimeBudget(t *testing.T) {
+	defer func(timeout int, concurrency int) {
+		common.ImageCountTimeout, common.ImageCountConcurrency = timeout, concurrency
+	}(common.ImageCountTimeout, common.ImageCountConcurrency)
+	common.ImageCountTimeout, common.ImageCountConcurrency = 100, 4
+	server := serveSlowImages(t, 2*time.Second)
+	defer server.Close()
+
+	start := time.Now()
+	tokens, _, errs, err := countTokenImages(newTestImages(server.URL, 6), "gpt-4o")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("wall-clock budget not honored, took %s", elapsed)
+	}
+	if err != nil || len(errs) != 6 || tokens != 6*765 {
+		t.Errorf("images not charged at the flat price: tokens %d, errs %d, err %v", tokens, len(errs), err)
+	}
+}
+
+func TestCountTokenImagesByteBudget(t *testing.T) {
+	defer func(limit int, concurrency int) {
+		common.MaxImageBytesPerRequest, common.ImageCountConcurrency = limit, concurrency
+	}(common.MaxImageBytesPerRequest, common.ImageCountConcurrency)
+	common.MaxImageBytesPerRequest, common.ImageCountConcurrency = 3<<20, 4
+
+	// every image streams 2 MB slowly, two of them exceed the shared budget and stop all downloads
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		chunk := make([]byte, 64<<10)
+		for sent := 0; sent < 2<<20; sent += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(5 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, imageBytes, _, err := countTokenImages(newTestImages(server.URL, 4), "gpt-4o")
+	limitErr, ok := err.(*imageLimitError)
+	if !ok || limitErr.Code != "image_payload_too_large" {
+		t.Fatalf("byte budget not enforced: %v", err)
+	}
+	if imageBytes > common.MaxImageBytesPerRequest+4*(64<<10)*2 {
+		t.Errorf("downloads went on past the budget: %d bytes", imageBytes)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("downloads not cancelled, took %s", elapsed)
+	}
+}
+
+// BenchmarkCountTokenImages compares sequential and concurrent counting of images behind slow urls
+func BenchmarkCountTokenImages(b *testing.B) {
+	server := serveSlowImages(b, 20*time.Millisecond)
+	defer server.Close()
+	images := newTestImages(server.URL, 8)
+	defer func(concurrency int) {
+		common.ImageCountConcurrency = concurrency
+	}(common.ImageCountConcurrency)
+	for _, bc := range []struct {
+		name        string
+		concurrency int
+	}{{"sequential", 1}, {"concurrent", 4}} {
+		b.Run(bc.name, func(b *testing.B) {
+			common.ImageCountConcurrency = bc.concurrency
+			for i := 0; i < b.N; i++ {
+				if _, _, errs, err := countTokenImages(images, "gpt-4o"); err != nil || len(errs) > 0 {
+					b.Fatalf("count failed: %v %v", err, errs)
+				}
+			}
+		})
+	}
+}
+
+func TestNonStreamRequestsSkipImageDownloads(t *testing.T) {
+	defer func(strict bool) { common.ImageTokenStrictEnabled = strict }(common.ImageTokenStrictEnabled)
+	png := newTestPNG(t)
+	var downloads int32
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(png)
+	}))
+	defer images.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(readAll(r), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, "data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"a cat\"}}]}\n\ndata: [DONE]\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","choices":[{"message":{"role":"assistant","content":"a cat"}}],"usage":{"prompt_tokens":300,"completion_tokens":2,"total_tokens":302}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "vision-skip-download")
+	token := createTestToken(t, createTestUser(t, "vision", 1000000).Id, "vision")
+	request := func(stream bool) int32 {
+		atomic.StoreInt32(&downloads, 0)
+		body := fmt.Sprintf(`{"model":"vision-skip-download","stream":%v,"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"%s/cat.png"}}]}]}`, stream, images.URL)
+		if recorder := serveRelay(t, token, "/v1/chat/completions", body); recorder.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", recorder.Code, recorder.Body.String())
+		}
+		return atomic.LoadInt32(&downloads)
+	}
+	common.ImageTokenStrictEnabled = false
+	if n := request(false); n != 0 {
+		t.Errorf("lenient non-stream request downloaded the image %d times, the upstream usage bills it", n)
+	}
+	if n := request(true); n != 1 {
+		t.Errorf("stream request downloaded the image %d times", n)
+	}
+	common.ImageTokenStrictEnabled = true
+	if n := request(false); n != 1 {
+		t.Errorf("strict non-stream request downloaded the image %d times", n)
+	}
+}
+
+func readAll(r *http.Request) string {
+	body, _ := io.ReadAll(r.Body)
+	return string(body)
+}
+
+func TestOversizedBase64ImageRejectedBeforeDecoding(t *testing.T) {
+	defer func(limit int) { common.MaxImageBytes = limit }(common.MaxImageBytes)
+	common.MaxImageBytes = 1 << 10
+	// not even valid base64, a decode attempt would fail with another error
+	dataURL := "data:image/png;base64," + strings.Repeat("!", 4<<10)
+	images := []*ContentPartImageUrl{{Url: dataURL, Detail: "high"}}
+	_, _, errs, err := countTokenImages(images, "gpt-4o")
+	if err != nil || len(errs) != 1 {
+		t.Fatalf("got errs %v, err %v", errs, err)
+	}
+	tooLargeErr, ok := errs[0].Err.(*imageTooLargeError)
+	if !ok || tooLargeErr.Size != 3<<10 {
+		t.Errorf("oversized image not rejected by its encoded length: %v", errs[0].Err)
+	}
+
+	common.MaxImageBytes = 0
+	_, _, errs, _ = countTokenImages(images, "gpt-4o")
+	if len(errs) != 1 {
+		t.Fatalf("got errs %v", errs)
+	}
+	if _, ok := errs[0].Err.(*imageTooLargeError); ok {
+		t.Error("image size limited with MaxImageBytes 0")
+	}
+}
+
+func TestCountTokenImageDataURLsWithoutSubtype(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(newTestPNG(t))
+	count := func(url string) int {
+		t.Helper()
+		tokens, imageBytes, errs, err := countTokenImages([]*ContentPartImageUrl{{Url: url, Detail: "high"}}, "gpt-4o")
+		if err != nil || len(errs) != 0 || imageBytes == 0 {
+			t.Fatalf("%.30s: errs %v, err %v, %d bytes", url, errs, err, imageBytes)
+		}
+		return tokens
+	}
+	want := count("data:image/png;base64," + encoded)
+	for _, prefix := range []string{"data:image;base64,", "data:;base64,", "data:IMAGE;base64,"} {
+		if tokens := count(prefix + encoded); tokens != want {
+			t.Errorf("%s counted %d tokens, want %d", prefix, tokens, want)
+		}
+	}
+}
+
+func TestAllowedImageMimeTypes(t *testing.T) {
+	defer func(allowed string) { common.AllowedImageMimeTypes = allowed }(common.AllowedImageMimeTypes)
+	common.AllowedImageMimeTypes = "image/jpeg, image/webp"
+	png := newTestPNG(t)
+	encoded := base64.StdEncoding.EncodeToString(png)
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", strings.TrimPrefix(r.URL.Path, "/"))
+		_, _ = w.Write(png)
+	}))
+	defer images.Close()
+	rejected := func(url string) bool {
+		t.Helper()
+		_, _, errs, err := countTokenImages([]*ContentPartImageUrl{{Url: url, Detail: "high"}}, "gpt-4o")
+		if err != nil || len(errs) > 1 {
+			t.Fatalf("%.30s: errs %v, err %v", url, errs, err)
+		}
+		if len(errs) == 0 {
+			return false
+		}
+		_, ok := errs[0].Err.(*imageMimeTypeError)
+		return ok
+	}
+	for _, url := range []string{
+		"data:image/png;base64," + encoded,
+		// without a declared type the decoded format is checked
+		"data:image;base64," + encoded,
+		images.URL + "/image/png",
+	} {
+		if !rejected(url) {
+			t.Errorf("%.40s not rejected", url)
+		}
+	}
+	// the declared type is trusted, the sniffed png format is not checked again
+	for _, url := range []string{
+		"data:image/jpeg;base64," + encoded,
+		"data:image/jpg;base64," + encoded,
+		images.URL + "/image/webp",
+	} {
+		if rejected(url) {
+			t.Errorf("%.40s rejected", url)
+		}
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request with a disallowed image relayed")
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "vision-mime")
+	token := createTestToken(t, createTestUser(t, "vision-mime", 1000000).Id, "vision-mime")
+	body := fmt.Sprintf(`{"model":"vision-mime","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,%s"}}]}]}`, encoded)
+	recorder := serveRelay(t, token, "/v1/chat/completions", body)
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "image_mime_type_not_allowed") {
+		t.Errorf("got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestCustomImageTokenParameters(t *testing.T) {
+	defer func(parameters map[string]common.ImageTokenParams) { common.ImageTokenParameters = parameters }(common.ImageTokenParameters)
+	err := common.UpdateImageTokenParametersByJSONString(`{"default":{"base_tokens":85,"tile_tokens":170,"tile_size":512,"max_long_side":2000,"max_short_side":768},
+		"gpt-4o-mini":{"base_tokens":2833,"tile_tokens":5667,"tile_size":512,"max_long_side":2000,"max_short_side":768},
+		"tiny-vision":{"base_tokens":10,"tile_tokens":20,"tile_size":128,"max_long_side":256,"max_short_side":256}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := []*ContentPartImageUrl{{Url: "data:image/png;base64," + base64.StdEncoding.EncodeToString(newTestPNG(t)), Detail: "high"}}
+	for _, tc := range []struct {
+		model  string
+		tokens int
+	}{
+		{"gpt-4o", 85 + 170},
+		{"gpt-4o-mini-2024-07-18", 2833 + 5667},
+		// scaled down to 256x256, four 128 pixel tiles
+		{"tiny-vision", 10 + 4*20},
+	} {
+		if tokens, _, errs, err := countTokenImages(images, tc.model); err != nil || len(errs) != 0 || tokens != tc.tokens {
+			t.Errorf("%s: %d tokens, want %d (errs %v, err %v)", tc.model, tokens, tc.tokens, errs, err)
+		}
+	}
+	low := []*ContentPartImageUrl{{Url: images[0].Url, Detail: "low"}}
+	if tokens, _, _, _ := countTokenImages(low, "gpt-4o-mini"); tokens != 2833 {
+		t.Errorf("low detail image counted %d tokens", tokens)
+	}
+	if err := common.UpdateImageTokenParametersByJSONString(`{"default":{"base_tokens":85,"tile_tokens":170,"tile_size":0,"max_long_side":2000,"max_short_side":768}}`); err == nil {
+		t.Error("tile size 0 accepted")
+	}
+}
+
+func TestMaxImagesPerRequest(t *testing.T) {
+	defer func(limit int) { common.MaxImagesPerRequest = limit }(common.MaxImagesPerRequest)
+	common.MaxImagesPerRequest = 3
+	var downloads int32
+	png := newTestPNG(t)
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(png)
+	}))
+	defer images.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"cats\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "vision-image-cap")
+	token := createTestToken(t, createTestUser(t, "vision-image-cap", 1000000).Id, "vision-image-cap")
+	request := func(count int) *httptest.ResponseRecorder {
+		atomic.StoreInt32(&downloads, 0)
+		parts := make([]string, count)
+		for i := range parts {
+			parts[i] = fmt.Sprintf(`{"type":"image_url","image_url":{"url":"%s/%d.png"}}`, images.URL, i)
+		}
+		// streamed, so every image is downloaded to be counted
+		return serveRelay(t, token, "/v1/chat/completions", `{"model":"vision-image-cap","stream":true,"messages":[{"role":"user","content":[`+strings.Join(parts, ",")+`]}]}`)
+	}
+	if recorder := request(3); recorder.Code != http.StatusOK || atomic.LoadInt32(&downloads) != 3 {
+		t.Errorf("request at the cap got %d after %d downloads: %s", recorder.Code, downloads, recorder.Body.String())
+	}
+	if recorder := request(50); recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "too_many_images") || atomic.LoadInt32(&downloads) != 0 {
+		t.Errorf("request over the cap got %d after %d downloads: %s", recorder.Code, downloads, recorder.Body.String())
+	}
+}
+
+func TestStrictImageTokenMode(t *testing.T) {
+	defer func(strict bool) { common.ImageTokenStrictEnabled = strict }(common.ImageTokenStrictEnabled)
+	png := newTestPNG(t)
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken.png" {
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = io.WriteString(w, "not a png")
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(png)
+	}))
+	defer images.Close()
+	var relayed int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&relayed, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"cats\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "vision-strict")
+	token := createTestToken(t, createTestUser(t, "vision-strict", 1000000).Id, "vision-strict")
+	body := fmt.Sprintf(`{"model":"vision-strict","stream":true,"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"%[1]s/cat.png"}},{"type":"image_url","image_url":{"url":"%[1]s/broken.png"}}]}]}`, images.URL)
+
+	common.ImageTokenStrictEnabled = true
+	recorder := serveRelay(t, token, "/v1/chat/completions", body)
+	if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), "image_token_count_failed") ||
+		!strings.Contains(recorder.Body.String(), "1 of 2 images") || !strings.Contains(recorder.Body.String(), "broken.png") || atomic.LoadInt32(&relayed) != 0 {
+		t.Errorf("strict mode got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// lenient mode charges the unmeasurable image at the flat price and says so
+	common.ImageTokenStrictEnabled = false
+	recorder = serveRelay(t, token, "/v1/chat/completions", body)
+	if recorder.Code != http.StatusOK || atomic.LoadInt32(&relayed) != 1 || !strings.Contains(recorder.Header().Get("Warning"), "broken.png") {
+		t.Errorf("lenient mode got %d, Warning %q: %s", recorder.Code, recorder.Header().Get("Warning"), recorder.Body.String())
+	}
+}
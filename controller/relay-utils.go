@@ -5,9 +5,12 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/pkoukk/tiktoken-go"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 	_ "golang.org/x/image/webp"
 	"image"
 	_ "image/gif"
@@ -20,6 +23,9 @@ import (
 	"one-api/model"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var stopFinishReason = "stop"
@@ -68,8 +74,55 @@ func getTokenEncoder(model string) *tiktoken.Tiktoken {
 	return defaultTokenEncoder
 }
 
-func getTokenNum(tokenEncoder *tiktoken.Tiktoken, text string) int {
-	if common.ApproximateTokenEnabled {
+// isApproximateTokenCount decides the counting mode of a request from the model and group overrides,
+// approximate counting can be disabled per token or per request with the X-Oneapi-Accurate-Count header
+func isApproximateTokenCount(c *gin.Context) bool {
+	if !common.IsApproximateTokenModel(c.GetString("request_model"), c.GetString("group")) {
+		return false
+	}
+	if c.GetBool("token_accurate_count") {
+		return false
+	}
+	if accurate, _ := strconv.ParseBool(c.Request.Header.Get("X-Oneapi-Accurate-Count")); accurate {
+		return false
+	}
+	return true
+}
+
+// approximateCountLogNote marks the consume logs charged with approximate counts, whichever of the model,
+// group, token or request override chose it, so that a recount counts them the same way
+const approximateCountLogNote = "近似计数"
+
+func isApproximateCountLog(log *model.Log) bool {
+	return strings.Contains(log.Content, approximateCountLogNote)
+}
+
+// hasOwnTokenEncoder reports whether the tokens of the model are counted with its own encoder
+// rather than the gpt-3.5-turbo fallback
+func hasOwnTokenEncoder(model string) bool {
+	return getTokenEncoder(model) != defaultTokenEncoder || strings.HasPrefix(model, "gpt-3.5")
+}
+
+// setApproximateCountWarning is called where our own counts replace the usage of the upstream, it marks the
+// request as billed with them and tells the client that they are imprecise, as a trailer once the headers are sent
+func setApproximateCountWarning(c *gin.Context, model string) {
+	c.Set("usage_counted_locally", true)
+	if !common.ApproximateCountWarningEnabled {
+		return
+	}
+	key := "Warning"
+	if c.Writer.Written() {
+		key = http.TrailerPrefix + key
+	}
+	if isApproximateTokenCount(c) {
+		c.Writer.Header().Add(key, "199 one-api \"token count is approximate\"")
+	} else if !hasOwnTokenEncoder(model) {
+		c.Writer.Header().Add(key, fmt.Sprintf("199 one-api \"token count of %s uses the gpt-3.5-turbo encoder\"", model))
+	}
+}
+
+func getTokenNum(tokenEncoder *tiktoken.Tiktoken, text string, approximate bool) int {
+	if approximate {
 		return int(float64(len(text)) * 0.38)
 	}
 	return len(tokenEncoder.Encode(text, nil, nil))
@@ -102,70 +155,349 @@ func resolveResolution(originW, originH, maxLongSide, maxShortSide int) (int, in
 	return int(math.Floor(w)), int(math.Floor(h))
 }
 
-func countTokenImage(img *ContentPartImageUrl) (int, error) {
+// imageMimeTypeError means the image was rejected by AllowedImageMimeTypes, not that counting failed
+type imageMimeTypeError struct {
+	MimeType string
+}
+
+func (e *imageMimeTypeError) Error() string {
+	return fmt.Sprintf("image mime type %q is not allowed", e.MimeType)
+}
+
+// imageTooLargeError means a base64 image exceeds MaxImageBytes, it is rejected without being decoded
+type imageTooLargeError struct {
+	Size int
+}
+
+func (e *imageTooLargeError) Error() string {
+	return fmt.Sprintf("image too large: %d bytes, at most %d bytes are allowed", e.Size, common.MaxImageBytes)
+}
+
+// checkImageMimeType returns nil if the mime type is empty, i.e. unknown until the image is decoded
+func checkImageMimeType(mimeType string) error {
+	if mimeType == "" || common.IsImageMimeTypeAllowed(mimeType) {
+		return nil
+	}
+	return &imageMimeTypeError{MimeType: mimeType}
+}
+
+// getMimeType strips the parameters of a media type, a type without subtype like "image" is treated as unknown
+func getMimeType(mediaType string) string {
+	mimeType := strings.ToLower(strings.TrimSpace(strings.Split(mediaType, ";")[0]))
+	if !strings.Contains(mimeType, "/") {
+		return ""
+	}
+	return mimeType
+}
+
+// countTokenImage also returns the size of the image in bytes, as far as it could be read,
+// remote images are fetched within ctx
+func countTokenImage(ctx context.Context, img *ContentPartImageUrl, params common.ImageTokenParams, budget *imageByteBudget) (int, int, error) {
 	if img.Detail == "low" {
-		return 85, nil
+		// not decoded, but data urls are still paid for in memory and upstream costs
+		if strings.HasPrefix(img.Url, "data:") {
+			if i := strings.Index(img.Url, ","); i >= 0 {
+				size := base64.StdEncoding.DecodedLen(len(img.Url) - i - 1)
+				if !budget.add(size) {
+					return 0, size, errImageByteBudgetExceeded
+				}
+				return params.BaseTokens, size, nil
+			}
+		}
+		return params.BaseTokens, 0, nil
 	}
 
 	var buf []byte
-	if strings.HasPrefix(img.Url, "data:image/") {
+	var mimeType string
+	// also accept data urls without media subtype like "data:image;base64," or "data:;base64,",
+	// image.Decode sniffs the format anyway
+	if strings.HasPrefix(img.Url, "data:") {
 		splitData := strings.Split(img.Url, ",")
 		if len(splitData) != 2 {
-			return 0, fmt.Errorf("invalid image data url")
+			return 0, 0, fmt.Errorf("invalid image data url")
+		}
+		mimeType = getMimeType(strings.TrimPrefix(splitData[0], "data:"))
+		if err := checkImageMimeType(mimeType); err != nil {
+			return 0, 0, err
+		}
+		// the decoded length is known from the encoded one, never allocate for an image that is rejected anyway
+		size := base64.StdEncoding.DecodedLen(len(splitData[1]))
+		if common.MaxImageBytes > 0 && size > common.MaxImageBytes {
+			return 0, 0, &imageTooLargeError{Size: size}
+		}
+		if !budget.add(size) {
+			return 0, size, errImageByteBudgetExceeded
 		}
 		var err error
 		buf, err = base64.StdEncoding.DecodeString(splitData[1])
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
 	} else {
-		resp, err := http.Get(img.Url)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, img.Url, nil)
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
-		buf, err = io.ReadAll(resp.Body)
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			return 0, err
+			return 0, 0, err
+		}
+		mimeType = getMimeType(resp.Header.Get("Content-Type"))
+		if err := checkImageMimeType(mimeType); err != nil {
+			_ = resp.Body.Close()
+			return 0, 0, err
+		}
+		// the downloads of the request share the byte budget, the one going over it stops all of them
+		buf, err = io.ReadAll(&imageBudgetReader{reader: resp.Body, budget: budget})
+		if err != nil {
+			_ = resp.Body.Close()
+			return 0, len(buf), err
 		}
 		err = resp.Body.Close()
 		if err != nil {
-			return 0, err
+			return 0, len(buf), err
 		}
 	}
 
-	// get image width & height
-	i, _, err := image.Decode(bytes.NewReader(buf))
+	// get image width & height, the header is enough and avif/heic can only be read this way
+	config, format, err := image.DecodeConfig(bytes.NewReader(buf))
 	if err != nil {
-		return 0, err
+		return 0, len(buf), err
 	}
+	if mimeType == "" {
+		if err := checkImageMimeType("image/" + format); err != nil {
+			return 0, len(buf), err
+		}
+	}
+
+	return countTokenImageSize(config.Width, config.Height, params), len(buf), nil
+}
+
+func countTokenImageSize(width int, height int, params common.ImageTokenParams) int {
+	width, height = resolveResolution(width, height, params.MaxLongSide, params.MaxShortSide)
+	h := math.Ceil(float64(height) / float64(params.TileSize))
+	w := math.Ceil(float64(width) / float64(params.TileSize))
+	return params.BaseTokens + int(h*w)*params.TileTokens
+}
+
+// imageTokenError records an image that could not be counted and was charged at the flat price
+type imageTokenError struct {
+	Url string
+	Err error
+}
+
+func (e *imageTokenError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Url, e.Err.Error())
+}
+
+// shortImageUrl keeps data urls readable in logs and headers
+func shortImageUrl(url string) string {
+	if strings.HasPrefix(url, "data:") && len(url) > 32 {
+		return url[:32] + "..."
+	}
+	return url
+}
+
+// reasoningModelUnsupportedParams are rejected by o-series models unless they have their default value
+var reasoningModelUnsupportedParams = []string{"temperature", "top_p", "presence_penalty", "frequency_penalty"}
+
+// stripReasoningModelParams removes the sampling parameters of a request to an o-series model
+func stripReasoningModelParams(body []byte) ([]byte, []string, error) {
+	var stripped []string
+	for _, param := range reasoningModelUnsupportedParams {
+		if !gjson.GetBytes(body, param).Exists() {
+			continue
+		}
+		var err error
+		body, err = sjson.DeleteBytes(body, param)
+		if err != nil {
+			return nil, nil, err
+		}
+		stripped = append(stripped, param)
+	}
+	return body, stripped, nil
+}
 
-	bounds := i.Bounds()
-	width := bounds.Max.X - bounds.Min.X
-	height := bounds.Max.Y - bounds.Min.Y
+// imageLimitError means the images of a request exceed MaxImagesPerRequest or MaxImageBytesPerRequest
+type imageLimitError struct {
+	Code    string
+	Message string
+}
+
+func (e *imageLimitError) Error() string {
+	return e.Message
+}
 
-	width, height = resolveResolution(width, height, 2000, 768)
+// checkImagesPerMessage enforces MaxImagesPerMessage on the multimodal messages of a chat request body
+func checkImagesPerMessage(body []byte) error {
+	if common.MaxImagesPerMessage <= 0 {
+		return nil
+	}
+	for i, message := range gjson.GetBytes(body, "messages").Array() {
+		count := 0
+		for _, part := range message.Get("content").Array() {
+			if ContentPartType(part.Get("type").String()) == ContentPartTypeImageUrl {
+				count++
+			}
+		}
+		if count > common.MaxImagesPerMessage {
+			return &imageLimitError{
+				Code:    "too_many_images",
+				Message: fmt.Sprintf("too many images: message %d has %d images, at most %d images are allowed per message", i, count, common.MaxImagesPerMessage),
+			}
+		}
+	}
+	return nil
+}
 
-	h := math.Ceil(float64(height) / 512)
-	w := math.Ceil(float64(width) / 512)
-	tokens := 85 + int(h*w)*170
-	return tokens, nil
+// checkImagesPerRequest enforces MaxImagesPerRequest
+func checkImagesPerRequest(count int) error {
+	if common.MaxImagesPerRequest > 0 && count > common.MaxImagesPerRequest {
+		return &imageLimitError{
+			Code:    "too_many_images",
+			Message: fmt.Sprintf("too many images: %d images in the request, at most %d images are allowed", count, common.MaxImagesPerRequest),
+		}
+	}
+	return nil
 }
 
-func countTokenImages(images []*ContentPartImageUrl) (int, []error) {
-	tokens := 0
-	var errs []error
+// imagesToMeasure picks the images of a request whose tokens we count: streamed requests are billed by our own
+// count, strict mode rejects what cannot be measured and the mime type allowlist needs the image, otherwise the
+// upstream usage bills the images, so only data urls are measured, which costs no download and still enforces
+// the size limits
+func imagesToMeasure(images []*ContentPartImageUrl, isStream bool) []*ContentPartImageUrl {
+	if isStream || common.ImageTokenStrictEnabled || common.AllowedImageMimeTypes != "" {
+		return images
+	}
+	var inline []*ContentPartImageUrl
 	for _, img := range images {
-		if token, err := countTokenImage(img); err != nil {
-			errs = append(errs, err)
+		if strings.HasPrefix(img.Url, "data:") {
+			inline = append(inline, img)
+		}
+	}
+	return inline
+}
+
+var errImageCountTimeout = errors.New("image token counting timed out")
+
+var errImageByteBudgetExceeded = errors.New("the images of the request exceed MaxImageBytesPerRequest")
+
+// imageByteBudget is the MaxImageBytesPerRequest budget shared by the concurrent image downloads of a request,
+// the first one going over it cancels the others, so a request never holds much more than the limit
+type imageByteBudget struct {
+	used     int64
+	limit    int64
+	exceeded int32
+	cancel   context.CancelFunc
+}
+
+// add takes n bytes from the budget and tells whether it still holds, a nil or unlimited budget always does
+func (b *imageByteBudget) add(n int) bool {
+	if b == nil || b.limit <= 0 {
+		return true
+	}
+	if atomic.AddInt64(&b.used, int64(n)) <= b.limit {
+		return true
+	}
+	if atomic.CompareAndSwapInt32(&b.exceeded, 0, 1) && b.cancel != nil {
+		b.cancel()
+	}
+	return false
+}
+
+func (b *imageByteBudget) isExceeded() bool {
+	return b != nil && atomic.LoadInt32(&b.exceeded) == 1
+}
+
+type imageBudgetReader struct {
+	reader io.Reader
+	budget *imageByteBudget
+}
+
+func (r *imageBudgetReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if !r.budget.add(n) {
+		return n, errImageByteBudgetExceeded
+	}
+	return n, err
+}
+
+type imageTokenResult struct {
+	tokens int
+	bytes  int
+	err    error
+}
+
+// measureImages counts the images with at most ImageCountConcurrency at once, within the ImageCountTimeout budget,
+// the results are in the order of the images and the ones not measured in time fail with errImageCountTimeout.
+// The downloads stop as soon as they exceed MaxImageBytesPerRequest together, the returned budget tells it.
+func measureImages(images []*ContentPartImageUrl, params common.ImageTokenParams) ([]imageTokenResult, *imageByteBudget) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if common.ImageCountTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, time.Duration(common.ImageCountTimeout)*time.Millisecond)
+		defer cancelTimeout()
+	}
+	budget := &imageByteBudget{limit: int64(common.MaxImageBytesPerRequest), cancel: cancel}
+	concurrency := common.ImageCountConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	results := make([]imageTokenResult, len(images))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, img := range images {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			results[i].err = errImageCountTimeout
+			continue
+		}
+		wg.Add(1)
+		go func(i int, img *ContentPartImageUrl) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			tokens, size, err := countTokenImage(ctx, img, params, budget)
+			if ctx.Err() != nil && err != nil && !budget.isExceeded() {
+				err = errImageCountTimeout
+			}
+			results[i] = imageTokenResult{tokens: tokens, bytes: size, err: err}
+		}(i, img)
+	}
+	wg.Wait()
+	return results, budget
+}
+
+// countTokenImages returns the tokens and total bytes of the images, the images that could not be counted
+// are charged at the flat price and reported in errs. The images are measured concurrently and fail the request
+// together once they exceed MaxImageBytesPerRequest.
+func countTokenImages(images []*ContentPartImageUrl, model string) (tokens int, imageBytes int, errs []*imageTokenError, err error) {
+	if err := checkImagesPerRequest(len(images)); err != nil {
+		return 0, 0, nil, err
+	}
+	params := common.GetImageTokenParams(model)
+	results, budget := measureImages(images, params)
+	if budget.isExceeded() {
+		return 0, int(atomic.LoadInt64(&budget.used)), nil, &imageLimitError{
+			Code:    "image_payload_too_large",
+			Message: fmt.Sprintf("image payload too large: the images in the request exceed %d bytes", common.MaxImageBytesPerRequest),
+		}
+	}
+	for i, result := range results {
+		img, token, size, err := images[i], result.tokens, result.bytes, result.err
+		imageBytes += size
+		if err != nil {
+			errs = append(errs, &imageTokenError{Url: shortImageUrl(img.Url), Err: err})
 			tokens += 765
 		} else {
 			tokens += token
 		}
 	}
-	return tokens, errs
+	return tokens, imageBytes, errs, nil
 }
 
-func countTokenMessages(messages []Message, model string) int {
+func countTokenMessages(messages []Message, model string, approximate bool) int {
 	tokenEncoder := getTokenEncoder(model)
 	// Reference:
 	// https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb
@@ -184,34 +516,51 @@ func countTokenMessages(messages []Message, model string) int {
 	tokenNum := 0
 	for _, message := range messages {
 		tokenNum += tokensPerMessage
-		tokenNum += getTokenNum(tokenEncoder, message.Content)
-		tokenNum += getTokenNum(tokenEncoder, message.Role)
+		tokenNum += getTokenNum(tokenEncoder, message.Content, approximate)
+		tokenNum += getTokenNum(tokenEncoder, message.Role, approximate)
 		if message.Name != nil {
 			tokenNum += tokensPerName
-			tokenNum += getTokenNum(tokenEncoder, *message.Name)
+			tokenNum += getTokenNum(tokenEncoder, *message.Name, approximate)
+		}
+		// null content decodes to "" above, the tool calls still cost tokens
+		for _, toolCall := range message.ToolCalls {
+			if toolCall == nil || toolCall.Function == nil {
+				continue
+			}
+			tokenNum += getTokenNum(tokenEncoder, toolCall.Function.Name, approximate)
+			tokenNum += getTokenNum(tokenEncoder, toolCall.Function.Arguments, approximate)
 		}
 	}
 	tokenNum += 3 // Every reply is primed with <|start|>assistant<|message|>
 	return tokenNum
 }
 
-func countTokenInput(input any, model string) int {
+func countTokenInput(input any, model string, approximate bool) int {
 	switch input.(type) {
 	case string:
-		return countTokenText(input.(string), model)
+		return countTokenText(input.(string), model, approximate)
 	case []string:
 		text := ""
 		for _, s := range input.([]string) {
 			text += s
 		}
-		return countTokenText(text, model)
+		return countTokenText(text, model, approximate)
+	case []any:
+		// a prompt array decoded from JSON, e.g. the legacy completions endpoint with several prompts
+		text := ""
+		for _, item := range input.([]any) {
+			if s, ok := item.(string); ok {
+				text += s
+			}
+		}
+		return countTokenText(text, model, approximate)
 	}
 	return 0
 }
 
-func countTokenText(text string, model string) int {
+func countTokenText(text string, model string, approximate bool) int {
 	tokenEncoder := getTokenEncoder(model)
-	return getTokenNum(tokenEncoder, text)
+	return getTokenNum(tokenEncoder, text, approximate)
 }
 
 func reformatJson(v json.RawMessage, indent bool) []byte {
@@ -232,23 +581,24 @@ func reformatJson(v json.RawMessage, indent bool) []byte {
 	return buf
 }
 
-func countTokenFunctions(functions json.RawMessage, functionCall json.RawMessage, model string) int {
+func countTokenFunctions(functions json.RawMessage, functionCall json.RawMessage, model string, approximate bool) int {
 	if functions == nil {
 		return 0
 	}
 	tokenEncoder := getTokenEncoder(model)
 
-	tokens := getTokenNum(tokenEncoder, string(reformatJson(functions, true)))
+	tokens := getTokenNum(tokenEncoder, string(reformatJson(functions, true)), approximate)
 	tokens = int(float64(tokens) * 0.6)
 
-	tokens += getTokenNum(tokenEncoder, string(reformatJson(functionCall, false)))
+	tokens += getTokenNum(tokenEncoder, string(reformatJson(functionCall, false)), approximate)
 
 	return tokens
 }
 
 func errorWrapper(err error, code string, statusCode int) *OpenAIErrorWithStatusCode {
 	openAIError := OpenAIError{
-		Message: err.Error(),
+		// errors of the http client contain the upstream url, which may carry the channel key
+		Message: common.RedactURLSecrets(err.Error()),
 		Type:    "one_api_error",
 		Code:    code,
 	}
@@ -258,6 +608,29 @@ func errorWrapper(err error, code string, statusCode int) *OpenAIErrorWithStatus
 	}
 }
 
+// validationErrorWrapper reports all field errors in one response, a single error keeps its own code
+func validationErrorWrapper(fieldErrors []*FieldError) *OpenAIErrorWithStatusCode {
+	messages := make([]string, 0, len(fieldErrors))
+	for _, fieldError := range fieldErrors {
+		messages = append(messages, fieldError.Message)
+	}
+	openAIError := OpenAIError{
+		Message: strings.Join(messages, "; "),
+		Type:    "one_api_error",
+		Param:   fieldErrors[0].Param,
+		Code:    fieldErrors[0].Code,
+		Errors:  fieldErrors,
+	}
+	if len(fieldErrors) > 1 {
+		openAIError.Param = ""
+		openAIError.Code = "invalid_request_parameters"
+	}
+	return &OpenAIErrorWithStatusCode{
+		OpenAIError: openAIError,
+		StatusCode:  http.StatusBadRequest,
+	}
+}
+
 func shouldDisableChannel(err *OpenAIError, statusCode int) bool {
 	if !common.AutomaticDisableChannelEnabled {
 		return false
@@ -282,6 +655,11 @@ func setEventStreamHeaders(c *gin.Context) {
 	c.Writer.Header().Set("X-Accel-Buffering", "no")
 }
 
+// isEmptyResponse tells whether upstream answered without a body, there is no usage to parse then
+func isEmptyResponse(resp *http.Response, body []byte) bool {
+	return resp.StatusCode == http.StatusNoContent || len(bytes.TrimSpace(body)) == 0
+}
+
 func relayErrorHandler(resp *http.Response) (openAIErrorWithStatusCode *OpenAIErrorWithStatusCode) {
 	openAIErrorWithStatusCode = &OpenAIErrorWithStatusCode{
 		StatusCode: resp.StatusCode,
@@ -300,27 +678,169 @@ func relayErrorHandler(resp *http.Response) (openAIErrorWithStatusCode *OpenAIEr
 	if err != nil {
 		return
 	}
-	var textResponse TextResponse
-	err = json.Unmarshal(responseBody, &textResponse)
-	if err != nil {
-		return
+	if openAIError, ok := parseUpstreamError(responseBody, resp.StatusCode); ok {
+		openAIErrorWithStatusCode.OpenAIError = openAIError
+		openAIErrorWithStatusCode.OpenAIError.Message = common.ScrubErrorMessage(openAIError.Message)
 	}
-	openAIErrorWithStatusCode.OpenAIError = textResponse.Error
 	return
 }
 
+// getUpstreamErrorType guesses the OpenAI error type of an upstream error without one
+func getUpstreamErrorType(statusCode int) string {
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		return "authentication_error"
+	case statusCode == http.StatusForbidden:
+		return "permission_error"
+	case statusCode == http.StatusNotFound:
+		return "not_found_error"
+	case statusCode == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case statusCode >= 400 && statusCode < 500:
+		return "invalid_request_error"
+	}
+	return "upstream_error"
+}
+
+// parseUpstreamError reads the error of an upstream response, besides the OpenAI shape it accepts
+// {"error": "message"}, {"message": "..."} and {"detail": ...} as sent by FastAPI based servers
+func parseUpstreamError(body []byte, statusCode int) (OpenAIError, bool) {
+	openAIError := OpenAIError{
+		Type: getUpstreamErrorType(statusCode),
+		Code: "upstream_error",
+	}
+	if !gjson.ValidBytes(body) {
+		return openAIError, false
+	}
+	result := gjson.ParseBytes(body)
+	errorResult := result.Get("error")
+	switch {
+	case errorResult.IsObject():
+		var upstreamError OpenAIError
+		if err := json.Unmarshal([]byte(errorResult.Raw), &upstreamError); err != nil || upstreamError.Message == "" {
+			break
+		}
+		if upstreamError.Type == "" {
+			upstreamError.Type = openAIError.Type
+		}
+		if upstreamError.Code == nil {
+			upstreamError.Code = openAIError.Code
+		}
+		return upstreamError, true
+	case errorResult.Type == gjson.String && errorResult.String() != "":
+		openAIError.Message = errorResult.String()
+		return openAIError, true
+	}
+	if message := result.Get("message"); message.Type == gjson.String && message.String() != "" {
+		openAIError.Message = message.String()
+		if code := result.Get("code"); code.Exists() {
+			openAIError.Code = code.Value()
+		}
+		return openAIError, true
+	}
+	detail := result.Get("detail")
+	switch {
+	case detail.Type == gjson.String && detail.String() != "":
+		openAIError.Message = detail.String()
+		return openAIError, true
+	case detail.IsArray():
+		// validation errors, e.g. [{"loc": ["body", "model"], "msg": "field required", "type": "value_error.missing"}]
+		var messages []string
+		for _, item := range detail.Array() {
+			message := item.Get("msg").String()
+			if message == "" {
+				message = item.Raw
+			}
+			if loc := item.Get("loc"); loc.IsArray() {
+				var parts []string
+				for _, part := range loc.Array() {
+					parts = append(parts, part.String())
+				}
+				message = strings.Join(parts, ".") + ": " + message
+			}
+			messages = append(messages, message)
+		}
+		if len(messages) > 0 {
+			openAIError.Message = strings.Join(messages, "; ")
+			return openAIError, true
+		}
+	case detail.IsObject():
+		openAIError.Message = detail.Get("message").String()
+		if openAIError.Message == "" {
+			openAIError.Message = detail.Raw
+		}
+		return openAIError, true
+	}
+	return openAIError, false
+}
+
 func getFullRequestURL(baseURL string, requestURL string, channelType int) string {
-	fullRequestURL := fmt.Sprintf("%s%s", baseURL, requestURL)
+	fullRequestURL := joinRequestURL(baseURL, requestURL)
 	if channelType == common.ChannelTypeOpenAI {
 		if strings.HasPrefix(baseURL, "https://gateway.ai.cloudflare.com") {
-			fullRequestURL = fmt.Sprintf("%s%s", baseURL, strings.TrimPrefix(requestURL, "/v1"))
+			fullRequestURL = fmt.Sprintf("%s%s", strings.TrimRight(baseURL, "/"), strings.TrimPrefix(requestURL, "/v1"))
 		}
 	}
 	return fullRequestURL
 }
 
-func postConsumeQuota(ctx context.Context, tokenId int, quota int, userId int, channelId int, modelRatio float64, groupRatio float64, modelName string, tokenName string) {
-	err := model.PostConsumeTokenQuota(tokenId, quota)
+// getTextQuota computes the quota of a text request, separate input and output ratios
+// take precedence over the model ratio when configured, a zero model ratio means free
+func getTextQuota(modelName string, promptTokens int, completionTokens int, modelRatio float64, groupRatio float64) int {
+	var quota int
+	ioRatio, hasIORatio := common.GetModelIORatio(modelName)
+	if hasIORatio && modelRatio != 0 {
+		quota = int(math.Ceil((float64(promptTokens)*ioRatio.Input + float64(completionTokens)*ioRatio.Output) * groupRatio))
+	} else {
+		completionRatio := common.GetCompletionRatio(modelName)
+		quota = int(math.Ceil((float64(promptTokens) + float64(completionTokens)*completionRatio) * modelRatio * groupRatio))
+	}
+	if modelRatio*groupRatio != 0 && quota <= 0 {
+		quota = 1
+	}
+	return quota
+}
+
+// getTextRatios returns the ratios the prompt and the completion tokens of the model are billed with
+func getTextRatios(modelName string, modelRatio float64) (inputRatio float64, outputRatio float64) {
+	if ioRatio, ok := common.GetModelIORatio(modelName); ok && modelRatio != 0 {
+		return ioRatio.Input, ioRatio.Output
+	}
+	return modelRatio, modelRatio * common.GetCompletionRatio(modelName)
+}
+
+// getAudioQuota computes the quota of audio completion tokens, the audio ratio applies on top of
+// the ratio the text completion tokens of the model are billed with
+func getAudioQuota(modelName string, audioTokens int, modelRatio float64, groupRatio float64) int {
+	_, outputRatio := getTextRatios(modelName, modelRatio)
+	return int(math.Ceil(float64(audioTokens) * common.AudioCompletionRatio * outputRatio * groupRatio))
+}
+
+// getUsageQuota computes the quota settled for the usage of a text request, the audio part of the
+// completion is billed at the audio ratio and a usage without tokens means the request failed
+func getUsageQuota(modelName string, promptTokens int, completionTokens int, audioTokens int, modelRatio float64, groupRatio float64) int {
+	if promptTokens+completionTokens == 0 {
+		return 0
+	}
+	quota := getTextQuota(modelName, promptTokens, completionTokens-audioTokens, modelRatio, groupRatio)
+	if audioTokens > 0 {
+		quota += getAudioQuota(modelName, audioTokens, modelRatio, groupRatio)
+	}
+	return quota
+}
+
+// wantCostFooter reports whether usage and cost should be injected into non-stream responses,
+// either for everyone by option or on request by admins
+func wantCostFooter(c *gin.Context) bool {
+	if common.CostFooterEnabled {
+		return true
+	}
+	requested, _ := strconv.ParseBool(c.Request.Header.Get("X-Oneapi-Cost-Footer"))
+	return requested && model.IsAdmin(c.GetInt("id"))
+}
+
+func postConsumeQuota(ctx context.Context, tokenId int, quota int, category string, userId int, channelId int, modelRatio float64, groupRatio float64, userDiscount float64, modelName string, tokenName string, group string) {
+	err := model.PostConsumeTokenQuota(tokenId, quota, category)
 	if err != nil {
 		common.SysError("error consuming token remain quota: " + err.Error())
 	}
@@ -331,8 +851,46 @@ func postConsumeQuota(ctx context.Context, tokenId int, quota int, userId int, c
 	if quota != 0 {
 		//logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 %.2f", modelRatio, groupRatio)
 		logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 1.00", modelRatio)
-		model.RecordConsumeLog(ctx, userId, channelId, 0, 0, modelName, tokenName, quota, logContent)
+		if userDiscount != 1 {
+			logContent += fmt.Sprintf("，用户折扣 %.2f", userDiscount)
+		}
+		model.RecordConsumeLog(ctx, userId, channelId, 0, 0, modelName, tokenName, group, quota, userDiscount, logContent)
 		model.UpdateUserUsedQuotaAndRequestCount(userId, quota)
 		model.UpdateChannelUsedQuota(channelId, quota)
 	}
 }
+
+func parseRateLimitInt(header http.Header, key string) *int {
+	value, err := strconv.Atoi(header.Get(key))
+	if err != nil {
+		return nil
+	}
+	return &value
+}
+
+func parseRateLimitReset(header http.Header, key string, now time.Time) *int64 {
+	duration, err := time.ParseDuration(header.Get(key))
+	if err != nil {
+		return nil
+	}
+	resetAt := now.Add(duration).UnixMilli()
+	return &resetAt
+}
+
+// parseRateLimitHeaders reads the x-ratelimit-* headers sent by OpenAI, returns nil if none is present
+func parseRateLimitHeaders(header http.Header) *model.ChannelRateLimit {
+	now := time.Now()
+	rateLimit := &model.ChannelRateLimit{
+		LimitRequests:     parseRateLimitInt(header, "x-ratelimit-limit-requests"),
+		LimitTokens:       parseRateLimitInt(header, "x-ratelimit-limit-tokens"),
+		RemainingRequests: parseRateLimitInt(header, "x-ratelimit-remaining-requests"),
+		RemainingTokens:   parseRateLimitInt(header, "x-ratelimit-remaining-tokens"),
+		ResetRequestsAt:   parseRateLimitReset(header, "x-ratelimit-reset-requests", now),
+		ResetTokensAt:     parseRateLimitReset(header, "x-ratelimit-reset-tokens", now),
+		UpdatedAt:         now.UnixMilli(),
+	}
+	if rateLimit.RemainingRequests == nil && rateLimit.RemainingTokens == nil {
+		return nil
+	}
+	return rateLimit
+}
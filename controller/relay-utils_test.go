@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"net/http"
+	"one-api/common"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestStripReasoningModelParams(t *testing.T) {
+	if !common.IsReasoningModel("o1") || !common.IsReasoningModel("o3-mini") || common.IsReasoningModel("gpt-4o") {
+		t.Error("o-series models not recognized")
+	}
+	body, stripped, err := stripReasoningModelParams([]byte(`{"model":"o1","temperature":0.2,"top_p":0.9,"messages":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gjson.GetBytes(body, "temperature").Exists() || gjson.GetBytes(body, "top_p").Exists() || !gjson.GetBytes(body, "messages").Exists() {
+		t.Errorf("unexpected body %s", body)
+	}
+	if len(stripped) != 2 || stripped[0] != "temperature" || stripped[1] != "top_p" {
+		t.Errorf("stripped %v", stripped)
+	}
+}
+
+func TestCountTokenNullContentMessages(t *testing.T) {
+	toolCall := `{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]}`
+	withToolCall := countTokenMessages([]Message{{Role: "assistant", ToolCalls: []*ToolCall{{Function: &FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}}}}}, "gpt-4o", true)
+	empty := countTokenMessages([]Message{{Role: "assistant"}}, "gpt-4o", true)
+	if withToolCall <= empty {
+		t.Fatalf("tool calls not counted: %d tokens, %d without", withToolCall, empty)
+	}
+	for _, user := range []string{
+		`{"role":"user","content":"hi"}`,
+		// array content of another message takes the other decoding path
+		`{"role":"user","content":[{"type":"text","text":"hi"}]}`,
+	} {
+		textRequest, _, _, err := parseTextRequest([]byte(`{"model":"gpt-4o","messages":[` + user + `,` + toolCall + `]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := textRequest.Messages[1]
+		if message.Content != "" || len(message.ToolCalls) != 1 {
+			t.Fatalf("%s: null content decoded as %q with %d tool calls", user, message.Content, len(message.ToolCalls))
+		}
+		if tokens := countTokenMessages(textRequest.Messages[1:], "gpt-4o", true); tokens != withToolCall {
+			t.Errorf("%s: null content message counted %d tokens, want %d", user, tokens, withToolCall)
+		}
+	}
+}
+
+func TestApproximateTokenCountOverrides(t *testing.T) {
+	defer func(enabled bool, models map[string]bool, groups map[string]bool) {
+		common.ApproximateTokenEnabled, common.ApproximateTokenModels, common.GroupApproximateToken = enabled, models, groups
+	}(common.ApproximateTokenEnabled, common.ApproximateTokenModels, common.GroupApproximateToken)
+	common.ApproximateTokenEnabled = false
+	if err := common.UpdateApproximateTokenModelsByJSONString(`{"bulk-model":true,"billing-model":false}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.UpdateGroupApproximateTokenByJSONString(`{"cheap":true}`); err != nil {
+		t.Fatal(err)
+	}
+	approximate := func(modelName string, group string) bool {
+		c, _ := newTestContext(http.MethodPost, "/v1/chat/completions", "")
+		c.Set("request_model", modelName)
+		c.Set("group", group)
+		return isApproximateTokenCount(c)
+	}
+	for _, tc := range []struct {
+		model string
+		group string
+		want  bool
+	}{
+		// the same process counts one model approximately and the other exactly
+		{"bulk-model", "default", true},
+		{"billing-model", "default", false},
+		// the model override wins over the group
+		{"billing-model", "cheap", false},
+		{"other-model", "cheap", true},
+		{"other-model", "default", false},
+	} {
+		if got := approximate(tc.model, tc.group); got != tc.want {
+			t.Errorf("%s in group %s: approximate %v, want %v", tc.model, tc.group, got, tc.want)
+		}
+	}
+	common.ApproximateTokenEnabled = true
+	if !approximate("other-model", "default") || approximate("billing-model", "default") {
+		t.Error("global default not used for models without override")
+	}
+}
@@ -2,11 +2,16 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/tidwall/gjson"
 	"net/http"
+	"net/url"
 	"one-api/common"
+	"one-api/model"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,8 +20,9 @@ type ContentPartType string
 
 //goland:noinspection GoUnusedConst
 const (
-	ContentPartTypeText     ContentPartType = "text"
-	ContentPartTypeImageUrl ContentPartType = "image_url"
+	ContentPartTypeText       ContentPartType = "text"
+	ContentPartTypeImageUrl   ContentPartType = "image_url"
+	ContentPartTypeInputAudio ContentPartType = "input_audio"
 )
 
 type ImageUrlDetail string
@@ -33,16 +39,23 @@ type ContentPartImageUrl struct {
 	Detail string `json:"detail"`
 }
 
+type ContentPartInputAudio struct {
+	Data   string `json:"data"` // base64 encoded
+	Format string `json:"format"`
+}
+
 type ContentParts struct {
-	Type     ContentPartType      `json:"type"`
-	Text     string               `json:"text,omitempty"`
-	ImageUrl *ContentPartImageUrl `json:"image_url,omitempty"`
+	Type       ContentPartType        `json:"type"`
+	Text       string                 `json:"text,omitempty"`
+	ImageUrl   *ContentPartImageUrl   `json:"image_url,omitempty"`
+	InputAudio *ContentPartInputAudio `json:"input_audio,omitempty"`
 }
 
 type Message struct {
-	Role    string  `json:"role"`
-	Content string  `json:"content"`
-	Name    *string `json:"name,omitempty"`
+	Role      string      `json:"role"`
+	Content   string      `json:"content"`
+	Name      *string     `json:"name,omitempty"`
+	ToolCalls []*ToolCall `json:"tool_calls,omitempty"`
 }
 
 const (
@@ -52,6 +65,8 @@ const (
 	RelayModeEmbeddings
 	RelayModeModerations
 	RelayModeImagesGenerations
+	RelayModeImagesEdits
+	RelayModeImagesVariations
 	RelayModeEdits
 	RelayModeAudioSpeech
 	RelayModeAudioTranscription
@@ -59,21 +74,79 @@ const (
 )
 
 type GeneralOpenAIRequest struct {
-	Model        string          `json:"model,omitempty"`
-	Messages     []Message       `json:"messages,omitempty"`
-	Prompt       any             `json:"prompt,omitempty"`
-	Stream       bool            `json:"stream,omitempty"`
-	MaxTokens    int             `json:"max_tokens,omitempty"`
-	Temperature  float64         `json:"temperature,omitempty"`
-	TopP         float64         `json:"top_p,omitempty"`
-	N            int             `json:"n,omitempty"`
-	Input        any             `json:"input,omitempty"`
-	Instruction  string          `json:"instruction,omitempty"`
-	Size         string          `json:"size,omitempty"`
-	Functions    json.RawMessage `json:"functions,omitempty"`
-	FunctionCall json.RawMessage `json:"function_call,omitempty"`
-	Tools        json.RawMessage `json:"tools,omitempty"`
-	ToolChoice   json.RawMessage `json:"toolChoice"`
+	Model     string    `json:"model,omitempty"`
+	Messages  []Message `json:"messages,omitempty"`
+	Prompt    any       `json:"prompt,omitempty"`
+	Stream    bool      `json:"stream,omitempty"`
+	MaxTokens int       `json:"max_tokens,omitempty"`
+	// MaxCompletionTokens replaces max_tokens for o-series models
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"`
+	Temperature         float64         `json:"temperature,omitempty"`
+	TopP                float64         `json:"top_p,omitempty"`
+	N                   int             `json:"n,omitempty"`
+	Input               any             `json:"input,omitempty"`
+	Instruction         string          `json:"instruction,omitempty"`
+	Size                string          `json:"size,omitempty"`
+	Functions           json.RawMessage `json:"functions,omitempty"`
+	FunctionCall        json.RawMessage `json:"function_call,omitempty"`
+	Tools               json.RawMessage `json:"tools,omitempty"`
+	ToolChoice          json.RawMessage `json:"toolChoice"`
+	Prediction          json.RawMessage `json:"prediction,omitempty"`
+	LogitBias           json.RawMessage `json:"logit_bias,omitempty"`
+	Seed                *int64          `json:"seed,omitempty"`
+	Modalities          []string        `json:"modalities,omitempty"`
+	Audio               json.RawMessage `json:"audio,omitempty"`
+	Logprobs            json.RawMessage `json:"logprobs,omitempty"` // an integer for legacy completions, a boolean for chat
+	// ResponseFormat is only read for conversion channels, OpenAI compatible ones get the raw body
+	ResponseFormat json.RawMessage `json:"response_format,omitempty"`
+}
+
+// getMaxTokens returns the output limit of the request, whichever field it is set in
+func (r GeneralOpenAIRequest) getMaxTokens() int {
+	if r.MaxCompletionTokens != 0 {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
+}
+
+// validateLogprobs checks the shape of logprobs for the endpoint, upstreams reject the other one with a vague 400
+func (r GeneralOpenAIRequest) validateLogprobs(relayMode int) error {
+	logprobs := gjson.ParseBytes(r.Logprobs)
+	if r.Logprobs == nil || logprobs.Type == gjson.Null {
+		return nil
+	}
+	switch relayMode {
+	case RelayModeCompletions:
+		if logprobs.Type != gjson.Number || logprobs.Num != float64(int(logprobs.Num)) {
+			return errors.New("logprobs must be an integer between 0 and 5 for completions")
+		}
+		if logprobs.Num < 0 || logprobs.Num > 5 {
+			return fmt.Errorf("logprobs must be between 0 and 5 for completions, got %d", int(logprobs.Num))
+		}
+	case RelayModeChatCompletions:
+		if logprobs.Type != gjson.True && logprobs.Type != gjson.False {
+			return errors.New("logprobs must be a boolean for chat completions, use top_logprobs for the number of tokens")
+		}
+	}
+	return nil
+}
+
+// WantsJSON tells whether the client asked for JSON mode, structured outputs included
+func (r GeneralOpenAIRequest) WantsJSON() bool {
+	formatType := gjson.GetBytes(r.ResponseFormat, "type").String()
+	return formatType == "json_object" || formatType == "json_schema"
+}
+
+func (r GeneralOpenAIRequest) HasAudioOutput() bool {
+	if r.Audio != nil {
+		return true
+	}
+	for _, modality := range r.Modalities {
+		if modality == "audio" {
+			return true
+		}
+	}
+	return false
 }
 
 func (r GeneralOpenAIRequest) ParseInput() []string {
@@ -112,7 +185,7 @@ type TextRequest struct {
 // ImageRequest docs: https://platform.openai.com/docs/api-reference/images/create
 type ImageRequest struct {
 	Model          string `json:"model"`
-	Prompt         string `json:"prompt" binding:"required"`
+	Prompt         string `json:"prompt"`
 	N              int    `json:"n"`
 	Size           string `json:"size"`
 	Quality        string `json:"quality"`
@@ -133,17 +206,48 @@ type TextToSpeechRequest struct {
 	ResponseFormat string  `json:"response_format"`
 }
 
+type CompletionTokensDetails struct {
+	AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
+	RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
+	AudioTokens              int `json:"audio_tokens"`
+}
+
 type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens            int                      `json:"prompt_tokens"`
+	CompletionTokens        int                      `json:"completion_tokens"`
+	TotalTokens             int                      `json:"total_tokens"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+}
+
+// GetRejectedPredictionTokens returns the predicted tokens that were not accepted,
+// they are still billed as completion tokens.
+func (u Usage) GetRejectedPredictionTokens() int {
+	if u.CompletionTokensDetails == nil {
+		return 0
+	}
+	return u.CompletionTokensDetails.RejectedPredictionTokens
+}
+
+// GetAudioTokens returns the audio output tokens, which are included in the completion tokens
+func (u Usage) GetAudioTokens() int {
+	if u.CompletionTokensDetails == nil {
+		return 0
+	}
+	return u.CompletionTokensDetails.AudioTokens
 }
 
 type OpenAIError struct {
-	Message string `json:"message"`
-	Type    string `json:"type"`
+	Message string        `json:"message"`
+	Type    string        `json:"type"`
+	Param   string        `json:"param"`
+	Code    any           `json:"code"`
+	Errors  []*FieldError `json:"errors,omitempty"` // every validation failure when several are reported at once
+}
+
+type FieldError struct {
 	Param   string `json:"param"`
-	Code    any    `json:"code"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 type OpenAIErrorWithStatusCode struct {
@@ -218,6 +322,7 @@ type ChatCompletionsStreamResponse struct {
 	Created int64                                 `json:"created"`
 	Model   string                                `json:"model"`
 	Choices []ChatCompletionsStreamResponseChoice `json:"choices"`
+	Usage   *Usage                                `json:"usage,omitempty"`
 }
 
 type CompletionsStreamResponse struct {
@@ -225,6 +330,24 @@ type CompletionsStreamResponse struct {
 		Text         string `json:"text"`
 		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+// getContextLengthFallback returns the model to retry on once the upstream rejected the prompt as too long,
+// the fallback is tried at most once and only when the token may use it
+func getContextLengthFallback(c *gin.Context, err *OpenAIErrorWithStatusCode) string {
+	if ticket := common.GetRetryTicket(c); ticket != nil && ticket.ContextFallback != "" {
+		return ""
+	}
+	if err.Code != "context_length_exceeded" ||
+		isRelayBudgetExceeded(c) {
+		return ""
+	}
+	fallbackModel := common.ContextLengthFallbacks[c.GetString("request_model")]
+	if fallbackModel == "" || !common.IsModelInList(c.GetString("token_models"), fallbackModel) {
+		return ""
+	}
+	return fallbackModel
 }
 
 func Relay(c *gin.Context) {
@@ -241,6 +364,10 @@ func Relay(c *gin.Context) {
 		relayMode = RelayModeModerations
 	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/images/generations") {
 		relayMode = RelayModeImagesGenerations
+	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/images/edits") {
+		relayMode = RelayModeImagesEdits
+	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/images/variations") {
+		relayMode = RelayModeImagesVariations
 	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/edits") {
 		relayMode = RelayModeEdits
 	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/audio/speech") {
@@ -250,9 +377,36 @@ func Relay(c *gin.Context) {
 	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/audio/translation") {
 		relayMode = RelayModeAudioTranslation
 	}
+	startTime := time.Now()
+	// retries are redirects, the ticket issued by the server links them to the first attempt
+	ticket := common.GetRetryTicket(c)
+	if ticket == nil {
+		ticket = &common.RetryTicket{
+			ChainId:   c.GetString(common.RequestIdKey),
+			StartTime: startTime.UnixMilli(),
+			Retry:     common.RetryTimes,
+			TokenId:   c.GetInt("token_id"),
+		}
+	}
+	if previousAttempts := getRelayAttempts(ticket.ChainId); len(previousAttempts) > 0 {
+		c.Set("relay_attempts", formatRelayAttempts(previousAttempts))
+	}
+	if ticket.Attempt > 0 {
+		// headers have to be set before the response is written, the count includes this attempt
+		c.Header("X-Oneapi-Attempts", strconv.Itoa(ticket.Attempt+1))
+	}
 	var err *OpenAIErrorWithStatusCode
+	if budget := common.GetGroupLatencyBudget(c.GetString("group")); budget > 0 {
+		// the budget covers retries too, so count from the start of the first attempt, the ticket carries it to the retries
+		cancel := setRelayDeadline(c, time.UnixMilli(ticket.StartTime).Add(time.Duration(budget)*time.Millisecond))
+		defer cancel()
+	}
 	switch relayMode {
 	case RelayModeImagesGenerations:
+		fallthrough
+	case RelayModeImagesEdits:
+		fallthrough
+	case RelayModeImagesVariations:
 		err = relayImageHelper(c, relayMode)
 	case RelayModeAudioSpeech:
 		fallthrough
@@ -263,16 +417,42 @@ func Relay(c *gin.Context) {
 	default:
 		err = relayTextHelper(c, relayMode)
 	}
+	if err == nil {
+		model.RecordChannelSuccess(c.GetInt("channel_id"))
+		model.RecordChannelRequest(c.GetInt("channel_id"), c.Writer.Status(), time.Since(startTime).Milliseconds())
+		if ticket.Attempt > 0 {
+			removeRelayAttempts(ticket.ChainId)
+		}
+	}
 	if err != nil {
+		// upstream errors may quote the request, keep prompts out of the logs below
+		logMessage := maskPromptEcho(c, err.Message)
+		model.RecordChannelError(c.GetInt("channel_id"), err.StatusCode)
+		model.RecordChannelRequest(c.GetInt("channel_id"), err.StatusCode, time.Since(startTime).Milliseconds())
+		addRelayAttempt(ticket.ChainId, newRelayAttempt(c, err, logMessage, startTime))
 		requestId := c.GetString(common.RequestIdKey)
-		retryTimesStr := c.Query("retry")
-		retryTimes, _ := strconv.Atoi(retryTimesStr)
-		if retryTimesStr == "" {
-			retryTimes = common.RetryTimes
+		retryTimes := ticket.Retry
+		if isRelayBudgetExceeded(c) {
+			// no budget left for another attempt
+			err = errorWrapper(errors.New("latency budget exceeded"), "latency_budget_exceeded", http.StatusGatewayTimeout)
+			retryTimes = 0
 		}
-		if retryTimes > 0 {
-			c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s?retry=%d", c.Request.URL.Path, retryTimes-1))
+		// the client resends the original body on redirects, the fallback model is passed along to every later attempt
+		nextTicket := *ticket
+		nextTicket.Attempt++
+		if fallbackModel := getContextLengthFallback(c, err); fallbackModel != "" {
+			common.LogInfo(c.Request.Context(), fmt.Sprintf("context length of model %s exceeded, retrying on %s", c.GetString("request_model"), fallbackModel))
+			nextTicket.Retry = retryTimes
+			nextTicket.ContextFallback = fallbackModel
+			c.Redirect(http.StatusTemporaryRedirect, getRetryURL(c, nextTicket))
+		} else if retryTimes > 0 {
+			addRelayRetryCount(c.GetInt("channel_id"), true)
+			nextTicket.Retry = retryTimes - 1
+			c.Redirect(http.StatusTemporaryRedirect, getRetryURL(c, nextTicket))
 		} else {
+			attempts := removeRelayAttempts(ticket.ChainId)
+			c.Header("X-Oneapi-Attempts", strconv.Itoa(len(attempts)))
+			recordFailedRequest(c, attempts, logMessage)
 			if err.StatusCode == http.StatusTooManyRequests {
 				err.OpenAIError.Message = "当前分组上游负载已饱和，请稍后再试"
 			}
@@ -282,16 +462,25 @@ func Relay(c *gin.Context) {
 			})
 		}
 		channelId := c.GetInt("channel_id")
-		common.LogError(c.Request.Context(), fmt.Sprintf("relay error (channel #%d): %s", channelId, err.Message))
+		common.LogError(c.Request.Context(), fmt.Sprintf("relay error (channel #%d): %s", channelId, logMessage))
 		// https://platform.openai.com/docs/guides/error-codes/api-errors
 		if shouldDisableChannel(&err.OpenAIError, err.StatusCode) {
 			channelId := c.GetInt("channel_id")
 			channelName := c.GetString("channel_name")
-			disableChannel(channelId, channelName, err.Message)
+			disableChannel(channelId, channelName, logMessage)
 		}
 	}
 }
 
+// getRetryURL is the redirect of a retry, the client's own query parameters are kept for signed requests
+func getRetryURL(c *gin.Context, ticket common.RetryTicket) string {
+	query := common.StripRetryTicket(c.Request.URL.RawQuery)
+	if query != "" {
+		query += "&"
+	}
+	return c.Request.URL.Path + "?" + query + common.RetryTicketKey + "=" + url.QueryEscape(common.IssueRetryTicket(ticket))
+}
+
 func RelayNotImplemented(c *gin.Context) {
 	err := OpenAIError{
 		Message: "API not implemented",
@@ -309,7 +498,7 @@ func RelayNotFound(c *gin.Context) {
 		Message: fmt.Sprintf("Invalid URL (%s %s)", c.Request.Method, c.Request.URL.Path),
 		Type:    "invalid_request_error",
 		Param:   "",
-		Code:    "",
+		Code:    "endpoint_not_supported",
 	}
 	c.JSON(http.StatusNotFound, gin.H{
 		"error": err,
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestValidateLogprobs(t *testing.T) {
+	cases := []struct {
+		relayMode int
+		logprobs  string
+		valid     bool
+	}{
+		{RelayModeCompletions, "0", true},
+		{RelayModeCompletions, "5", true},
+		{RelayModeCompletions, "null", true},
+		{RelayModeCompletions, "6", false},
+		{RelayModeCompletions, "-1", false},
+		{RelayModeCompletions, "2.5", false},
+		{RelayModeCompletions, "true", false},
+		{RelayModeChatCompletions, "true", true},
+		{RelayModeChatCompletions, "false", true},
+		{RelayModeChatCompletions, "3", false},
+	}
+	for _, tc := range cases {
+		request := GeneralOpenAIRequest{Logprobs: []byte(tc.logprobs)}
+		if err := request.validateLogprobs(tc.relayMode); (err == nil) != tc.valid {
+			t.Errorf("relay mode %d, logprobs %s: got %v", tc.relayMode, tc.logprobs, err)
+		}
+	}
+}
+
+func TestLegacyLogprobsPassThrough(t *testing.T) {
+	var upstreamLogprobs gjson.Result
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstreamLogprobs = gjson.GetBytes(body, "logprobs")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","object":"text_completion","choices":[{"text":"hi","index":0}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+	createTestRelayChannel(t, upstream.URL, "logprobs-instruct")
+	token := createTestToken(t, createTestUser(t, "logprobs", 1000000).Id, "logprobs")
+	recorder := serveRelay(t, token, "/v1/completions", `{"model":"logprobs-instruct","prompt":"hi","logprobs":3}`)
+	if recorder.Code != http.StatusOK || upstreamLogprobs.Type != gjson.Number || upstreamLogprobs.Int() != 3 {
+		t.Errorf("got %d, upstream logprobs %s: %s", recorder.Code, upstreamLogprobs.Raw, recorder.Body.String())
+	}
+	upstreamLogprobs = gjson.Result{}
+	recorder = serveRelay(t, token, "/v1/completions", `{"model":"logprobs-instruct","prompt":"hi","logprobs":9}`)
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "invalid_logprobs") || upstreamLogprobs.Exists() {
+		t.Errorf("out of range logprobs got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+	"strings"
+)
+
+type provisionTokenRequest struct {
+	Name   string `json:"name"`
+	TTL    int64  `json:"ttl"` // in seconds
+	Quota  int    `json:"quota"`
+	Models string `json:"models"`
+}
+
+// ProvisionToken mints a short-lived relay token for a logged in session or an access token,
+// so that pipelines do not need to create tokens by hand
+func ProvisionToken(c *gin.Context) {
+	userId := c.GetInt("id")
+	var request provisionTokenRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if request.Name == "" {
+		request.Name = "provisioned"
+	}
+	if len(request.Name) > 30 {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "令牌名称过长",
+		})
+		return
+	}
+	if request.TTL <= 0 || request.TTL > int64(common.ProvisionedTokenMaxTTL) {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "有效期必须大于 0 且不超过 " + strconv.Itoa(common.ProvisionedTokenMaxTTL) + " 秒",
+		})
+		return
+	}
+	userQuota, err := model.GetUserQuota(userId)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if request.Quota <= 0 || request.Quota > userQuota {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "额度必须大于 0 且不超过当前剩余额度",
+		})
+		return
+	}
+	var models []string
+	for _, name := range strings.Split(request.Models, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			models = append(models, name)
+		}
+	}
+	now := common.GetTimestamp()
+	token := model.Token{
+		UserId:       userId,
+		Name:         request.Name,
+		Key:          common.GenerateKey(),
+		CreatedTime:  now,
+		AccessedTime: now,
+		ExpiredTime:  now + request.TTL,
+		RemainQuota:  request.Quota,
+		Models:       strings.Join(models, ","),
+		Provisioned:  true,
+	}
+	err = token.Insert()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    token,
+	})
+	return
+}
+
+func GetProvisionedTokens(c *gin.Context) {
+	tokens, err := model.GetProvisionedTokens(c.GetInt("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    tokens,
+	})
+	return
+}
+
+func RevokeProvisionedToken(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	token, err := model.GetTokenByIds(id, c.GetInt("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if !token.Provisioned {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "该令牌不是通过接口创建的",
+		})
+		return
+	}
+	err = token.Delete()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+	return
+}
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"one-api/common"
@@ -99,6 +100,29 @@ func GetTokenStatus(c *gin.Context) {
 	})
 }
 
+// newUserToken copies the settings a user may choose from token into a new token of the user
+func newUserToken(userId int, token *model.Token) (*model.Token, error) {
+	if len(token.Name) > 30 {
+		return nil, errors.New("令牌名称过长")
+	}
+	if len(token.Secret) > 64 {
+		return nil, errors.New("令牌签名密钥过长")
+	}
+	return &model.Token{
+		UserId:         userId,
+		Name:           token.Name,
+		Key:            common.GenerateKey(),
+		CreatedTime:    common.GetTimestamp(),
+		AccessedTime:   common.GetTimestamp(),
+		ExpiredTime:    token.ExpiredTime,
+		RemainQuota:    token.RemainQuota,
+		UnlimitedQuota: token.UnlimitedQuota,
+		AccurateCount:  token.AccurateCount,
+		Models:         token.Models,
+		Secret:         token.Secret,
+	}, nil
+}
+
 func AddToken(c *gin.Context) {
 	token := model.Token{}
 	err := c.ShouldBindJSON(&token)
@@ -109,24 +133,12 @@ func AddToken(c *gin.Context) {
 		})
 		return
 	}
-	if len(token.Name) > 30 {
-		c.JSON(http.StatusOK, gin.H{
-			"success": false,
-			"message": "令牌名称过长",
-		})
-		return
-	}
-	cleanToken := model.Token{
-		UserId:         c.GetInt("id"),
-		Name:           token.Name,
-		Key:            common.GenerateKey(),
-		CreatedTime:    common.GetTimestamp(),
-		AccessedTime:   common.GetTimestamp(),
-		ExpiredTime:    token.ExpiredTime,
-		RemainQuota:    token.RemainQuota,
-		UnlimitedQuota: token.UnlimitedQuota,
+	cleanToken, err := newUserToken(c.GetInt("id"), &token)
+	if err == nil {
+		// the audit flag keeps full prompts in the logs, only admins may turn it on
+		cleanToken.Audit = token.Audit && c.GetInt("role") >= common.RoleAdminUser
+		err = cleanToken.Insert()
 	}
-	err = cleanToken.Insert()
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -178,6 +190,13 @@ func UpdateToken(c *gin.Context) {
 		})
 		return
 	}
+	if len(token.Secret) > 64 {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "令牌签名密钥过长",
+		})
+		return
+	}
 	cleanToken, err := model.GetTokenByIds(token.Id, userId)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
@@ -210,6 +229,12 @@ func UpdateToken(c *gin.Context) {
 		cleanToken.ExpiredTime = token.ExpiredTime
 		cleanToken.RemainQuota = token.RemainQuota
 		cleanToken.UnlimitedQuota = token.UnlimitedQuota
+		cleanToken.AccurateCount = token.AccurateCount
+		cleanToken.Models = token.Models
+		if c.GetInt("role") >= common.RoleAdminUser {
+			cleanToken.Audit = token.Audit
+		}
+		cleanToken.Secret = token.Secret
 	}
 	err = cleanToken.Update()
 	if err != nil {
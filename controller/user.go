@@ -2,7 +2,9 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"one-api/common"
 	"one-api/model"
@@ -176,12 +178,22 @@ func Register(c *gin.Context) {
 	return
 }
 
+// getTenantId returns the tenant a reseller admin is scoped to, 0 means the global view,
+// admins are only scoped once the root user flags them as reseller
+func getTenantId(c *gin.Context) int {
+	id := c.GetInt("id")
+	if c.GetInt("role") >= common.RoleRootUser || !model.IsReseller(id) {
+		return 0
+	}
+	return id
+}
+
 func GetAllUsers(c *gin.Context) {
 	p, _ := strconv.Atoi(c.Query("p"))
 	if p < 0 {
 		p = 0
 	}
-	users, err := model.GetAllUsers(p*common.ItemsPerPage, common.ItemsPerPage)
+	users, err := model.GetAllUsers(p*common.ItemsPerPage, common.ItemsPerPage, getTenantId(c))
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -199,7 +211,7 @@ func GetAllUsers(c *gin.Context) {
 
 func SearchUsers(c *gin.Context) {
 	keyword := c.Query("keyword")
-	users, err := model.SearchUsers(keyword)
+	users, err := model.SearchUsers(keyword, getTenantId(c))
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -224,7 +236,7 @@ func GetUser(c *gin.Context) {
 		})
 		return
 	}
-	user, err := model.GetUserById(id, false)
+	user, err := model.GetTenantUserById(id, getTenantId(c))
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -330,9 +342,27 @@ func GetSelf(c *gin.Context) {
 	return
 }
 
+// getClearedQuotaCategories lists the categories whose bucket the body sets to null, a missing field keeps the bucket
+func getClearedQuotaCategories(body []byte) []string {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return nil
+	}
+	var categories []string
+	for _, category := range model.QuotaCategories {
+		if value, ok := fields[category+"_quota"]; ok && string(value) == "null" {
+			categories = append(categories, category)
+		}
+	}
+	return categories
+}
+
 func UpdateUser(c *gin.Context) {
 	var updatedUser model.User
-	err := json.NewDecoder(c.Request.Body).Decode(&updatedUser)
+	body, err := io.ReadAll(c.Request.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &updatedUser)
+	}
 	if err != nil || updatedUser.Id == 0 {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -350,7 +380,8 @@ func UpdateUser(c *gin.Context) {
 		})
 		return
 	}
-	originUser, err := model.GetUserById(updatedUser.Id, false)
+	tenantId := getTenantId(c)
+	originUser, err := model.GetTenantUserById(updatedUser.Id, tenantId)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -373,11 +404,57 @@ func UpdateUser(c *gin.Context) {
 		})
 		return
 	}
+	if updatedUser.Discount < 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "用户折扣不能为负数",
+		})
+		return
+	}
+	clearedCategories := getClearedQuotaCategories(body)
+	if tenantId != 0 {
+		if originUser.Quota != updatedUser.Quota {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "无权直接修改用户额度，请从自己的额度中划转",
+			})
+			return
+		}
+		if updatedUser.Discount != 0 && originUser.Discount != updatedUser.Discount {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "无权修改用户折扣",
+			})
+			return
+		}
+		if isQuotaBucketChanged(originUser.ChatQuota, updatedUser.ChatQuota) || isQuotaBucketChanged(originUser.ImageQuota, updatedUser.ImageQuota) ||
+			isQuotaBucketChanged(originUser.AudioQuota, updatedUser.AudioQuota) || len(clearedCategories) > 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "无权直接修改用户额度，请从自己的额度中划转",
+			})
+			return
+		}
+		updatedUser.TenantId = tenantId
+	}
 	if updatedUser.Password == "$I_LOVE_U" {
 		updatedUser.Password = "" // rollback to what it should be
 	}
 	updatePassword := updatedUser.Password != ""
-	if err := updatedUser.Update(updatePassword); err != nil {
+	err = updatedUser.Update(updatePassword)
+	if err == nil {
+		err = model.ClearUserQuotaBuckets(updatedUser.Id, clearedCategories)
+	}
+	if err == nil {
+		err = model.CacheDeleteUserCategoryQuotas(updatedUser.Id)
+	}
+	if err == nil {
+		err = model.CacheDeleteUserDiscount(updatedUser.Id)
+	}
+	if err == nil {
+		err = model.CacheDeleteUserRole(updatedUser.Id)
+	}
+	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
 			"message": err.Error(),
@@ -387,6 +464,9 @@ func UpdateUser(c *gin.Context) {
 	if originUser.Quota != updatedUser.Quota {
 		model.RecordLog(originUser.Id, model.LogTypeManage, fmt.Sprintf("管理员将用户额度从 %s修改为 %s", common.LogQuota(originUser.Quota), common.LogQuota(updatedUser.Quota)))
 	}
+	if updatedUser.Discount != 0 && originUser.Discount != updatedUser.Discount {
+		model.RecordLog(originUser.Id, model.LogTypeManage, fmt.Sprintf("管理员将用户折扣从 %.2f 修改为 %.2f", originUser.Discount, updatedUser.Discount))
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -394,6 +474,11 @@ func UpdateUser(c *gin.Context) {
 	return
 }
 
+// isQuotaBucketChanged tells whether the update sets a bucket to another value, a missing bucket is left as is
+func isQuotaBucketChanged(origin *int, updated *int) bool {
+	return updated != nil && (origin == nil || *origin != *updated)
+}
+
 func UpdateSelf(c *gin.Context) {
 	var user model.User
 	err := json.NewDecoder(c.Request.Body).Decode(&user)
@@ -450,7 +535,7 @@ func DeleteUser(c *gin.Context) {
 		})
 		return
 	}
-	originUser, err := model.GetUserById(id, false)
+	originUser, err := model.GetTenantUserById(id, getTenantId(c))
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -503,26 +588,35 @@ func DeleteSelf(c *gin.Context) {
 	return
 }
 
+// validateNewUser checks a user created by an administrator and defaults its display name
+func validateNewUser(user *model.User) error {
+	if user.Username == "" || user.Password == "" {
+		return errors.New("无效的参数")
+	}
+	if err := common.Validate.Struct(user); err != nil {
+		return errors.New("输入不合法 " + err.Error())
+	}
+	if user.DisplayName == "" {
+		user.DisplayName = user.Username
+	}
+	return nil
+}
+
 func CreateUser(c *gin.Context) {
 	var user model.User
 	err := json.NewDecoder(c.Request.Body).Decode(&user)
-	if err != nil || user.Username == "" || user.Password == "" {
-		c.JSON(http.StatusOK, gin.H{
-			"success": false,
-			"message": "无效的参数",
-		})
-		return
+	if err == nil {
+		err = validateNewUser(&user)
+	} else {
+		err = errors.New("无效的参数")
 	}
-	if err := common.Validate.Struct(&user); err != nil {
+	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
-			"message": "输入不合法 " + err.Error(),
+			"message": err.Error(),
 		})
 		return
 	}
-	if user.DisplayName == "" {
-		user.DisplayName = user.Username
-	}
 	myRole := c.GetInt("role")
 	if user.Role >= myRole {
 		c.JSON(http.StatusOK, gin.H{
@@ -536,6 +630,7 @@ func CreateUser(c *gin.Context) {
 		Username:    user.Username,
 		Password:    user.Password,
 		DisplayName: user.DisplayName,
+		TenantId:    getTenantId(c),
 	}
 	if err := cleanUser.Insert(0); err != nil {
 		c.JSON(http.StatusOK, gin.H{
@@ -571,6 +666,7 @@ func ManageUser(c *gin.Context) {
 	}
 	user := model.User{
 		Username: req.Username,
+		TenantId: getTenantId(c), // zero value is ignored, so root admins are not scoped
 	}
 	// Fill attributes
 	model.DB.Where(&user).First(&user)
@@ -648,6 +744,29 @@ func ManageUser(c *gin.Context) {
 			return
 		}
 		user.Role = common.RoleCommonUser
+	case "reseller", "unreseller":
+		if myRole != common.RoleRootUser {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "普通管理员用户无法设置分销管理员",
+			})
+			return
+		}
+		if user.Role != common.RoleAdminUser {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "只有管理员可以设置为分销管理员",
+			})
+			return
+		}
+		if err := model.SetUserReseller(user.Id, req.Action == "reseller"); err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		user.Reseller = req.Action == "reseller"
 	}
 
 	if err := user.Update(false); err != nil {
@@ -657,9 +776,13 @@ func ManageUser(c *gin.Context) {
 		})
 		return
 	}
+	if err := model.CacheDeleteUserRole(user.Id); err != nil {
+		common.SysError("failed to delete cached user role: " + err.Error())
+	}
 	clearUser := model.User{
-		Role:   user.Role,
-		Status: user.Status,
+		Role:     user.Role,
+		Status:   user.Status,
+		Reseller: user.Reseller,
 	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -741,3 +864,53 @@ func TopUp(c *gin.Context) {
 	})
 	return
 }
+
+type TransferQuotaRequest struct {
+	UserId int `json:"user_id"`
+	Quota  int `json:"quota"`
+}
+
+// TransferQuota moves quota from the admin's own pool to one of their users
+func TransferQuota(c *gin.Context) {
+	var req TransferQuotaRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil || req.UserId == 0 || req.Quota <= 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "无效的参数",
+		})
+		return
+	}
+	id := c.GetInt("id")
+	if req.UserId == id {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "不能向自己划转额度",
+		})
+		return
+	}
+	if _, err := model.GetTenantUserById(req.UserId, getTenantId(c)); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "用户不存在",
+		})
+		return
+	}
+	err = model.TransferUserQuota(id, req.UserId, req.Quota)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	_ = model.CacheUpdateUserQuota(id)
+	_ = model.CacheUpdateUserQuota(req.UserId)
+	model.RecordLog(id, model.LogTypeManage, fmt.Sprintf("向用户 #%d 划转 %s", req.UserId, common.LogQuota(req.Quota)))
+	model.RecordLog(req.UserId, model.LogTypeManage, fmt.Sprintf("管理员划转 %s", common.LogQuota(req.Quota)))
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+	return
+}
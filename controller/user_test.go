@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/model"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestUpdateUserClearsQuotaBuckets(t *testing.T) {
+	user := createTestUser(t, "buckets", 1000)
+	reseller := createTestUser(t, "buckets-reseller", 0)
+	model.DB.Model(reseller).Updates(map[string]interface{}{"role": common.RoleAdminUser, "reseller": true})
+	model.DB.Model(user).Updates(map[string]interface{}{"chat_quota": 10, "image_quota": 20})
+	update := func(id int, role int, fields string) string {
+		body := fmt.Sprintf(`{"id":%d,"username":"buckets","display_name":"buckets","quota":1000,"group":"default",%s}`, user.Id, fields)
+		c, recorder := newTestContext(http.MethodPut, "/api/user/", body)
+		c.Set("id", id)
+		c.Set("role", role)
+		UpdateUser(c)
+		return recorder.Body.String()
+	}
+	if body := update(1, common.RoleRootUser, `"chat_quota":null`); !strings.Contains(body, `"success":true`) {
+		t.Fatal(body)
+	}
+	var got model.User
+	model.DB.First(&got, user.Id)
+	if got.ChatQuota != nil || got.ImageQuota == nil || *got.ImageQuota != 20 {
+		t.Errorf("got chat quota %v and image quota %v", got.ChatQuota, got.ImageQuota)
+	}
+	model.DB.Model(user).Update("tenant_id", reseller.Id)
+	if body := update(reseller.Id, common.RoleAdminUser, `"image_quota":20`); !strings.Contains(body, `"success":true`) {
+		t.Fatalf("a reseller could not keep a bucket: %s", body)
+	}
+	if body := update(reseller.Id, common.RoleAdminUser, `"image_quota":null`); !strings.Contains(body, `"success":false`) {
+		t.Errorf("a reseller cleared a bucket: %s", body)
+	}
+	if body := update(reseller.Id, common.RoleAdminUser, `"image_quota":5000`); !strings.Contains(body, `"success":false`) {
+		t.Errorf("a reseller raised a bucket: %s", body)
+	}
+}
+
+func TestResellerScopingIsOptIn(t *testing.T) {
+	admin := createTestUser(t, "scoping-admin", 1000)
+	model.DB.Model(admin).Update("role", common.RoleAdminUser)
+	member := createTestUser(t, "scoping-member", 0)
+	model.DB.Model(member).Update("tenant_id", admin.Id)
+	adminContext := func(method string, path string, body string) (*gin.Context, *httptest.ResponseRecorder) {
+		c, recorder := newTestContext(method, path, body)
+		c.Set("id", admin.Id)
+		c.Set("role", common.RoleAdminUser)
+		return c, recorder
+	}
+	// admins from before tenants keep the global view
+	c, _ := adminContext(http.MethodGet, "/api/user/", "")
+	if tenantId := getTenantId(c); tenantId != 0 {
+		t.Fatalf("unflagged admin scoped to tenant %d", tenantId)
+	}
+	manage := func(role int, action string) string {
+		c, recorder := newTestContext(http.MethodPost, "/api/user/manage", fmt.Sprintf(`{"username":"scoping-admin","action":"%s"}`, action))
+		c.Set("id", 1)
+		c.Set("role", role)
+		ManageUser(c)
+		return recorder.Body.String()
+	}
+	if body := manage(common.RoleAdminUser, "reseller"); !strings.Contains(body, `"success":false`) {
+		t.Fatalf("an admin flagged a reseller: %s", body)
+	}
+	if body := manage(common.RoleRootUser, "reseller"); !strings.Contains(body, `"reseller":true`) {
+		t.Fatal(body)
+	}
+	c, _ = adminContext(http.MethodGet, "/api/user/", "")
+	if tenantId := getTenantId(c); tenantId != admin.Id {
+		t.Fatalf("reseller scoped to tenant %d", tenantId)
+	}
+	c, recorder := adminContext(http.MethodPost, "/api/redemption/", `{"name":"mint","count":1,"quota":1000}`)
+	AddRedemption(c)
+	if !strings.Contains(recorder.Body.String(), `"success":false`) {
+		t.Errorf("a reseller minted redemption codes: %s", recorder.Body.String())
+	}
+	c, recorder = adminContext(http.MethodPost, "/api/user/transfer_quota", fmt.Sprintf(`{"user_id":%d,"quota":400}`, member.Id))
+	TransferQuota(c)
+	if !strings.Contains(recorder.Body.String(), `"success":true`) {
+		t.Fatal(recorder.Body.String())
+	}
+	var got model.User
+	model.DB.First(&got, member.Id)
+	if got.Quota != 400 {
+		t.Errorf("member got %d quota, want 400", got.Quota)
+	}
+	if body := manage(common.RoleRootUser, "unreseller"); !strings.Contains(body, `"success":true`) {
+		t.Fatal(body)
+	}
+	c, _ = adminContext(http.MethodGet, "/api/user/", "")
+	if tenantId := getTenantId(c); tenantId != 0 {
+		t.Errorf("admin still scoped to tenant %d after the flag was cleared", tenantId)
+	}
+}
+
+func TestUpdateUserDropsTheCachedDiscount(t *testing.T) {
+	user := createTestUser(t, "rebate", 1000)
+	model.DB.Model(user).Update("discount", 0.5)
+	if discount := model.CacheGetUserDiscount(user.Id); discount != 0.5 {
+		t.Fatalf("discount %v, want 0.5", discount)
+	}
+	body := fmt.Sprintf(`{"id":%d,"username":"rebate","display_name":"rebate","quota":1000,"group":"default","discount":0.8}`, user.Id)
+	c, recorder := newTestContext(http.MethodPut, "/api/user/", body)
+	c.Set("id", 1)
+	c.Set("role", common.RoleRootUser)
+	UpdateUser(c)
+	if !strings.Contains(recorder.Body.String(), `"success":true`) {
+		t.Fatal(recorder.Body.String())
+	}
+	if discount := model.CacheGetUserDiscount(user.Id); discount != 0.8 {
+		t.Errorf("discount %v after the update, want 0.8", discount)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"embed"
+	"flag"
 	"fmt"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
@@ -12,7 +13,9 @@ import (
 	"one-api/model"
 	"one-api/router"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 )
 
 //go:embed web/build
@@ -23,6 +26,11 @@ var indexPage []byte
 
 func main() {
 	common.SetupLogger()
+	isAdminCommand := flag.Arg(0) == "admin"
+	if isAdminCommand {
+		// keep stdout for the output of the command
+		gin.DefaultWriter = gin.DefaultErrorWriter
+	}
 	common.SysLog("One API " + common.Version + " started")
 	if os.Getenv("GIN_MODE") != "debug" {
 		gin.SetMode(gin.ReleaseMode)
@@ -50,6 +58,11 @@ func main() {
 
 	// Initialize options
 	model.InitOptionMap()
+	if isAdminCommand {
+		code := controller.RunAdminCommand(flag.Args()[1:], os.Stdout)
+		_ = model.CloseDB()
+		os.Exit(code)
+	}
 	if common.RedisEnabled {
 		// for compatibility with old versions
 		common.MemoryCacheEnabled = true
@@ -77,6 +90,18 @@ func main() {
 		}
 		go controller.AutomaticallyTestChannels(frequency)
 	}
+	if common.IsMasterNode {
+		go controller.AutomaticallyRunCanaries()
+		go controller.AutomaticallyExportCostReports()
+		go controller.AutomaticallySettleFineTuningJobs()
+	}
+	go model.SyncModelMaintenances()
+	go model.DeleteExpiredProvisionedTokens()
+	go model.AutomaticallyRemindExpiringTokens()
+	go model.SyncChannelHourlyStats()
+	go model.SyncChannelDailyUsages()
+	go flushOnShutdown()
+	go controller.AutomaticallyWarmUpChannels()
 	if os.Getenv("BATCH_UPDATE_ENABLED") == "true" {
 		common.BatchUpdateEnabled = true
 		common.SysLog("batch update enabled with interval " + strconv.Itoa(common.BatchUpdateInterval) + "s")
@@ -90,6 +115,7 @@ func main() {
 	// This will cause SSE not to work!!!
 	//server.Use(gzip.Gzip(gzip.DefaultCompression))
 	server.Use(middleware.RequestId())
+	server.Use(middleware.ReusableBodyCleanup())
 	middleware.SetUpLogger(server)
 	// Initialize session store
 	store := cookie.NewStore([]byte(common.SessionSecret))
@@ -105,3 +131,14 @@ func main() {
 		common.FatalLog("failed to start HTTP server: " + err.Error())
 	}
 }
+
+// flushOnShutdown writes the counters kept in memory before the process exits on SIGINT or SIGTERM
+func flushOnShutdown() {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	common.SysLog("shutting down, flushing pending channel usages")
+	model.FlushChannelDailyUsages()
+	_ = model.CloseDB()
+	os.Exit(0)
+}
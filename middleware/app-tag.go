@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"one-api/common"
+	"strings"
+	"sync"
+)
+
+const (
+	maxAppTagLength = 32
+	maxAppTagCount  = 100
+	otherAppTag     = "other"
+)
+
+// knownAppTags bounds the cardinality of app tags, tags beyond maxAppTagCount are recorded as "other"
+var knownAppTags = map[string]bool{}
+var knownAppTagsLock sync.Mutex
+
+func normalizeAppTag(tag string) string {
+	tag = strings.TrimSpace(tag)
+	if len(tag) > maxAppTagLength {
+		tag = tag[:maxAppTagLength]
+	}
+	tag = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return -1
+	}, tag)
+	if tag == "" {
+		return ""
+	}
+	knownAppTagsLock.Lock()
+	defer knownAppTagsLock.Unlock()
+	if !knownAppTags[tag] {
+		if len(knownAppTags) >= maxAppTagCount {
+			return otherAppTag
+		}
+		knownAppTags[tag] = true
+	}
+	return tag
+}
+
+func AppTag() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if common.AppTagHeader == "" {
+			c.Next()
+			return
+		}
+		tag := normalizeAppTag(c.Request.Header.Get(common.AppTagHeader))
+		if tag != "" {
+			c.Set(common.AppTagKey, tag)
+			ctx := context.WithValue(c.Request.Context(), common.AppTagKey, tag)
+			c.Request = c.Request.WithContext(ctx)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAppTagCardinalityIsBounded(t *testing.T) {
+	defer func(tags map[string]bool) { knownAppTags = tags }(knownAppTags)
+	knownAppTags = map[string]bool{}
+	if tag := normalizeAppTag(" mobile/app\n"); tag != "mobileapp" {
+		t.Errorf("tag normalized to %q", tag)
+	}
+	if tag := normalizeAppTag(strings.Repeat("a", 40)); len(tag) != maxAppTagLength {
+		t.Errorf("long tag kept %d characters", len(tag))
+	}
+	for i := len(knownAppTags); i < maxAppTagCount; i++ {
+		normalizeAppTag(fmt.Sprintf("app-%d", i))
+	}
+	if tag := normalizeAppTag("one-too-many"); tag != otherAppTag {
+		t.Errorf("tag beyond the limit recorded as %q", tag)
+	}
+	if tag := normalizeAppTag("mobileapp"); tag != "mobileapp" {
+		t.Errorf("known tag recorded as %q", tag)
+	}
+}
@@ -85,6 +85,27 @@ func RootAuth() func(c *gin.Context) {
 func TokenAuth() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		key := c.Request.Header.Get("Authorization")
+		if key == "" && common.TokenHeaderName != "" {
+			if key = c.Request.Header.Get(common.TokenHeaderName); key != "" {
+				// normalize, the rest of the relay only looks at Authorization
+				key = "Bearer " + strings.TrimPrefix(key, "Bearer ")
+				c.Request.Header.Set("Authorization", key)
+				c.Request.Header.Del(common.TokenHeaderName)
+			}
+		}
+		if strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(key, "Bearer")), "sk-") == "" {
+			// tell misconfigured clients apart from invalid tokens, e.g. "Bearer sk-" from an unset key variable
+			message := "未提供令牌，请在 Authorization 请求头中以 Bearer 方式提供令牌"
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": gin.H{
+					"message": common.MessageWithRequestId(message, c.GetString(common.RequestIdKey)),
+					"type":    "invalid_request_error",
+					"code":    "missing_authorization",
+				},
+			})
+			c.Abort()
+			return
+		}
 		key = strings.TrimPrefix(key, "Bearer ")
 		key = strings.TrimPrefix(key, "sk-")
 		parts := strings.Split(key, "-")
@@ -100,12 +121,39 @@ func TokenAuth() func(c *gin.Context) {
 			return
 		}
 		if !userEnabled {
-			abortWithMessage(c, http.StatusForbidden, "用户已被封禁")
+			abortWithAccessTerminated(c, token.UserId)
 			return
 		}
+		if value := c.Query(common.RetryTicketKey); value != "" {
+			// retries are only recognized by the ticket the server put in the redirect
+			ticket, err := common.ParseRetryTicket(value)
+			if err != nil || ticket.TokenId != token.Id {
+				abortWithMessage(c, http.StatusBadRequest, "无效的重试凭据")
+				return
+			}
+			c.Set(common.RetryTicketKey, ticket)
+		}
+		if token.Secret != "" {
+			if err := verifyRequestSignature(c, token.Secret); err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{
+					"error": gin.H{
+						"message": common.MessageWithRequestId(err.Error(), c.GetString(common.RequestIdKey)),
+						"type":    "invalid_request_error",
+						"code":    "invalid_signature",
+					},
+				})
+				c.Abort()
+				return
+			}
+		}
 		c.Set("id", token.UserId)
 		c.Set("token_id", token.Id)
 		c.Set("token_name", token.Name)
+		c.Set("token_accurate_count", token.AccurateCount)
+		c.Set("token_models", token.Models)
+		c.Set("token_audit", token.Audit)
+		c.Set("token_remain_quota", token.RemainQuota)
+		c.Set("token_unlimited_quota", token.UnlimitedQuota)
 		requestURL := c.Request.URL.String()
 		consumeQuota := true
 		if strings.HasPrefix(requestURL, "/v1/models") {
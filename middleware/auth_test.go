@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+func TestBannedUserAccessTerminated(t *testing.T) {
+	defer func(contact string) { common.SupportContact = contact }(common.SupportContact)
+	common.SupportContact = "support@example.com"
+	user := &model.User{Username: "banned", Password: "password", Quota: 1000, Status: common.UserStatusDisabled, Group: "default",
+		AccessToken: common.GetUUID(), AffCode: common.GetUUID()[:8]}
+	if err := model.DB.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	token := &model.Token{UserId: user.Id, Name: "banned", Key: common.GetUUID(), Status: common.TokenStatusEnabled,
+		ExpiredTime: -1, RemainQuota: 1000, CreatedTime: common.GetTimestamp()}
+	if err := model.DB.Create(token).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	engine := gin.New()
+	engine.Use(TokenAuth(), Distribute())
+	engine.POST("/v1/chat/completions", func(c *gin.Context) {
+		t.Error("request of a banned user relayed")
+	})
+	request := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini","messages":[]}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer sk-"+token.Key)
+	request.RemoteAddr = "203.0.113.7:1234"
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, request)
+
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusUnauthorized || gjson.Get(body, "error.type").String() != "access_terminated" ||
+		!strings.Contains(gjson.Get(body, "error.message").String(), "support@example.com") {
+		t.Errorf("got %d: %s", recorder.Code, body)
+	}
+	var logs []model.Log
+	model.DB.Where("user_id = ?", user.Id).Find(&logs)
+	if len(logs) != 1 || logs[0].Type != model.LogTypeSystem || !strings.Contains(logs[0].Content, "203.0.113.7") {
+		t.Errorf("attempt not logged once with the client ip: %+v", logs)
+	}
+	storedUser, _ := model.GetUserById(user.Id, true)
+	storedToken, _ := model.GetTokenById(token.Id)
+	if storedUser.Quota != 1000 || storedUser.UsedQuota != 0 || storedToken.RemainQuota != 1000 || storedToken.UsedQuota != 0 {
+		t.Errorf("quota touched: user %d/%d, token %d/%d", storedUser.Quota, storedUser.UsedQuota, storedToken.RemainQuota, storedToken.UsedQuota)
+	}
+}
+
+func TestTokenFromAlternateHeader(t *testing.T) {
+	defer func(name string) { common.TokenHeaderName = name }(common.TokenHeaderName)
+	user := &model.User{Username: "alternate-header", Password: "password", Quota: 1000, Status: common.UserStatusEnabled, Group: "default",
+		AccessToken: common.GetUUID(), AffCode: common.GetUUID()[:8]}
+	if err := model.DB.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	token := &model.Token{UserId: user.Id, Name: "alternate-header", Key: common.GetUUID(), Status: common.TokenStatusEnabled,
+		ExpiredTime: -1, RemainQuota: 1000, CreatedTime: common.GetTimestamp()}
+	if err := model.DB.Create(token).Error; err != nil {
+		t.Fatal(err)
+	}
+	engine := gin.New()
+	engine.Use(TokenAuth())
+	var authorization string
+	engine.POST("/v1/chat/completions", func(c *gin.Context) {
+		authorization = c.Request.Header.Get("Authorization")
+		c.String(http.StatusOK, strconv.Itoa(c.GetInt("token_id")))
+	})
+	request := func(header string, value string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`))
+		request.Header.Set(header, value)
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	common.TokenHeaderName = ""
+	if recorder := request("X-Api-Key", "sk-"+token.Key); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("alternate header accepted while not configured: %d", recorder.Code)
+	}
+	common.TokenHeaderName = "X-Api-Key"
+	for _, value := range []string{"sk-" + token.Key, "Bearer sk-" + token.Key} {
+		recorder := request("X-Api-Key", value)
+		if recorder.Code != http.StatusOK || recorder.Body.String() != strconv.Itoa(token.Id) || authorization != "Bearer sk-"+token.Key {
+			t.Errorf("%s: got %d %s, Authorization %q", value, recorder.Code, recorder.Body.String(), authorization)
+		}
+	}
+	// Authorization still works
+	if recorder := request("Authorization", "Bearer sk-"+token.Key); recorder.Code != http.StatusOK {
+		t.Errorf("Authorization rejected: %d", recorder.Code)
+	}
+}
+
+func TestMissingAuthorization(t *testing.T) {
+	engine := gin.New()
+	engine.Use(TokenAuth(), Distribute())
+	engine.POST("/v1/chat/completions", func(c *gin.Context) {
+		t.Error("request without a token relayed")
+	})
+	request := func(authorization string) (int, string) {
+		request := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini","messages":[]}`))
+		request.Header.Set("Content-Type", "application/json")
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+		return recorder.Code, gjson.Get(recorder.Body.String(), "error.code").String()
+	}
+	for _, authorization := range []string{"", "Bearer ", "Bearer sk-"} {
+		if code, errorCode := request(authorization); code != http.StatusUnauthorized || errorCode != "missing_authorization" {
+			t.Errorf("%q: got %d %s", authorization, code, errorCode)
+		}
+	}
+	// an invalid token is told apart
+	if code, errorCode := request("Bearer sk-invalid"); code != http.StatusUnauthorized || errorCode == "missing_authorization" {
+		t.Errorf("invalid token: got %d %s", code, errorCode)
+	}
+}
@@ -1,18 +1,25 @@
 package middleware
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"one-api/common"
 	"one-api/model"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 type ModelRequest struct {
-	Model string `json:"model"`
+	Model       string `json:"model"`
+	ServiceTier string `json:"service_tier"`
 }
 
 func Distribute() func(c *gin.Context) {
@@ -20,6 +27,10 @@ func Distribute() func(c *gin.Context) {
 		userId := c.GetInt("id")
 		userGroup, _ := model.CacheGetUserGroup(userId)
 		c.Set("group", userGroup)
+		// before the pinned channel branch, a pinned channel is also sent the concrete model
+		if !resolveVirtualModel(c) {
+			return
+		}
 		var channel *model.Channel
 		channelId, ok := c.Get("channelId")
 		if ok {
@@ -33,39 +44,139 @@ func Distribute() func(c *gin.Context) {
 				abortWithMessage(c, http.StatusBadRequest, "无效的渠道 Id")
 				return
 			}
+			// the kill switch also stops the requests pinned to a channel
+			modelRequest, err := getModelRequest(c)
+			if err != nil {
+				abortWithMessage(c, http.StatusBadRequest, "无效的请求")
+				return
+			}
+			if common.IsModelDisabled(modelRequest.Model) {
+				abortWithModelDisabled(c, modelRequest.Model)
+				return
+			}
 			//if channel.Status != common.ChannelStatusEnabled {
 			//	abortWithMessage(c, http.StatusForbidden, "该渠道已被禁用")
 			//	return
 			//}
 		} else {
 			// Select a channel for the user
-			var modelRequest ModelRequest
-			err := common.UnmarshalBodyReusable(c, &modelRequest)
+			modelRequest, err := getModelRequest(c)
 			if err != nil {
 				abortWithMessage(c, http.StatusBadRequest, "无效的请求")
 				return
 			}
-			if strings.HasPrefix(c.Request.URL.Path, "/v1/moderations") {
-				if modelRequest.Model == "" {
-					modelRequest.Model = "text-moderation-stable"
+			virtualModel := c.GetString("virtual_model")
+			retryTicket := common.GetRetryTicket(c)
+			if retryTicket != nil && retryTicket.ContextFallback != "" && common.ContextLengthFallbacks[modelRequest.Model] == retryTicket.ContextFallback {
+				fallbackModel := retryTicket.ContextFallback
+				// a previous attempt exceeded the context window of the model, see getContextLengthFallback
+				err = common.SetBodyReusable(c, func(body []byte) ([]byte, error) {
+					return sjson.SetBytes(body, "model", fallbackModel)
+				})
+				if err != nil {
+					abortWithMessage(c, http.StatusBadRequest, "无效的请求")
+					return
 				}
+				c.Set("context_fallback_from", modelRequest.Model)
+				c.Header("X-Oneapi-Context-Fallback", modelRequest.Model+" -> "+fallbackModel)
+				modelRequest.Model = fallbackModel
 			}
-			if strings.HasSuffix(c.Request.URL.Path, "embeddings") {
-				if modelRequest.Model == "" {
-					modelRequest.Model = c.Param("model")
-				}
+			c.Set("request_model", modelRequest.Model)
+			switch modelRequest.ServiceTier {
+			case "", common.ServiceTierAuto, common.ServiceTierDefault, common.ServiceTierFlex:
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": gin.H{
+						"message": fmt.Sprintf("Invalid value: '%s'. Supported values are: 'auto', 'default', and 'flex'.", modelRequest.ServiceTier),
+						"type":    "invalid_request_error",
+						"param":   "service_tier",
+						"code":    "invalid_value",
+					},
+				})
+				c.Abort()
+				return
+			}
+			serviceTier := common.ServiceTierDefault
+			if modelRequest.ServiceTier == common.ServiceTierFlex {
+				serviceTier = common.ServiceTierFlex
+			}
+			// the effective tier is only echoed to clients that asked for one
+			c.Set("service_tier_requested", modelRequest.ServiceTier != "")
+			// tokens are granted the virtual model, not the models it resolves to
+			permittedModel := modelRequest.Model
+			if virtualModel != "" {
+				permittedModel = virtualModel
 			}
-			if strings.HasPrefix(c.Request.URL.Path, "/v1/images/generations") {
-				if modelRequest.Model == "" {
-					modelRequest.Model = "dall-e-2"
+			if !common.IsModelInList(c.GetString("token_models"), permittedModel) {
+				message := fmt.Sprintf("该令牌无权使用模型 %s", permittedModel)
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": gin.H{
+						"message": common.MessageWithRequestId(message, c.GetString(common.RequestIdKey)),
+						"type":    "one_api_error",
+						"code":    "model_not_allowed",
+					},
+				})
+				c.Abort()
+				return
+			}
+			selection, err := model.SelectChannel(&model.ChannelSelectionRequest{
+				Group:       userGroup,
+				Model:       modelRequest.Model,
+				UserId:      userId,
+				ServiceTier: serviceTier,
+				TokenModels: c.GetString("token_models"),
+				Retry:       retryTicket != nil,
+				Multipart:   strings.HasPrefix(c.Request.Header.Get("Content-Type"), "multipart/form-data"),
+			}, nil)
+			var disabledErr *model.ModelDisabledError
+			if errors.As(err, &disabledErr) {
+				abortWithModelDisabled(c, disabledErr.Model)
+				return
+			}
+			if selection.Model != modelRequest.Model {
+				err := common.SetBodyReusable(c, func(body []byte) ([]byte, error) {
+					return sjson.SetBytes(body, "model", selection.Model)
+				})
+				if err != nil {
+					abortWithMessage(c, http.StatusBadRequest, "无效的请求")
+					return
 				}
 			}
-			if strings.HasPrefix(c.Request.URL.Path, "/v1/audio/transcriptions") || strings.HasPrefix(c.Request.URL.Path, "/v1/audio/translations") {
-				if modelRequest.Model == "" {
-					modelRequest.Model = "whisper-1"
+			if selection.DowngradedFrom != "" {
+				downgradedTo := selection.Model
+				if selection.FallbackFrom != "" {
+					downgradedTo = selection.FallbackFrom
 				}
+				common.LogInfo(c.Request.Context(), fmt.Sprintf("user %d quota %d below %d, model %s downgraded to %s", userId, selection.UserQuota, selection.DowngradeThreshold, selection.DowngradedFrom, downgradedTo))
+				c.Set("downgraded_from", selection.DowngradedFrom)
+			}
+			if selection.GroupFallbackFrom != "" {
+				common.LogInfo(c.Request.Context(), fmt.Sprintf("no channel available in group %s for model %s, falling back to group %s", userGroup, selection.Model, selection.Group))
+				c.Set("group", selection.Group)
+				c.Set("group_fallback_from", selection.GroupFallbackFrom)
+			}
+			if selection.FallbackFrom != "" {
+				common.LogInfo(c.Request.Context(), fmt.Sprintf("no channel available for model %s, falling back to %s", selection.FallbackFrom, selection.Model))
+				c.Set("fallback_from", selection.FallbackFrom)
+				c.Set("request_model", selection.Model)
+			}
+			modelRequest.Model = selection.Model
+			channel = selection.Channel
+			var maintenanceErr *model.ModelUnderMaintenanceError
+			if errors.As(err, &maintenanceErr) {
+				message := fmt.Sprintf("模型 %s 正在维护中，预计 %s 结束", modelRequest.Model, time.Unix(maintenanceErr.EndTime, 0).Format("2006-01-02 15:04:05"))
+				c.Header("Retry-After", strconv.FormatInt(maintenanceErr.EndTime-common.GetTimestamp(), 10))
+				c.JSON(http.StatusServiceUnavailable, gin.H{
+					"error": gin.H{
+						"message":  common.MessageWithRequestId(message, c.GetString(common.RequestIdKey)),
+						"type":     "one_api_error",
+						"code":     "model_under_maintenance",
+						"end_time": maintenanceErr.EndTime,
+					},
+				})
+				c.Abort()
+				return
 			}
-			channel, err = model.CacheGetRandomSatisfiedChannel(userGroup, modelRequest.Model)
 			if err != nil {
 				message := fmt.Sprintf("当前分组 %s 下对于模型 %s 无可用渠道", userGroup, modelRequest.Model)
 				if channel != nil {
@@ -83,6 +194,18 @@ func Distribute() func(c *gin.Context) {
 		c.Header("X-Channel-Id", strconv.Itoa(channel.Id))
 		c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", channel.Key))
 		c.Set("base_url", channel.GetBaseURL())
+		c.Set("channel_headers", channel.GetHeaders())
+		c.Set("body_transforms", channel.GetBodyTransforms())
+		c.Set("auth_type", channel.GetAuthType())
+		c.Set("auth_param", channel.GetAuthParam())
+		c.Set("embedding_batch_size", channel.GetEmbeddingBatchSize())
+		c.Set("channel_timeout", channel.GetTimeout())
+		c.Set("channel_max_tokens", channel.GetMaxTokens())
+		// the tier the request is served and billed in, whatever the client asked for
+		c.Set("service_tier", channel.GetServiceTier())
+		if channel.HasCustomTLS() {
+			c.Set("tls_channel", channel)
+		}
 		switch channel.Type {
 		case common.ChannelTypeAzure:
 			c.Set("api_version", channel.Other)
@@ -94,3 +217,130 @@ func Distribute() func(c *gin.Context) {
 		c.Next()
 	}
 }
+
+// getModelRequest reads the model and service tier of the request, with the default model of the endpoints
+// that do not require one
+func getModelRequest(c *gin.Context) (ModelRequest, error) {
+	var modelRequest ModelRequest
+	var err error
+	if strings.HasPrefix(c.Request.Header.Get("Content-Type"), "multipart/form-data") {
+		err = common.ParseMultipartFormReusable(c)
+		modelRequest.Model = c.Request.FormValue("model")
+	} else {
+		err = common.UnmarshalBodyReusable(c, &modelRequest)
+	}
+	if err != nil {
+		return modelRequest, err
+	}
+	if strings.HasPrefix(c.Request.URL.Path, "/v1/moderations") {
+		if modelRequest.Model == "" {
+			modelRequest.Model = "text-moderation-stable"
+		}
+	}
+	if strings.HasSuffix(c.Request.URL.Path, "embeddings") {
+		if modelRequest.Model == "" {
+			modelRequest.Model = c.Param("model")
+		}
+	}
+	if strings.HasPrefix(c.Request.URL.Path, "/v1/images/") {
+		if modelRequest.Model == "" {
+			modelRequest.Model = "dall-e-2"
+		}
+	}
+	if strings.HasPrefix(c.Request.URL.Path, "/v1/audio/transcriptions") || strings.HasPrefix(c.Request.URL.Path, "/v1/audio/translations") {
+		if modelRequest.Model == "" {
+			modelRequest.Model = "whisper-1"
+		}
+	}
+	return modelRequest, nil
+}
+
+func abortWithModelDisabled(c *gin.Context, modelName string) {
+	message := fmt.Sprintf("模型 %s 已被临时禁用", modelName)
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": gin.H{
+			"message": common.MessageWithRequestId(message, c.GetString(common.RequestIdKey)),
+			"type":    "one_api_error",
+			"code":    "model_temporarily_disabled",
+		},
+	})
+	c.Abort()
+}
+
+// resolveVirtualModel replaces a virtual model in the request body by the model it routes to,
+// it returns false when the request was aborted
+func resolveVirtualModel(c *gin.Context) bool {
+	if len(common.VirtualModels) == 0 || strings.HasPrefix(c.Request.Header.Get("Content-Type"), "multipart/form-data") {
+		return true
+	}
+	// the model is decoded from the buffered body first, a spilled body is only loaded for virtual models
+	var modelRequest ModelRequest
+	if err := common.UnmarshalBodyReusable(c, &modelRequest); err != nil {
+		abortWithMessage(c, http.StatusBadRequest, "无效的请求")
+		return false
+	}
+	virtualModel := modelRequest.Model
+	if !common.IsVirtualModel(virtualModel) {
+		return true
+	}
+	body, err := common.GetBodyReusable(c)
+	if err != nil {
+		abortWithMessage(c, http.StatusBadRequest, "无效的请求")
+		return false
+	}
+	prompt := getVirtualModelPrompt(body)
+	resolvedModel := common.ResolveVirtualModel(virtualModel, countVirtualModelPromptTokens(prompt), prompt)
+	err = common.SetBodyReusable(c, func(body []byte) ([]byte, error) {
+		return sjson.SetBytes(body, "model", resolvedModel)
+	})
+	if err != nil {
+		abortWithMessage(c, http.StatusBadRequest, "无效的请求")
+		return false
+	}
+	c.Set("virtual_model", virtualModel)
+	return true
+}
+
+var virtualModelTokenEncoder *tiktoken.Tiktoken
+var virtualModelTokenEncoderOnce sync.Once
+
+// countVirtualModelPromptTokens counts the prompt tokens with cl100k_base, the encoding of the gpt-4 family,
+// the exact count needs the encoder of the concrete model, which is not known before the virtual model is resolved
+func countVirtualModelPromptTokens(prompt string) int {
+	virtualModelTokenEncoderOnce.Do(func() {
+		encoder, err := tiktoken.GetEncoding("cl100k_base")
+		if err != nil {
+			common.SysError("failed to get cl100k_base token encoder, prompt tokens of virtual models are estimated: " + err.Error())
+			return
+		}
+		virtualModelTokenEncoder = encoder
+	})
+	if virtualModelTokenEncoder == nil {
+		return int(float64(len(prompt)) * 0.38)
+	}
+	return len(virtualModelTokenEncoder.Encode(prompt, nil, nil))
+}
+
+// getVirtualModelPrompt collects the prompt text of a request body
+func getVirtualModelPrompt(body []byte) string {
+	var texts []string
+	addTexts := func(value gjson.Result) {
+		if value.Type == gjson.String {
+			texts = append(texts, value.String())
+			return
+		}
+		for _, item := range value.Array() {
+			if item.Type == gjson.String {
+				texts = append(texts, item.String())
+			} else if text := item.Get("text"); text.Type == gjson.String {
+				texts = append(texts, text.String())
+			}
+		}
+	}
+	for _, message := range gjson.GetBytes(body, "messages").Array() {
+		addTexts(message.Get("content"))
+	}
+	addTexts(gjson.GetBytes(body, "prompt"))
+	addTexts(gjson.GetBytes(body, "input"))
+	return strings.Join(texts, "\n")
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// serveDistribute runs a request through Distribute and returns the body the relay would read
+func serveDistribute(t *testing.T, body string, setup func(c *gin.Context)) (int, *gin.Context, string) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	_, engine := gin.CreateTestContext(recorder)
+	var relayed *gin.Context
+	relayedBody := ""
+	engine.Use(func(c *gin.Context) {
+		c.Set("token_models", "")
+		setup(c)
+	}, Distribute())
+	engine.POST("/v1/chat/completions", func(c *gin.Context) {
+		relayed = c
+		rawBody, err := common.GetBodyReusable(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relayedBody = string(rawBody)
+		c.Status(http.StatusOK)
+	})
+	request := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	engine.ServeHTTP(recorder, request)
+	return recorder.Code, relayed, relayedBody
+}
+
+func TestDistributeResolvesVirtualModelForPinnedChannel(t *testing.T) {
+	defer func(virtualModels map[string]*common.VirtualModel) { common.VirtualModels = virtualModels }(common.VirtualModels)
+	if err := common.UpdateVirtualModelsByJSONString(`{"company-smart":{"rules":[{"max_prompt_tokens":100,"model":"gpt-4o-mini"}],"default":"gpt-4o"}}`); err != nil {
+		t.Fatal(err)
+	}
+	channel := createTestChannel(t, "pinned", "gpt-4o-mini,gpt-4o")
+	code, relayed, body := serveDistribute(t, `{"model":"company-smart","messages":[{"role":"user","content":"hi"}]}`, func(c *gin.Context) {
+		c.Set("channelId", strconv.Itoa(channel.Id))
+	})
+	if code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	if model := gjson.Get(body, "model").String(); model != "gpt-4o-mini" {
+		t.Errorf("pinned channel is sent model %s", model)
+	}
+	if relayed.GetString("virtual_model") != "company-smart" {
+		t.Errorf("virtual model not kept for the response, got %q", relayed.GetString("virtual_model"))
+	}
+}
+
+func TestCountVirtualModelPromptTokens(t *testing.T) {
+	countVirtualModelPromptTokens("")
+	if virtualModelTokenEncoder == nil {
+		t.Skip("cl100k_base is not available offline, the estimate is used")
+	}
+	// "hello world" is two cl100k tokens, the estimate would give four
+	if tokens := countVirtualModelPromptTokens("hello world"); tokens != 2 {
+		t.Errorf("got %d tokens", tokens)
+	}
+}
+
+func TestKillSwitchStopsPinnedChannelRequests(t *testing.T) {
+	defer func(disabledModels string) { common.DisabledModels = disabledModels }(common.DisabledModels)
+	common.DisabledModels = "killed-model"
+	channel := createTestChannel(t, "pinned-killed", "killed-model,alive-model")
+	pin := func(c *gin.Context) {
+		c.Set("channelId", strconv.Itoa(channel.Id))
+	}
+	if code, _, _ := serveDistribute(t, `{"model":"killed-model","messages":[]}`, pin); code != http.StatusServiceUnavailable {
+		t.Errorf("a disabled model pinned to a channel got %d", code)
+	}
+	if code, _, _ := serveDistribute(t, `{"model":"alive-model","messages":[]}`, pin); code != http.StatusOK {
+		t.Errorf("an enabled model pinned to a channel got %d", code)
+	}
+}
+
+// countingReader counts the bytes read from the request body
+type countingReader struct {
+	reader *strings.Reader
+	read   int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+func TestResolveVirtualModelSkipsBodyWithoutVirtualModels(t *testing.T) {
+	defer func(virtualModels map[string]*common.VirtualModel) { common.VirtualModels = virtualModels }(common.VirtualModels)
+	body := &countingReader{reader: strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)}
+	resolve := func() *gin.Context {
+		t.Helper()
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", body)
+		c.Request.Header.Set("Content-Type", "application/json")
+		if !resolveVirtualModel(c) {
+			t.Fatal("request aborted")
+		}
+		return c
+	}
+	common.VirtualModels = map[string]*common.VirtualModel{}
+	resolve()
+	if body.read != 0 {
+		t.Errorf("read %d bytes of the body without virtual models", body.read)
+	}
+	if err := common.UpdateVirtualModelsByJSONString(`{"company-smart":{"default":"gpt-4o"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if c := resolve(); body.read == 0 || c.GetString("virtual_model") != "" {
+		t.Errorf("read %d bytes, virtual model %q", body.read, c.GetString("virtual_model"))
+	}
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"strings"
+	"sync"
+	"time"
+)
+
+// getRequestHash hashes the request body with the JSON keys sorted and the whitespace removed,
+// so that retries of the same prompt collide whatever the client's serializer does,
+// spilled bodies are hashed as they are, streamed from the buffer
+func getRequestHash(c *gin.Context) (string, error) {
+	if common.IsBodySpilled(c) {
+		hash := sha256.New()
+		hash.Write([]byte(c.Request.URL.Path + "\n"))
+		if err := common.CopyBodyReusable(c, hash); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+	body, err := common.GetBodyReusable(c)
+	if err != nil {
+		return "", err
+	}
+	var parsed any
+	if json.Unmarshal(body, &parsed) == nil {
+		if normalized, err := json.Marshal(parsed); err == nil {
+			body = normalized
+		}
+	}
+	hash := sha256.Sum256(append([]byte(c.Request.URL.Path+"\n"), body...))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+type duplicateRequestCount struct {
+	count     int
+	expiresAt time.Time
+}
+
+type duplicateRequestExpiry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// duplicateRequestCounts are the counters without Redis, they expire with their window like the Redis keys,
+// duplicateRequestExpiries holds them in the order they were created so that expired ones are evicted without a scan
+var duplicateRequestCounts = make(map[string]*duplicateRequestCount)
+var duplicateRequestExpiries []duplicateRequestExpiry
+var duplicateRequestCountsLock sync.Mutex
+
+func countDuplicateRequestInMemory(key string, window time.Duration) int {
+	now := time.Now()
+	duplicateRequestCountsLock.Lock()
+	defer duplicateRequestCountsLock.Unlock()
+	evicted := 0
+	for ; evicted < len(duplicateRequestExpiries) && !duplicateRequestExpiries[evicted].expiresAt.After(now); evicted++ {
+		expiry := duplicateRequestExpiries[evicted]
+		if count, ok := duplicateRequestCounts[expiry.key]; ok && count.expiresAt.Equal(expiry.expiresAt) {
+			delete(duplicateRequestCounts, expiry.key)
+		}
+	}
+	duplicateRequestExpiries = duplicateRequestExpiries[evicted:]
+	count, ok := duplicateRequestCounts[key]
+	if !ok || !count.expiresAt.After(now) {
+		count = &duplicateRequestCount{expiresAt: now.Add(window)}
+		duplicateRequestCounts[key] = count
+		duplicateRequestExpiries = append(duplicateRequestExpiries, duplicateRequestExpiry{key: key, expiresAt: count.expiresAt})
+	}
+	count.count++
+	return count.count
+}
+
+// isDuplicateRequestAllowed counts the request and tells whether it is within DuplicateRequestLimit,
+// the counters live in Redis when available so that all nodes share them
+func isDuplicateRequestAllowed(key string) bool {
+	if common.RedisEnabled {
+		ctx := context.Background()
+		count, err := common.RDB.Incr(ctx, key).Result()
+		if err != nil {
+			// never block traffic because of the detection itself
+			common.SysError("failed to count duplicate requests: " + err.Error())
+			return true
+		}
+		if count == 1 {
+			common.RDB.Expire(ctx, key, time.Duration(common.DuplicateRequestWindow)*time.Second)
+		}
+		return count <= int64(common.DuplicateRequestLimit)
+	}
+	return countDuplicateRequestInMemory(key, time.Duration(common.DuplicateRequestWindow)*time.Second) <= common.DuplicateRequestLimit
+}
+
+// DuplicateRequestThrottle rejects a token sending the same request more than DuplicateRequestLimit times
+// within DuplicateRequestWindow seconds, which protects quota and upstream limits from client retry storms
+func DuplicateRequestThrottle() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if common.DuplicateRequestLimit <= 0 || common.DuplicateRequestWindow <= 0 ||
+			// our own retries replay the same body, they carry the ticket of the server's redirect
+			common.GetRetryTicket(c) != nil ||
+			// the multipart boundary changes on every retry of the client, the bodies never collide
+			strings.HasPrefix(c.Request.Header.Get("Content-Type"), "multipart/form-data") ||
+			common.IsDuplicateRequestExemptModel(c.GetString("request_model")) {
+			c.Next()
+			return
+		}
+		hash, err := getRequestHash(c)
+		if err != nil {
+			c.Next()
+			return
+		}
+		if isDuplicateRequestAllowed(fmt.Sprintf("duplicateRequest:%d:%s", c.GetInt("token_id"), hash)) {
+			c.Next()
+			return
+		}
+		message := fmt.Sprintf("相同的请求在 %d 秒内重复超过 %d 次，请稍后再试", common.DuplicateRequestWindow, common.DuplicateRequestLimit)
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": gin.H{
+				"message": common.MessageWithRequestId(message, c.GetString(common.RequestIdKey)),
+				"type":    "one_api_error",
+				"code":    "duplicate_request_throttled",
+			},
+		})
+		c.Abort()
+		common.LogWarn(c.Request.Context(), fmt.Sprintf("duplicate request throttled, token #%d, model %s", c.GetInt("token_id"), c.GetString("request_model")))
+	}
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func serveDuplicateRequest(t *testing.T, body string, ticket *common.RetryTicket, target string) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	_, engine := gin.CreateTestContext(recorder)
+	engine.Use(func(c *gin.Context) {
+		c.Set("token_id", 1)
+		c.Set("request_model", "gpt-4o")
+		if ticket != nil {
+			c.Set(common.RetryTicketKey, ticket)
+		}
+	}, DuplicateRequestThrottle())
+	engine.POST("/v1/chat/completions", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+	return recorder.Code
+}
+
+func TestDuplicateRequestThrottle(t *testing.T) {
+	defer func(limit int, window int) {
+		common.DuplicateRequestLimit, common.DuplicateRequestWindow = limit, window
+	}(common.DuplicateRequestLimit, common.DuplicateRequestWindow)
+	common.DuplicateRequestLimit, common.DuplicateRequestWindow = 2, 60
+
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"storm"}]}`
+	reordered := `{ "messages": [{"content":"storm","role":"user"}], "model": "gpt-4o" }`
+	if code := serveDuplicateRequest(t, body, nil, "/v1/chat/completions"); code != http.StatusOK {
+		t.Fatalf("first request got %d", code)
+	}
+	if code := serveDuplicateRequest(t, reordered, nil, "/v1/chat/completions"); code != http.StatusOK {
+		t.Fatalf("second request got %d", code)
+	}
+	if code := serveDuplicateRequest(t, body, nil, "/v1/chat/completions"); code != http.StatusTooManyRequests {
+		t.Errorf("third identical request got %d, want 429", code)
+	}
+	// a retry parameter set by the client is no longer an exemption
+	if code := serveDuplicateRequest(t, body, nil, "/v1/chat/completions?retry=1"); code != http.StatusTooManyRequests {
+		t.Errorf("client supplied retry parameter bypassed the throttle, got %d", code)
+	}
+	if code := serveDuplicateRequest(t, body, &common.RetryTicket{ChainId: "chain"}, "/v1/chat/completions"); code != http.StatusOK {
+		t.Errorf("server retry throttled, got %d", code)
+	}
+}
+
+func TestDuplicateRequestCountsExpire(t *testing.T) {
+	duplicateRequestCountsLock.Lock()
+	duplicateRequestCounts = make(map[string]*duplicateRequestCount)
+	duplicateRequestExpiries = nil
+	duplicateRequestCountsLock.Unlock()
+	if count := countDuplicateRequestInMemory("expiring", 20*time.Millisecond); count != 1 {
+		t.Fatalf("first count %d", count)
+	}
+	if count := countDuplicateRequestInMemory("expiring", 20*time.Millisecond); count != 2 {
+		t.Fatalf("second count %d", count)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if count := countDuplicateRequestInMemory("other", 20*time.Millisecond); count != 1 {
+		t.Fatalf("other count %d", count)
+	}
+	duplicateRequestCountsLock.Lock()
+	_, ok := duplicateRequestCounts["expiring"]
+	duplicateRequestCountsLock.Unlock()
+	if ok {
+		t.Error("expired counter was not evicted")
+	}
+	if count := countDuplicateRequestInMemory("expiring", 20*time.Millisecond); count != 1 {
+		t.Errorf("counter did not restart after its window, got %d", count)
+	}
+}
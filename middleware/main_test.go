@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"one-api/common"
+	"one-api/model"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	// the in-memory fallbacks are tested, InitRedisClient is never called
+	common.RedisEnabled = false
+	gin.SetMode(gin.TestMode)
+	dir, err := os.MkdirTemp("", "one-api-middleware-test")
+	if err != nil {
+		panic(err)
+	}
+	common.SQLitePath = filepath.Join(dir, "one-api.db")
+	if err := model.InitDB(); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = model.CloseDB()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func createTestChannel(t *testing.T, name string, models string) *model.Channel {
+	t.Helper()
+	baseURL := "http://127.0.0.1"
+	channel := &model.Channel{Name: name, Type: common.ChannelTypeOpenAI, Key: "sk-test", Status: common.ChannelStatusEnabled,
+		BaseURL: &baseURL, Models: models, Group: "default"}
+	if err := model.DB.Create(channel).Error; err != nil {
+		t.Fatalf("failed to create channel: %v", err)
+	}
+	return channel
+}
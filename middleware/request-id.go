@@ -16,3 +16,12 @@ func RequestId() func(c *gin.Context) {
 		c.Next()
 	}
 }
+
+// ReusableBodyCleanup removes spilled request bodies once the request is done, deferred so that
+// it also runs when a handler panics
+func ReusableBodyCleanup() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		defer common.CleanupReusableBody(c)
+		c.Next()
+	}
+}
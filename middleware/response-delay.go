@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"math/rand"
+	"one-api/common"
+	"time"
+)
+
+// delayWriter holds back the first write of a response, for load testing clients against a slow upstream
+type delayWriter struct {
+	gin.ResponseWriter
+	delay   time.Duration
+	delayed bool
+}
+
+func (w *delayWriter) wait() {
+	if w.delayed {
+		return
+	}
+	w.delayed = true
+	time.Sleep(w.delay)
+}
+
+func (w *delayWriter) Write(data []byte) (int, error) {
+	w.wait()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *delayWriter) WriteString(s string) (int, error) {
+	w.wait()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func getResponseDelay() time.Duration {
+	delay := common.ResponseDelayMin
+	if common.ResponseDelayMax > common.ResponseDelayMin {
+		delay += rand.Intn(common.ResponseDelayMax - common.ResponseDelayMin + 1)
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// ResponseDelay injects an artificial delay before responses are forwarded, it is a debugging aid
+// switched by the ResponseDelayEnabled option, which is off by default and like every option only set by root
+// through the option API or by the admin CLI on the server, it must stay off in production
+func ResponseDelay() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if !common.ResponseDelayEnabled {
+			c.Next()
+			return
+		}
+		c.Writer = &delayWriter{ResponseWriter: c.Writer, delay: getResponseDelay()}
+		c.Next()
+	}
+}
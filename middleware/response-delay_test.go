@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResponseDelay(t *testing.T) {
+	defer func(enabled bool, min int, max int) {
+		common.ResponseDelayEnabled, common.ResponseDelayMin, common.ResponseDelayMax = enabled, min, max
+	}(common.ResponseDelayEnabled, common.ResponseDelayMin, common.ResponseDelayMax)
+	engine := gin.New()
+	engine.Use(ResponseDelay())
+	engine.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	elapsed := func() time.Duration {
+		start := time.Now()
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		if recorder.Body.String() != "ok" {
+			t.Fatalf("unexpected body %q", recorder.Body.String())
+		}
+		return time.Since(start)
+	}
+
+	common.ResponseDelayEnabled, common.ResponseDelayMin, common.ResponseDelayMax = false, 200, 200
+	if d := elapsed(); d >= 200*time.Millisecond {
+		t.Errorf("delayed by %s while disabled", d)
+	}
+	common.ResponseDelayEnabled = true
+	if d := elapsed(); d < 200*time.Millisecond {
+		t.Errorf("fixed delay not applied, took %s", d)
+	}
+	common.ResponseDelayMin, common.ResponseDelayMax = 50, 100
+	for i := 0; i < 5; i++ {
+		if d := elapsed(); d < 50*time.Millisecond || d > 500*time.Millisecond {
+			t.Errorf("random delay out of range: %s", d)
+		}
+	}
+}
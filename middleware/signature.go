@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"one-api/common"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errSignatureUsed = errors.New("请求签名已被使用")
+
+// getRequestSignaturePrefix is what the client signs before the body: method, path, query and timestamp separated by newlines,
+// the query as sent by the client, without the retry ticket added by our retry redirects
+func getRequestSignaturePrefix(c *gin.Context, timestamp string) string {
+	return c.Request.Method + "\n" + c.Request.URL.Path + "\n" + common.StripRetryTicket(c.Request.URL.RawQuery) + "\n" + timestamp + "\n"
+}
+
+// verifyRequestSignature checks the X-Oneapi-Signature of a request sent with a token that has a secret,
+// the signature is "sha256=" and the hex HMAC-SHA256 of the payload, like the one of our outgoing webhooks
+func verifyRequestSignature(c *gin.Context, secret string) error {
+	signature := c.Request.Header.Get("X-Oneapi-Signature")
+	timestampStr := c.Request.Header.Get("X-Oneapi-Timestamp")
+	if signature == "" || timestampStr == "" {
+		return errors.New("该令牌要求请求签名，缺少 X-Oneapi-Signature 或 X-Oneapi-Timestamp 请求头")
+	}
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return errors.New("无效的 X-Oneapi-Timestamp")
+	}
+	skew := common.GetTimestamp() - timestamp
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > int64(common.RequestSignatureTolerance) {
+		return errors.New("请求签名已过期，请检查客户端时钟")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(getRequestSignaturePrefix(c, timestampStr)))
+	// the body is streamed, a spilled upload is not loaded into memory
+	if err := common.CopyBodyReusable(c, mac); err != nil {
+		return errors.New("无效的请求")
+	}
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.TrimPrefix(signature, "sha256="))) {
+		return errors.New("请求签名无效")
+	}
+	return checkSignatureReplay(strings.TrimPrefix(signature, "sha256="), common.GetRetryTicket(c), c.GetString(common.RequestIdKey))
+}
+
+// checkSignatureReplay accepts a signature once, our own retries replay it with the server signed ticket of the chain
+// the signature was first used in, and each attempt of the chain only once
+func checkSignatureReplay(signature string, ticket *common.RetryTicket, requestId string) error {
+	window := time.Duration(2*common.RequestSignatureTolerance) * time.Second
+	key := "requestSignature:" + signature
+	if ticket == nil {
+		ok, err := recordSignatureUse(key, requestId, window)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errSignatureUsed
+		}
+		return nil
+	}
+	chainId, err := getSignatureUse(key)
+	if err != nil {
+		return err
+	}
+	if chainId != ticket.ChainId {
+		return errSignatureUsed
+	}
+	ok, err := recordSignatureUse(key+":"+strconv.Itoa(ticket.Attempt), ticket.ChainId, window)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errSignatureUsed
+	}
+	return nil
+}
+
+type signatureUse struct {
+	key       string
+	expiresAt time.Time
+}
+
+// signatureUses remembers the signatures without Redis, signatureUseQueue holds them in the order they expire,
+// the window only changes with RequestSignatureTolerance, so expired ones are always at the front
+var signatureUses = make(map[string]string)
+var signatureUseQueue []signatureUse
+var signatureUsesLock sync.Mutex
+
+// recordSignatureUse stores value under key for the window and tells whether the key was unused,
+// errors fail closed, a signature that cannot be checked is not accepted
+func recordSignatureUse(key string, value string, window time.Duration) (bool, error) {
+	if common.RedisEnabled {
+		ok, err := common.RDB.SetNX(context.Background(), key, value, window).Result()
+		if err != nil {
+			common.SysError("failed to record request signature: " + err.Error())
+			return false, errors.New("无法校验请求签名，请稍后重试")
+		}
+		return ok, nil
+	}
+	now := time.Now()
+	signatureUsesLock.Lock()
+	defer signatureUsesLock.Unlock()
+	expireSignatureUses(now)
+	if _, ok := signatureUses[key]; ok {
+		return false, nil
+	}
+	signatureUses[key] = value
+	signatureUseQueue = append(signatureUseQueue, signatureUse{key: key, expiresAt: now.Add(window)})
+	return true, nil
+}
+
+func getSignatureUse(key string) (string, error) {
+	if common.RedisEnabled {
+		value, err := common.RDB.Get(context.Background(), key).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			common.SysError("failed to get request signature: " + err.Error())
+			return "", errors.New("无法校验请求签名，请稍后重试")
+		}
+		return value, nil
+	}
+	signatureUsesLock.Lock()
+	defer signatureUsesLock.Unlock()
+	expireSignatureUses(time.Now())
+	return signatureUses[key], nil
+}
+
+func expireSignatureUses(now time.Time) {
+	expired := 0
+	for expired < len(signatureUseQueue) && !signatureUseQueue[expired].expiresAt.After(now) {
+		delete(signatureUses, signatureUseQueue[expired].key)
+		expired++
+	}
+	signatureUseQueue = signatureUseQueue[expired:]
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testSignatureSecret = "secret"
+
+func sign(method string, path string, query string, timestamp string, body string) string {
+	mac := hmac.New(sha256.New, []byte(testSignatureSecret))
+	mac.Write([]byte(method + "\n" + path + "\n" + query + "\n" + timestamp + "\n" + body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newSignedContext(target string, body string, signature string, timestamp string, requestId string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	c.Request.Header.Set("X-Oneapi-Signature", signature)
+	c.Request.Header.Set("X-Oneapi-Timestamp", timestamp)
+	c.Set(common.RequestIdKey, requestId)
+	return c
+}
+
+func TestVerifyRequestSignature(t *testing.T) {
+	timestamp := strconv.FormatInt(common.GetTimestamp(), 10)
+	body := `{"model":"gpt-4o"}`
+	signature := sign(http.MethodPost, "/v1/chat/completions", "a=1", timestamp, body)
+
+	if err := verifyRequestSignature(newSignedContext("/v1/chat/completions?a=1", body, signature, timestamp, "first"), testSignatureSecret); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	if err := verifyRequestSignature(newSignedContext("/v1/chat/completions?a=1", body, signature, timestamp, "replay"), testSignatureSecret); err == nil {
+		t.Error("replayed signature accepted")
+	}
+	// the signature covers the path and the query
+	if err := verifyRequestSignature(newSignedContext("/v1/embeddings?a=1", body, signature, timestamp, "other"), testSignatureSecret); err == nil {
+		t.Error("signature accepted on another path")
+	}
+	if err := verifyRequestSignature(newSignedContext("/v1/chat/completions?a=2", body, signature, timestamp, "other"), testSignatureSecret); err == nil {
+		t.Error("signature accepted with another query")
+	}
+	stale := strconv.FormatInt(common.GetTimestamp()-int64(common.RequestSignatureTolerance)-10, 10)
+	if err := verifyRequestSignature(newSignedContext("/v1/chat/completions", body, sign(http.MethodPost, "/v1/chat/completions", "", stale, body), stale, "stale"), testSignatureSecret); err == nil {
+		t.Error("stale timestamp accepted")
+	}
+}
+
+func TestVerifyRequestSignatureRetry(t *testing.T) {
+	timestamp := strconv.FormatInt(common.GetTimestamp(), 10)
+	body := `{"model":"gpt-4o-mini"}`
+	signature := sign(http.MethodPost, "/v1/chat/completions", "", timestamp, body)
+	if err := verifyRequestSignature(newSignedContext("/v1/chat/completions", body, signature, timestamp, "chain"), testSignatureSecret); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	retry := func(ticket *common.RetryTicket) error {
+		c := newSignedContext("/v1/chat/completions?retry_ticket=x", body, signature, timestamp, "retry")
+		c.Set(common.RetryTicketKey, ticket)
+		return verifyRequestSignature(c, testSignatureSecret)
+	}
+	if err := retry(&common.RetryTicket{ChainId: "chain", Attempt: 1}); err != nil {
+		t.Fatalf("retry of the same chain rejected: %v", err)
+	}
+	if err := retry(&common.RetryTicket{ChainId: "chain", Attempt: 1}); err == nil {
+		t.Error("the same attempt accepted twice")
+	}
+	if err := retry(&common.RetryTicket{ChainId: "another", Attempt: 2}); err == nil {
+		t.Error("ticket of another chain accepted")
+	}
+}
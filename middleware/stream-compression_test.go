@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testStreamEvent = "data: {\"id\":\"chatcmpl-1\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hello\"}}]}\n\n"
+
+// decodeFlushed decodes what the client has received so far, a sync flushed gzip stream has no trailer yet
+func decodeFlushed(t testing.TB, compressed []byte) string {
+	t.Helper()
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+	return string(decoded)
+}
+
+func TestStreamCompression(t *testing.T) {
+	defer func(enabled bool) { common.StreamCompressionEnabled = enabled }(common.StreamCompressionEnabled)
+	common.StreamCompressionEnabled = true
+	recorder := httptest.NewRecorder()
+	var flushed []string
+	engine := gin.New()
+	engine.Use(StreamCompression())
+	engine.GET("/stream", func(c *gin.Context) {
+		c.Writer.Header().Set("Content-Type", "text/event-stream")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("X-Accel-Buffering", "no")
+		for i := 0; i < 3; i++ {
+			_, _ = c.Writer.WriteString(testStreamEvent)
+			c.Writer.Flush()
+			if c.Writer.Header().Get("Content-Encoding") == "gzip" {
+				flushed = append(flushed, decodeFlushed(t, recorder.Body.Bytes()))
+			}
+		}
+	})
+	engine.GET("/json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+	request := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	request.Header.Set("Accept-Encoding", "gzip, deflate")
+	engine.ServeHTTP(recorder, request)
+
+	header := recorder.Header()
+	if header.Get("Content-Encoding") != "gzip" || header.Get("X-Accel-Buffering") != "no" || header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("event stream headers %v", header)
+	}
+	for i, decoded := range flushed {
+		if want := bytes.Repeat([]byte(testStreamEvent), i+1); decoded != string(want) {
+			t.Errorf("after flush %d the client decoded %q", i+1, decoded)
+		}
+	}
+	if decoded := decodeFlushed(t, recorder.Body.Bytes()); decoded != string(bytes.Repeat([]byte(testStreamEvent), 3)) {
+		t.Errorf("the whole stream decoded to %q", decoded)
+	}
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodGet, "/json", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	engine.ServeHTTP(recorder, request)
+	if recorder.Header().Get("Content-Encoding") != "" || recorder.Body.String() != `{"success":true}` {
+		t.Errorf("JSON response compressed: %q", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if recorder.Header().Get("Content-Encoding") != "" {
+		t.Error("compressed for a client without gzip support")
+	}
+}
+
+// BenchmarkStreamEvent measures the cost of writing and flushing one event, the difference between
+// the two cases is the latency gzip adds to every chunk
+func BenchmarkStreamEvent(b *testing.B) {
+	for _, compressed := range []bool{false, true} {
+		name := "plain"
+		if compressed {
+			name = "gzip"
+		}
+		b.Run(name, func(b *testing.B) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Writer.Header().Set("Content-Type", "text/event-stream")
+			var writer gin.ResponseWriter = c.Writer
+			if compressed {
+				writer = &gzipStreamWriter{ResponseWriter: c.Writer}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = writer.WriteString(testStreamEvent)
+				writer.Flush()
+				if recorder.Body.Len() > 1<<20 {
+					recorder.Body.Reset()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"one-api/common"
+	"strconv"
+)
+
+// Trace starts a span for every relayed request when an OTLP endpoint is configured
+func Trace() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if common.OtelExporterEndpoint == "" {
+			c.Next()
+			return
+		}
+		ctx, span := common.StartServerSpan(c.Request.Context(), "relay "+c.Request.URL.Path, c.Request.Header.Get("traceparent"))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		span.SetAttribute("http.status_code", c.Writer.Status())
+		span.SetAttribute("model", c.GetString("request_model"))
+		span.SetAttribute("channel.id", c.GetInt("channel_id"))
+		if tokenId := c.GetInt("token_id"); tokenId != 0 {
+			span.SetAttribute("token.id_hash", hashTraceTokenId(tokenId))
+		}
+		span.SetFailed(c.Writer.Status() >= 400)
+		span.End()
+	}
+}
+
+// hashTraceTokenId keys the hash of the token id with SessionSecret, the id is enough to look up a key and
+// small sequential ids are reversed from a plain hash by trying them all
+func hashTraceTokenId(tokenId int) string {
+	mac := hmac.New(sha256.New, []byte(common.SessionSecret))
+	mac.Write([]byte(strconv.Itoa(tokenId)))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"one-api/common"
+	"testing"
+)
+
+func TestHashTraceTokenIdIsKeyed(t *testing.T) {
+	defer func(secret string) { common.SessionSecret = secret }(common.SessionSecret)
+	common.SessionSecret = "first"
+	hash := hashTraceTokenId(42)
+	if hashTraceTokenId(42) != hash || hashTraceTokenId(43) == hash {
+		t.Error("hash is not a stable per token value")
+	}
+	plain := sha256.Sum256([]byte("42"))
+	if hash == hex.EncodeToString(plain[:8]) {
+		t.Error("token id hashed without a key")
+	}
+	common.SessionSecret = "second"
+	if hashTraceTokenId(42) == hash {
+		t.Error("hash does not depend on the server secret")
+	}
+}
@@ -1,8 +1,11 @@
 package middleware
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"net/http"
 	"one-api/common"
+	"one-api/model"
 )
 
 func abortWithMessage(c *gin.Context, statusCode int, message string) {
@@ -15,3 +18,21 @@ func abortWithMessage(c *gin.Context, statusCode int, message string) {
 	c.Abort()
 	common.LogError(c.Request.Context(), message)
 }
+
+// abortWithAccessTerminated answers banned users with a non-retryable OpenAI style error,
+// before any quota or channel work is done
+func abortWithAccessTerminated(c *gin.Context, userId int) {
+	message := "用户已被封禁"
+	if common.SupportContact != "" {
+		message += "，如有疑问请联系 " + common.SupportContact
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"error": gin.H{
+			"message": common.MessageWithRequestId(message, c.GetString(common.RequestIdKey)),
+			"type":    "access_terminated",
+			"code":    "access_terminated",
+		},
+	})
+	c.Abort()
+	model.RecordLog(userId, model.LogTypeSystem, fmt.Sprintf("已封禁用户尝试访问 %s，IP：%s", c.Request.URL.Path, c.ClientIP()))
+}
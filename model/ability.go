@@ -1,8 +1,12 @@
 package model
 
 import (
+	"errors"
+	"gorm.io/gorm"
 	"one-api/common"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Ability struct {
@@ -13,7 +17,71 @@ type Ability struct {
 	Priority  *int64 `json:"priority" gorm:"bigint;default:0;index"`
 }
 
-func GetRandomSatisfiedChannel(group string, model string) (*Channel, error) {
+func GetRandomSatisfiedChannel(group string, model string, userId int) (*Channel, error) {
+	return GetRandomSatisfiedChannelForTier(group, model, userId, common.ServiceTierDefault)
+}
+
+// GetRandomSatisfiedChannelForTier prefers the channels of the service tier, see CacheGetRandomSatisfiedChannelForTier
+func GetRandomSatisfiedChannelForTier(group string, model string, userId int, tier string) (*Channel, error) {
+	return getRandomSatisfiedChannelForTier(group, model, userId, tier, nil)
+}
+
+// the service tier conditions of getRandomSatisfiedChannel
+const (
+	inChannelIds    = "channel_id in ?"
+	notInChannelIds = "channel_id not in ?"
+)
+
+// flexChannelIds caches the ids of the economy channels for the selection without the memory cache,
+// the channels changed on this node drop it, the others are seen after SyncFrequency
+var flexChannelIds []int
+var flexChannelIdsExpireAt time.Time
+var flexChannelIdsLock sync.Mutex
+
+func getFlexChannelIds() ([]int, error) {
+	flexChannelIdsLock.Lock()
+	defer flexChannelIdsLock.Unlock()
+	if time.Now().Before(flexChannelIdsExpireAt) {
+		return flexChannelIds, nil
+	}
+	var channelIds []int
+	err := DB.Model(&Channel{}).Where("service_tier = ?", common.ServiceTierFlex).Pluck("id", &channelIds).Error
+	if err != nil {
+		return nil, err
+	}
+	flexChannelIds = channelIds
+	flexChannelIdsExpireAt = time.Now().Add(time.Duration(common.SyncFrequency) * time.Second)
+	return flexChannelIds, nil
+}
+
+func invalidateFlexChannelIds() {
+	flexChannelIdsLock.Lock()
+	defer flexChannelIdsLock.Unlock()
+	flexChannelIdsExpireAt = time.Time{}
+}
+
+func getRandomSatisfiedChannelForTier(group string, model string, userId int, tier string, attempt *ChannelSelectionAttempt) (*Channel, error) {
+	flexChannelIds, err := getFlexChannelIds()
+	if err != nil {
+		return nil, err
+	}
+	if len(flexChannelIds) > 0 {
+		condition := notInChannelIds
+		if tier == common.ServiceTierFlex {
+			condition = inChannelIds
+		}
+		channel, err := getRandomSatisfiedChannel(group, model, userId, condition, flexChannelIds, attempt)
+		var maintenanceErr *ModelUnderMaintenanceError
+		if !errors.Is(err, gorm.ErrRecordNotFound) && !errors.As(err, &maintenanceErr) {
+			return channel, err
+		}
+	}
+	return getRandomSatisfiedChannel(group, model, userId, "", nil, attempt)
+}
+
+// getRandomSatisfiedChannel picks a channel among the abilities matching the extra condition, if any,
+// the candidates and the exclusions of the query are recorded in attempt when it is not nil
+func getRandomSatisfiedChannel(group string, model string, userId int, condition string, channelIds []int, attempt *ChannelSelectionAttempt) (*Channel, error) {
 	ability := Ability{}
 	groupCol := "`group`"
 	trueVal := "1"
@@ -24,12 +92,56 @@ func GetRandomSatisfiedChannel(group string, model string) (*Channel, error) {
 
 	var err error = nil
 	maxPrioritySubQuery := DB.Model(&Ability{}).Select("MAX(priority)").Where(groupCol+" = ? and model = ? and enabled = "+trueVal, group, model)
+	maintenanceChannelIds, maintenanceEndTime := getMaintenanceChannelIds(model)
+	if attempt != nil {
+		if err := attempt.traceAbilities(group, model, condition, channelIds, maintenanceChannelIds); err != nil {
+			return nil, err
+		}
+	}
+	if len(maintenanceChannelIds) > 0 {
+		maxPrioritySubQuery = maxPrioritySubQuery.Where("channel_id not in ?", maintenanceChannelIds)
+	}
+	if condition != "" {
+		maxPrioritySubQuery = maxPrioritySubQuery.Where(condition, channelIds)
+	}
 	channelQuery := DB.Where(groupCol+" = ? and model = ? and enabled = "+trueVal+" and priority = (?)", group, model, maxPrioritySubQuery)
-	if common.UsingSQLite || common.UsingPostgreSQL {
+	if condition != "" {
+		channelQuery = channelQuery.Where(condition, channelIds)
+	}
+	if len(maintenanceChannelIds) > 0 {
+		channelQuery = channelQuery.Where("channel_id not in ?", maintenanceChannelIds)
+	}
+	if common.ChannelAffinityEnabled && userId != 0 {
+		var abilities []Ability
+		err = channelQuery.Order("channel_id").Find(&abilities).Error
+		if err == nil && len(abilities) == 0 {
+			err = gorm.ErrRecordNotFound
+		}
+		if err == nil {
+			ability = abilities[getAffinityIndex(userId, len(abilities))]
+		}
+	} else if common.ChannelWeightDecayEnabled {
+		// the same adaptive weights as the memory cache
+		var channelIds []int
+		err = channelQuery.Model(&Ability{}).Pluck("channel_id", &channelIds).Error
+		var channels []*Channel
+		if err == nil {
+			err = DB.Where("id in ?", channelIds).Find(&channels).Error
+		}
+		if err == nil && len(channels) == 0 {
+			err = gorm.ErrRecordNotFound
+		}
+		if err == nil {
+			return pickWeightedChannel(channels), nil
+		}
+	} else if common.UsingSQLite || common.UsingPostgreSQL {
 		err = channelQuery.Order("RANDOM()").First(&ability).Error
 	} else {
 		err = channelQuery.Order("RAND()").First(&ability).Error
 	}
+	if errors.Is(err, gorm.ErrRecordNotFound) && len(maintenanceChannelIds) > 0 {
+		return nil, &ModelUnderMaintenanceError{EndTime: maintenanceEndTime}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -82,3 +194,12 @@ func (channel *Channel) UpdateAbilities() error {
 func UpdateAbilityStatus(channelId int, status bool) error {
 	return DB.Model(&Ability{}).Where("channel_id = ?", channelId).Select("enabled").Update("enabled", status).Error
 }
+
+func GetEnabledChannelIdsByModel(model string) (channelIds []int, err error) {
+	trueVal := "1"
+	if common.UsingPostgreSQL {
+		trueVal = "true"
+	}
+	err = DB.Model(&Ability{}).Distinct("channel_id").Where("model = ? and enabled = "+trueVal, model).Pluck("channel_id", &channelIds).Error
+	return channelIds, err
+}
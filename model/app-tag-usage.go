@@ -0,0 +1,43 @@
+package model
+
+import "sync"
+
+// AppTagUsage counts the consumption of an app tag since startup
+type AppTagUsage struct {
+	Requests         int `json:"requests"`
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	Quota            int `json:"quota"`
+}
+
+// appTagUsages is keyed by the app tag, the middleware already bounds its cardinality
+var appTagUsages = map[string]*AppTagUsage{}
+var appTagUsagesLock sync.Mutex
+
+func addAppTagUsage(appTag string, promptTokens int, completionTokens int, quota int) {
+	if appTag == "" {
+		return
+	}
+	appTagUsagesLock.Lock()
+	defer appTagUsagesLock.Unlock()
+	usage, ok := appTagUsages[appTag]
+	if !ok {
+		usage = &AppTagUsage{}
+		appTagUsages[appTag] = usage
+	}
+	usage.Requests++
+	usage.PromptTokens += promptTokens
+	usage.CompletionTokens += completionTokens
+	usage.Quota += quota
+}
+
+// GetAppTagUsages returns a copy of the counters of every app tag
+func GetAppTagUsages() map[string]AppTagUsage {
+	appTagUsagesLock.Lock()
+	defer appTagUsagesLock.Unlock()
+	usages := make(map[string]AppTagUsage, len(appTagUsages))
+	for appTag, usage := range appTagUsages {
+		usages[appTag] = *usage
+	}
+	return usages
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"one-api/common"
 	"sort"
@@ -50,6 +51,17 @@ func CacheGetTokenByKey(key string) (*Token, error) {
 	return &token, err
 }
 
+// InvalidateTokenCache drops the cached token so changes to it take effect on the next request
+func InvalidateTokenCache(key string) {
+	if !common.RedisEnabled || key == "" {
+		return
+	}
+	err := common.RedisDel(fmt.Sprintf("token:%s", key))
+	if err != nil {
+		common.SysError("Redis delete token error: " + err.Error())
+	}
+}
+
 func CacheGetUserGroup(id int) (group string, err error) {
 	if !common.RedisEnabled {
 		return GetUserGroup(id)
@@ -68,6 +80,123 @@ func CacheGetUserGroup(id int) (group string, err error) {
 	return group, err
 }
 
+type cachedUserDiscount struct {
+	discount  float64
+	expiresAt time.Time
+}
+
+// userDiscounts caches the discounts in memory when Redis is disabled, one entry per user
+var userDiscounts = make(map[int]cachedUserDiscount)
+var userDiscountsLock sync.RWMutex
+
+// CacheGetUserDiscount never fails, billing falls back to no discount
+func CacheGetUserDiscount(id int) float64 {
+	if !common.RedisEnabled {
+		userDiscountsLock.RLock()
+		cached, ok := userDiscounts[id]
+		userDiscountsLock.RUnlock()
+		if ok && time.Now().Before(cached.expiresAt) {
+			return cached.discount
+		}
+		discount, err := GetUserDiscount(id)
+		if err != nil {
+			common.SysError("failed to get user discount: " + err.Error())
+			return discount
+		}
+		userDiscountsLock.Lock()
+		userDiscounts[id] = cachedUserDiscount{discount: discount, expiresAt: time.Now().Add(time.Duration(UserId2GroupCacheSeconds) * time.Second)}
+		userDiscountsLock.Unlock()
+		return discount
+	}
+	discountString, err := common.RedisGet(fmt.Sprintf("user_discount:%d", id))
+	if err == nil {
+		if discount, err := strconv.ParseFloat(discountString, 64); err == nil && discount > 0 {
+			return discount
+		}
+	}
+	discount, err := GetUserDiscount(id)
+	if err != nil {
+		common.SysError("failed to get user discount: " + err.Error())
+		return discount
+	}
+	err = common.RedisSet(fmt.Sprintf("user_discount:%d", id), strconv.FormatFloat(discount, 'f', -1, 64), time.Duration(UserId2GroupCacheSeconds)*time.Second)
+	if err != nil {
+		common.SysError("Redis set user discount error: " + err.Error())
+	}
+	return discount
+}
+
+// CacheDeleteUserDiscount drops the cached discount after an admin changed it
+func CacheDeleteUserDiscount(id int) error {
+	userDiscountsLock.Lock()
+	delete(userDiscounts, id)
+	userDiscountsLock.Unlock()
+	if !common.RedisEnabled {
+		return nil
+	}
+	return common.RedisDel(fmt.Sprintf("user_discount:%d", id))
+}
+
+type cachedUserRole struct {
+	role      int
+	expiresAt time.Time
+}
+
+// userRoles caches the roles in memory when Redis is disabled, one entry per user
+var userRoles = make(map[int]cachedUserRole)
+var userRolesLock sync.RWMutex
+
+// CacheIsAdmin tells whether the user is an admin without hitting the database on every call
+func CacheIsAdmin(id int) bool {
+	if id == 0 {
+		return false
+	}
+	if !common.RedisEnabled {
+		userRolesLock.RLock()
+		cached, ok := userRoles[id]
+		userRolesLock.RUnlock()
+		if ok && time.Now().Before(cached.expiresAt) {
+			return cached.role >= common.RoleAdminUser
+		}
+		role, err := GetUserRole(id)
+		if err != nil {
+			common.SysError("failed to get user role: " + err.Error())
+			return false
+		}
+		userRolesLock.Lock()
+		userRoles[id] = cachedUserRole{role: role, expiresAt: time.Now().Add(time.Duration(UserId2StatusCacheSeconds) * time.Second)}
+		userRolesLock.Unlock()
+		return role >= common.RoleAdminUser
+	}
+	roleString, err := common.RedisGet(fmt.Sprintf("user_role:%d", id))
+	if err == nil {
+		if role, err := strconv.Atoi(roleString); err == nil {
+			return role >= common.RoleAdminUser
+		}
+	}
+	role, err := GetUserRole(id)
+	if err != nil {
+		common.SysError("failed to get user role: " + err.Error())
+		return false
+	}
+	err = common.RedisSet(fmt.Sprintf("user_role:%d", id), strconv.Itoa(role), time.Duration(UserId2StatusCacheSeconds)*time.Second)
+	if err != nil {
+		common.SysError("Redis set user role error: " + err.Error())
+	}
+	return role >= common.RoleAdminUser
+}
+
+// CacheDeleteUserRole drops the cached role after the user was promoted, demoted or deleted
+func CacheDeleteUserRole(id int) error {
+	userRolesLock.Lock()
+	delete(userRoles, id)
+	userRolesLock.Unlock()
+	if !common.RedisEnabled {
+		return nil
+	}
+	return common.RedisDel(fmt.Sprintf("user_role:%d", id))
+}
+
 func CacheGetUserQuota(id int) (quota int, err error) {
 	if !common.RedisEnabled {
 		return GetUserQuota(id)
@@ -189,16 +318,62 @@ func SyncChannelCache(frequency int) {
 	}
 }
 
-func CacheGetRandomSatisfiedChannel(group string, model string) (*Channel, error) {
+// getAffinityIndex maps a user to a stable index in [0, n), so the user keeps hitting the same channel
+func getAffinityIndex(userId int, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(strconv.Itoa(userId)))
+	return int(h.Sum32() % uint32(n))
+}
+
+func CacheGetRandomSatisfiedChannel(group string, model string, userId int) (*Channel, error) {
+	return CacheGetRandomSatisfiedChannelForTier(group, model, userId, common.ServiceTierDefault)
+}
+
+// filterServiceTierChannels keeps the channels of the service tier, or all of them when none is in the tier
+func filterServiceTierChannels(channels []*Channel, tier string) []*Channel {
+	var matched []*Channel
+	for _, channel := range channels {
+		if channel.GetServiceTier() == tier {
+			matched = append(matched, channel)
+		}
+	}
+	if len(matched) == 0 {
+		return channels
+	}
+	return matched
+}
+
+// CacheGetRandomSatisfiedChannelForTier prefers the channels of the service tier, flex requests go to economy channels
+// and the other requests avoid them
+func CacheGetRandomSatisfiedChannelForTier(group string, model string, userId int, tier string) (*Channel, error) {
+	return selectChannel(group, model, userId, tier, nil)
+}
+
+// selectChannel picks a channel of the group serving the model, the decisions are recorded in attempt when it is not nil
+func selectChannel(group string, model string, userId int, tier string, attempt *ChannelSelectionAttempt) (*Channel, error) {
 	if !common.MemoryCacheEnabled {
-		return GetRandomSatisfiedChannel(group, model)
+		attempt.setStrategy(ChannelSelectionStrategyDatabase)
+		return getRandomSatisfiedChannelForTier(group, model, userId, tier, attempt)
 	}
 	channelSyncLock.RLock()
 	defer channelSyncLock.RUnlock()
 	channels := group2model2channels[group][model]
+	attempt.add(channels)
 	if len(channels) == 0 {
 		return nil, errors.New("channel not found")
 	}
+	available, maintenanceEndTime := filterMaintenanceChannels(channels, model)
+	attempt.exclude(channels, available, ChannelExcludedMaintenance)
+	channels = available
+	if len(channels) == 0 {
+		return nil, &ModelUnderMaintenanceError{EndTime: maintenanceEndTime}
+	}
+	available = filterServiceTierChannels(channels, tier)
+	attempt.exclude(channels, available, ChannelExcludedServiceTier)
+	channels = available
+	available = filterBelowSLOChannels(channels)
+	attempt.exclude(channels, available, ChannelExcludedBelowSLO)
+	channels = available
 	endIdx := len(channels)
 	// choose by priority
 	firstChannel := channels[0]
@@ -210,6 +385,24 @@ func CacheGetRandomSatisfiedChannel(group string, model string) (*Channel, error
 			}
 		}
 	}
-	idx := rand.Intn(endIdx)
-	return channels[idx], nil
+	attempt.exclude(channels, channels[:endIdx], ChannelExcludedLowerPriority)
+	candidates := filterNearlyExhaustedChannels(channels[:endIdx])
+	attempt.exclude(channels[:endIdx], candidates, ChannelExcludedNearlyExhausted)
+	if common.ChannelAffinityEnabled && userId != 0 {
+		attempt.setStrategy(ChannelSelectionStrategyAffinity)
+		// channels are sorted by priority only, sort the candidates by id to keep the mapping stable
+		sorted := make([]*Channel, len(candidates))
+		copy(sorted, candidates)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].Id < sorted[j].Id
+		})
+		return sorted[getAffinityIndex(userId, len(sorted))], nil
+	}
+	if common.ChannelWeightDecayEnabled {
+		attempt.setStrategy(ChannelSelectionStrategyWeighted)
+		return pickWeightedChannel(candidates), nil
+	}
+	attempt.setStrategy(ChannelSelectionStrategyRandom)
+	idx := rand.Intn(len(candidates))
+	return candidates[idx], nil
 }
@@ -0,0 +1,105 @@
+package model
+
+import (
+	"errors"
+	"one-api/common"
+)
+
+// Canary is a synthetic request scheduled against a specific channel and model.
+type Canary struct {
+	Id        int    `json:"id"`
+	ChannelId int    `json:"channel_id" gorm:"index"`
+	Model     string `json:"model"`
+	Prompt    string `json:"prompt"`
+	Interval  int    `json:"interval" gorm:"default:10"` // in minutes
+	Status    int    `json:"status" gorm:"default:1"`
+	// like Token.AccurateCount, never use approximate token counting for the attributed quota
+	AccurateCount bool  `json:"accurate_count" gorm:"default:false"`
+	CreatedTime   int64 `json:"created_time" gorm:"bigint"`
+	LastRunTime   int64 `json:"last_run_time" gorm:"bigint"`
+}
+
+type CanaryResult struct {
+	Id             int    `json:"id"`
+	CanaryId       int    `json:"canary_id" gorm:"index"`
+	ChannelId      int    `json:"channel_id" gorm:"index:idx_canary_result_channel_model,priority:1"`
+	Model          string `json:"model" gorm:"index:idx_canary_result_channel_model,priority:2"`
+	CreatedAt      int64  `json:"created_at" gorm:"bigint;index"`
+	Success        bool   `json:"success"`
+	Latency        int    `json:"latency"`          // in milliseconds
+	FirstTokenTime int    `json:"first_token_time"` // in milliseconds
+	Message        string `json:"message"`
+}
+
+type CanarySummary struct {
+	ChannelId         int     `json:"channel_id"`
+	Model             string  `json:"model"`
+	Total             int     `json:"total"`
+	SuccessCount      int     `json:"success_count"`
+	AvgLatency        float64 `json:"avg_latency"`
+	AvgFirstTokenTime float64 `json:"avg_first_token_time"`
+	LastCreatedAt     int64   `json:"last_created_at"`
+}
+
+func GetAllCanaries() (canaries []*Canary, err error) {
+	err = DB.Order("id desc").Find(&canaries).Error
+	return canaries, err
+}
+
+func GetEnabledCanaries() (canaries []*Canary, err error) {
+	err = DB.Where("status = ?", common.CanaryStatusEnabled).Find(&canaries).Error
+	return canaries, err
+}
+
+func GetCanaryById(id int) (*Canary, error) {
+	if id == 0 {
+		return nil, errors.New("id 为空！")
+	}
+	canary := Canary{Id: id}
+	err := DB.First(&canary, "id = ?", id).Error
+	return &canary, err
+}
+
+func (canary *Canary) Insert() error {
+	return DB.Create(canary).Error
+}
+
+func (canary *Canary) Update() error {
+	return DB.Model(canary).Select("channel_id", "model", "prompt", "interval", "status", "accurate_count").Updates(canary).Error
+}
+
+func (canary *Canary) UpdateLastRunTime(timestamp int64) {
+	err := DB.Model(canary).Update("last_run_time", timestamp).Error
+	if err != nil {
+		common.SysError("failed to update canary last run time: " + err.Error())
+	}
+}
+
+func (canary *Canary) Delete() error {
+	return DB.Delete(canary).Error
+}
+
+func RecordCanaryResult(result *CanaryResult) {
+	result.CreatedAt = common.GetTimestamp()
+	err := DB.Create(result).Error
+	if err != nil {
+		common.SysError("failed to record canary result: " + err.Error())
+	}
+}
+
+func GetCanarySummaries(startTimestamp int64) (summaries []*CanarySummary, err error) {
+	trueVal := "1"
+	if common.UsingPostgreSQL {
+		trueVal = "true"
+	}
+	err = DB.Table("canary_results").
+		Select("channel_id, model, count(*) as total, "+
+			"sum(case when success = "+trueVal+" then 1 else 0 end) as success_count, "+
+			"avg(latency) as avg_latency, avg(first_token_time) as avg_first_token_time, "+
+			"max(created_at) as last_created_at").
+		Where("created_at >= ?", startTimestamp).
+		Group("channel_id, model").
+		Order("channel_id, model").
+		Scan(&summaries).Error
+	return summaries, err
+}
@@ -0,0 +1,152 @@
+package model
+
+import (
+	"errors"
+	"one-api/common"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ChannelDailyUsage is the per-day rollup of the quota consumed through a channel, days start at 00:00 UTC
+type ChannelDailyUsage struct {
+	Id        int   `json:"id"`
+	ChannelId int   `json:"channel_id" gorm:"uniqueIndex:idx_channel_daily_usage,priority:1"`
+	Day       int64 `json:"day" gorm:"bigint;uniqueIndex:idx_channel_daily_usage,priority:2;index"` // start of the day
+	Quota     int64 `json:"quota" gorm:"bigint;default:0"`
+	Requests  int   `json:"requests" gorm:"default:0"`
+}
+
+type channelDayKey struct {
+	channelId int
+	day       int64
+}
+
+// pendingChannelUsages are accumulated in memory and flushed by SyncChannelDailyUsages,
+// so the rollup costs one write per channel and day per flush instead of one per request
+var pendingChannelUsages = make(map[channelDayKey]*ChannelDailyUsage)
+var pendingChannelUsagesLock sync.Mutex
+
+func getDayStart(timestamp int64) int64 {
+	return timestamp - timestamp%(24*3600)
+}
+
+func recordChannelDailyUsage(channelId int, quota int) {
+	if channelId == 0 {
+		return
+	}
+	key := channelDayKey{channelId: channelId, day: getDayStart(common.GetTimestamp())}
+	pendingChannelUsagesLock.Lock()
+	defer pendingChannelUsagesLock.Unlock()
+	usage, ok := pendingChannelUsages[key]
+	if !ok {
+		usage = &ChannelDailyUsage{ChannelId: channelId, Day: key.day}
+		pendingChannelUsages[key] = usage
+	}
+	usage.Quota += int64(quota)
+	usage.Requests++
+}
+
+// FlushChannelDailyUsages adds the pending counters to the rollup table, a counter that fails to be written
+// is put back and retried with the next flush
+func FlushChannelDailyUsages() {
+	pendingChannelUsagesLock.Lock()
+	usages := pendingChannelUsages
+	pendingChannelUsages = make(map[channelDayKey]*ChannelDailyUsage)
+	pendingChannelUsagesLock.Unlock()
+	for key, usage := range usages {
+		// a single upsert, concurrent flushes of several nodes never race on the insert
+		err := DB.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "channel_id"}, {Name: "day"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"quota":    gorm.Expr("channel_daily_usages.quota + ?", usage.Quota),
+				"requests": gorm.Expr("channel_daily_usages.requests + ?", usage.Requests),
+			}),
+		}).Create(&ChannelDailyUsage{ChannelId: usage.ChannelId, Day: usage.Day, Quota: usage.Quota, Requests: usage.Requests}).Error
+		if err != nil {
+			common.SysError("failed to flush channel daily usage: " + err.Error())
+			requeueChannelDailyUsage(key, usage)
+		}
+	}
+}
+
+func requeueChannelDailyUsage(key channelDayKey, usage *ChannelDailyUsage) {
+	pendingChannelUsagesLock.Lock()
+	defer pendingChannelUsagesLock.Unlock()
+	if pending, ok := pendingChannelUsages[key]; ok {
+		pending.Quota += usage.Quota
+		pending.Requests += usage.Requests
+		return
+	}
+	pendingChannelUsages[key] = usage
+}
+
+// SyncChannelDailyUsages flushes the channel usage counters to the rollup table
+func SyncChannelDailyUsages() {
+	for {
+		time.Sleep(time.Minute)
+		FlushChannelDailyUsages()
+	}
+}
+
+// GetChannelDailyUsages returns the rollups of the days in [startTimestamp, endTimestamp],
+// channelId 0 means all channels
+func GetChannelDailyUsages(channelId int, startTimestamp int64, endTimestamp int64) (usages []*ChannelDailyUsage, err error) {
+	tx := DB.Where("day >= ?", getDayStart(startTimestamp))
+	if endTimestamp != 0 {
+		tx = tx.Where("day <= ?", endTimestamp)
+	}
+	if channelId != 0 {
+		tx = tx.Where("channel_id = ?", channelId)
+	}
+	err = tx.Order("day, channel_id").Find(&usages).Error
+	return usages, err
+}
+
+// GetTopChannelIds returns the channels with the most requests in the rollups since startTimestamp,
+// the rollup table is small, unlike the logs it is cheap to query from every node
+func GetTopChannelIds(num int, startTimestamp int64) (channelIds []int, err error) {
+	err = DB.Model(&ChannelDailyUsage{}).
+		Select("channel_id").
+		Where("day >= ?", getDayStart(startTimestamp)).
+		Group("channel_id").
+		Order("sum(requests) desc").
+		Limit(num).
+		Pluck("channel_id", &channelIds).Error
+	return channelIds, err
+}
+
+// BackfillChannelDailyUsages rebuilds the rollups of the days in [startTimestamp, endTimestamp] from the consume logs,
+// the current day is still being written by the relay and is never rebuilt
+func BackfillChannelDailyUsages(startTimestamp int64, endTimestamp int64) (int, error) {
+	startDay := getDayStart(startTimestamp)
+	endDay := getDayStart(common.GetTimestamp())
+	if endTimestamp != 0 && getDayStart(endTimestamp)+24*3600 < endDay {
+		endDay = getDayStart(endTimestamp) + 24*3600
+	}
+	if startDay >= endDay {
+		return 0, errors.New("没有可回填的日期")
+	}
+	var usages []*ChannelDailyUsage
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Table("logs").
+			Select("channel_id, created_at - created_at % 86400 as day, sum(quota) as quota, count(*) as requests").
+			Where("type = ? and channel_id <> 0 and created_at >= ? and created_at < ?", LogTypeConsume, startDay, endDay).
+			Group("channel_id, created_at - created_at % 86400").
+			Scan(&usages).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("day >= ? and day < ?", startDay, endDay).Delete(&ChannelDailyUsage{}).Error
+		if err != nil {
+			return err
+		}
+		if len(usages) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(usages, 100).Error
+	})
+	return len(usages), err
+}
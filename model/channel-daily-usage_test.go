@@ -0,0 +1,41 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestFlushChannelDailyUsages(t *testing.T) {
+	recordChannelDailyUsage(901, 100)
+	recordChannelDailyUsage(901, 50)
+	FlushChannelDailyUsages()
+	recordChannelDailyUsage(901, 25)
+	FlushChannelDailyUsages()
+	usages, err := GetChannelDailyUsages(901, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 1 || usages[0].Quota != 175 || usages[0].Requests != 3 {
+		t.Fatalf("flushes not added up: %+v", usages)
+	}
+}
+
+func TestFlushChannelDailyUsagesRequeuesOnFailure(t *testing.T) {
+	recordChannelDailyUsage(902, 10)
+	// a failed write keeps the counter for the next flush
+	if err := DB.Migrator().RenameTable(&ChannelDailyUsage{}, "channel_daily_usages_moved"); err != nil {
+		t.Fatal(err)
+	}
+	FlushChannelDailyUsages()
+	if err := DB.Migrator().RenameTable("channel_daily_usages_moved", &ChannelDailyUsage{}); err != nil {
+		t.Fatal(err)
+	}
+	recordChannelDailyUsage(902, 5)
+	FlushChannelDailyUsages()
+	usages, err := GetChannelDailyUsages(902, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 1 || usages[0].Quota != 15 || usages[0].Requests != 2 {
+		t.Fatalf("failed flush lost usage: %+v", usages)
+	}
+}
@@ -0,0 +1,134 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"one-api/common"
+	"sync"
+	"time"
+)
+
+const (
+	nearlyExhaustedRemainingRequests = 1
+	nearlyExhaustedRemainingTokens   = 1000
+	// remaining values reported without a reset time are trusted this long
+	channelRateLimitDefaultTTL = time.Minute
+)
+
+// ChannelRateLimit is the latest rate limit state reported by the upstream through
+// the x-ratelimit-* response headers, fields are nil when the provider does not send them
+type ChannelRateLimit struct {
+	LimitRequests     *int   `json:"limit_requests"`
+	LimitTokens       *int   `json:"limit_tokens"`
+	RemainingRequests *int   `json:"remaining_requests"`
+	RemainingTokens   *int   `json:"remaining_tokens"`
+	ResetRequestsAt   *int64 `json:"reset_requests_at"` // in milliseconds
+	ResetTokensAt     *int64 `json:"reset_tokens_at"`   // in milliseconds
+	UpdatedAt         int64  `json:"updated_at"`
+}
+
+// channelRateLimits holds the state in memory when Redis is disabled, with Redis it is shared by all nodes
+var channelRateLimits = map[int]*ChannelRateLimit{}
+var channelRateLimitsLock sync.RWMutex
+
+func getChannelRateLimitKey(channelId int) string {
+	return fmt.Sprintf("channel_rate_limit:%d", channelId)
+}
+
+// SetChannelRateLimit stores the latest state of the channel, remaining values without a reset time
+// expire after channelRateLimitDefaultTTL, so a single low value does not hold the channel back for good
+func SetChannelRateLimit(channelId int, rateLimit *ChannelRateLimit) {
+	now := time.Now()
+	defaultResetAt := now.Add(channelRateLimitDefaultTTL).UnixMilli()
+	if rateLimit.RemainingRequests != nil && rateLimit.ResetRequestsAt == nil {
+		rateLimit.ResetRequestsAt = &defaultResetAt
+	}
+	if rateLimit.RemainingTokens != nil && rateLimit.ResetTokensAt == nil {
+		rateLimit.ResetTokensAt = &defaultResetAt
+	}
+	if !common.RedisEnabled {
+		channelRateLimitsLock.Lock()
+		defer channelRateLimitsLock.Unlock()
+		channelRateLimits[channelId] = rateLimit
+		return
+	}
+	// the key outlives the latest reset, the limits alone are not worth keeping longer
+	expiration := channelRateLimitDefaultTTL
+	for _, resetAt := range []*int64{rateLimit.ResetRequestsAt, rateLimit.ResetTokensAt} {
+		if resetAt != nil && time.UnixMilli(*resetAt).Sub(now) > expiration {
+			expiration = time.UnixMilli(*resetAt).Sub(now)
+		}
+	}
+	jsonBytes, err := json.Marshal(rateLimit)
+	if err == nil {
+		err = common.RedisSet(getChannelRateLimitKey(channelId), string(jsonBytes), expiration)
+	}
+	if err != nil {
+		common.SysError("Redis set channel rate limit error: " + err.Error())
+	}
+}
+
+func loadChannelRateLimit(channelId int) *ChannelRateLimit {
+	if !common.RedisEnabled {
+		channelRateLimitsLock.RLock()
+		defer channelRateLimitsLock.RUnlock()
+		return channelRateLimits[channelId]
+	}
+	jsonString, err := common.RedisGet(getChannelRateLimitKey(channelId))
+	if err != nil {
+		return nil
+	}
+	var rateLimit ChannelRateLimit
+	if err := json.Unmarshal([]byte(jsonString), &rateLimit); err != nil {
+		common.SysError("failed to unmarshal channel rate limit: " + err.Error())
+		return nil
+	}
+	return &rateLimit
+}
+
+// GetChannelRateLimit returns a copy of the channel's rate limit state, values whose reset time has passed are dropped
+func GetChannelRateLimit(channelId int) *ChannelRateLimit {
+	rateLimit := loadChannelRateLimit(channelId)
+	if rateLimit == nil {
+		return nil
+	}
+	result := *rateLimit
+	now := time.Now().UnixMilli()
+	if result.ResetRequestsAt != nil && *result.ResetRequestsAt <= now {
+		result.RemainingRequests = nil
+		result.ResetRequestsAt = nil
+	}
+	if result.ResetTokensAt != nil && *result.ResetTokensAt <= now {
+		result.RemainingTokens = nil
+		result.ResetTokensAt = nil
+	}
+	return &result
+}
+
+func IsChannelNearlyExhausted(channelId int) bool {
+	rateLimit := GetChannelRateLimit(channelId)
+	if rateLimit == nil {
+		return false
+	}
+	if rateLimit.RemainingRequests != nil && *rateLimit.RemainingRequests <= nearlyExhaustedRemainingRequests {
+		return true
+	}
+	if rateLimit.RemainingTokens != nil && *rateLimit.RemainingTokens <= nearlyExhaustedRemainingTokens {
+		return true
+	}
+	return false
+}
+
+// filterNearlyExhaustedChannels drops channels close to their upstream rate limit, unless all of them are
+func filterNearlyExhaustedChannels(channels []*Channel) []*Channel {
+	var available []*Channel
+	for _, channel := range channels {
+		if !IsChannelNearlyExhausted(channel.Id) {
+			available = append(available, channel)
+		}
+	}
+	if len(available) == 0 {
+		return channels
+	}
+	return available
+}
@@ -0,0 +1,82 @@
+package model
+
+import (
+	"one-api/common"
+	"testing"
+	"time"
+)
+
+func clearChannelRateLimit(channelId int) {
+	channelRateLimitsLock.Lock()
+	defer channelRateLimitsLock.Unlock()
+	delete(channelRateLimits, channelId)
+}
+
+func TestNearlyExhaustedChannelsAreDeprioritized(t *testing.T) {
+	exhausted := createSelectionChannel(t, "exhausted", "sim-ratelimit", "default", 0, common.ChannelStatusEnabled)
+	fresh := createSelectionChannel(t, "fresh", "sim-ratelimit", "default", 0, common.ChannelStatusEnabled)
+	remaining, resetAt := 0, time.Now().Add(time.Minute).UnixMilli()
+	SetChannelRateLimit(exhausted.Id, &ChannelRateLimit{RemainingRequests: &remaining, ResetRequestsAt: &resetAt})
+	defer clearChannelRateLimit(exhausted.Id)
+	defer func(enabled bool) {
+		common.MemoryCacheEnabled = enabled
+		InitChannelCache()
+	}(common.MemoryCacheEnabled)
+	common.MemoryCacheEnabled = true
+	InitChannelCache()
+	for i := 0; i < 20; i++ {
+		channel, err := CacheGetRandomSatisfiedChannel("default", "sim-ratelimit", 0)
+		if err != nil || channel.Id != fresh.Id {
+			t.Fatalf("selected %v, %v instead of the channel with quota left", channel, err)
+		}
+	}
+	// unless every channel is nearly exhausted
+	SetChannelRateLimit(fresh.Id, &ChannelRateLimit{RemainingRequests: &remaining, ResetRequestsAt: &resetAt})
+	defer clearChannelRateLimit(fresh.Id)
+	if _, err := CacheGetRandomSatisfiedChannel("default", "sim-ratelimit", 0); err != nil {
+		t.Errorf("no channel selected while all are exhausted: %v", err)
+	}
+}
+
+func TestChannelRateLimitAgesOut(t *testing.T) {
+	const channelId = 161
+	remainingRequests, remainingTokens := 0, 0
+	passed, pending := time.Now().Add(-time.Second).UnixMilli(), time.Now().Add(time.Minute).UnixMilli()
+	SetChannelRateLimit(channelId, &ChannelRateLimit{RemainingRequests: &remainingRequests, ResetRequestsAt: &passed,
+		RemainingTokens: &remainingTokens, ResetTokensAt: &pending})
+	defer clearChannelRateLimit(channelId)
+	rateLimit := GetChannelRateLimit(channelId)
+	if rateLimit.RemainingRequests != nil || rateLimit.ResetRequestsAt != nil {
+		t.Errorf("remaining requests kept after their reset: %v", *rateLimit.RemainingRequests)
+	}
+	if rateLimit.RemainingTokens == nil || !IsChannelNearlyExhausted(channelId) {
+		t.Error("remaining tokens dropped before their reset")
+	}
+	passedTokens := passed
+	SetChannelRateLimit(channelId, &ChannelRateLimit{RemainingTokens: &remainingTokens, ResetTokensAt: &passedTokens})
+	if IsChannelNearlyExhausted(channelId) {
+		t.Error("channel still exhausted after the reset time passed")
+	}
+}
+
+func TestChannelRateLimitWithoutResetExpires(t *testing.T) {
+	const channelId = 1610
+	remaining := 0
+	SetChannelRateLimit(channelId, &ChannelRateLimit{RemainingRequests: &remaining})
+	defer clearChannelRateLimit(channelId)
+	if !IsChannelNearlyExhausted(channelId) {
+		t.Fatal("low remaining requests ignored")
+	}
+	// the value ages out like one sent with a reset time
+	rateLimit := GetChannelRateLimit(channelId)
+	if rateLimit.ResetRequestsAt == nil || time.UnixMilli(*rateLimit.ResetRequestsAt).After(time.Now().Add(channelRateLimitDefaultTTL)) {
+		t.Fatalf("remaining requests kept without expiry: %v", rateLimit.ResetRequestsAt)
+	}
+	passed := time.Now().Add(-time.Second).UnixMilli()
+	channelRateLimitsLock.Lock()
+	channelRateLimits[channelId].ResetRequestsAt = &passed
+	channelRateLimitsLock.Unlock()
+	if IsChannelNearlyExhausted(channelId) {
+		t.Error("channel still exhausted after the default expiry")
+	}
+}
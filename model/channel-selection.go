@@ -0,0 +1,350 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"one-api/common"
+	"strings"
+)
+
+// reasons a channel is left out of the selection
+const (
+	ChannelExcludedDisabled        = "disabled"
+	ChannelExcludedGroupMismatch   = "group_mismatch"
+	ChannelExcludedMaintenance     = "maintenance"
+	ChannelExcludedServiceTier     = "service_tier"
+	ChannelExcludedBelowSLO        = "below_slo"
+	ChannelExcludedLowerPriority   = "lower_priority"
+	ChannelExcludedNearlyExhausted = "nearly_exhausted" // close to the upstream rate limit
+)
+
+const (
+	ChannelSelectionStrategyAffinity = "affinity"
+	ChannelSelectionStrategyWeighted = "weighted"
+	ChannelSelectionStrategyRandom   = "random"
+	ChannelSelectionStrategyDatabase = "database" // memory cache disabled, the selection is a database query
+)
+
+// ModelDisabledError is returned for the models listed in DisabledModels
+type ModelDisabledError struct {
+	Model string
+}
+
+func (e *ModelDisabledError) Error() string {
+	return fmt.Sprintf("model %s is disabled", e.Model)
+}
+
+// ChannelSelectionRequest is what the channel selection of a relay request depends on
+type ChannelSelectionRequest struct {
+	Group       string
+	Model       string
+	UserId      int    // for the channel affinity and the quota based downgrade, 0 for none
+	ServiceTier string // the effective tier, see Distribute
+	TokenModels string // the fallback model must be allowed to the token as well
+	Retry       bool   // the sticky channel has failed, the channel is picked at random
+	Multipart   bool   // the model of a multipart body cannot be rewritten, it is neither downgraded nor replaced by its fallback
+}
+
+// ChannelSelection is the outcome of SelectChannel, the request is relayed as Model and billed in Group
+type ChannelSelection struct {
+	Channel            *Channel
+	Model              string
+	Group              string
+	DowngradedFrom     string
+	UserQuota          int // the quota below DowngradeThreshold that caused the downgrade
+	DowngradeThreshold int
+	FallbackFrom       string
+	GroupFallbackFrom  string
+}
+
+// SelectChannel is the channel selection of the relay: the model kill switch, the quota based downgrade,
+// the channels of the group, then of the fallback groups and at last of the fallback model,
+// the decisions are recorded in trace when it is not nil
+func SelectChannel(request *ChannelSelectionRequest, trace *ChannelSelectionTrace) (*ChannelSelection, error) {
+	selection := &ChannelSelection{Model: request.Model, Group: request.Group}
+	if common.IsModelDisabled(request.Model) {
+		return selection, &ModelDisabledError{Model: request.Model}
+	}
+	if fallbackModel, threshold := common.GetModelDowngrade(request.Group, request.Model); fallbackModel != "" && !request.Multipart && request.UserId != 0 {
+		userQuota, err := CacheGetUserQuota(request.UserId)
+		if err == nil && userQuota < threshold {
+			selection.DowngradedFrom = selection.Model
+			selection.Model = fallbackModel
+			selection.UserQuota = userQuota
+			selection.DowngradeThreshold = threshold
+		}
+	}
+	affinityUserId := request.UserId
+	if request.Retry {
+		affinityUserId = 0
+	}
+	selectIn := func(group string, model string) (*Channel, error) {
+		attempt := trace.newAttempt(group, model, request.ServiceTier)
+		channel, err := selectChannel(group, model, affinityUserId, request.ServiceTier, attempt)
+		attempt.setResult(channel, err)
+		return channel, err
+	}
+	// the fallback groups are tried in order, the group ratio and the group settings of the group found apply from here on
+	selectInGroups := func(model string) (*Channel, error) {
+		channel, err := selectIn(request.Group, model)
+		var maintenanceErr *ModelUnderMaintenanceError
+		if err == nil || errors.As(err, &maintenanceErr) {
+			selection.Group = request.Group
+			return channel, err
+		}
+		for _, fallbackGroup := range common.GetGroupFallbacks(request.Group) {
+			fallbackChannel, fallbackErr := selectIn(fallbackGroup, model)
+			if fallbackErr != nil {
+				continue
+			}
+			selection.Group = fallbackGroup
+			return fallbackChannel, nil
+		}
+		return channel, err
+	}
+	channel, err := selectInGroups(selection.Model)
+	// the kill switch applies to the fallback model as well
+	if fallbackModel := common.ModelFallbacks[selection.Model]; err != nil && fallbackModel != "" && !common.IsModelDisabled(fallbackModel) &&
+		common.IsModelInList(request.TokenModels, fallbackModel) && !request.Multipart {
+		fallbackChannel, fallbackErr := selectInGroups(fallbackModel)
+		if fallbackErr == nil {
+			selection.FallbackFrom = selection.Model
+			selection.Model = fallbackModel
+			channel, err = fallbackChannel, nil
+		}
+	}
+	if err == nil && selection.Group != request.Group {
+		selection.GroupFallbackFrom = request.Group
+	}
+	selection.Channel = channel
+	return selection, err
+}
+
+// ChannelSelectionCandidate is a channel serving the model, Reason tells why it was excluded
+type ChannelSelectionCandidate struct {
+	ChannelId   int     `json:"channel_id"`
+	Name        string  `json:"name"`
+	Priority    int64   `json:"priority"`
+	Weight      float64 `json:"weight"`       // effective weight used by weighted selection
+	WeightScale float64 `json:"weight_scale"` // below 1 while the channel recovers from upstream errors
+	Excluded    bool    `json:"excluded"`
+	Reason      string  `json:"reason"`
+	Selected    bool    `json:"selected"`
+}
+
+// ChannelSelectionAttempt records the decisions of one selectChannel call, candidates are in priority order
+type ChannelSelectionAttempt struct {
+	Group             string                       `json:"group"`
+	Model             string                       `json:"model"`
+	ServiceTier       string                       `json:"service_tier"`
+	Strategy          string                       `json:"strategy"`
+	Candidates        []*ChannelSelectionCandidate `json:"candidates"`
+	SelectedChannelId int                          `json:"selected_channel_id"`
+	Error             string                       `json:"error"`
+}
+
+// ChannelSelectionTrace records the decisions of SelectChannel, one attempt per group and model tried
+type ChannelSelectionTrace struct {
+	Group             string                     `json:"group"`
+	Model             string                     `json:"model"`
+	ServiceTier       string                     `json:"service_tier"`
+	AppTag            string                     `json:"app_tag"`
+	Attempts          []*ChannelSelectionAttempt `json:"attempts"`
+	SelectedGroup     string                     `json:"selected_group"`
+	SelectedModel     string                     `json:"selected_model"`
+	DowngradedFrom    string                     `json:"downgraded_from"`
+	FallbackFrom      string                     `json:"fallback_from"`
+	GroupFallbackFrom string                     `json:"group_fallback_from"`
+	SelectedChannelId int                        `json:"selected_channel_id"`
+	Error             string                     `json:"error"`
+}
+
+func (trace *ChannelSelectionTrace) newAttempt(group string, model string, tier string) *ChannelSelectionAttempt {
+	if trace == nil {
+		return nil
+	}
+	attempt := &ChannelSelectionAttempt{Group: group, Model: model, ServiceTier: tier}
+	trace.Attempts = append(trace.Attempts, attempt)
+	return attempt
+}
+
+func (attempt *ChannelSelectionAttempt) add(channels []*Channel) {
+	if attempt == nil {
+		return
+	}
+	for _, channel := range channels {
+		if attempt.get(channel.Id) != nil {
+			continue
+		}
+		attempt.Candidates = append(attempt.Candidates, &ChannelSelectionCandidate{
+			ChannelId:   channel.Id,
+			Name:        channel.Name,
+			Priority:    channel.GetPriority(),
+			Weight:      GetChannelEffectiveWeight(channel),
+			WeightScale: GetChannelWeightScale(channel.Id),
+		})
+	}
+}
+
+// exclude marks the channels of before missing from after
+func (attempt *ChannelSelectionAttempt) exclude(before []*Channel, after []*Channel, reason string) {
+	if attempt == nil || len(before) == len(after) {
+		return
+	}
+	kept := make(map[int]bool, len(after))
+	for _, channel := range after {
+		kept[channel.Id] = true
+	}
+	for _, channel := range before {
+		if kept[channel.Id] {
+			continue
+		}
+		attempt.excludeChannel(channel.Id, reason)
+	}
+}
+
+func (attempt *ChannelSelectionAttempt) excludeChannel(channelId int, reason string) {
+	if candidate := attempt.get(channelId); candidate != nil && !candidate.Excluded {
+		candidate.Excluded = true
+		candidate.Reason = reason
+	}
+}
+
+func (attempt *ChannelSelectionAttempt) get(channelId int) *ChannelSelectionCandidate {
+	for _, candidate := range attempt.Candidates {
+		if candidate.ChannelId == channelId {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func (attempt *ChannelSelectionAttempt) setResult(channel *Channel, err error) {
+	if attempt == nil {
+		return
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		return
+	}
+	attempt.add([]*Channel{channel})
+	attempt.SelectedChannelId = channel.Id
+	attempt.get(channel.Id).Selected = true
+}
+
+func (attempt *ChannelSelectionAttempt) setStrategy(strategy string) {
+	if attempt != nil {
+		attempt.Strategy = strategy
+	}
+}
+
+// traceAbilities records the candidates of a database selection with the exclusions of its query,
+// condition and channelIds are the service tier condition of getRandomSatisfiedChannel
+func (attempt *ChannelSelectionAttempt) traceAbilities(group string, model string, condition string, channelIds []int, maintenanceChannelIds []int) error {
+	var abilities []*Ability
+	err := DB.Where(&Ability{Group: group, Model: model}).Order("priority desc").Find(&abilities).Error
+	if err != nil {
+		return err
+	}
+	ids := make([]int, 0, len(abilities))
+	for _, ability := range abilities {
+		ids = append(ids, ability.ChannelId)
+	}
+	var channels []*Channel
+	err = DB.Omit("key").Where("id in ?", ids).Find(&channels).Error
+	if err != nil {
+		return err
+	}
+	channelMap := make(map[int]*Channel, len(channels))
+	for _, channel := range channels {
+		channelMap[channel.Id] = channel
+	}
+	// a later pass of the same selection replaces the earlier one
+	attempt.Candidates = nil
+	var maxPriority *int64
+	for _, ability := range abilities {
+		channel, ok := channelMap[ability.ChannelId]
+		if !ok {
+			continue
+		}
+		attempt.add([]*Channel{channel})
+		switch {
+		case !ability.Enabled:
+			attempt.excludeChannel(channel.Id, ChannelExcludedDisabled)
+		case containsInt(maintenanceChannelIds, channel.Id):
+			attempt.excludeChannel(channel.Id, ChannelExcludedMaintenance)
+		case condition != "" && (condition == inChannelIds) != containsInt(channelIds, channel.Id):
+			attempt.excludeChannel(channel.Id, ChannelExcludedServiceTier)
+		default:
+			priority := channel.GetPriority()
+			if maxPriority == nil {
+				maxPriority = &priority
+			} else if priority < *maxPriority {
+				attempt.excludeChannel(channel.Id, ChannelExcludedLowerPriority)
+			}
+		}
+	}
+	return nil
+}
+
+// addUnservedChannels lists the channels of the model that never reach the selector as disabled or out of the group
+func (attempt *ChannelSelectionAttempt) addUnservedChannels() error {
+	var channels []*Channel
+	err := DB.Omit("key").Order("priority desc").Find(&channels).Error
+	if err != nil {
+		return err
+	}
+	for _, channel := range channels {
+		if attempt.get(channel.Id) != nil || !isInCommaList(channel.Models, attempt.Model) {
+			continue
+		}
+		attempt.add([]*Channel{channel})
+		if channel.Status != common.ChannelStatusEnabled {
+			attempt.excludeChannel(channel.Id, ChannelExcludedDisabled)
+		} else if !isInCommaList(channel.Group, attempt.Group) {
+			attempt.excludeChannel(channel.Id, ChannelExcludedGroupMismatch)
+		}
+		// otherwise a channel the cache has not synced yet
+	}
+	return nil
+}
+
+// SimulateChannelSelection runs SelectChannel without relaying and explains the decision
+func SimulateChannelSelection(request *ChannelSelectionRequest, appTag string) (*ChannelSelectionTrace, error) {
+	trace := &ChannelSelectionTrace{Group: request.Group, Model: request.Model, ServiceTier: request.ServiceTier, AppTag: appTag}
+	selection, err := SelectChannel(request, trace)
+	trace.SelectedGroup = selection.Group
+	trace.SelectedModel = selection.Model
+	trace.DowngradedFrom = selection.DowngradedFrom
+	trace.FallbackFrom = selection.FallbackFrom
+	trace.GroupFallbackFrom = selection.GroupFallbackFrom
+	if err != nil {
+		trace.Error = err.Error()
+	} else {
+		trace.SelectedChannelId = selection.Channel.Id
+	}
+	for _, attempt := range trace.Attempts {
+		if err := attempt.addUnservedChannels(); err != nil {
+			return nil, err
+		}
+	}
+	return trace, nil
+}
+
+func isInCommaList(list string, name string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, value int) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package model
+
+import (
+	"errors"
+	"one-api/common"
+	"testing"
+)
+
+func createSelectionChannel(t *testing.T, name string, models string, group string, priority int64, status int) *Channel {
+	t.Helper()
+	channel := &Channel{Name: name, Type: common.ChannelTypeOpenAI, Key: "sk-test", Status: status, Models: models, Group: group, Priority: &priority}
+	if err := channel.Insert(); err != nil {
+		t.Fatalf("failed to create channel: %v", err)
+	}
+	return channel
+}
+
+func findCandidate(attempt *ChannelSelectionAttempt, channelId int) *ChannelSelectionCandidate {
+	for _, candidate := range attempt.Candidates {
+		if candidate.ChannelId == channelId {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func TestSimulateChannelSelectionReasons(t *testing.T) {
+	high := createSelectionChannel(t, "high", "sim-b", "default", 10, common.ChannelStatusEnabled)
+	low := createSelectionChannel(t, "low", "sim-b", "default", 0, common.ChannelStatusEnabled)
+	disabled := createSelectionChannel(t, "disabled", "sim-b", "default", 10, common.ChannelStatusManuallyDisabled)
+	other := createSelectionChannel(t, "other", "sim-b", "vip", 10, common.ChannelStatusEnabled)
+	defer func(enabled bool) {
+		common.MemoryCacheEnabled = enabled
+		InitChannelCache()
+	}(common.MemoryCacheEnabled)
+	for _, memoryCache := range []bool{false, true} {
+		common.MemoryCacheEnabled = memoryCache
+		InitChannelCache()
+		trace, err := SimulateChannelSelection(&ChannelSelectionRequest{Group: "default", Model: "sim-b", ServiceTier: common.ServiceTierDefault}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trace.SelectedChannelId != high.Id || len(trace.Attempts) != 1 {
+			t.Fatalf("memory cache %v: selected %d in %d attempts", memoryCache, trace.SelectedChannelId, len(trace.Attempts))
+		}
+		want := map[int]string{low.Id: ChannelExcludedLowerPriority, disabled.Id: ChannelExcludedDisabled, other.Id: ChannelExcludedGroupMismatch}
+		for channelId, reason := range want {
+			candidate := findCandidate(trace.Attempts[0], channelId)
+			if candidate == nil || !candidate.Excluded || candidate.Reason != reason {
+				t.Errorf("memory cache %v: channel %d got %+v, want %s", memoryCache, channelId, candidate, reason)
+			}
+		}
+	}
+}
+
+func TestSelectChannelFallbacks(t *testing.T) {
+	defer func(disabled string, groupFallbacks map[string][]string, modelFallbacks map[string]string) {
+		common.DisabledModels, common.GroupFallbacks, common.ModelFallbacks = disabled, groupFallbacks, modelFallbacks
+	}(common.DisabledModels, common.GroupFallbacks, common.ModelFallbacks)
+	overflow := createSelectionChannel(t, "overflow", "sim-overflow", "overflow", 0, common.ChannelStatusEnabled)
+	comparable := createSelectionChannel(t, "comparable", "sim-comparable", "default", 0, common.ChannelStatusEnabled)
+
+	common.DisabledModels = "sim-killed"
+	if _, err := SelectChannel(&ChannelSelectionRequest{Group: "default", Model: "sim-killed"}, nil); !errors.As(err, new(*ModelDisabledError)) {
+		t.Errorf("disabled model got %v", err)
+	}
+
+	common.GroupFallbacks = map[string][]string{"default": {"overflow"}}
+	trace := &ChannelSelectionTrace{}
+	selection, err := SelectChannel(&ChannelSelectionRequest{Group: "default", Model: "sim-overflow"}, trace)
+	if err != nil || selection.Channel.Id != overflow.Id || selection.Group != "overflow" || selection.GroupFallbackFrom != "default" {
+		t.Fatalf("group fallback got %+v, %v", selection, err)
+	}
+	if len(trace.Attempts) != 2 || trace.Attempts[0].Error == "" || trace.Attempts[1].SelectedChannelId != overflow.Id {
+		t.Errorf("group fallback attempts not traced: %+v", trace.Attempts)
+	}
+
+	common.ModelFallbacks = map[string]string{"sim-missing": "sim-comparable"}
+	selection, err = SelectChannel(&ChannelSelectionRequest{Group: "default", Model: "sim-missing"}, nil)
+	if err != nil || selection.Channel.Id != comparable.Id || selection.Model != "sim-comparable" || selection.FallbackFrom != "sim-missing" {
+		t.Fatalf("model fallback got %+v, %v", selection, err)
+	}
+	// the model of a multipart body cannot be replaced
+	if _, err = SelectChannel(&ChannelSelectionRequest{Group: "default", Model: "sim-missing", Multipart: true}, nil); err == nil {
+		t.Error("multipart request fell back to another model")
+	}
+	common.DisabledModels = "sim-comparable"
+	if selection, err = SelectChannel(&ChannelSelectionRequest{Group: "default", Model: "sim-missing"}, nil); err == nil {
+		t.Errorf("fell back to the disabled model %s", selection.Model)
+	}
+}
+
+func TestSelectChannelFallbackModelInFallbackGroup(t *testing.T) {
+	defer func(groupFallbacks map[string][]string, modelFallbacks map[string]string) {
+		common.GroupFallbacks, common.ModelFallbacks = groupFallbacks, modelFallbacks
+	}(common.GroupFallbacks, common.ModelFallbacks)
+	overflow := createSelectionChannel(t, "overflow comparable", "sim-overflow-comparable", "overflow", 0, common.ChannelStatusEnabled)
+	common.GroupFallbacks = map[string][]string{"default": {"overflow"}}
+	common.ModelFallbacks = map[string]string{"sim-gone": "sim-overflow-comparable"}
+	selection, err := SelectChannel(&ChannelSelectionRequest{Group: "default", Model: "sim-gone"}, nil)
+	if err != nil || selection.Channel.Id != overflow.Id {
+		t.Fatalf("fallback model not looked up in the fallback group: %+v, %v", selection, err)
+	}
+	// billed in the group that served the request
+	if selection.Group != "overflow" || selection.GroupFallbackFrom != "default" || selection.FallbackFrom != "sim-gone" {
+		t.Errorf("got %+v", selection)
+	}
+}
+
+func TestFlexChannelIdsAreCached(t *testing.T) {
+	invalidateFlexChannelIds()
+	before, err := getFlexChannelIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flex := common.ServiceTierFlex
+	// written behind the back of the cache, seen once it expires
+	hidden := &Channel{Name: "hidden flex", Key: "sk-test", Models: "sim-flex", Group: "default", ServiceTier: &flex}
+	DB.Create(hidden)
+	if cached, _ := getFlexChannelIds(); len(cached) != len(before) {
+		t.Errorf("flex channel ids queried again: %v", cached)
+	}
+	inserted := createSelectionChannel(t, "inserted flex", "sim-flex", "default", 0, common.ChannelStatusEnabled)
+	update := &Channel{Id: inserted.Id, Models: inserted.Models, Group: inserted.Group, ServiceTier: &flex}
+	if err := update.Update(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := getFlexChannelIds()
+	if len(after) != len(before)+2 {
+		t.Errorf("got flex channel ids %v, before %v", after, before)
+	}
+}
+
+func TestChannelAffinity(t *testing.T) {
+	defer func(affinity bool, memoryCache bool) {
+		common.ChannelAffinityEnabled, common.MemoryCacheEnabled = affinity, memoryCache
+		InitChannelCache()
+	}(common.ChannelAffinityEnabled, common.MemoryCacheEnabled)
+	common.ChannelAffinityEnabled = true
+	for _, name := range []string{"sticky a", "sticky b", "sticky c"} {
+		createSelectionChannel(t, name, "sim-sticky", "default", 0, common.ChannelStatusEnabled)
+	}
+	for _, memoryCache := range []bool{false, true} {
+		common.MemoryCacheEnabled = memoryCache
+		InitChannelCache()
+		selected := map[int]int{}
+		used := map[int]bool{}
+		for userId := 1; userId <= 30; userId++ {
+			for i := 0; i < 5; i++ {
+				channel, err := CacheGetRandomSatisfiedChannel("default", "sim-sticky", userId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i > 0 && channel.Id != selected[userId] {
+					t.Fatalf("memory cache %v: user %d moved from channel %d to %d", memoryCache, userId, selected[userId], channel.Id)
+				}
+				selected[userId] = channel.Id
+				used[channel.Id] = true
+			}
+		}
+		if len(used) < 2 {
+			t.Errorf("memory cache %v: all users share channel %v", memoryCache, used)
+		}
+	}
+
+	// the user falls back to another channel while theirs is unavailable
+	common.MemoryCacheEnabled = false
+	sticky, _ := CacheGetRandomSatisfiedChannel("default", "sim-sticky", 7)
+	UpdateChannelStatusById(sticky.Id, common.ChannelStatusAutoDisabled)
+	defer UpdateChannelStatusById(sticky.Id, common.ChannelStatusEnabled)
+	for _, memoryCache := range []bool{false, true} {
+		common.MemoryCacheEnabled = memoryCache
+		InitChannelCache()
+		channel, err := CacheGetRandomSatisfiedChannel("default", "sim-sticky", 7)
+		if err != nil || channel.Id == sticky.Id {
+			t.Errorf("memory cache %v: got channel %v, %v while the sticky one is disabled", memoryCache, channel, err)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package model
+
+import (
+	"net/http"
+	"one-api/common"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// channelLatencyBounds are the upper bounds of the latency histogram buckets in milliseconds,
+// the last bucket counts everything slower
+var channelLatencyBounds = []int64{100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// ChannelHourlyStat is the per-hour rollup of the requests relayed to a channel
+type ChannelHourlyStat struct {
+	Id           int   `json:"id"`
+	ChannelId    int   `json:"channel_id" gorm:"uniqueIndex:idx_channel_hourly_stat,priority:1"`
+	Hour         int64 `json:"hour" gorm:"bigint;uniqueIndex:idx_channel_hourly_stat,priority:2;index"` // start of the hour
+	Total        int   `json:"total" gorm:"default:0"`
+	ClientErrors int   `json:"client_errors" gorm:"default:0"`
+	ServerErrors int   `json:"server_errors" gorm:"default:0"`
+}
+
+// ChannelHourlyLatency is the count of one latency histogram bucket of a ChannelHourlyStat,
+// one row per bucket so that the counts can be added by an upsert
+type ChannelHourlyLatency struct {
+	Id        int   `json:"id"`
+	ChannelId int   `json:"channel_id" gorm:"uniqueIndex:idx_channel_hourly_latency,priority:1"`
+	Hour      int64 `json:"hour" gorm:"bigint;uniqueIndex:idx_channel_hourly_latency,priority:2;index"`
+	Bucket    int   `json:"bucket" gorm:"uniqueIndex:idx_channel_hourly_latency,priority:3"` // index into channelLatencyBounds
+	Count     int   `json:"count" gorm:"default:0"`
+}
+
+type ChannelSLO struct {
+	ChannelId            int     `json:"channel_id"`
+	Total                int     `json:"total"`
+	ClientErrors         int     `json:"client_errors"`
+	ServerErrors         int     `json:"server_errors"`
+	Availability         float64 `json:"availability"`           // percent of non 5xx responses, client errors excluded
+	ErrorBudgetRemaining float64 `json:"error_budget_remaining"` // percent of the allowed server errors left
+	LatencyP50           int64   `json:"latency_p50"`            // in milliseconds, upper bound of the bucket
+	LatencyP90           int64   `json:"latency_p90"`
+	LatencyP99           int64   `json:"latency_p99"`
+}
+
+type channelHourKey struct {
+	channelId int
+	hour      int64
+}
+
+type channelHourCounter struct {
+	total        int
+	clientErrors int
+	serverErrors int
+	latencies    []int // counts per bucket, see channelLatencyBounds
+}
+
+// pendingChannelStats are accumulated in memory and flushed to the rollup tables by SyncChannelHourlyStats
+var pendingChannelStats = make(map[channelHourKey]*channelHourCounter)
+var pendingChannelStatsLock sync.Mutex
+
+// belowSLOChannels are deprioritized in channel selection
+var belowSLOChannels = make(map[int]bool)
+var belowSLOChannelsLock sync.RWMutex
+
+func getLatencyBucket(latency int64) int {
+	for i, bound := range channelLatencyBounds {
+		if latency <= bound {
+			return i
+		}
+	}
+	return len(channelLatencyBounds)
+}
+
+// RecordChannelRequest counts a relayed request towards the channel's availability and latency
+func RecordChannelRequest(channelId int, statusCode int, latency int64) {
+	if channelId == 0 {
+		return
+	}
+	now := common.GetTimestamp()
+	key := channelHourKey{channelId: channelId, hour: now - now%3600}
+	pendingChannelStatsLock.Lock()
+	defer pendingChannelStatsLock.Unlock()
+	counter, ok := pendingChannelStats[key]
+	if !ok {
+		counter = &channelHourCounter{latencies: make([]int, len(channelLatencyBounds)+1)}
+		pendingChannelStats[key] = counter
+	}
+	counter.total++
+	if statusCode >= http.StatusInternalServerError {
+		counter.serverErrors++
+	} else if statusCode >= http.StatusBadRequest {
+		// rate limits are counted with the client errors, they say nothing about the channel's availability
+		counter.clientErrors++
+	}
+	counter.latencies[getLatencyBucket(latency)]++
+}
+
+// addExcluded adds the value of the row that failed to be inserted to the stored column
+func addExcluded(table string, column string) clause.Expr {
+	if !common.UsingSQLite && !common.UsingPostgreSQL {
+		return gorm.Expr(table + "." + column + " + VALUES(" + column + ")")
+	}
+	return gorm.Expr(table + "." + column + " + excluded." + column)
+}
+
+// flushChannelHourlyStats adds the pending counters to the rollup tables with one upsert per table,
+// the counters are put back and retried with the next flush if it fails
+func flushChannelHourlyStats() {
+	pendingChannelStatsLock.Lock()
+	counters := pendingChannelStats
+	pendingChannelStats = make(map[channelHourKey]*channelHourCounter)
+	pendingChannelStatsLock.Unlock()
+	if len(counters) == 0 {
+		return
+	}
+	var stats []*ChannelHourlyStat
+	var latencies []*ChannelHourlyLatency
+	for key, counter := range counters {
+		stats = append(stats, &ChannelHourlyStat{ChannelId: key.channelId, Hour: key.hour,
+			Total: counter.total, ClientErrors: counter.clientErrors, ServerErrors: counter.serverErrors})
+		for bucket, count := range counter.latencies {
+			if count > 0 {
+				latencies = append(latencies, &ChannelHourlyLatency{ChannelId: key.channelId, Hour: key.hour, Bucket: bucket, Count: count})
+			}
+		}
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "channel_id"}, {Name: "hour"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"total":         addExcluded("channel_hourly_stats", "total"),
+				"client_errors": addExcluded("channel_hourly_stats", "client_errors"),
+				"server_errors": addExcluded("channel_hourly_stats", "server_errors"),
+			}),
+		}).CreateInBatches(stats, 100).Error
+		if err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "channel_id"}, {Name: "hour"}, {Name: "bucket"}},
+			DoUpdates: clause.Assignments(map[string]any{"count": addExcluded("channel_hourly_latencies", "count")}),
+		}).CreateInBatches(latencies, 100).Error
+	})
+	if err != nil {
+		common.SysError("failed to flush channel hourly stats: " + err.Error())
+		requeueChannelHourCounters(counters)
+	}
+}
+
+func requeueChannelHourCounters(counters map[channelHourKey]*channelHourCounter) {
+	pendingChannelStatsLock.Lock()
+	defer pendingChannelStatsLock.Unlock()
+	for key, counter := range counters {
+		pending, ok := pendingChannelStats[key]
+		if !ok {
+			pendingChannelStats[key] = counter
+			continue
+		}
+		pending.total += counter.total
+		pending.clientErrors += counter.clientErrors
+		pending.serverErrors += counter.serverErrors
+		for i, count := range counter.latencies {
+			pending.latencies[i] += count
+		}
+	}
+}
+
+func getLatencyPercentile(counts []int, total int, percentile float64) int64 {
+	if total == 0 {
+		return 0
+	}
+	target := int(float64(total)*percentile + 0.5)
+	seen := 0
+	for i, count := range counts {
+		seen += count
+		if seen >= target && seen > 0 {
+			if i < len(channelLatencyBounds) {
+				return channelLatencyBounds[i]
+			}
+			break
+		}
+	}
+	// slower than the last bound, report it as a lower bound
+	return channelLatencyBounds[len(channelLatencyBounds)-1]
+}
+
+// GetChannelSLOs aggregates the hourly rollups since startTimestamp, target is the availability objective in percent
+func GetChannelSLOs(startTimestamp int64, target float64) ([]*ChannelSLO, error) {
+	var stats []*ChannelHourlyStat
+	err := DB.Where("hour >= ?", startTimestamp-startTimestamp%3600).Order("channel_id").Find(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+	var slos []*ChannelSLO
+	counts := make(map[int][]int)
+	index := make(map[int]*ChannelSLO)
+	for _, stat := range stats {
+		slo, ok := index[stat.ChannelId]
+		if !ok {
+			slo = &ChannelSLO{ChannelId: stat.ChannelId}
+			index[stat.ChannelId] = slo
+			counts[stat.ChannelId] = make([]int, len(channelLatencyBounds)+1)
+			slos = append(slos, slo)
+		}
+		slo.Total += stat.Total
+		slo.ClientErrors += stat.ClientErrors
+		slo.ServerErrors += stat.ServerErrors
+	}
+	var latencies []*ChannelHourlyLatency
+	err = DB.Where("hour >= ?", startTimestamp-startTimestamp%3600).Find(&latencies).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, latency := range latencies {
+		if _, ok := counts[latency.ChannelId]; ok && latency.Bucket >= 0 && latency.Bucket < len(channelLatencyBounds)+1 {
+			counts[latency.ChannelId][latency.Bucket] += latency.Count
+		}
+	}
+	for _, slo := range slos {
+		eligible := slo.Total - slo.ClientErrors
+		slo.Availability = 100
+		if eligible > 0 {
+			slo.Availability = float64(eligible-slo.ServerErrors) / float64(eligible) * 100
+		}
+		slo.ErrorBudgetRemaining = 100
+		if budget := float64(eligible) * (100 - target) / 100; budget > 0 {
+			slo.ErrorBudgetRemaining = (budget - float64(slo.ServerErrors)) / budget * 100
+		} else if slo.ServerErrors > 0 {
+			slo.ErrorBudgetRemaining = 0
+		}
+		slo.LatencyP50 = getLatencyPercentile(counts[slo.ChannelId], slo.Total, 0.5)
+		slo.LatencyP90 = getLatencyPercentile(counts[slo.ChannelId], slo.Total, 0.9)
+		slo.LatencyP99 = getLatencyPercentile(counts[slo.ChannelId], slo.Total, 0.99)
+	}
+	return slos, nil
+}
+
+func updateBelowSLOChannels() {
+	below := make(map[int]bool)
+	if common.ChannelSLODeprioritizeThreshold > 0 {
+		slos, err := GetChannelSLOs(common.GetTimestamp()-7*24*3600, common.ChannelSLOTarget)
+		if err != nil {
+			common.SysError("failed to get channel slos: " + err.Error())
+			return
+		}
+		for _, slo := range slos {
+			if slo.Availability < common.ChannelSLODeprioritizeThreshold {
+				below[slo.ChannelId] = true
+			}
+		}
+	}
+	belowSLOChannelsLock.Lock()
+	belowSLOChannels = below
+	belowSLOChannelsLock.Unlock()
+}
+
+// SyncChannelHourlyStats flushes the request counters to the rollup table and refreshes the deprioritized channels
+func SyncChannelHourlyStats() {
+	for {
+		time.Sleep(time.Minute)
+		flushChannelHourlyStats()
+		updateBelowSLOChannels()
+	}
+}
+
+func isChannelBelowSLO(channelId int) bool {
+	belowSLOChannelsLock.RLock()
+	defer belowSLOChannelsLock.RUnlock()
+	return belowSLOChannels[channelId]
+}
+
+// filterBelowSLOChannels leaves out channels below the availability threshold, unless no channel is left
+func filterBelowSLOChannels(channels []*Channel) []*Channel {
+	belowSLOChannelsLock.RLock()
+	defer belowSLOChannelsLock.RUnlock()
+	if len(belowSLOChannels) == 0 {
+		return channels
+	}
+	var available []*Channel
+	for _, channel := range channels {
+		if !belowSLOChannels[channel.Id] {
+			available = append(available, channel)
+		}
+	}
+	if len(available) == 0 {
+		return channels
+	}
+	return available
+}
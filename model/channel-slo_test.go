@@ -0,0 +1,58 @@
+package model
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFlushChannelHourlyStats(t *testing.T) {
+	RecordChannelRequest(911, http.StatusOK, 80)
+	RecordChannelRequest(911, http.StatusOK, 80)
+	RecordChannelRequest(911, http.StatusTooManyRequests, 80)
+	flushChannelHourlyStats()
+	RecordChannelRequest(911, http.StatusBadGateway, 3000)
+	RecordChannelRequest(912, http.StatusOK, 80)
+	flushChannelHourlyStats()
+	slos, err := GetChannelSLOs(0, 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slo *ChannelSLO
+	for _, s := range slos {
+		if s.ChannelId == 911 {
+			slo = s
+		}
+	}
+	if slo == nil || slo.Total != 4 {
+		t.Fatalf("flushes not added up: %+v", slo)
+	}
+	// a rate limit is not a server error
+	if slo.ServerErrors != 1 || slo.ClientErrors != 1 {
+		t.Errorf("got %d server and %d client errors", slo.ServerErrors, slo.ClientErrors)
+	}
+	if slo.LatencyP50 != 100 || slo.LatencyP99 != 5000 {
+		t.Errorf("got p50 %d and p99 %d", slo.LatencyP50, slo.LatencyP99)
+	}
+}
+
+func TestFlushChannelHourlyStatsRequeuesOnFailure(t *testing.T) {
+	RecordChannelRequest(913, http.StatusOK, 80)
+	if err := DB.Migrator().RenameTable(&ChannelHourlyLatency{}, "channel_hourly_latencies_moved"); err != nil {
+		t.Fatal(err)
+	}
+	flushChannelHourlyStats()
+	if err := DB.Migrator().RenameTable("channel_hourly_latencies_moved", &ChannelHourlyLatency{}); err != nil {
+		t.Fatal(err)
+	}
+	RecordChannelRequest(913, http.StatusOK, 80)
+	flushChannelHourlyStats()
+	slos, err := GetChannelSLOs(0, 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, slo := range slos {
+		if slo.ChannelId == 913 && (slo.Total != 2 || slo.LatencyP50 != 100) {
+			t.Errorf("failed flush lost or doubled counters: %+v", slo)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package model
+
+import (
+	"math/rand"
+	"net/http"
+	"one-api/common"
+	"sync"
+)
+
+const (
+	channelWeightDecay    = 0.5
+	channelWeightRecovery = 0.1
+	minChannelWeightScale = 0.05
+)
+
+// channelWeightScales holds the adaptive scale of each channel's weight, missing means 1
+var channelWeightScales = map[int]float64{}
+var channelWeightScalesLock sync.RWMutex
+
+func (channel *Channel) GetWeight() uint {
+	if channel.Weight == nil {
+		return 0
+	}
+	return *channel.Weight
+}
+
+// RecordChannelError reduces the channel's effective weight so traffic moves away from it,
+// only server and network errors count, a client error says nothing about the channel
+func RecordChannelError(channelId int, statusCode int) {
+	if !common.ChannelWeightDecayEnabled || statusCode < http.StatusInternalServerError {
+		return
+	}
+	channelWeightScalesLock.Lock()
+	defer channelWeightScalesLock.Unlock()
+	scale := getChannelWeightScaleLocked(channelId) * channelWeightDecay
+	if scale < minChannelWeightScale {
+		scale = minChannelWeightScale
+	}
+	channelWeightScales[channelId] = scale
+}
+
+// RecordChannelSuccess recovers the channel's effective weight step by step
+func RecordChannelSuccess(channelId int) {
+	if !common.ChannelWeightDecayEnabled {
+		return
+	}
+	channelWeightScalesLock.Lock()
+	defer channelWeightScalesLock.Unlock()
+	scale, ok := channelWeightScales[channelId]
+	if !ok {
+		return
+	}
+	scale += channelWeightRecovery
+	if scale >= 1 {
+		delete(channelWeightScales, channelId)
+		return
+	}
+	channelWeightScales[channelId] = scale
+}
+
+func getChannelWeightScaleLocked(channelId int) float64 {
+	scale, ok := channelWeightScales[channelId]
+	if !ok {
+		return 1
+	}
+	return scale
+}
+
+// GetChannelWeightScale returns the adaptive scale of the channel's weight, 1 when it has not failed recently
+func GetChannelWeightScale(channelId int) float64 {
+	channelWeightScalesLock.RLock()
+	defer channelWeightScalesLock.RUnlock()
+	return getChannelWeightScaleLocked(channelId)
+}
+
+func GetChannelEffectiveWeight(channel *Channel) float64 {
+	channelWeightScalesLock.RLock()
+	defer channelWeightScalesLock.RUnlock()
+	// add 10 so that channels with zero weight can still be selected
+	return float64(channel.GetWeight()+10) * getChannelWeightScaleLocked(channel.Id)
+}
+
+// pickWeightedChannel selects one of the channels with probability proportional to its effective weight
+func pickWeightedChannel(channels []*Channel) *Channel {
+	weights := make([]float64, len(channels))
+	totalWeight := 0.0
+	for i, channel := range channels {
+		weights[i] = GetChannelEffectiveWeight(channel)
+		totalWeight += weights[i]
+	}
+	r := rand.Float64() * totalWeight
+	for i, weight := range weights {
+		r -= weight
+		if r < 0 {
+			return channels[i]
+		}
+	}
+	return channels[len(channels)-1]
+}
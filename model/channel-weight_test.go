@@ -0,0 +1,64 @@
+package model
+
+import (
+	"net/http"
+	"one-api/common"
+	"testing"
+)
+
+func TestChannelWeightDecaysOnServerErrors(t *testing.T) {
+	defer func(enabled bool) { common.ChannelWeightDecayEnabled = enabled }(common.ChannelWeightDecayEnabled)
+	common.ChannelWeightDecayEnabled = true
+	const channelId = 160
+	RecordChannelError(channelId, http.StatusBadRequest)
+	RecordChannelError(channelId, http.StatusTooManyRequests)
+	if scale := GetChannelWeightScale(channelId); scale != 1 {
+		t.Fatalf("client errors lowered the scale to %v", scale)
+	}
+	RecordChannelError(channelId, http.StatusBadGateway)
+	RecordChannelError(channelId, http.StatusInternalServerError)
+	decayed := GetChannelWeightScale(channelId)
+	if decayed >= 0.5 {
+		t.Fatalf("server errors only lowered the scale to %v", decayed)
+	}
+	RecordChannelSuccess(channelId)
+	if scale := GetChannelWeightScale(channelId); scale <= decayed {
+		t.Errorf("a success did not recover the scale, %v", scale)
+	}
+	for i := 0; i < 10; i++ {
+		RecordChannelSuccess(channelId)
+	}
+	if scale := GetChannelWeightScale(channelId); scale != 1 {
+		t.Errorf("the scale did not fully recover, %v", scale)
+	}
+}
+
+func TestDatabaseSelectionUsesDecayedWeights(t *testing.T) {
+	defer func(enabled bool, memoryCache bool) {
+		common.ChannelWeightDecayEnabled, common.MemoryCacheEnabled = enabled, memoryCache
+	}(common.ChannelWeightDecayEnabled, common.MemoryCacheEnabled)
+	common.ChannelWeightDecayEnabled = true
+	common.MemoryCacheEnabled = false
+	healthy := createSelectionChannel(t, "healthy", "weight-db", "default", 0, common.ChannelStatusEnabled)
+	flaky := createSelectionChannel(t, "flaky", "weight-db", "default", 0, common.ChannelStatusEnabled)
+	for i := 0; i < 10; i++ {
+		RecordChannelError(flaky.Id, http.StatusServiceUnavailable)
+	}
+	defer func() {
+		channelWeightScalesLock.Lock()
+		delete(channelWeightScales, flaky.Id)
+		channelWeightScalesLock.Unlock()
+	}()
+	picks := map[int]int{}
+	for i := 0; i < 200; i++ {
+		channel, err := GetRandomSatisfiedChannelForTier("default", "weight-db", 0, common.ServiceTierDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[channel.Id]++
+	}
+	// the flaky channel keeps 5% of its weight, about 10 of 200 picks
+	if picks[flaky.Id] > 40 || picks[healthy.Id] < 160 {
+		t.Errorf("picks %v, the flaky channel is not avoided", picks)
+	}
+}
@@ -9,33 +9,50 @@ import (
 )
 
 type Channel struct {
-	Id                 int     `json:"id"`
-	Type               int     `json:"type" gorm:"default:0"`
-	Key                string  `json:"key" gorm:"not null;index"`
-	Status             int     `json:"status" gorm:"default:1"`
-	Name               string  `json:"name" gorm:"index"`
-	Weight             *uint   `json:"weight" gorm:"default:0"`
-	CreatedTime        int64   `json:"created_time" gorm:"bigint"`
-	TestTime           int64   `json:"test_time" gorm:"bigint"`
-	ResponseTime       int     `json:"response_time"` // in milliseconds
-	BaseURL            *string `json:"base_url" gorm:"column:base_url;default:''"`
-	Other              string  `json:"other"`
-	Balance            float64 `json:"balance"` // in USD
-	BalanceUpdatedTime int64   `json:"balance_updated_time" gorm:"bigint"`
-	Models             string  `json:"models"`
-	Group              string  `json:"group" gorm:"type:varchar(32);default:'default'"`
-	UsedQuota          int64   `json:"used_quota" gorm:"bigint;default:0"`
-	ModelMapping       *string `json:"model_mapping" gorm:"type:varchar(1024);default:''"`
-	Priority           *int64  `json:"priority" gorm:"bigint;default:0"`
+	Id                 int               `json:"id"`
+	Type               int               `json:"type" gorm:"default:0"`
+	Key                string            `json:"key" gorm:"not null;index"`
+	Status             int               `json:"status" gorm:"default:1"`
+	Name               string            `json:"name" gorm:"index"`
+	Weight             *uint             `json:"weight" gorm:"default:0"`
+	CreatedTime        int64             `json:"created_time" gorm:"bigint"`
+	TestTime           int64             `json:"test_time" gorm:"bigint"`
+	ResponseTime       int               `json:"response_time"` // in milliseconds
+	BaseURL            *string           `json:"base_url" gorm:"column:base_url;default:''"`
+	Other              string            `json:"other"`
+	Balance            float64           `json:"balance"` // in USD
+	BalanceUpdatedTime int64             `json:"balance_updated_time" gorm:"bigint"`
+	Models             string            `json:"models"`
+	Group              string            `json:"group" gorm:"type:varchar(32);default:'default'"`
+	UsedQuota          int64             `json:"used_quota" gorm:"bigint;default:0"`
+	ModelMapping       *string           `json:"model_mapping" gorm:"type:varchar(1024);default:''"`
+	Priority           *int64            `json:"priority" gorm:"bigint;default:0"`
+	TLSCACert          *string           `json:"tls_ca_cert" gorm:"column:tls_ca_cert;type:text"`
+	TLSClientCert      *string           `json:"tls_client_cert" gorm:"column:tls_client_cert;type:text"`
+	TLSClientKey       *string           `json:"tls_client_key" gorm:"column:tls_client_key;type:text"`
+	TLSInsecure        *bool             `json:"tls_insecure_skip_verify" gorm:"column:tls_insecure_skip_verify;default:false"`
+	Headers            *string           `json:"headers" gorm:"type:text"`
+	BodyTransforms     *string           `json:"body_transforms" gorm:"type:text"`
+	AuthType           *string           `json:"auth_type" gorm:"type:varchar(16);default:''"`    // bearer, header or query
+	AuthParam          *string           `json:"auth_param" gorm:"type:varchar(64);default:''"`   // header or query parameter name
+	EmbeddingBatchSize *int              `json:"embedding_batch_size" gorm:"default:0"`           // max inputs per upstream embeddings request, 0 means unlimited
+	Timeout            *int              `json:"timeout" gorm:"default:0"`                        // upstream request timeout in seconds, 0 falls back to the model and global timeout
+	ServiceTier        *string           `json:"service_tier" gorm:"type:varchar(16);default:''"` // "flex" for economy channels, empty for the default tier
+	MaxTokens          *int              `json:"max_tokens" gorm:"default:0"`                     // upper bound of max_tokens sent to this channel, 0 means unlimited
+	TPMLimit           *int              `json:"tpm_limit" gorm:"column:tpm_limit;default:0"`     // tokens per minute of the upstream deployment, 0 means unknown
+	RateLimit          *ChannelRateLimit `json:"rate_limit,omitempty" gorm:"-"`
 }
 
+// secretChannelColumns are never sent to the frontend, custom headers carry credentials as well
+var secretChannelColumns = []string{"key", "tls_client_key", "headers"}
+
 func GetAllChannels(startIdx int, num int, selectAll bool) ([]*Channel, error) {
 	var channels []*Channel
 	var err error
 	if selectAll {
 		err = DB.Order("id desc").Find(&channels).Error
 	} else {
-		err = DB.Order("id desc").Limit(num).Offset(startIdx).Omit("key").Find(&channels).Error
+		err = DB.Order("id desc").Limit(num).Offset(startIdx).Omit(secretChannelColumns...).Find(&channels).Error
 	}
 	return channels, err
 }
@@ -45,7 +62,7 @@ func SearchChannels(keyword string) (channels []*Channel, err error) {
 	if common.UsingPostgreSQL {
 		keyCol = `"key"`
 	}
-	err = DB.Omit("key").Where("id = ? or name LIKE ? or "+keyCol+" = ?", common.String2Int(keyword), keyword+"%", keyword).Find(&channels).Error
+	err = DB.Omit(secretChannelColumns...).Where("id = ? or name LIKE ? or "+keyCol+" = ?", common.String2Int(keyword), keyword+"%", keyword).Find(&channels).Error
 	return channels, err
 }
 
@@ -55,17 +72,23 @@ func GetChannelById(id int, selectAll bool) (*Channel, error) {
 	if selectAll {
 		err = DB.First(&channel, "id = ?", id).Error
 	} else {
-		err = DB.Omit("key").First(&channel, "id = ?", id).Error
+		err = DB.Omit(secretChannelColumns...).First(&channel, "id = ?", id).Error
 	}
 	return &channel, err
 }
 
+func GetChannelsByIds(ids []int) (channels []*Channel, err error) {
+	err = DB.Omit(secretChannelColumns...).Where("id in ?", ids).Find(&channels).Error
+	return channels, err
+}
+
 func BatchInsertChannels(channels []Channel) error {
 	var err error
 	err = DB.Create(&channels).Error
 	if err != nil {
 		return err
 	}
+	invalidateFlexChannelIds()
 	for _, channel_ := range channels {
 		err = channel_.AddAbilities()
 		if err != nil {
@@ -82,6 +105,13 @@ func (channel *Channel) GetPriority() int64 {
 	return *channel.Priority
 }
 
+func (channel *Channel) GetServiceTier() string {
+	if channel.ServiceTier == nil || *channel.ServiceTier != common.ServiceTierFlex {
+		return common.ServiceTierDefault
+	}
+	return common.ServiceTierFlex
+}
+
 func (channel *Channel) GetBaseURL() string {
 	if channel.BaseURL == nil {
 		return ""
@@ -96,12 +126,95 @@ func (channel *Channel) GetModelMapping() string {
 	return *channel.ModelMapping
 }
 
+func (channel *Channel) GetHeaders() string {
+	if channel.Headers == nil {
+		return ""
+	}
+	return *channel.Headers
+}
+
+func (channel *Channel) GetAuthType() string {
+	if channel.AuthType == nil {
+		return ""
+	}
+	return *channel.AuthType
+}
+
+func (channel *Channel) GetAuthParam() string {
+	if channel.AuthParam == nil {
+		return ""
+	}
+	return *channel.AuthParam
+}
+
+func (channel *Channel) GetBodyTransforms() string {
+	if channel.BodyTransforms == nil {
+		return ""
+	}
+	return *channel.BodyTransforms
+}
+
+func (channel *Channel) GetEmbeddingBatchSize() int {
+	if channel.EmbeddingBatchSize == nil {
+		return 0
+	}
+	return *channel.EmbeddingBatchSize
+}
+
+func (channel *Channel) GetTimeout() int {
+	if channel.Timeout == nil {
+		return 0
+	}
+	return *channel.Timeout
+}
+
+func (channel *Channel) GetMaxTokens() int {
+	if channel.MaxTokens == nil {
+		return 0
+	}
+	return *channel.MaxTokens
+}
+
+func (channel *Channel) GetTLSCACert() string {
+	if channel.TLSCACert == nil {
+		return ""
+	}
+	return *channel.TLSCACert
+}
+
+func (channel *Channel) GetTLSClientCert() string {
+	if channel.TLSClientCert == nil {
+		return ""
+	}
+	return *channel.TLSClientCert
+}
+
+func (channel *Channel) GetTLSClientKey() string {
+	if channel.TLSClientKey == nil {
+		return ""
+	}
+	return *channel.TLSClientKey
+}
+
+func (channel *Channel) GetTLSInsecure() bool {
+	if channel.TLSInsecure == nil {
+		return false
+	}
+	return *channel.TLSInsecure
+}
+
+// HasCustomTLS reports whether the channel needs its own transport instead of the shared one.
+func (channel *Channel) HasCustomTLS() bool {
+	return channel.GetTLSCACert() != "" || channel.GetTLSClientCert() != "" || channel.GetTLSInsecure()
+}
+
 func (channel *Channel) Insert() error {
 	var err error
 	err = DB.Create(channel).Error
 	if err != nil {
 		return err
 	}
+	invalidateFlexChannelIds()
 	err = channel.AddAbilities()
 	return err
 }
@@ -136,6 +249,7 @@ func (channel *Channel) Update() error {
 	if err != nil {
 		return err
 	}
+	invalidateFlexChannelIds()
 	DB.Model(channel).First(channel, "id = ?", channel.Id)
 	err = channel.UpdateAbilities()
 	return err
@@ -183,6 +297,7 @@ func UpdateChannelStatusById(id int, status int) {
 }
 
 func UpdateChannelUsedQuota(id int, quota int) {
+	recordChannelDailyUsage(id, quota)
 	if common.BatchUpdateEnabled {
 		addNewRecord(BatchUpdateTypeChannelUsedQuota, id, quota)
 		return
@@ -0,0 +1,84 @@
+package model
+
+import (
+	"errors"
+	"one-api/common"
+
+	"gorm.io/gorm"
+)
+
+// CostReportRow is the consumption of a model by a group over a day
+type CostReportRow struct {
+	ModelName        string  `json:"model"`
+	Group            string  `json:"group"`
+	Users            int     `json:"users"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Quota            int64   `json:"quota"`
+	USD              float64 `json:"usd" gorm:"-"`
+}
+
+// CostExport is the status of the cost report export of a day, days start at 00:00 UTC
+type CostExport struct {
+	Id         int    `json:"id"`
+	Day        int64  `json:"day" gorm:"bigint;uniqueIndex"`
+	Success    bool   `json:"success"`
+	Attempts   int    `json:"attempts" gorm:"default:0"`
+	Message    string `json:"message"`
+	ExportedAt int64  `json:"exported_at" gorm:"bigint"`
+}
+
+// GetCostReport aggregates the consume logs in [startTimestamp, endTimestamp) per model and group,
+// the group is the one charged at request time, logs written before it was recorded fall back to the current group of the user
+func GetCostReport(startTimestamp int64, endTimestamp int64) (rows []*CostReportRow, err error) {
+	groupCol := "`group`"
+	if common.UsingPostgreSQL {
+		groupCol = `"group"`
+	}
+	group := "case when logs." + groupCol + " = '' then users." + groupCol + " else logs." + groupCol + " end"
+	err = DB.Table("logs").
+		Select("logs.model_name as model_name, "+group+" as "+groupCol+", count(distinct logs.user_id) as users, count(*) as requests, "+
+			"sum(logs.prompt_tokens) as prompt_tokens, sum(logs.completion_tokens) as completion_tokens, sum(logs.quota) as quota").
+		Joins("left join users on users.id = logs.user_id").
+		Where("logs.type = ? and logs.created_at >= ? and logs.created_at < ?", LogTypeConsume, startTimestamp, endTimestamp).
+		Group("logs.model_name, " + group).
+		Order("logs.model_name").
+		Scan(&rows).Error
+	for _, row := range rows {
+		row.USD = float64(row.Quota) / common.QuotaPerUnit
+	}
+	return rows, err
+}
+
+func GetCostExport(day int64) (*CostExport, error) {
+	var export CostExport
+	err := DB.Where("day = ?", day).First(&export).Error
+	return &export, err
+}
+
+func GetRecentCostExports(num int) (exports []*CostExport, err error) {
+	err = DB.Order("day desc").Limit(num).Find(&exports).Error
+	return exports, err
+}
+
+// RecordCostExport saves the outcome of an export of the day, attempts is the number of sends it took
+func RecordCostExport(day int64, success bool, attempts int, message string) {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var export CostExport
+		err := tx.Where("day = ?", day).First(&export).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			export = CostExport{Day: day}
+		} else if err != nil {
+			return err
+		}
+		export.Success = success
+		export.Attempts += attempts
+		export.Message = message
+		export.ExportedAt = common.GetTimestamp()
+		return tx.Save(&export).Error
+	})
+	if err != nil {
+		common.SysError("failed to record cost export: " + err.Error())
+	}
+}
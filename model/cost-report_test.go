@@ -0,0 +1,30 @@
+package model
+
+import "testing"
+
+func TestCostReportUsesTheGroupAtRequestTime(t *testing.T) {
+	user := createTestUser(t, "cost groups", 0)
+	DB.Model(user).Update("group", "vip")
+	day := int64(300 * 24 * 3600)
+	logs := []*Log{
+		{UserId: user.Id, Type: LogTypeConsume, CreatedAt: day + 1, ModelName: "cost-model", Quota: 10, Group: "default"},
+		// written before the group was recorded
+		{UserId: user.Id, Type: LogTypeConsume, CreatedAt: day + 2, ModelName: "cost-model", Quota: 20},
+	}
+	for _, log := range logs {
+		if err := DB.Create(log).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := GetCostReport(day, day+24*3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas := map[string]int64{}
+	for _, row := range rows {
+		quotas[row.Group] = row.Quota
+	}
+	if len(rows) != 2 || quotas["default"] != 10 || quotas["vip"] != 20 {
+		t.Errorf("got %v", quotas)
+	}
+}
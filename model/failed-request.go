@@ -0,0 +1,39 @@
+package model
+
+import (
+	"one-api/common"
+)
+
+// FailedRequest records a relay request that failed on every attempted channel
+type FailedRequest struct {
+	Id        int    `json:"id"`
+	CreatedAt int64  `json:"created_at" gorm:"bigint;index"`
+	UserId    int    `json:"user_id" gorm:"index"`
+	ModelName string `json:"model_name" gorm:"index;default:''"`
+	RequestId string `json:"request_id" gorm:"default:''"`
+	Attempts  string `json:"attempts" gorm:"type:text"` // JSON array of attempts
+	Message   string `json:"message"`
+}
+
+func RecordFailedRequest(failedRequest *FailedRequest) {
+	failedRequest.CreatedAt = common.GetTimestamp()
+	err := DB.Create(failedRequest).Error
+	if err != nil {
+		common.SysError("failed to record failed request: " + err.Error())
+	}
+}
+
+func GetFailedRequests(startTimestamp int64, endTimestamp int64, modelName string, startIdx int, num int) (failedRequests []*FailedRequest, err error) {
+	tx := DB
+	if startTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", startTimestamp)
+	}
+	if endTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", endTimestamp)
+	}
+	if modelName != "" {
+		tx = tx.Where("model_name = ?", modelName)
+	}
+	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&failedRequests).Error
+	return failedRequests, err
+}
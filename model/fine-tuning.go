@@ -0,0 +1,68 @@
+package model
+
+import (
+	"one-api/common"
+)
+
+const (
+	FineTuningObjectTypeFile = "file"
+	FineTuningObjectTypeJob  = "job"
+)
+
+// FineTuningObject pins an upstream file or fine-tuning job to the channel it was created on,
+// so that later requests about it reach the same upstream key
+type FineTuningObject struct {
+	Id        string `json:"id" gorm:"primaryKey;type:varchar(64)"` // upstream file or job id
+	Type      string `json:"type" gorm:"type:varchar(16);index"`
+	UserId    int    `json:"user_id" gorm:"index"`
+	TokenId   int    `json:"token_id"`
+	ChannelId int    `json:"channel_id"`
+	Model     string `json:"model" gorm:"default:''"`
+	CreatedAt int64  `json:"created_at" gorm:"bigint"`
+	Billed    bool   `json:"billed" gorm:"default:false"` // the job has ended and its trained tokens have been settled
+}
+
+func RecordFineTuningObject(object *FineTuningObject) error {
+	object.CreatedAt = common.GetTimestamp()
+	return DB.Create(object).Error
+}
+
+func GetFineTuningObject(id string, objectType string, userId int) (*FineTuningObject, error) {
+	object := FineTuningObject{}
+	err := DB.First(&object, "id = ? and type = ? and user_id = ?", id, objectType, userId).Error
+	return &object, err
+}
+
+func GetUserFineTuningObjects(userId int, objectType string) (objects []*FineTuningObject, err error) {
+	err = DB.Where("user_id = ? and type = ?", userId, objectType).Order("created_at desc").Find(&objects).Error
+	return objects, err
+}
+
+// GetUnsettledFineTuningJobs returns the jobs whose trained tokens have not been settled yet
+func GetUnsettledFineTuningJobs() (objects []*FineTuningObject, err error) {
+	err = DB.Where("type = ? and billed = ?", FineTuningObjectTypeJob, false).Find(&objects).Error
+	return objects, err
+}
+
+func DeleteFineTuningObject(id string) error {
+	return DB.Delete(&FineTuningObject{Id: id}).Error
+}
+
+// MarkFineTuningObjectBilled returns true only for the caller that actually flipped the flag,
+// so trained tokens are settled once even if the job is polled concurrently
+func MarkFineTuningObjectBilled(id string) bool {
+	result := DB.Model(&FineTuningObject{}).Where("id = ? and billed = ?", id, false).Update("billed", true)
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+func IsChannelServingModel(group string, model string, channelId int) bool {
+	groupCol := "`group`"
+	trueVal := "1"
+	if common.UsingPostgreSQL {
+		groupCol = `"group"`
+		trueVal = "true"
+	}
+	var count int64
+	err := DB.Model(&Ability{}).Where(groupCol+" = ? and model = ? and channel_id = ? and enabled = "+trueVal, group, model, channelId).Count(&count).Error
+	return err == nil && count > 0
+}
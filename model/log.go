@@ -2,24 +2,30 @@ package model
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"gorm.io/gorm"
 	"one-api/common"
 )
 
 type Log struct {
-	Id               int    `json:"id;index:idx_created_at_id,priority:1"`
-	UserId           int    `json:"user_id" gorm:"index"`
-	CreatedAt        int64  `json:"created_at" gorm:"bigint;index:idx_created_at_id,priority:2;index:idx_created_at_type"`
-	Type             int    `json:"type" gorm:"index:idx_created_at_type"`
-	Content          string `json:"content"`
-	Username         string `json:"username" gorm:"index:index_username_model_name,priority:2;default:''"`
-	TokenName        string `json:"token_name" gorm:"index;default:''"`
-	ModelName        string `json:"model_name" gorm:"index;index:index_username_model_name,priority:1;default:''"`
-	Quota            int    `json:"quota" gorm:"default:0"`
-	PromptTokens     int    `json:"prompt_tokens" gorm:"default:0"`
-	CompletionTokens int    `json:"completion_tokens" gorm:"default:0"`
-	ChannelId        int    `json:"channel" gorm:"index"`
+	Id               int     `json:"id;index:idx_created_at_id,priority:1"`
+	UserId           int     `json:"user_id" gorm:"index"`
+	CreatedAt        int64   `json:"created_at" gorm:"bigint;index:idx_created_at_id,priority:2;index:idx_created_at_type"`
+	Type             int     `json:"type" gorm:"index:idx_created_at_type"`
+	Content          string  `json:"content"`
+	Username         string  `json:"username" gorm:"index:index_username_model_name,priority:2;default:''"`
+	TokenName        string  `json:"token_name" gorm:"index;default:''"`
+	ModelName        string  `json:"model_name" gorm:"index;index:index_username_model_name,priority:1;default:''"`
+	Quota            int     `json:"quota" gorm:"default:0"`
+	PromptTokens     int     `json:"prompt_tokens" gorm:"default:0"`
+	CompletionTokens int     `json:"completion_tokens" gorm:"default:0"`
+	ChannelId        int     `json:"channel" gorm:"index"`
+	AppTag           string  `json:"app_tag" gorm:"index;default:''"`
+	Recounted        bool    `json:"recounted" gorm:"default:false"` // the quota was adjusted by a recount, see ApplyLogRecount
+	RecountedQuota   int     `json:"recounted_quota" gorm:"default:0"`
+	Discount         float64 `json:"discount" gorm:"default:1"` // the user discount the quota was charged with
+	Group            string  `json:"group" gorm:"default:''"`   // the group the quota was charged in
 }
 
 const (
@@ -47,8 +53,11 @@ func RecordLog(userId int, logType int, content string) {
 	}
 }
 
-func RecordConsumeLog(ctx context.Context, userId int, channelId int, promptTokens int, completionTokens int, modelName string, tokenName string, quota int, content string) {
+func RecordConsumeLog(ctx context.Context, userId int, channelId int, promptTokens int, completionTokens int, modelName string, tokenName string, group string, quota int, discount float64, content string) {
 	common.LogInfo(ctx, fmt.Sprintf("record consume log: userId=%d, channelId=%d, promptTokens=%d, completionTokens=%d, modelName=%s, tokenName=%s, quota=%d, content=%s", userId, channelId, promptTokens, completionTokens, modelName, tokenName, quota, content))
+	// the metrics are kept even when consume logs are disabled
+	appTag, _ := ctx.Value(common.AppTagKey).(string)
+	addAppTagUsage(appTag, promptTokens, completionTokens, quota)
 	if !common.LogConsumeEnabled {
 		return
 	}
@@ -63,7 +72,10 @@ func RecordConsumeLog(ctx context.Context, userId int, channelId int, promptToke
 		TokenName:        tokenName,
 		ModelName:        modelName,
 		Quota:            quota,
+		Discount:         discount,
+		Group:            group,
 		ChannelId:        channelId,
+		AppTag:           appTag,
 	}
 	err := DB.Create(log).Error
 	if err != nil {
@@ -71,13 +83,14 @@ func RecordConsumeLog(ctx context.Context, userId int, channelId int, promptToke
 	}
 }
 
-func GetAllLogs(logType int, startTimestamp int64, endTimestamp int64, modelName string, username string, tokenName string, startIdx int, num int, channel int) (logs []*Log, err error) {
+func GetAllLogs(logType int, startTimestamp int64, endTimestamp int64, modelName string, username string, tokenName string, startIdx int, num int, channel int, appTag string, tenantId int) (logs []*Log, err error) {
 	var tx *gorm.DB
 	if logType == LogTypeUnknown {
 		tx = DB
 	} else {
 		tx = DB.Where("type = ?", logType)
 	}
+	tx = scopeByTenantUsers(tx, tenantId)
 	if modelName != "" {
 		tx = tx.Where("model_name = ?", modelName)
 	}
@@ -96,11 +109,14 @@ func GetAllLogs(logType int, startTimestamp int64, endTimestamp int64, modelName
 	if channel != 0 {
 		tx = tx.Where("channel_id = ?", channel)
 	}
+	if appTag != "" {
+		tx = tx.Where("app_tag = ?", appTag)
+	}
 	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&logs).Error
 	return logs, err
 }
 
-func GetUserLogs(userId int, logType int, startTimestamp int64, endTimestamp int64, modelName string, tokenName string, startIdx int, num int) (logs []*Log, err error) {
+func GetUserLogs(userId int, logType int, startTimestamp int64, endTimestamp int64, modelName string, tokenName string, startIdx int, num int, appTag string) (logs []*Log, err error) {
 	var tx *gorm.DB
 	if logType == LogTypeUnknown {
 		tx = DB.Where("user_id = ?", userId)
@@ -119,12 +135,15 @@ func GetUserLogs(userId int, logType int, startTimestamp int64, endTimestamp int
 	if endTimestamp != 0 {
 		tx = tx.Where("created_at <= ?", endTimestamp)
 	}
+	if appTag != "" {
+		tx = tx.Where("app_tag = ?", appTag)
+	}
 	err = tx.Order("id desc").Limit(num).Offset(startIdx).Omit("id").Find(&logs).Error
 	return logs, err
 }
 
-func SearchAllLogs(keyword string) (logs []*Log, err error) {
-	err = DB.Where("type = ? or content LIKE ?", keyword, keyword+"%").Order("id desc").Limit(common.MaxRecentItems).Find(&logs).Error
+func SearchAllLogs(keyword string, tenantId int) (logs []*Log, err error) {
+	err = scopeByTenantUsers(DB, tenantId).Where("type = ? or content LIKE ?", keyword, keyword+"%").Order("id desc").Limit(common.MaxRecentItems).Find(&logs).Error
 	return logs, err
 }
 
@@ -133,8 +152,8 @@ func SearchUserLogs(userId int, keyword string) (logs []*Log, err error) {
 	return logs, err
 }
 
-func SumUsedQuota(logType int, startTimestamp int64, endTimestamp int64, modelName string, username string, tokenName string, channel int) (quota int) {
-	tx := DB.Table("logs").Select("ifnull(sum(quota),0)")
+func SumUsedQuota(logType int, startTimestamp int64, endTimestamp int64, modelName string, username string, tokenName string, channel int, tenantId int) (quota int) {
+	tx := scopeByTenantUsers(DB.Table("logs").Select("ifnull(sum(quota),0)"), tenantId)
 	if username != "" {
 		tx = tx.Where("username = ?", username)
 	}
@@ -182,3 +201,65 @@ func DeleteOldLog(targetTimestamp int64) (int64, error) {
 	result := DB.Where("created_at < ?", targetTimestamp).Delete(&Log{})
 	return result.RowsAffected, result.Error
 }
+
+func GetLogById(id int) (*Log, error) {
+	if id == 0 {
+		return nil, errors.New("id 为空！")
+	}
+	log := Log{Id: id}
+	err := DB.First(&log, "id = ?", id).Error
+	return &log, err
+}
+
+// GetConsumeLogsInRange returns up to num consume logs of the time range with an id above afterId in id order,
+// so a range is walked page by page, an end of 0 means no end
+func GetConsumeLogsInRange(startTimestamp int64, endTimestamp int64, afterId int, num int) (logs []*Log, err error) {
+	tx := DB.Where("type = ? and id > ? and created_at >= ?", LogTypeConsume, afterId, startTimestamp)
+	if endTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", endTimestamp)
+	}
+	err = tx.Order("id asc").Limit(num).Find(&logs).Error
+	return logs, err
+}
+
+var ErrLogAlreadyRecounted = errors.New("该日志已重新计费")
+
+// ApplyLogRecount marks a consume log as recounted and charges the user the difference, or refunds it when negative,
+// in the same transaction, so that a log is only ever adjusted once
+func ApplyLogRecount(logId int, userId int, recountedQuota int, delta int) error {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Log{}).Where("id = ? and recounted = ?", logId, false).Updates(map[string]any{
+			"recounted":       true,
+			"recounted_quota": recountedQuota,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrLogAlreadyRecounted
+		}
+		return tx.Model(&User{}).Where("id = ?", userId).Update("quota", gorm.Expr("quota - ?", delta)).Error
+	})
+	if err != nil {
+		return err
+	}
+	return CacheUpdateUserQuota(userId)
+}
+
+type DailyTokenUsage struct {
+	Day    int64 `json:"day"` // timestamp of 00:00 UTC
+	Tokens int64 `json:"tokens"`
+}
+
+func GetDailyTokenUsage(modelName string, startTimestamp int64) (usages []*DailyTokenUsage, err error) {
+	// modulo works on MySQL, PostgreSQL and SQLite alike, unlike date functions
+	dayExpr := "created_at - created_at % 86400"
+	tx := DB.Table("logs").
+		Select(dayExpr+" as day, sum(prompt_tokens) + sum(completion_tokens) as tokens").
+		Where("type = ? and created_at >= ?", LogTypeConsume, startTimestamp)
+	if modelName != "" {
+		tx = tx.Where("model_name = ?", modelName)
+	}
+	err = tx.Group(dayExpr).Order("day").Scan(&usages).Error
+	return usages, err
+}
@@ -0,0 +1,34 @@
+package model
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestApplyLogRecountIsIdempotent(t *testing.T) {
+	user := createTestUser(t, "recount", 1000)
+	log := &Log{UserId: user.Id, Type: LogTypeConsume, ModelName: "gpt-4o", Quota: 100}
+	if err := DB.Create(log).Error; err != nil {
+		t.Fatalf("failed to create log: %v", err)
+	}
+	if err := ApplyLogRecount(log.Id, user.Id, 150, 50); err != nil {
+		t.Fatalf("ApplyLogRecount: %v", err)
+	}
+	if err := ApplyLogRecount(log.Id, user.Id, 150, 50); !errors.Is(err, ErrLogAlreadyRecounted) {
+		t.Fatalf("second ApplyLogRecount returned %v, want ErrLogAlreadyRecounted", err)
+	}
+	quota, err := GetUserQuota(user.Id)
+	if err != nil {
+		t.Fatalf("GetUserQuota: %v", err)
+	}
+	if quota != 950 {
+		t.Errorf("user quota %d, want 950 after a single adjustment", quota)
+	}
+	stored, err := GetLogById(log.Id)
+	if err != nil {
+		t.Fatalf("GetLogById: %v", err)
+	}
+	if !stored.Recounted || stored.RecountedQuota != 150 || stored.Quota != 100 {
+		t.Errorf("unexpected log after recount %+v", stored)
+	}
+}
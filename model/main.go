@@ -95,6 +95,10 @@ func InitDB() (err error) {
 		if err != nil {
 			return err
 		}
+		err = migrateUserTenants(db)
+		if err != nil {
+			return err
+		}
 		err = db.AutoMigrate(&Option{})
 		if err != nil {
 			return err
@@ -111,6 +115,50 @@ func InitDB() (err error) {
 		if err != nil {
 			return err
 		}
+		err = db.AutoMigrate(&Canary{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&CanaryResult{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&FailedRequest{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&ModelMaintenance{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&FineTuningObject{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&ChannelHourlyStat{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&ChannelHourlyLatency{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&ChannelDailyUsage{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&QuotaTransfer{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&CostExport{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&Reminder{})
+		if err != nil {
+			return err
+		}
 		common.SysLog("database migrated")
 		err = createRootAccountIfNeed()
 		return err
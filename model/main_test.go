@@ -0,0 +1,35 @@
+package model
+
+import (
+	"one-api/common"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// the in-memory fallbacks are tested, InitRedisClient is never called
+	common.RedisEnabled = false
+	dir, err := os.MkdirTemp("", "one-api-model-test")
+	if err != nil {
+		panic(err)
+	}
+	common.SQLitePath = filepath.Join(dir, "one-api.db")
+	if err := InitDB(); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = CloseDB()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func createTestUser(t *testing.T, username string, quota int) *User {
+	t.Helper()
+	user := &User{Username: username, Password: "password", Quota: quota, Status: common.UserStatusEnabled, Group: "default",
+		AccessToken: common.GetUUID(), AffCode: common.GetUUID()[:8]}
+	if err := DB.Create(user).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return user
+}
@@ -0,0 +1,123 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"one-api/common"
+	"sync"
+	"time"
+)
+
+// ModelMaintenance takes a model of a channel out of rotation during [StartTime, EndTime)
+type ModelMaintenance struct {
+	Id        int    `json:"id"`
+	ChannelId int    `json:"channel_id" gorm:"index"`
+	Model     string `json:"model"`
+	StartTime int64  `json:"start_time" gorm:"bigint"`
+	EndTime   int64  `json:"end_time" gorm:"bigint;index"`
+	Reason    string `json:"reason"`
+}
+
+// ModelUnderMaintenanceError is returned when every channel of a model is under maintenance
+type ModelUnderMaintenanceError struct {
+	EndTime int64
+}
+
+func (e *ModelUnderMaintenanceError) Error() string {
+	return fmt.Sprintf("model under maintenance until %s", time.Unix(e.EndTime, 0).Format("2006-01-02 15:04:05"))
+}
+
+// maintenances holds the active and upcoming windows, reloaded periodically so every node sees changes
+var maintenances []*ModelMaintenance
+var maintenancesLock sync.RWMutex
+
+func GetModelMaintenances() (windows []*ModelMaintenance, err error) {
+	err = DB.Where("end_time > ?", common.GetTimestamp()).Order("start_time").Find(&windows).Error
+	return windows, err
+}
+
+func (maintenance *ModelMaintenance) Insert() error {
+	if maintenance.EndTime <= maintenance.StartTime {
+		return errors.New("结束时间必须晚于开始时间")
+	}
+	err := DB.Create(maintenance).Error
+	if err == nil {
+		LoadModelMaintenances()
+	}
+	return err
+}
+
+func DeleteModelMaintenanceById(id int) error {
+	err := DB.Delete(&ModelMaintenance{Id: id}).Error
+	if err == nil {
+		LoadModelMaintenances()
+	}
+	return err
+}
+
+func LoadModelMaintenances() {
+	windows, err := GetModelMaintenances()
+	if err != nil {
+		common.SysError("failed to load model maintenances: " + err.Error())
+		return
+	}
+	maintenancesLock.Lock()
+	maintenances = windows
+	maintenancesLock.Unlock()
+}
+
+// SyncModelMaintenances clears expired windows and reloads the rest
+func SyncModelMaintenances() {
+	for {
+		if common.IsMasterNode {
+			err := DB.Where("end_time <= ?", common.GetTimestamp()).Delete(&ModelMaintenance{}).Error
+			if err != nil {
+				common.SysError("failed to clear expired model maintenances: " + err.Error())
+			}
+		}
+		LoadModelMaintenances()
+		time.Sleep(time.Minute)
+	}
+}
+
+// getMaintenanceEndTime returns when the maintenance of the model on the channel ends, 0 if it is not under maintenance
+func getMaintenanceEndTime(channelId int, model string) int64 {
+	now := common.GetTimestamp()
+	maintenancesLock.RLock()
+	defer maintenancesLock.RUnlock()
+	for _, maintenance := range maintenances {
+		if maintenance.ChannelId == channelId && maintenance.Model == model && maintenance.StartTime <= now && now < maintenance.EndTime {
+			return maintenance.EndTime
+		}
+	}
+	return 0
+}
+
+func getMaintenanceChannelIds(model string) (channelIds []int, endTime int64) {
+	now := common.GetTimestamp()
+	maintenancesLock.RLock()
+	defer maintenancesLock.RUnlock()
+	for _, maintenance := range maintenances {
+		if maintenance.Model == model && maintenance.StartTime <= now && now < maintenance.EndTime {
+			channelIds = append(channelIds, maintenance.ChannelId)
+			if endTime == 0 || maintenance.EndTime < endTime {
+				endTime = maintenance.EndTime
+			}
+		}
+	}
+	return channelIds, endTime
+}
+
+// filterMaintenanceChannels drops the channels under maintenance for the model,
+// endTime is the earliest end among the dropped ones
+func filterMaintenanceChannels(channels []*Channel, model string) (available []*Channel, endTime int64) {
+	for _, channel := range channels {
+		channelEndTime := getMaintenanceEndTime(channel.Id, model)
+		if channelEndTime == 0 {
+			available = append(available, channel)
+		} else if endTime == 0 || channelEndTime < endTime {
+			endTime = channelEndTime
+		}
+	}
+	return available, endTime
+}
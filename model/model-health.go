@@ -0,0 +1,105 @@
+package model
+
+import (
+	"one-api/common"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modelHealthCacheDuration keeps the aggregation cheap for tools polling the model list
+const modelHealthCacheDuration = 30 * time.Second
+
+// ModelHealth aggregates the enabled channels serving a model, only admins may see it
+type ModelHealth struct {
+	EnabledChannels  int      `json:"enabled_channels"`
+	MinBalance       *float64 `json:"min_balance"`       // in USD, nil when no channel reported a balance
+	UsedQuota        int64    `json:"used_quota"`        // spent on the model over the last day, from the consume logs
+	CanaryLatency    float64  `json:"canary_latency"`    // average over the last hour in milliseconds, 0 without canary
+	DegradedChannels int      `json:"degraded_channels"` // channels recovering from upstream errors or below the SLO threshold
+}
+
+var modelHealths map[string]*ModelHealth
+var modelHealthsUpdatedAt time.Time
+var modelHealthsLock sync.Mutex
+
+func isChannelDegraded(channelId int) bool {
+	return GetChannelWeightScale(channelId) < 1 || isChannelBelowSLO(channelId)
+}
+
+func computeModelHealths() (map[string]*ModelHealth, error) {
+	var channels []*Channel
+	err := DB.Omit("key").Where("status = ?", common.ChannelStatusEnabled).Find(&channels).Error
+	if err != nil {
+		return nil, err
+	}
+	healths := make(map[string]*ModelHealth)
+	for _, channel := range channels {
+		for _, name := range strings.Split(channel.Models, ",") {
+			if name == "" {
+				continue
+			}
+			health, ok := healths[name]
+			if !ok {
+				health = &ModelHealth{}
+				healths[name] = health
+			}
+			health.EnabledChannels++
+			if channel.BalanceUpdatedTime != 0 && (health.MinBalance == nil || channel.Balance < *health.MinBalance) {
+				balance := channel.Balance
+				health.MinBalance = &balance
+			}
+			if isChannelDegraded(channel.Id) {
+				health.DegradedChannels++
+			}
+		}
+	}
+	// the used quota of a channel is shared by all its models, so the spend per model comes from the logs
+	var usages []struct {
+		ModelName string
+		Quota     int64
+	}
+	err = DB.Table("logs").Select("model_name, sum(quota) as quota").
+		Where("type = ? and created_at >= ?", LogTypeConsume, common.GetTimestamp()-24*3600).
+		Group("model_name").Scan(&usages).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, usage := range usages {
+		if health, ok := healths[usage.ModelName]; ok {
+			health.UsedQuota = usage.Quota
+		}
+	}
+	summaries, err := GetCanarySummaries(common.GetTimestamp() - 3600)
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[string]int)
+	for _, summary := range summaries {
+		health, ok := healths[summary.Model]
+		if !ok || summary.Total == 0 {
+			continue
+		}
+		// weighted by the number of runs of each channel
+		total := totals[summary.Model] + summary.Total
+		health.CanaryLatency += (summary.AvgLatency - health.CanaryLatency) * float64(summary.Total) / float64(total)
+		totals[summary.Model] = total
+	}
+	return healths, nil
+}
+
+// GetModelHealths returns the per-model aggregates, computed at most once per modelHealthCacheDuration
+func GetModelHealths() (map[string]*ModelHealth, error) {
+	modelHealthsLock.Lock()
+	defer modelHealthsLock.Unlock()
+	if modelHealths != nil && time.Since(modelHealthsUpdatedAt) < modelHealthCacheDuration {
+		return modelHealths, nil
+	}
+	healths, err := computeModelHealths()
+	if err != nil {
+		return nil, err
+	}
+	modelHealths = healths
+	modelHealthsUpdatedAt = time.Now()
+	return modelHealths, nil
+}
@@ -0,0 +1,28 @@
+package model
+
+import (
+	"one-api/common"
+	"testing"
+)
+
+func TestModelHealthUsedQuotaPerModel(t *testing.T) {
+	channel := createSelectionChannel(t, "health", "health-a,health-b", "default", 0, common.ChannelStatusEnabled)
+	DB.Model(channel).Update("used_quota", 1000)
+	for _, log := range []*Log{
+		{Type: LogTypeConsume, ModelName: "health-a", Quota: 300, CreatedAt: common.GetTimestamp()},
+		{Type: LogTypeConsume, ModelName: "health-b", Quota: 700, CreatedAt: common.GetTimestamp()},
+		{Type: LogTypeConsume, ModelName: "health-b", Quota: 5000, CreatedAt: common.GetTimestamp() - 2*24*3600},
+	} {
+		if err := DB.Create(log).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	healths, err := computeModelHealths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the channel's spend is split between its models, not counted for each
+	if healths["health-a"].UsedQuota != 300 || healths["health-b"].UsedQuota != 700 {
+		t.Errorf("used quota %d and %d", healths["health-a"].UsedQuota, healths["health-b"].UsedQuota)
+	}
+}
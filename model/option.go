@@ -34,11 +34,34 @@ func InitOptionMap() {
 	common.OptionMap["TurnstileCheckEnabled"] = strconv.FormatBool(common.TurnstileCheckEnabled)
 	common.OptionMap["RegisterEnabled"] = strconv.FormatBool(common.RegisterEnabled)
 	common.OptionMap["AutomaticDisableChannelEnabled"] = strconv.FormatBool(common.AutomaticDisableChannelEnabled)
+	common.OptionMap["ChannelAffinityEnabled"] = strconv.FormatBool(common.ChannelAffinityEnabled)
+	common.OptionMap["ChannelWeightDecayEnabled"] = strconv.FormatBool(common.ChannelWeightDecayEnabled)
+	common.OptionMap["StreamCompressionEnabled"] = strconv.FormatBool(common.StreamCompressionEnabled)
+	common.OptionMap["CostFooterEnabled"] = strconv.FormatBool(common.CostFooterEnabled)
+	common.OptionMap["QuotaTransferAutoApproveEnabled"] = strconv.FormatBool(common.QuotaTransferAutoApproveEnabled)
+	common.OptionMap["PromptMaskEnabled"] = strconv.FormatBool(common.PromptMaskEnabled)
+	common.OptionMap["PromptMaskPrefixLength"] = strconv.Itoa(common.PromptMaskPrefixLength)
+	common.OptionMap["StreamQuotaCutoffEnabled"] = strconv.FormatBool(common.StreamQuotaCutoffEnabled)
+	common.OptionMap["StreamQuotaOverdraft"] = strconv.Itoa(common.StreamQuotaOverdraft)
+	common.OptionMap["StripSystemFingerprintEnabled"] = strconv.FormatBool(common.StripSystemFingerprintEnabled)
+	common.OptionMap["AzureEmptyChoiceChunkEnabled"] = strconv.FormatBool(common.AzureEmptyChoiceChunkEnabled)
+	common.OptionMap["ReasoningModelParamStripEnabled"] = strconv.FormatBool(common.ReasoningModelParamStripEnabled)
+	common.OptionMap["StreamUsageChunkEnabled"] = strconv.FormatBool(common.StreamUsageChunkEnabled)
+	common.OptionMap["JSONModeStrictEnabled"] = strconv.FormatBool(common.JSONModeStrictEnabled)
+	common.OptionMap["ErrorMessageScrubPatterns"] = common.ErrorMessageScrubPatterns
+	common.OptionMap["ResponseDelayEnabled"] = strconv.FormatBool(common.ResponseDelayEnabled)
+	common.OptionMap["ResponseDelayMin"] = strconv.Itoa(common.ResponseDelayMin)
+	common.OptionMap["ResponseDelayMax"] = strconv.Itoa(common.ResponseDelayMax)
 	common.OptionMap["ApproximateTokenEnabled"] = strconv.FormatBool(common.ApproximateTokenEnabled)
+	common.OptionMap["ApproximateCountWarningEnabled"] = strconv.FormatBool(common.ApproximateCountWarningEnabled)
+	common.OptionMap["ImageTokenStrictEnabled"] = strconv.FormatBool(common.ImageTokenStrictEnabled)
 	common.OptionMap["LogConsumeEnabled"] = strconv.FormatBool(common.LogConsumeEnabled)
 	common.OptionMap["DisplayInCurrencyEnabled"] = strconv.FormatBool(common.DisplayInCurrencyEnabled)
 	common.OptionMap["DisplayTokenStatEnabled"] = strconv.FormatBool(common.DisplayTokenStatEnabled)
 	common.OptionMap["ChannelDisableThreshold"] = strconv.FormatFloat(common.ChannelDisableThreshold, 'f', -1, 64)
+	common.OptionMap["ChannelSLOTarget"] = strconv.FormatFloat(common.ChannelSLOTarget, 'f', -1, 64)
+	common.OptionMap["ChannelSLODeprioritizeThreshold"] = strconv.FormatFloat(common.ChannelSLODeprioritizeThreshold, 'f', -1, 64)
+	common.OptionMap["AudioCompletionRatio"] = strconv.FormatFloat(common.AudioCompletionRatio, 'f', -1, 64)
 	common.OptionMap["EmailDomainRestrictionEnabled"] = strconv.FormatBool(common.EmailDomainRestrictionEnabled)
 	common.OptionMap["EmailDomainWhitelist"] = strings.Join(common.EmailDomainWhitelist, ",")
 	common.OptionMap["SMTPServer"] = ""
@@ -64,13 +87,66 @@ func InitOptionMap() {
 	common.OptionMap["QuotaForInviter"] = strconv.Itoa(common.QuotaForInviter)
 	common.OptionMap["QuotaForInvitee"] = strconv.Itoa(common.QuotaForInvitee)
 	common.OptionMap["QuotaRemindThreshold"] = strconv.Itoa(common.QuotaRemindThreshold)
+	common.OptionMap["TokenExpiryRemindHours"] = strconv.Itoa(common.TokenExpiryRemindHours)
+	common.OptionMap["ReminderWebhookURL"] = common.ReminderWebhookURL
+	common.OptionMap["ReminderWebhookSecret"] = ""
+	common.OptionMap["ProvisionedTokenMaxTTL"] = strconv.Itoa(common.ProvisionedTokenMaxTTL)
 	common.OptionMap["PreConsumedQuota"] = strconv.Itoa(common.PreConsumedQuota)
+	common.OptionMap["FineTuningJobQuota"] = strconv.Itoa(common.FineTuningJobQuota)
+	common.OptionMap["AudioInputTokensPerSecond"] = strconv.Itoa(common.AudioInputTokensPerSecond)
+	common.OptionMap["MaxMessageContentSize"] = strconv.Itoa(common.MaxMessageContentSize)
+	common.OptionMap["MessageSanitizeMode"] = common.MessageSanitizeMode
+	common.OptionMap["StreamTrailingDataMode"] = common.StreamTrailingDataMode
 	common.OptionMap["ModelRatio"] = common.ModelRatio2JSONString()
+	common.OptionMap["ModelIORatio"] = common.ModelIORatio2JSONString()
 	common.OptionMap["GroupRatio"] = common.GroupRatio2JSONString()
+	common.OptionMap["GroupMaxMessages"] = common.GroupMaxMessages2JSONString()
+	common.OptionMap["GroupMaxTokens"] = common.GroupMaxTokens2JSONString()
+	common.OptionMap["GroupModelDowngrade"] = common.GroupModelDowngrade2JSONString()
+	common.OptionMap["GroupLatencyBudget"] = common.GroupLatencyBudget2JSONString()
+	common.OptionMap["GroupApproximateToken"] = common.GroupApproximateToken2JSONString()
+	common.OptionMap["GroupStorePolicy"] = common.GroupStorePolicy2JSONString()
+	common.OptionMap["GroupFallbacks"] = common.GroupFallbacks2JSONString()
+	common.OptionMap["VirtualModels"] = common.VirtualModels2JSONString()
+	common.OptionMap["DalleImagePromptRequirements"] = common.DalleImagePromptRequirements2JSONString()
+	common.OptionMap["ImageTokenParameters"] = common.ImageTokenParameters2JSONString()
+	common.OptionMap["ModelTimeouts"] = common.ModelTimeouts2JSONString()
+	common.OptionMap["ApproximateTokenModels"] = common.ApproximateTokenModels2JSONString()
+	common.OptionMap["ModelFallbacks"] = common.ModelFallbacks2JSONString()
+	common.OptionMap["ContextLengthFallbacks"] = common.ContextLengthFallbacks2JSONString()
+	common.OptionMap["ModelContextLimits"] = common.ModelContextLimits2JSONString()
+	common.OptionMap["ModelStreamModes"] = common.ModelStreamModes2JSONString()
+	common.OptionMap["StreamModeMismatchAction"] = common.StreamModeMismatchAction
+	common.OptionMap["RequestSignatureTolerance"] = strconv.Itoa(common.RequestSignatureTolerance)
+	common.OptionMap["ServiceTierRatios"] = common.ServiceTierRatios2JSONString()
+	common.OptionMap["ForwardedRequestHeaders"] = common.ForwardedRequestHeaders
+	common.OptionMap["ChannelTypeForwardedRequestHeaders"] = common.ChannelTypeForwardedRequestHeaders2JSONString()
+	common.OptionMap["DalleImagePromptLengthLimitations"] = common.DalleImagePromptLengthLimitations2JSONString()
 	common.OptionMap["TopUpLink"] = common.TopUpLink
 	common.OptionMap["ChatLink"] = common.ChatLink
 	common.OptionMap["QuotaPerUnit"] = strconv.FormatFloat(common.QuotaPerUnit, 'f', -1, 64)
 	common.OptionMap["RetryTimes"] = strconv.Itoa(common.RetryTimes)
+	common.OptionMap["UpstreamRetryTimes"] = strconv.Itoa(common.UpstreamRetryTimes)
+	common.OptionMap["UpstreamRetryBackoff"] = strconv.Itoa(common.UpstreamRetryBackoff)
+	common.OptionMap["AppTagHeader"] = common.AppTagHeader
+	common.OptionMap["SupportContact"] = common.SupportContact
+	common.OptionMap["TokenHeaderName"] = common.TokenHeaderName
+	common.OptionMap["FreeModels"] = common.FreeModels
+	common.OptionMap["DisabledModels"] = common.DisabledModels
+	common.OptionMap["AllowedImageMimeTypes"] = common.AllowedImageMimeTypes
+	common.OptionMap["MaxImagesPerRequest"] = strconv.Itoa(common.MaxImagesPerRequest)
+	common.OptionMap["MaxImagesPerMessage"] = strconv.Itoa(common.MaxImagesPerMessage)
+	common.OptionMap["CostExportDestination"] = common.CostExportDestination
+	common.OptionMap["CostExportWebhookSecret"] = ""
+	common.OptionMap["CostExportRetryTimes"] = strconv.Itoa(common.CostExportRetryTimes)
+	common.OptionMap["MaxImageBytesPerRequest"] = strconv.Itoa(common.MaxImageBytesPerRequest)
+	common.OptionMap["MaxImageBytes"] = strconv.Itoa(common.MaxImageBytes)
+	common.OptionMap["ImageCountConcurrency"] = strconv.Itoa(common.ImageCountConcurrency)
+	common.OptionMap["ChannelWarmUpCount"] = strconv.Itoa(common.ChannelWarmUpCount)
+	common.OptionMap["ImageCountTimeout"] = strconv.Itoa(common.ImageCountTimeout)
+	common.OptionMap["DuplicateRequestLimit"] = strconv.Itoa(common.DuplicateRequestLimit)
+	common.OptionMap["DuplicateRequestWindow"] = strconv.Itoa(common.DuplicateRequestWindow)
+	common.OptionMap["DuplicateRequestExemptModels"] = common.DuplicateRequestExemptModels
 	common.OptionMapRWMutex.Unlock()
 	loadOptionsFromDatabase()
 }
@@ -147,8 +223,38 @@ func updateOptionMap(key string, value string) (err error) {
 			common.EmailDomainRestrictionEnabled = boolValue
 		case "AutomaticDisableChannelEnabled":
 			common.AutomaticDisableChannelEnabled = boolValue
+		case "ChannelAffinityEnabled":
+			common.ChannelAffinityEnabled = boolValue
+		case "ChannelWeightDecayEnabled":
+			common.ChannelWeightDecayEnabled = boolValue
+		case "StreamCompressionEnabled":
+			common.StreamCompressionEnabled = boolValue
+		case "CostFooterEnabled":
+			common.CostFooterEnabled = boolValue
+		case "QuotaTransferAutoApproveEnabled":
+			common.QuotaTransferAutoApproveEnabled = boolValue
+		case "PromptMaskEnabled":
+			common.PromptMaskEnabled = boolValue
+		case "StreamQuotaCutoffEnabled":
+			common.StreamQuotaCutoffEnabled = boolValue
+		case "StripSystemFingerprintEnabled":
+			common.StripSystemFingerprintEnabled = boolValue
+		case "AzureEmptyChoiceChunkEnabled":
+			common.AzureEmptyChoiceChunkEnabled = boolValue
+		case "ReasoningModelParamStripEnabled":
+			common.ReasoningModelParamStripEnabled = boolValue
+		case "StreamUsageChunkEnabled":
+			common.StreamUsageChunkEnabled = boolValue
+		case "JSONModeStrictEnabled":
+			common.JSONModeStrictEnabled = boolValue
+		case "ResponseDelayEnabled":
+			common.ResponseDelayEnabled = boolValue
 		case "ApproximateTokenEnabled":
 			common.ApproximateTokenEnabled = boolValue
+		case "ApproximateCountWarningEnabled":
+			common.ApproximateCountWarningEnabled = boolValue
+		case "ImageTokenStrictEnabled":
+			common.ImageTokenStrictEnabled = boolValue
 		case "LogConsumeEnabled":
 			common.LogConsumeEnabled = boolValue
 		case "DisplayInCurrencyEnabled":
@@ -203,18 +309,140 @@ func updateOptionMap(key string, value string) (err error) {
 		common.QuotaRemindThreshold, _ = strconv.Atoi(value)
 	case "PreConsumedQuota":
 		common.PreConsumedQuota, _ = strconv.Atoi(value)
+	case "AudioInputTokensPerSecond":
+		common.AudioInputTokensPerSecond, _ = strconv.Atoi(value)
+	case "PromptMaskPrefixLength":
+		common.PromptMaskPrefixLength, _ = strconv.Atoi(value)
+	case "StreamQuotaOverdraft":
+		common.StreamQuotaOverdraft, _ = strconv.Atoi(value)
+	case "ProvisionedTokenMaxTTL":
+		common.ProvisionedTokenMaxTTL, _ = strconv.Atoi(value)
+	case "TokenExpiryRemindHours":
+		common.TokenExpiryRemindHours, _ = strconv.Atoi(value)
+	case "ReminderWebhookURL":
+		common.ReminderWebhookURL = value
+	case "ReminderWebhookSecret":
+		common.ReminderWebhookSecret = value
+	case "FineTuningJobQuota":
+		common.FineTuningJobQuota, _ = strconv.Atoi(value)
+	case "MaxMessageContentSize":
+		common.MaxMessageContentSize, _ = strconv.Atoi(value)
+	case "ResponseDelayMin":
+		common.ResponseDelayMin, _ = strconv.Atoi(value)
+	case "ResponseDelayMax":
+		common.ResponseDelayMax, _ = strconv.Atoi(value)
 	case "RetryTimes":
 		common.RetryTimes, _ = strconv.Atoi(value)
+	case "UpstreamRetryTimes":
+		common.UpstreamRetryTimes, _ = strconv.Atoi(value)
+	case "UpstreamRetryBackoff":
+		common.UpstreamRetryBackoff, _ = strconv.Atoi(value)
+	case "RequestSignatureTolerance":
+		common.RequestSignatureTolerance, _ = strconv.Atoi(value)
+	case "DuplicateRequestLimit":
+		common.DuplicateRequestLimit, _ = strconv.Atoi(value)
+	case "DuplicateRequestWindow":
+		common.DuplicateRequestWindow, _ = strconv.Atoi(value)
+	case "DuplicateRequestExemptModels":
+		common.DuplicateRequestExemptModels = value
 	case "ModelRatio":
 		err = common.UpdateModelRatioByJSONString(value)
+	case "ModelIORatio":
+		err = common.UpdateModelIORatioByJSONString(value)
 	case "GroupRatio":
 		err = common.UpdateGroupRatioByJSONString(value)
+	case "GroupMaxMessages":
+		err = common.UpdateGroupMaxMessagesByJSONString(value)
+	case "GroupMaxTokens":
+		err = common.UpdateGroupMaxTokensByJSONString(value)
+	case "GroupModelDowngrade":
+		err = common.UpdateGroupModelDowngradeByJSONString(value)
+	case "GroupLatencyBudget":
+		err = common.UpdateGroupLatencyBudgetByJSONString(value)
+	case "GroupApproximateToken":
+		err = common.UpdateGroupApproximateTokenByJSONString(value)
+	case "GroupStorePolicy":
+		err = common.UpdateGroupStorePolicyByJSONString(value)
+	case "GroupFallbacks":
+		err = common.UpdateGroupFallbacksByJSONString(value)
+	case "VirtualModels":
+		err = common.UpdateVirtualModelsByJSONString(value)
+	case "DalleImagePromptRequirements":
+		err = common.UpdateDalleImagePromptRequirementsByJSONString(value)
+	case "ImageTokenParameters":
+		err = common.UpdateImageTokenParametersByJSONString(value)
+	case "ModelTimeouts":
+		err = common.UpdateModelTimeoutsByJSONString(value)
+	case "ApproximateTokenModels":
+		err = common.UpdateApproximateTokenModelsByJSONString(value)
+	case "ModelFallbacks":
+		err = common.UpdateModelFallbacksByJSONString(value)
+	case "ContextLengthFallbacks":
+		err = common.UpdateContextLengthFallbacksByJSONString(value)
+	case "ModelContextLimits":
+		err = common.UpdateModelContextLimitsByJSONString(value)
+	case "ModelStreamModes":
+		err = common.UpdateModelStreamModesByJSONString(value)
+	case "StreamModeMismatchAction":
+		common.StreamModeMismatchAction = value
+	case "ServiceTierRatios":
+		err = common.UpdateServiceTierRatiosByJSONString(value)
+	case "ForwardedRequestHeaders":
+		common.ForwardedRequestHeaders = value
+	case "ChannelTypeForwardedRequestHeaders":
+		err = common.UpdateChannelTypeForwardedRequestHeadersByJSONString(value)
+	case "DalleImagePromptLengthLimitations":
+		err = common.UpdateDalleImagePromptLengthLimitationsByJSONString(value)
 	case "TopUpLink":
 		common.TopUpLink = value
 	case "ChatLink":
 		common.ChatLink = value
+	case "AppTagHeader":
+		common.AppTagHeader = value
+	case "SupportContact":
+		common.SupportContact = value
+	case "ErrorMessageScrubPatterns":
+		err = common.UpdateErrorMessageScrubPatterns(value)
+	case "MessageSanitizeMode":
+		common.MessageSanitizeMode = value
+	case "StreamTrailingDataMode":
+		common.StreamTrailingDataMode = value
+	case "TokenHeaderName":
+		common.TokenHeaderName = value
+	case "FreeModels":
+		common.FreeModels = value
+	case "DisabledModels":
+		common.DisabledModels = value
+	case "AllowedImageMimeTypes":
+		common.AllowedImageMimeTypes = value
+	case "MaxImagesPerRequest":
+		common.MaxImagesPerRequest, _ = strconv.Atoi(value)
+	case "MaxImagesPerMessage":
+		common.MaxImagesPerMessage, _ = strconv.Atoi(value)
+	case "CostExportDestination":
+		common.CostExportDestination = value
+	case "CostExportWebhookSecret":
+		common.CostExportWebhookSecret = value
+	case "CostExportRetryTimes":
+		common.CostExportRetryTimes, _ = strconv.Atoi(value)
+	case "MaxImageBytesPerRequest":
+		common.MaxImageBytesPerRequest, _ = strconv.Atoi(value)
+	case "MaxImageBytes":
+		common.MaxImageBytes, _ = strconv.Atoi(value)
+	case "ImageCountConcurrency":
+		common.ImageCountConcurrency, _ = strconv.Atoi(value)
+	case "ChannelWarmUpCount":
+		common.ChannelWarmUpCount, _ = strconv.Atoi(value)
+	case "ImageCountTimeout":
+		common.ImageCountTimeout, _ = strconv.Atoi(value)
 	case "ChannelDisableThreshold":
 		common.ChannelDisableThreshold, _ = strconv.ParseFloat(value, 64)
+	case "ChannelSLOTarget":
+		common.ChannelSLOTarget, _ = strconv.ParseFloat(value, 64)
+	case "ChannelSLODeprioritizeThreshold":
+		common.ChannelSLODeprioritizeThreshold, _ = strconv.ParseFloat(value, 64)
+	case "AudioCompletionRatio":
+		common.AudioCompletionRatio, _ = strconv.ParseFloat(value, 64)
 	case "QuotaPerUnit":
 		common.QuotaPerUnit, _ = strconv.ParseFloat(value, 64)
 	}
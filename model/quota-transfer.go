@@ -0,0 +1,155 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"one-api/common"
+)
+
+// QuotaTransfer moves quota between users, the quota is held from the sender until the transfer
+// is approved, or released when it is cancelled or rejected
+type QuotaTransfer struct {
+	Id          int   `json:"id"`
+	FromUserId  int   `json:"from_user_id" gorm:"index"`
+	ToUserId    int   `json:"to_user_id" gorm:"index"`
+	TenantId    int   `json:"tenant_id" gorm:"index"` // the sender's tenant, reseller admins only review their own
+	Quota       int   `json:"quota"`
+	Status      int   `json:"status" gorm:"default:1;index"`
+	CreatedTime int64 `json:"created_time" gorm:"bigint"`
+	UpdatedTime int64 `json:"updated_time" gorm:"bigint"`
+}
+
+func GetQuotaTransferById(id int) (*QuotaTransfer, error) {
+	if id == 0 {
+		return nil, errors.New("id 为空！")
+	}
+	transfer := QuotaTransfer{Id: id}
+	err := DB.First(&transfer, "id = ?", id).Error
+	return &transfer, err
+}
+
+func GetUserQuotaTransfers(userId int, startIdx int, num int) (transfers []*QuotaTransfer, err error) {
+	err = DB.Where("from_user_id = ? or to_user_id = ?", userId, userId).Order("id desc").Limit(num).Offset(startIdx).Find(&transfers).Error
+	return transfers, err
+}
+
+func GetPendingQuotaTransfers(tenantId int) (transfers []*QuotaTransfer, err error) {
+	tx := DB.Where("status = ?", common.QuotaTransferStatusPending)
+	if tenantId != 0 {
+		tx = tx.Where("tenant_id = ?", tenantId)
+	}
+	err = tx.Order("id").Find(&transfers).Error
+	return transfers, err
+}
+
+// CreateQuotaTransfer holds the quota from the sender and records a pending transfer
+func CreateQuotaTransfer(fromId int, toId int, tenantId int, quota int) (*QuotaTransfer, error) {
+	if quota <= 0 {
+		return nil, errors.New("quota 必须大于 0！")
+	}
+	now := common.GetTimestamp()
+	transfer := &QuotaTransfer{
+		FromUserId:  fromId,
+		ToUserId:    toId,
+		TenantId:    tenantId,
+		Quota:       quota,
+		Status:      common.QuotaTransferStatusPending,
+		CreatedTime: now,
+		UpdatedTime: now,
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).Where("id = ? and quota >= ?", fromId, quota).Update("quota", gorm.Expr("quota - ?", quota))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("额度不足")
+		}
+		return tx.Create(transfer).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	RecordLog(fromId, LogTypeManage, fmt.Sprintf("发起额度转账 #%d，向用户 #%d 转出 %s，等待审核", transfer.Id, toId, common.LogQuota(quota)))
+	return transfer, nil
+}
+
+// settleQuotaTransfer moves a pending transfer to status, crediting the recipient on approval and
+// refunding the sender otherwise. Settling a transfer again with the same status is a no-op.
+func settleQuotaTransfer(id int, status int, check func(transfer *QuotaTransfer) error) (*QuotaTransfer, error) {
+	var transfer QuotaTransfer
+	settled := false
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.First(&transfer, "id = ?", id).Error
+		if err != nil {
+			return err
+		}
+		if err := check(&transfer); err != nil {
+			return err
+		}
+		if transfer.Status == status {
+			return nil
+		}
+		result := tx.Model(&QuotaTransfer{}).Where("id = ? and status = ?", id, common.QuotaTransferStatusPending).
+			Updates(map[string]any{"status": status, "updated_time": common.GetTimestamp()})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("该转账已处理")
+		}
+		userId := transfer.FromUserId
+		if status == common.QuotaTransferStatusCompleted {
+			userId = transfer.ToUserId
+		}
+		transfer.Status = status
+		settled = true
+		return tx.Model(&User{}).Where("id = ?", userId).Update("quota", gorm.Expr("quota + ?", transfer.Quota)).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !settled {
+		return &transfer, nil
+	}
+	switch status {
+	case common.QuotaTransferStatusCompleted:
+		RecordLog(transfer.FromUserId, LogTypeManage, fmt.Sprintf("额度转账 #%d 已完成，向用户 #%d 转出 %s", transfer.Id, transfer.ToUserId, common.LogQuota(transfer.Quota)))
+		RecordLog(transfer.ToUserId, LogTypeManage, fmt.Sprintf("额度转账 #%d 已完成，收到用户 #%d 转入 %s", transfer.Id, transfer.FromUserId, common.LogQuota(transfer.Quota)))
+	case common.QuotaTransferStatusCancelled:
+		RecordLog(transfer.FromUserId, LogTypeManage, fmt.Sprintf("额度转账 #%d 已取消，退回 %s", transfer.Id, common.LogQuota(transfer.Quota)))
+	case common.QuotaTransferStatusRejected:
+		RecordLog(transfer.FromUserId, LogTypeManage, fmt.Sprintf("额度转账 #%d 被拒绝，退回 %s", transfer.Id, common.LogQuota(transfer.Quota)))
+	}
+	return &transfer, nil
+}
+
+// ApproveQuotaTransfer credits the recipient, approving an approved transfer again succeeds without effect
+func ApproveQuotaTransfer(id int, tenantId int) (*QuotaTransfer, error) {
+	return settleQuotaTransfer(id, common.QuotaTransferStatusCompleted, func(transfer *QuotaTransfer) error {
+		if tenantId != 0 && transfer.TenantId != tenantId {
+			return errors.New("转账不存在")
+		}
+		return nil
+	})
+}
+
+func RejectQuotaTransfer(id int, tenantId int) (*QuotaTransfer, error) {
+	return settleQuotaTransfer(id, common.QuotaTransferStatusRejected, func(transfer *QuotaTransfer) error {
+		if tenantId != 0 && transfer.TenantId != tenantId {
+			return errors.New("转账不存在")
+		}
+		return nil
+	})
+}
+
+// CancelQuotaTransfer releases the hold, only the sender can cancel and only before approval
+func CancelQuotaTransfer(id int, userId int) (*QuotaTransfer, error) {
+	return settleQuotaTransfer(id, common.QuotaTransferStatusCancelled, func(transfer *QuotaTransfer) error {
+		if transfer.FromUserId != userId {
+			return errors.New("转账不存在")
+		}
+		return nil
+	})
+}
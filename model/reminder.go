@@ -0,0 +1,182 @@
+package model
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"one-api/common"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ReminderEventQuotaLow       = "quota_low"
+	ReminderEventQuotaExhausted = "quota_exhausted"
+	ReminderEventTokenExpiry    = "token_expiry"
+)
+
+// the same debounced reminder is sent at most once per window
+const reminderDebounceWindow = 24 * time.Hour
+
+// Reminder records when a debounced reminder was last sent, in the database so that all nodes
+// share it and a restart does not send the reminders again
+type Reminder struct {
+	Key    string `gorm:"column:reminder_key;primaryKey;type:varchar(64)"`
+	SentAt int64  `gorm:"bigint"`
+}
+
+var reminderWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// reminderPayload is the body posted to ReminderWebhookURL
+type reminderPayload struct {
+	Event     string `json:"event"`
+	UserId    int    `json:"user_id"`
+	TokenId   int    `json:"token_id,omitempty"`
+	Subject   string `json:"subject"`
+	Content   string `json:"content"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// shouldSendReminder tells whether the debounced reminder with the key was not sent within the window, and marks it sent,
+// the conditional update and the insert let a single node claim it
+func shouldSendReminder(key string, now time.Time) bool {
+	sentAt := now.Unix()
+	result := DB.Model(&Reminder{}).Where("reminder_key = ? and sent_at <= ?", key, sentAt-int64(reminderDebounceWindow.Seconds())).
+		Update("sent_at", sentAt)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result = DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&Reminder{Key: key, SentAt: sentAt})
+	}
+	if result.Error != nil {
+		common.SysError("failed to record reminder: " + result.Error.Error())
+		return false
+	}
+	return result.RowsAffected > 0
+}
+
+// sendUserReminder emails the user and posts the reminder to ReminderWebhookURL if configured
+func sendUserReminder(payload reminderPayload) {
+	payload.Timestamp = common.GetTimestamp()
+	go func() {
+		email, err := GetUserEmail(payload.UserId)
+		if err != nil {
+			common.SysError("failed to fetch user email: " + err.Error())
+		}
+		if email != "" {
+			err = common.SendEmail(payload.Subject, email, payload.Content)
+			if err != nil {
+				common.SysError("failed to send email" + err.Error())
+			}
+		}
+		if common.ReminderWebhookURL != "" {
+			err = postReminderWebhook(payload)
+			if err != nil {
+				common.SysError("failed to post reminder webhook: " + err.Error())
+			}
+		}
+	}()
+}
+
+// postReminderWebhook signs the body like the cost export webhook when ReminderWebhookSecret is set
+func postReminderWebhook(payload reminderPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, common.ReminderWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if common.ReminderWebhookSecret != "" {
+		timestamp := strconv.FormatInt(payload.Timestamp, 10)
+		mac := hmac.New(sha256.New, []byte(common.ReminderWebhookSecret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		req.Header.Set("X-Oneapi-Timestamp", timestamp)
+		req.Header.Set("X-Oneapi-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := reminderWebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// remindUserQuota warns the user whose quota crosses QuotaRemindThreshold or runs out, once per debounce window and event
+func remindUserQuota(userId int, userQuota int, noMoreQuota bool) {
+	prompt := "您的额度即将用尽"
+	event := ReminderEventQuotaLow
+	if noMoreQuota {
+		prompt = "您的额度已用尽"
+		event = ReminderEventQuotaExhausted
+	}
+	if !shouldSendReminder(fmt.Sprintf("%s:%d", event, userId), time.Now()) {
+		return
+	}
+	topUpLink := fmt.Sprintf("%s/topup", common.ServerAddress)
+	sendUserReminder(reminderPayload{
+		Event:   event,
+		UserId:  userId,
+		Subject: prompt,
+		Content: fmt.Sprintf("%s，当前剩余额度为 %d，为了不影响您的使用，请及时充值。<br/>充值链接：<a href='%s'>%s</a>", prompt, userQuota, topUpLink, topUpLink),
+	})
+}
+
+// remindTokenExpiry warns the owner of a token that expires within TokenExpiryRemindHours, once per debounce window
+func remindTokenExpiry(token *Token) {
+	if common.TokenExpiryRemindHours <= 0 || token.ExpiredTime == -1 {
+		return
+	}
+	remaining := token.ExpiredTime - common.GetTimestamp()
+	if remaining <= 0 || remaining > int64(common.TokenExpiryRemindHours)*3600 {
+		return
+	}
+	// an extended token is reminded again for its new expiry
+	if !shouldSendReminder(fmt.Sprintf("%s:%d:%d", ReminderEventTokenExpiry, token.Id, token.ExpiredTime), time.Now()) {
+		return
+	}
+	subject := fmt.Sprintf("您的令牌 %s 即将过期", token.Name)
+	sendUserReminder(reminderPayload{
+		Event:   ReminderEventTokenExpiry,
+		UserId:  token.UserId,
+		TokenId: token.Id,
+		Subject: subject,
+		Content: fmt.Sprintf("%s，过期时间为 %s，为了不影响您的使用，请及时延长有效期。",
+			subject, time.Unix(token.ExpiredTime, 0).Format("2006-01-02 15:04:05")),
+	})
+}
+
+// AutomaticallyRemindExpiringTokens looks for tokens expiring within TokenExpiryRemindHours every hour,
+// off the relay path, the reminders are debounced so every node may run it
+func AutomaticallyRemindExpiringTokens() {
+	for {
+		if common.TokenExpiryRemindHours > 0 {
+			RemindExpiringTokens()
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func RemindExpiringTokens() {
+	var tokens []*Token
+	now := common.GetTimestamp()
+	err := DB.Where("status = ? and expired_time != -1 and expired_time > ? and expired_time <= ?", common.TokenStatusEnabled,
+		now, now+int64(common.TokenExpiryRemindHours)*3600).Find(&tokens).Error
+	if err != nil {
+		common.SysError("failed to get expiring tokens: " + err.Error())
+		return
+	}
+	for _, token := range tokens {
+		remindTokenExpiry(token)
+	}
+}
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"testing"
+	"time"
+)
+
+func startReminderWebhook(t *testing.T) chan reminderPayload {
+	t.Helper()
+	payloads := make(chan reminderPayload, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("reminder-secret"))
+		mac.Write([]byte(r.Header.Get("X-Oneapi-Timestamp") + "."))
+		mac.Write(body)
+		if r.Header.Get("X-Oneapi-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("bad signature %q", r.Header.Get("X-Oneapi-Signature"))
+		}
+		var payload reminderPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+		payloads <- payload
+	}))
+	t.Cleanup(server.Close)
+	url, secret := common.ReminderWebhookURL, common.ReminderWebhookSecret
+	t.Cleanup(func() { common.ReminderWebhookURL, common.ReminderWebhookSecret = url, secret })
+	common.ReminderWebhookURL, common.ReminderWebhookSecret = server.URL, "reminder-secret"
+	return payloads
+}
+
+func receiveReminder(payloads chan reminderPayload) *reminderPayload {
+	select {
+	case payload := <-payloads:
+		return &payload
+	case <-time.After(300 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestSoonExpiringTokenSendsDebouncedReminder(t *testing.T) {
+	defer func(hours int) { common.TokenExpiryRemindHours = hours }(common.TokenExpiryRemindHours)
+	common.TokenExpiryRemindHours = 24
+	payloads := startReminderWebhook(t)
+	user := createTestUser(t, "expiring", 0)
+	token := &Token{UserId: user.Id, Name: "expiring", Key: common.GetUUID(), Status: common.TokenStatusEnabled,
+		ExpiredTime: common.GetTimestamp() + 3600}
+	later := &Token{UserId: user.Id, Name: "later", Key: common.GetUUID(), Status: common.TokenStatusEnabled,
+		ExpiredTime: common.GetTimestamp() + 72*3600}
+	for _, tk := range []*Token{token, later} {
+		if err := DB.Create(tk).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	RemindExpiringTokens()
+	payload := receiveReminder(payloads)
+	if payload == nil || payload.Event != ReminderEventTokenExpiry || payload.TokenId != token.Id || payload.UserId != user.Id {
+		t.Fatalf("got reminder %+v", payload)
+	}
+	if payload := receiveReminder(payloads); payload != nil {
+		t.Errorf("a token expiring in 3 days was reminded, got %+v", payload)
+	}
+	RemindExpiringTokens()
+	if payload := receiveReminder(payloads); payload != nil {
+		t.Errorf("the expiry reminder was not debounced, got %+v", payload)
+	}
+	token.ExpiredTime += 60
+	remindTokenExpiry(token)
+	if payload := receiveReminder(payloads); payload == nil {
+		t.Error("an extended token was not reminded of its new expiry")
+	}
+}
+
+func TestQuotaReminderIsDebouncedPerEvent(t *testing.T) {
+	payloads := startReminderWebhook(t)
+	user := createTestUser(t, "low quota", 0)
+	remindUserQuota(user.Id, 900, false)
+	remindUserQuota(user.Id, 0, true)
+	events := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		if payload := receiveReminder(payloads); payload != nil {
+			events[payload.Event] = true
+		}
+	}
+	if !events[ReminderEventQuotaLow] || !events[ReminderEventQuotaExhausted] {
+		t.Errorf("got events %v", events)
+	}
+	remindUserQuota(user.Id, 800, false)
+	if payload := receiveReminder(payloads); payload != nil {
+		t.Errorf("the low quota reminder was not debounced, got %+v", payload)
+	}
+}
+
+func TestReminderDebounceIsPersisted(t *testing.T) {
+	now := time.Now()
+	if !shouldSendReminder("persist:1", now) {
+		t.Fatal("persist:1 was debounced before it was sent")
+	}
+	if shouldSendReminder("persist:1", now.Add(time.Hour)) {
+		t.Error("persist:1 was sent twice within the window")
+	}
+	var reminder Reminder
+	if err := DB.Where("reminder_key = ?", "persist:1").First(&reminder).Error; err != nil || reminder.SentAt != now.Unix() {
+		t.Fatalf("got reminder %+v, err %v", reminder, err)
+	}
+	if !shouldSendReminder("persist:1", now.Add(reminderDebounceWindow)) {
+		t.Error("persist:1 was not sent again after the window")
+	}
+}
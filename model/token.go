@@ -2,9 +2,9 @@ package model
 
 import (
 	"errors"
-	"fmt"
 	"gorm.io/gorm"
 	"one-api/common"
+	"time"
 )
 
 type Token struct {
@@ -18,7 +18,12 @@ type Token struct {
 	ExpiredTime    int64  `json:"expired_time" gorm:"bigint;default:-1"` // -1 means never expired
 	RemainQuota    int    `json:"remain_quota" gorm:"default:0"`
 	UnlimitedQuota bool   `json:"unlimited_quota" gorm:"default:false"`
-	UsedQuota      int    `json:"used_quota" gorm:"default:0"` // used quota
+	UsedQuota      int    `json:"used_quota" gorm:"default:0"`               // used quota
+	AccurateCount  bool   `json:"accurate_count" gorm:"default:false"`       // never use approximate token counting
+	Models         string `json:"models" gorm:"type:text"`                   // comma separated allowed models, empty means all
+	Provisioned    bool   `json:"provisioned" gorm:"default:false"`          // minted by the provisioning api, deleted once expired
+	Audit          bool   `json:"audit" gorm:"default:false"`                // log full prompts even when prompt masking is enabled
+	Secret         string `json:"secret" gorm:"type:varchar(64);default:''"` // HMAC secret of signed requests, empty disables signature verification
 }
 
 func GetAllUserTokens(userId int, startIdx int, num int) ([]*Token, error) {
@@ -93,6 +98,16 @@ func GetTokenById(id int) (*Token, error) {
 	return &token, err
 }
 
+// GetTenantTokenById is GetTokenById restricted to tokens of users of the given tenant
+func GetTenantTokenById(id int, tenantId int) (*Token, error) {
+	if id == 0 {
+		return nil, errors.New("id 为空！")
+	}
+	token := Token{Id: id}
+	err := scopeByTenantUsers(DB, tenantId).First(&token, "id = ?", id).Error
+	return &token, err
+}
+
 func (token *Token) Insert() error {
 	var err error
 	err = DB.Create(token).Error
@@ -102,7 +117,10 @@ func (token *Token) Insert() error {
 // Update Make sure your token's fields is completed, because this will update non-zero values
 func (token *Token) Update() error {
 	var err error
-	err = DB.Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota").Updates(token).Error
+	err = DB.Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota", "accurate_count", "models", "audit", "secret").Updates(token).Error
+	if err == nil {
+		InvalidateTokenCache(token.Key)
+	}
 	return err
 }
 
@@ -114,9 +132,38 @@ func (token *Token) SelectUpdate() error {
 func (token *Token) Delete() error {
 	var err error
 	err = DB.Delete(token).Error
+	if err == nil {
+		// revocation must take effect immediately
+		InvalidateTokenCache(token.Key)
+	}
 	return err
 }
 
+func GetProvisionedTokens(userId int) (tokens []*Token, err error) {
+	err = DB.Where("user_id = ? and provisioned = ?", userId, true).Order("id desc").Find(&tokens).Error
+	return tokens, err
+}
+
+// DeleteExpiredProvisionedTokens garbage-collects short-lived tokens
+func DeleteExpiredProvisionedTokens() {
+	for {
+		if common.IsMasterNode {
+			var tokens []*Token
+			err := DB.Where("provisioned = ? and expired_time != -1 and expired_time < ?", true, common.GetTimestamp()).Find(&tokens).Error
+			if err != nil {
+				common.SysError("failed to get expired provisioned tokens: " + err.Error())
+			}
+			for _, token := range tokens {
+				err = token.Delete()
+				if err != nil {
+					common.SysError("failed to delete expired provisioned token: " + err.Error())
+				}
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
 func DeleteTokenById(id int, userId int) (err error) {
 	// Why we need userId here? In case user want to delete other's token.
 	if id == 0 || userId == 0 {
@@ -174,7 +221,7 @@ func decreaseTokenQuota(id int, quota int) (err error) {
 	return err
 }
 
-func PreConsumeTokenQuota(tokenId int, quota int) (err error) {
+func PreConsumeTokenQuota(tokenId int, quota int, category string) (err error) {
 	if quota < 0 {
 		return errors.New("quota 不能为负数！")
 	}
@@ -185,7 +232,7 @@ func PreConsumeTokenQuota(tokenId int, quota int) (err error) {
 	if !token.UnlimitedQuota && token.RemainQuota < quota {
 		return errors.New("令牌额度不足")
 	}
-	userQuota, err := GetUserQuota(token.UserId)
+	userQuota, _, err := getUserCategoryQuota(token.UserId, category)
 	if err != nil {
 		return err
 	}
@@ -195,24 +242,7 @@ func PreConsumeTokenQuota(tokenId int, quota int) (err error) {
 	quotaTooLow := userQuota >= common.QuotaRemindThreshold && userQuota-quota < common.QuotaRemindThreshold
 	noMoreQuota := userQuota-quota <= 0
 	if quotaTooLow || noMoreQuota {
-		go func() {
-			email, err := GetUserEmail(token.UserId)
-			if err != nil {
-				common.SysError("failed to fetch user email: " + err.Error())
-			}
-			prompt := "您的额度即将用尽"
-			if noMoreQuota {
-				prompt = "您的额度已用尽"
-			}
-			if email != "" {
-				topUpLink := fmt.Sprintf("%s/topup", common.ServerAddress)
-				err = common.SendEmail(prompt, email,
-					fmt.Sprintf("%s，当前剩余额度为 %d，为了不影响您的使用，请及时充值。<br/>充值链接：<a href='%s'>%s</a>", prompt, userQuota, topUpLink, topUpLink))
-				if err != nil {
-					common.SysError("failed to send email" + err.Error())
-				}
-			}
-		}()
+		go remindUserQuota(token.UserId, userQuota, noMoreQuota)
 	}
 	if !token.UnlimitedQuota {
 		err = DecreaseTokenQuota(tokenId, quota)
@@ -220,17 +250,16 @@ func PreConsumeTokenQuota(tokenId int, quota int) (err error) {
 			return err
 		}
 	}
-	err = DecreaseUserQuota(token.UserId, quota)
+	err = consumeUserQuota(token.UserId, category, quota)
 	return err
 }
 
-func PostConsumeTokenQuota(tokenId int, quota int) (err error) {
+func PostConsumeTokenQuota(tokenId int, quota int, category string) (err error) {
 	token, err := GetTokenById(tokenId)
-	if quota > 0 {
-		err = DecreaseUserQuota(token.UserId, quota)
-	} else {
-		err = IncreaseUserQuota(token.UserId, -quota)
+	if err != nil {
+		return err
 	}
+	err = consumeUserQuota(token.UserId, category, quota)
 	if err != nil {
 		return err
 	}
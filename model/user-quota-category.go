@@ -0,0 +1,171 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"gorm.io/gorm"
+	"one-api/common"
+	"strconv"
+	"time"
+)
+
+// Users may have separate quota buckets per category, a NULL bucket means the category
+// spends from the shared quota
+const (
+	QuotaCategoryChat  = "chat"
+	QuotaCategoryImage = "image"
+	QuotaCategoryAudio = "audio"
+)
+
+var QuotaCategories = []string{QuotaCategoryChat, QuotaCategoryImage, QuotaCategoryAudio}
+
+func quotaCategoryColumn(category string) string {
+	switch category {
+	case QuotaCategoryChat:
+		return "chat_quota"
+	case QuotaCategoryImage:
+		return "image_quota"
+	case QuotaCategoryAudio:
+		return "audio_quota"
+	}
+	return ""
+}
+
+// quotaCategoryBatchUpdateTypes are the batch updater stores of the category buckets
+var quotaCategoryBatchUpdateTypes = map[string]int{
+	QuotaCategoryChat:  BatchUpdateTypeChatQuota,
+	QuotaCategoryImage: BatchUpdateTypeImageQuota,
+	QuotaCategoryAudio: BatchUpdateTypeAudioQuota,
+}
+
+// getUserCategoryQuota returns the remaining quota of the category bucket, or the shared quota
+// when the user has no bucket for the category, in a single query
+func getUserCategoryQuota(id int, category string) (quota int, bucket bool, err error) {
+	column := quotaCategoryColumn(category)
+	if column == "" {
+		quota, err = GetUserQuota(id)
+		return quota, false, err
+	}
+	var sharedQuota int
+	var categoryQuota sql.NullInt64
+	err = DB.Model(&User{}).Where("id = ?", id).Select("quota", column).Row().Scan(&sharedQuota, &categoryQuota)
+	if err != nil {
+		return 0, false, err
+	}
+	if categoryQuota.Valid {
+		return int(categoryQuota.Int64), true, nil
+	}
+	return sharedQuota, false, nil
+}
+
+func userCategoryQuotaKey(id int, category string) string {
+	return fmt.Sprintf("user_quota:%d:%s", id, category)
+}
+
+// CacheGetUserCategoryQuota is getUserCategoryQuota cached like the shared quota,
+// a user without a bucket for the category is cached as "null"
+func CacheGetUserCategoryQuota(id int, category string) (quota int, bucket bool, err error) {
+	if !common.RedisEnabled || quotaCategoryColumn(category) == "" {
+		return getUserCategoryQuota(id, category)
+	}
+	value, err := common.RedisGet(userCategoryQuotaKey(id, category))
+	if err == nil {
+		if value == "null" {
+			quota, err = CacheGetUserQuota(id)
+			return quota, false, err
+		}
+		quota, err = strconv.Atoi(value)
+		return quota, true, err
+	}
+	quota, bucket, err = getUserCategoryQuota(id, category)
+	if err != nil {
+		return 0, false, err
+	}
+	value = "null"
+	if bucket {
+		value = strconv.Itoa(quota)
+	}
+	err = common.RedisSet(userCategoryQuotaKey(id, category), value, time.Duration(UserId2QuotaCacheSeconds)*time.Second)
+	if err != nil {
+		common.SysError("Redis set user category quota error: " + err.Error())
+	}
+	return quota, bucket, nil
+}
+
+// CacheDecreaseUserCategoryQuota is CacheDecreaseUserQuota for the bucket the category spends from
+func CacheDecreaseUserCategoryQuota(id int, category string, quota int) error {
+	if !common.RedisEnabled {
+		return nil
+	}
+	_, bucket, err := CacheGetUserCategoryQuota(id, category)
+	if err != nil {
+		return err
+	}
+	if !bucket {
+		return CacheDecreaseUserQuota(id, quota)
+	}
+	return common.RedisDecrease(userCategoryQuotaKey(id, category), int64(quota))
+}
+
+// GetUserQuotaForCategory returns what the user can spend on the category
+func GetUserQuotaForCategory(id int, category string) (int, error) {
+	quota, _, err := CacheGetUserCategoryQuota(id, category)
+	return quota, err
+}
+
+// consumeUserQuota spends from the category bucket if configured, otherwise from the shared quota,
+// a negative quota refunds
+func consumeUserQuota(id int, category string, quota int) error {
+	_, bucket, err := CacheGetUserCategoryQuota(id, category)
+	if err != nil {
+		return err
+	}
+	if !bucket {
+		if quota > 0 {
+			return DecreaseUserQuota(id, quota)
+		}
+		return IncreaseUserQuota(id, -quota)
+	}
+	if common.BatchUpdateEnabled {
+		addNewRecord(quotaCategoryBatchUpdateTypes[category], id, -quota)
+		return nil
+	}
+	return increaseUserCategoryQuota(id, category, -quota)
+}
+
+func increaseUserCategoryQuota(id int, category string, quota int) error {
+	column := quotaCategoryColumn(category)
+	// a bucket cleared in the meantime stays NULL, the spend is lost like a refund to a deleted user
+	return DB.Model(&User{}).Where("id = ? and "+column+" is not null", id).Update(column, gorm.Expr(column+" + ?", quota)).Error
+}
+
+// ClearUserQuotaBuckets sets the buckets of the categories back to NULL, they spend from the shared quota again
+func ClearUserQuotaBuckets(id int, categories []string) error {
+	columns := make(map[string]interface{}, len(categories))
+	for _, category := range categories {
+		if column := quotaCategoryColumn(category); column != "" {
+			columns[column] = gorm.Expr("NULL")
+		}
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	err := DB.Model(&User{}).Where("id = ?", id).Updates(columns).Error
+	if err != nil {
+		return err
+	}
+	return CacheDeleteUserCategoryQuotas(id)
+}
+
+// CacheDeleteUserCategoryQuotas drops the cached buckets of the user after an admin changed them
+func CacheDeleteUserCategoryQuotas(id int) error {
+	if !common.RedisEnabled {
+		return nil
+	}
+	for _, category := range QuotaCategories {
+		if err := common.RedisDel(userCategoryQuotaKey(id, category)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package model
+
+import (
+	"one-api/common"
+	"testing"
+)
+
+func getTestUserQuotas(t *testing.T, id int) *User {
+	t.Helper()
+	user := &User{}
+	if err := DB.First(user, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestImageSpendDrawsFromImageBucket(t *testing.T) {
+	user := createTestUser(t, "image bucket", 1000)
+	DB.Model(user).Update("image_quota", 500)
+	token := &Token{UserId: user.Id, Name: "bucket", Key: common.GetUUID(), Status: common.TokenStatusEnabled, UnlimitedQuota: true}
+	if err := DB.Create(token).Error; err != nil {
+		t.Fatal(err)
+	}
+	if quota, _ := GetUserQuotaForCategory(user.Id, QuotaCategoryImage); quota != 500 {
+		t.Errorf("image quota is %d", quota)
+	}
+	if quota, _ := GetUserQuotaForCategory(user.Id, QuotaCategoryChat); quota != 1000 {
+		t.Errorf("chat spends from %d, not the shared quota", quota)
+	}
+	if err := PostConsumeTokenQuota(token.Id, 200, QuotaCategoryImage); err != nil {
+		t.Fatal(err)
+	}
+	if err := PostConsumeTokenQuota(token.Id, 100, QuotaCategoryChat); err != nil {
+		t.Fatal(err)
+	}
+	if got := getTestUserQuotas(t, user.Id); got.Quota != 900 || got.ImageQuota == nil || *got.ImageQuota != 300 {
+		t.Errorf("got quota %d and image quota %v", got.Quota, got.ImageQuota)
+	}
+	if err := PreConsumeTokenQuota(token.Id, 400, QuotaCategoryImage); err == nil {
+		t.Error("pre-consumed more than the image bucket holds")
+	}
+}
+
+func TestUserQuotaBucketsGoThroughBatchUpdater(t *testing.T) {
+	defer func(enabled bool) { common.BatchUpdateEnabled = enabled }(common.BatchUpdateEnabled)
+	common.BatchUpdateEnabled = true
+	user := createTestUser(t, "batched bucket", 1000)
+	DB.Model(user).Update("audio_quota", 500)
+	if err := consumeUserQuota(user.Id, QuotaCategoryAudio, 120); err != nil {
+		t.Fatal(err)
+	}
+	if got := getTestUserQuotas(t, user.Id); *got.AudioQuota != 500 {
+		t.Fatalf("the spend was written at once, audio quota %d", *got.AudioQuota)
+	}
+	batchUpdate()
+	if got := getTestUserQuotas(t, user.Id); got.Quota != 1000 || *got.AudioQuota != 380 {
+		t.Errorf("got quota %d and audio quota %d after the batch update", got.Quota, *got.AudioQuota)
+	}
+}
+
+func TestClearUserQuotaBuckets(t *testing.T) {
+	user := createTestUser(t, "cleared bucket", 1000)
+	DB.Model(user).Updates(map[string]interface{}{"chat_quota": 10, "image_quota": 20})
+	if err := ClearUserQuotaBuckets(user.Id, []string{QuotaCategoryChat}); err != nil {
+		t.Fatal(err)
+	}
+	got := getTestUserQuotas(t, user.Id)
+	if got.ChatQuota != nil || got.ImageQuota == nil || *got.ImageQuota != 20 {
+		t.Fatalf("got chat quota %v and image quota %v", got.ChatQuota, got.ImageQuota)
+	}
+	if quota, _ := GetUserQuotaForCategory(user.Id, QuotaCategoryChat); quota != 1000 {
+		t.Errorf("a cleared bucket spends from %d, not the shared quota", quota)
+	}
+}
@@ -11,23 +11,29 @@ import (
 // User if you add sensitive fields, don't forget to clean them in setupLogin function.
 // Otherwise, the sensitive information will be saved on local storage in plain text!
 type User struct {
-	Id               int    `json:"id"`
-	Username         string `json:"username" gorm:"unique;index" validate:"max=12"`
-	Password         string `json:"password" gorm:"not null;" validate:"min=8,max=20"`
-	DisplayName      string `json:"display_name" gorm:"index" validate:"max=20"`
-	Role             int    `json:"role" gorm:"type:int;default:1"`   // admin, common
-	Status           int    `json:"status" gorm:"type:int;default:1"` // enabled, disabled
-	Email            string `json:"email" gorm:"index" validate:"max=50"`
-	GitHubId         string `json:"github_id" gorm:"column:github_id;index"`
-	WeChatId         string `json:"wechat_id" gorm:"column:wechat_id;index"`
-	VerificationCode string `json:"verification_code" gorm:"-:all"`                                    // this field is only for Email verification, don't save it to database!
-	AccessToken      string `json:"access_token" gorm:"type:char(32);column:access_token;uniqueIndex"` // this token is for system management
-	Quota            int    `json:"quota" gorm:"type:int;default:0"`
-	UsedQuota        int    `json:"used_quota" gorm:"type:int;default:0;column:used_quota"` // used quota
-	RequestCount     int    `json:"request_count" gorm:"type:int;default:0;"`               // request number
-	Group            string `json:"group" gorm:"type:varchar(32);default:'default'"`
-	AffCode          string `json:"aff_code" gorm:"type:varchar(32);column:aff_code;uniqueIndex"`
-	InviterId        int    `json:"inviter_id" gorm:"type:int;column:inviter_id;index"`
+	Id               int     `json:"id"`
+	Username         string  `json:"username" gorm:"unique;index" validate:"max=12"`
+	Password         string  `json:"password" gorm:"not null;" validate:"min=8,max=20"`
+	DisplayName      string  `json:"display_name" gorm:"index" validate:"max=20"`
+	Role             int     `json:"role" gorm:"type:int;default:1"`   // admin, common
+	Status           int     `json:"status" gorm:"type:int;default:1"` // enabled, disabled
+	Email            string  `json:"email" gorm:"index" validate:"max=50"`
+	GitHubId         string  `json:"github_id" gorm:"column:github_id;index"`
+	WeChatId         string  `json:"wechat_id" gorm:"column:wechat_id;index"`
+	VerificationCode string  `json:"verification_code" gorm:"-:all"`                                    // this field is only for Email verification, don't save it to database!
+	AccessToken      string  `json:"access_token" gorm:"type:char(32);column:access_token;uniqueIndex"` // this token is for system management
+	Quota            int     `json:"quota" gorm:"type:int;default:0"`
+	UsedQuota        int     `json:"used_quota" gorm:"type:int;default:0;column:used_quota"` // used quota
+	RequestCount     int     `json:"request_count" gorm:"type:int;default:0;"`               // request number
+	Group            string  `json:"group" gorm:"type:varchar(32);default:'default'"`
+	AffCode          string  `json:"aff_code" gorm:"type:varchar(32);column:aff_code;uniqueIndex"`
+	InviterId        int     `json:"inviter_id" gorm:"type:int;column:inviter_id;index"`
+	TenantId         int     `json:"tenant_id" gorm:"type:int;column:tenant_id;default:0;index"` // the reseller admin who owns this user, 0 means global
+	Reseller         bool    `json:"reseller" gorm:"default:false"`                              // scopes an admin to the users of their own tenant
+	ChatQuota        *int    `json:"chat_quota" gorm:"type:int"`                                 // category buckets, null spends from quota
+	ImageQuota       *int    `json:"image_quota" gorm:"type:int"`
+	AudioQuota       *int    `json:"audio_quota" gorm:"type:int"`
+	Discount         float64 `json:"discount" gorm:"default:1"` // negotiated multiplier applied after the group ratio
 }
 
 func GetMaxUserId() int {
@@ -36,16 +42,48 @@ func GetMaxUserId() int {
 	return user.Id
 }
 
-func GetAllUsers(startIdx int, num int) (users []*User, err error) {
-	err = DB.Order("id desc").Limit(num).Offset(startIdx).Omit("password").Find(&users).Error
+// migrateUserTenants puts the users that existed before tenants into the global tenant 0,
+// the column added by AutoMigrate is NULL for them on some databases and NULL matches no tenant scope
+func migrateUserTenants(db *gorm.DB) error {
+	return db.Model(&User{}).Where("tenant_id is null").Update("tenant_id", 0).Error
+}
+
+// scopeUsersByTenant restricts a user query to the given tenant, tenant 0 means no restriction
+func scopeUsersByTenant(tx *gorm.DB, tenantId int) *gorm.DB {
+	if tenantId == 0 {
+		return tx
+	}
+	return tx.Where("tenant_id = ?", tenantId)
+}
+
+// scopeByTenantUsers restricts a query on a table with user_id column to users of the given tenant
+func scopeByTenantUsers(tx *gorm.DB, tenantId int) *gorm.DB {
+	if tenantId == 0 {
+		return tx
+	}
+	return tx.Where("user_id in (?)", DB.Model(&User{}).Select("id").Where("tenant_id = ?", tenantId))
+}
+
+func GetAllUsers(startIdx int, num int, tenantId int) (users []*User, err error) {
+	err = scopeUsersByTenant(DB, tenantId).Order("id desc").Limit(num).Offset(startIdx).Omit("password").Find(&users).Error
 	return users, err
 }
 
-func SearchUsers(keyword string) (users []*User, err error) {
-	err = DB.Omit("password").Where("id = ? or username LIKE ? or email LIKE ? or display_name LIKE ?", keyword, keyword+"%", keyword+"%", keyword+"%").Find(&users).Error
+func SearchUsers(keyword string, tenantId int) (users []*User, err error) {
+	err = scopeUsersByTenant(DB, tenantId).Omit("password").Where("id = ? or username LIKE ? or email LIKE ? or display_name LIKE ?", keyword, keyword+"%", keyword+"%", keyword+"%").Find(&users).Error
 	return users, err
 }
 
+// GetTenantUserById is GetUserById restricted to users of the given tenant
+func GetTenantUserById(id int, tenantId int) (*User, error) {
+	if id == 0 {
+		return nil, errors.New("id 为空！")
+	}
+	user := User{Id: id}
+	err := scopeUsersByTenant(DB, tenantId).Omit("password").First(&user, "id = ?", id).Error
+	return &user, err
+}
+
 func GetUserById(id int, selectAll bool) (*User, error) {
 	if id == 0 {
 		return nil, errors.New("id 为空！")
@@ -108,6 +146,23 @@ func (user *User) Insert(inviterId int) error {
 	return nil
 }
 
+// InsertWithRole creates a user of the role with the quota in a single insert, for provisioning
+// outside of the sign-up flow, nothing is gifted
+func (user *User) InsertWithRole(role int, quota int) error {
+	var err error
+	if user.Password != "" {
+		user.Password, err = common.Password2Hash(user.Password)
+		if err != nil {
+			return err
+		}
+	}
+	user.Role = role
+	user.Quota = quota
+	user.AccessToken = common.GetUUID()
+	user.AffCode = common.GetRandomString(4)
+	return DB.Create(user).Error
+}
+
 func (user *User) Update(updatePassword bool) error {
 	var err error
 	if updatePassword {
@@ -275,6 +330,37 @@ func GetUserGroup(id int) (group string, err error) {
 	return group, err
 }
 
+// GetUserRole returns the role of the user, an error when the user does not exist
+func GetUserRole(id int) (role int, err error) {
+	var user User
+	err = DB.Where("id = ?", id).Select("role").First(&user).Error
+	return user.Role, err
+}
+
+// IsReseller reports whether the admin is scoped to their own tenant
+func IsReseller(id int) bool {
+	var reseller bool
+	if err := DB.Model(&User{}).Where("id = ?", id).Select("reseller").Find(&reseller).Error; err != nil {
+		common.SysError("failed to get reseller flag: " + err.Error())
+		return false
+	}
+	return reseller
+}
+
+// SetUserReseller sets or clears the reseller flag, Updates with a struct would skip false
+func SetUserReseller(id int, reseller bool) error {
+	return DB.Model(&User{}).Where("id = ?", id).Update("reseller", reseller).Error
+}
+
+// GetUserDiscount returns the discount multiplier of the user, 1 when none is set
+func GetUserDiscount(id int) (discount float64, err error) {
+	err = DB.Model(&User{}).Where("id = ?", id).Select("discount").Find(&discount).Error
+	if discount <= 0 {
+		discount = 1
+	}
+	return discount, err
+}
+
 func IncreaseUserQuota(id int, quota int) (err error) {
 	if quota < 0 {
 		return errors.New("quota 不能为负数！")
@@ -307,6 +393,23 @@ func decreaseUserQuota(id int, quota int) (err error) {
 	return err
 }
 
+// TransferUserQuota moves quota from a reseller's own pool to one of their users
+func TransferUserQuota(fromId int, toId int, quota int) error {
+	if quota <= 0 {
+		return errors.New("quota 必须大于 0！")
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).Where("id = ? and quota >= ?", fromId, quota).Update("quota", gorm.Expr("quota - ?", quota))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("额度不足")
+		}
+		return tx.Model(&User{}).Where("id = ?", toId).Update("quota", gorm.Expr("quota + ?", quota)).Error
+	})
+}
+
 func GetRootUserEmail() (email string) {
 	DB.Model(&User{}).Where("role = ?", common.RoleRootUser).Select("email").Find(&email)
 	return email
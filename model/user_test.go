@@ -0,0 +1,71 @@
+package model
+
+import (
+	"one-api/common"
+	"testing"
+)
+
+func TestMigrateUserTenants(t *testing.T) {
+	user := createTestUser(t, "before tenants", 0)
+	if err := DB.Exec("update users set tenant_id = null where id = ?", user.Id).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUserTenants(DB); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	DB.Model(&User{}).Where("id = ? and tenant_id = 0", user.Id).Count(&count)
+	if count != 1 {
+		t.Error("user without tenant not moved to tenant 0")
+	}
+}
+
+func TestTenantScopedQueries(t *testing.T) {
+	reseller := createTestUser(t, "reseller", 0)
+	own := createTestUser(t, "own customer", 0)
+	other := createTestUser(t, "other customer", 0)
+	DB.Model(own).Update("tenant_id", reseller.Id)
+	ownToken := &Token{UserId: own.Id, Name: "own", Key: common.GetUUID(), Status: common.TokenStatusEnabled}
+	otherToken := &Token{UserId: other.Id, Name: "other", Key: common.GetUUID(), Status: common.TokenStatusEnabled}
+	for _, token := range []*Token{ownToken, otherToken} {
+		if err := DB.Create(token).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, err := GetAllUsers(0, 100, reseller.Id)
+	if err != nil || len(users) != 1 || users[0].Id != own.Id {
+		t.Errorf("reseller sees %d users, %v", len(users), err)
+	}
+	if _, err := GetTenantUserById(other.Id, reseller.Id); err == nil {
+		t.Error("reseller got a user of another tenant")
+	}
+	if _, err := GetTenantTokenById(ownToken.Id, reseller.Id); err != nil {
+		t.Errorf("reseller cannot get the token of their user: %v", err)
+	}
+	if _, err := GetTenantTokenById(otherToken.Id, reseller.Id); err == nil {
+		t.Error("reseller got a token of another tenant")
+	}
+	if _, err := GetTenantTokenById(otherToken.Id, 0); err != nil {
+		t.Errorf("root cannot get every token: %v", err)
+	}
+}
+
+func TestAdminRoleIsCached(t *testing.T) {
+	user := createTestUser(t, "cached admin", 0)
+	if CacheIsAdmin(user.Id) {
+		t.Fatal("a common user is an admin")
+	}
+	DB.Model(user).Update("role", common.RoleAdminUser)
+	if CacheIsAdmin(user.Id) {
+		t.Error("the role was read from the database again")
+	}
+	if err := CacheDeleteUserRole(user.Id); err != nil {
+		t.Fatal(err)
+	}
+	if !CacheIsAdmin(user.Id) {
+		t.Error("the promotion is not seen after dropping the cached role")
+	}
+	if CacheIsAdmin(0) {
+		t.Error("an anonymous request is an admin")
+	}
+}
@@ -12,6 +12,9 @@ const (
 	BatchUpdateTypeUsedQuota
 	BatchUpdateTypeChannelUsedQuota
 	BatchUpdateTypeRequestCount
+	BatchUpdateTypeChatQuota
+	BatchUpdateTypeImageQuota
+	BatchUpdateTypeAudioQuota
 	BatchUpdateTypeCount // if you add a new type, you need to add a new map and a new lock
 )
 
@@ -70,6 +73,16 @@ func batchUpdate() {
 				updateUserRequestCount(key, value)
 			case BatchUpdateTypeChannelUsedQuota:
 				updateChannelUsedQuota(key, value)
+			case BatchUpdateTypeChatQuota, BatchUpdateTypeImageQuota, BatchUpdateTypeAudioQuota:
+				for category, type_ := range quotaCategoryBatchUpdateTypes {
+					if type_ != i {
+						continue
+					}
+					err := increaseUserCategoryQuota(key, category, value)
+					if err != nil {
+						common.SysError("failed to batch update user " + category + " quota: " + err.Error())
+					}
+				}
 			}
 		}
 	}
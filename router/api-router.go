@@ -41,6 +41,9 @@ func SetApiRouter(router *gin.Engine) {
 				selfRoute.GET("/token", controller.GenerateAccessToken)
 				selfRoute.GET("/aff", controller.GetAffCode)
 				selfRoute.POST("/topup", controller.TopUp)
+				selfRoute.GET("/quota_transfer", controller.GetSelfQuotaTransfers)
+				selfRoute.POST("/quota_transfer", controller.RequestQuotaTransfer)
+				selfRoute.DELETE("/quota_transfer/:id", controller.CancelQuotaTransfer)
 			}
 
 			adminRoute := userRoute.Group("/")
@@ -51,6 +54,9 @@ func SetApiRouter(router *gin.Engine) {
 				adminRoute.GET("/:id", controller.GetUser)
 				adminRoute.POST("/", controller.CreateUser)
 				adminRoute.POST("/manage", controller.ManageUser)
+				adminRoute.POST("/transfer_quota", controller.TransferQuota)
+				adminRoute.GET("/quota_transfer/pending", controller.GetPendingQuotaTransfers)
+				adminRoute.POST("/quota_transfer/:id", controller.ReviewQuotaTransfer)
 				adminRoute.PUT("/", controller.UpdateUser)
 				adminRoute.DELETE("/:id", controller.DeleteUser)
 			}
@@ -67,6 +73,18 @@ func SetApiRouter(router *gin.Engine) {
 			channelRoute.GET("/", controller.GetAllChannels)
 			channelRoute.GET("/search", controller.SearchChannels)
 			channelRoute.GET("/models", controller.ListModels)
+			channelRoute.GET("/stream_repairs", controller.GetStreamRepairCounts)
+			channelRoute.GET("/retries", controller.GetRelayRetryCounts)
+			channelRoute.GET("/warmup", controller.GetChannelWarmUpResults)
+			channelRoute.GET("/maintenance", controller.GetModelMaintenances)
+			channelRoute.GET("/slo", controller.GetChannelSLOs)
+			channelRoute.GET("/daily_usage", controller.GetChannelDailyUsages)
+			channelRoute.GET("/simulate", controller.SimulateChannelSelection)
+			channelRoute.POST("/simulate", controller.SimulateChannelSelection)
+			channelRoute.POST("/daily_usage/backfill", middleware.RootAuth(), controller.BackfillChannelDailyUsages)
+			channelRoute.POST("/maintenance", controller.AddModelMaintenance)
+			channelRoute.DELETE("/maintenance/:id", controller.DeleteModelMaintenance)
+			channelRoute.PUT("/disabled_models", controller.UpdateDisabledModel)
 			channelRoute.GET("/:id", controller.GetChannel)
 			channelRoute.GET("/test", controller.TestAllChannels)
 			channelRoute.GET("/test/:id", controller.TestChannel)
@@ -77,11 +95,23 @@ func SetApiRouter(router *gin.Engine) {
 			channelRoute.DELETE("/disabled", controller.DeleteDisabledChannel)
 			channelRoute.DELETE("/:id", controller.DeleteChannel)
 		}
+		canaryRoute := apiRouter.Group("/canary")
+		canaryRoute.Use(middleware.AdminAuth())
+		{
+			canaryRoute.GET("/", controller.GetAllCanaries)
+			canaryRoute.GET("/summary", controller.GetCanarySummary)
+			canaryRoute.POST("/", controller.AddCanary)
+			canaryRoute.PUT("/", controller.UpdateCanary)
+			canaryRoute.DELETE("/:id", controller.DeleteCanary)
+		}
 		tokenRoute := apiRouter.Group("/token")
 		tokenRoute.Use(middleware.UserAuth())
 		{
 			tokenRoute.GET("/", controller.GetAllTokens)
 			tokenRoute.GET("/search", controller.SearchTokens)
+			tokenRoute.GET("/provision", controller.GetProvisionedTokens)
+			tokenRoute.POST("/provision", controller.ProvisionToken)
+			tokenRoute.DELETE("/provision/:id", controller.RevokeProvisionedToken)
 			tokenRoute.GET("/:id", controller.GetToken)
 			tokenRoute.POST("/", controller.AddToken)
 			tokenRoute.PUT("/", controller.UpdateToken)
@@ -101,8 +131,15 @@ func SetApiRouter(router *gin.Engine) {
 		logRoute.GET("/", middleware.AdminAuth(), controller.GetAllLogs)
 		logRoute.DELETE("/", middleware.AdminAuth(), controller.DeleteHistoryLogs)
 		logRoute.GET("/stat", middleware.AdminAuth(), controller.GetLogsStat)
+		logRoute.GET("/app_tags", middleware.RootAuth(), controller.GetAppTagUsage)
 		logRoute.GET("/self/stat", middleware.UserAuth(), controller.GetLogsSelfStat)
 		logRoute.GET("/search", middleware.AdminAuth(), controller.SearchAllLogs)
+		logRoute.GET("/failed", middleware.AdminAuth(), controller.GetFailedRequests)
+		logRoute.GET("/forecast", middleware.AdminAuth(), controller.GetUsageForecast)
+		logRoute.POST("/recount", middleware.RootAuth(), controller.RecountLog)
+		logRoute.POST("/recount/batch", middleware.RootAuth(), controller.BatchRecountLogs)
+		logRoute.GET("/cost_export", middleware.AdminAuth(), controller.GetCostExports)
+		logRoute.POST("/cost_export", middleware.RootAuth(), controller.ExportCostReport)
 		logRoute.GET("/self", middleware.UserAuth(), controller.GetUserLogs)
 		logRoute.GET("/self/search", middleware.UserAuth(), controller.SearchUserLogs)
 		groupRoute := apiRouter.Group("/group")
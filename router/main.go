@@ -6,6 +6,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"one-api/common"
+	"one-api/controller"
 	"os"
 	"strings"
 )
@@ -23,8 +24,20 @@ func SetRouter(router *gin.Engine, buildFS embed.FS, indexPage []byte) {
 		SetWebRouter(router, buildFS, indexPage)
 	} else {
 		frontendBaseUrl = strings.TrimSuffix(frontendBaseUrl, "/")
-		router.NoRoute(func(c *gin.Context) {
+		router.NoRoute(noRoute(func(c *gin.Context) {
 			c.Redirect(http.StatusMovedPermanently, fmt.Sprintf("%s%s", frontendBaseUrl, c.Request.RequestURI))
-		})
+		}))
+	}
+}
+
+// noRoute answers unknown api and relay endpoints with endpoint_not_supported before any channel is selected,
+// everything else goes to the frontend
+func noRoute(frontend gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.RequestURI, "/v1") || strings.HasPrefix(c.Request.RequestURI, "/api") {
+			controller.RelayNotFound(c)
+			return
+		}
+		frontend(c)
 	}
 }
@@ -0,0 +1,48 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"one-api/common"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	common.RedisEnabled = false
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func TestUnsupportedRelayEndpoint(t *testing.T) {
+	engine := gin.New()
+	SetRelayRouter(engine)
+	engine.NoRoute(noRoute(func(c *gin.Context) {
+		c.String(http.StatusOK, "index")
+	}))
+
+	for _, target := range []string{"/v1/assistants", "/v1/chat/completions/extra", "/api/unknown"} {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, target, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%s got %d, want 404", target, recorder.Code)
+			continue
+		}
+		var response struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.Error.Code != "endpoint_not_supported" {
+			t.Errorf("%s got %s", target, recorder.Body.String())
+		}
+	}
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/channel", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("frontend route got %d", recorder.Code)
+	}
+}
@@ -17,30 +17,44 @@ func SetRelayRouter(router *gin.Engine) {
 		modelsRouter.GET("/:model", controller.RetrieveModel)
 	}
 	relayV1Router := router.Group("/v1")
-	relayV1Router.Use(middleware.TokenAuth(), middleware.Distribute())
+	relayV1Router.Use(middleware.Trace(), middleware.AppTag(), middleware.TokenAuth(), middleware.ResponseDelay(), middleware.StreamCompression(), middleware.Distribute(), middleware.DuplicateRequestThrottle())
 	{
 		relayV1Router.POST("/completions", controller.Relay)
 		relayV1Router.POST("/chat/completions", controller.Relay)
 		relayV1Router.POST("/edits", controller.Relay)
 		relayV1Router.POST("/images/generations", controller.Relay)
-		relayV1Router.POST("/images/edits", controller.RelayNotImplemented)
-		relayV1Router.POST("/images/variations", controller.RelayNotImplemented)
+		relayV1Router.POST("/images/edits", controller.Relay)
+		relayV1Router.POST("/images/variations", controller.Relay)
 		relayV1Router.POST("/embeddings", controller.Relay)
 		relayV1Router.POST("/engines/:model/embeddings", controller.Relay)
 		relayV1Router.POST("/audio/transcriptions", controller.Relay)
 		relayV1Router.POST("/audio/translations", controller.Relay)
 		relayV1Router.POST("/audio/speech", controller.Relay)
-		relayV1Router.GET("/files", controller.RelayNotImplemented)
-		relayV1Router.POST("/files", controller.RelayNotImplemented)
-		relayV1Router.DELETE("/files/:id", controller.RelayNotImplemented)
-		relayV1Router.GET("/files/:id", controller.RelayNotImplemented)
-		relayV1Router.GET("/files/:id/content", controller.RelayNotImplemented)
-		relayV1Router.POST("/fine-tunes", controller.RelayNotImplemented)
-		relayV1Router.GET("/fine-tunes", controller.RelayNotImplemented)
-		relayV1Router.GET("/fine-tunes/:id", controller.RelayNotImplemented)
-		relayV1Router.POST("/fine-tunes/:id/cancel", controller.RelayNotImplemented)
-		relayV1Router.GET("/fine-tunes/:id/events", controller.RelayNotImplemented)
-		relayV1Router.DELETE("/models/:model", controller.RelayNotImplemented)
 		relayV1Router.POST("/moderations", controller.Relay)
 	}
+	// files and fine-tuning jobs are pinned to the channel they were created on
+	fineTuningV1Router := router.Group("/v1")
+	fineTuningV1Router.Use(middleware.TokenAuth())
+	{
+		fineTuningV1Router.GET("/files", controller.RelayFineTuningFileList)
+		fineTuningV1Router.POST("/files", controller.RelayFineTuningFileUpload)
+		fineTuningV1Router.DELETE("/files/:id", controller.RelayFineTuningFile)
+		fineTuningV1Router.GET("/files/:id", controller.RelayFineTuningFile)
+		fineTuningV1Router.GET("/files/:id/content", controller.RelayFineTuningFile)
+		fineTuningV1Router.GET("/fine_tuning/jobs", controller.RelayFineTuningJobList)
+		fineTuningV1Router.POST("/fine_tuning/jobs", controller.RelayFineTuningJobCreate)
+		fineTuningV1Router.GET("/fine_tuning/jobs/:id", controller.RelayFineTuningJob)
+		fineTuningV1Router.POST("/fine_tuning/jobs/:id/cancel", controller.RelayFineTuningJob)
+		fineTuningV1Router.GET("/fine_tuning/jobs/:id/events", controller.RelayFineTuningJob)
+	}
+	notImplementedV1Router := router.Group("/v1")
+	notImplementedV1Router.Use(middleware.TokenAuth())
+	{
+		notImplementedV1Router.POST("/fine-tunes", controller.RelayNotImplemented)
+		notImplementedV1Router.GET("/fine-tunes", controller.RelayNotImplemented)
+		notImplementedV1Router.GET("/fine-tunes/:id", controller.RelayNotImplemented)
+		notImplementedV1Router.POST("/fine-tunes/:id/cancel", controller.RelayNotImplemented)
+		notImplementedV1Router.GET("/fine-tunes/:id/events", controller.RelayNotImplemented)
+		notImplementedV1Router.DELETE("/models/:model", controller.RelayNotImplemented)
+	}
 }